@@ -1,63 +1,103 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/oleksandr/bioproxy/internal/admission"
 	"github.com/oleksandr/bioproxy/internal/admin"
+	"github.com/oleksandr/bioproxy/internal/backendpool"
 	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/diag"
+	"github.com/oleksandr/bioproxy/internal/grpchealth"
+	"github.com/oleksandr/bioproxy/internal/idle"
+	"github.com/oleksandr/bioproxy/internal/kvcache"
 	"github.com/oleksandr/bioproxy/internal/proxy"
 	"github.com/oleksandr/bioproxy/internal/state"
 	"github.com/oleksandr/bioproxy/internal/template"
+	"github.com/oleksandr/bioproxy/internal/tracing"
 	"github.com/oleksandr/bioproxy/internal/warmup"
 )
 
 // main is the entry point for the bioproxy server.
 // It loads configuration, creates the proxy, and runs it until interrupted.
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "warmup" {
+		os.Exit(runWarmupCommand(os.Args[2:]))
+	}
+
 	// Define command-line flags
 	// These allow users to override default configuration
-	configPath := flag.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	configPath := flag.String("config", config.DefaultConfigPath(), "Configuration source: file path, \"-\" for stdin, or http(s):// URL")
 	proxyHost := flag.String("host", "", "Host to bind proxy server to (use 0.0.0.0 for all interfaces)")
 	proxyPort := flag.Int("port", 0, "Port for proxy server to listen on")
 	adminHost := flag.String("admin-host", "", "Host to bind admin server to")
 	adminPort := flag.Int("admin-port", 0, "Port for admin server to listen on")
 	backendURL := flag.String("backend", "", "URL of the llama.cpp backend server")
+	passthrough := flag.Bool("passthrough", false, "Run as a pure reverse proxy: no templates, KV cache operations or warmup")
+	selftest := flag.Bool("selftest", false, "Run diagnostic checks (config, templates, backend, slot save/restore) and exit")
 
 	// Parse command-line flags
 	flag.Parse()
 
+	// applyOverrides applies command-line flags on top of the loaded configuration
+	applyOverrides := func(cfg *config.Config) {
+		if *proxyHost != "" {
+			cfg.ProxyHost = *proxyHost
+		}
+		if *proxyPort != 0 {
+			cfg.ProxyPort = *proxyPort
+		}
+		if *adminHost != "" {
+			cfg.AdminHost = *adminHost
+		}
+		if *adminPort != 0 {
+			cfg.AdminPort = *adminPort
+		}
+		if *backendURL != "" {
+			cfg.BackendURL = *backendURL
+		}
+		if *passthrough {
+			cfg.PassthroughMode = true
+		}
+	}
+
+	// Self-test mode: run diagnostics, print a report and exit
+	if *selftest {
+		fmt.Println("🩺 Running bioproxy self-test")
+		fmt.Println()
+		results := diag.Run(*configPath, applyOverrides)
+		if !diag.PrintReport(os.Stdout, results) {
+			fmt.Println()
+			fmt.Println("❌ Self-test failed")
+			os.Exit(1)
+		}
+		fmt.Println()
+		fmt.Println("✅ All checks passed")
+		return
+	}
+
 	// Print startup banner
 	fmt.Println("🚀 Starting bioproxy - llama.cpp reverse proxy with KV cache warmup")
 	fmt.Println()
 
-	// Load configuration from file
-	cfg, err := config.LoadConfig(*configPath)
+	// Load configuration from file, stdin or URL
+	cfg, err := config.LoadConfigFrom(*configPath)
 	if err != nil {
 		log.Fatalf("FATAL: Failed to load config: %v", err)
 	}
 
 	// Override with command-line flags if provided
-	if *proxyHost != "" {
-		cfg.ProxyHost = *proxyHost
-	}
-	if *proxyPort != 0 {
-		cfg.ProxyPort = *proxyPort
-	}
-	if *adminHost != "" {
-		cfg.AdminHost = *adminHost
-	}
-	if *adminPort != 0 {
-		cfg.AdminPort = *adminPort
-	}
-	if *backendURL != "" {
-		cfg.BackendURL = *backendURL
-	}
+	applyOverrides(cfg)
 
 	// Print configuration
 	fmt.Println("Configuration:")
@@ -66,33 +106,74 @@ func main() {
 	fmt.Printf("  Admin server:       http://%s:%d\n", cfg.AdminHost, cfg.AdminPort)
 	fmt.Printf("  Warmup interval:    %ds\n", cfg.WarmupCheckInterval)
 	fmt.Printf("  Templates:          %d configured\n", len(cfg.Prefixes))
+	if cfg.PassthroughMode {
+		fmt.Println("  Passthrough mode:   templates, KV cache and warmup disabled")
+	}
 	fmt.Println()
 
+	// Health checks and the shutdown cache save use the backend TLS settings
+	backendTransport, err := cfg.BackendTransport()
+	if err != nil {
+		log.Fatalf("FATAL: Failed to set up backend transport: %v", err)
+	}
+
+	// Create shared metrics instance
+	// Both proxy, admin server, and warmup manager will use this
+	metrics := admin.NewMetrics()
+	metrics.SetMaxTrackedEndpoints(cfg.MaxTrackedEndpoints)
+	metrics.RecordConfigLoad()
+
+	// Continue the counters saved by the previous run
+	var metricsSnapshotter *admin.Snapshotter
+	if cfg.MetricsSnapshotFile != "" {
+		if err := metrics.LoadFile(cfg.MetricsSnapshotFile); errors.Is(err, os.ErrNotExist) {
+			log.Printf("INFO: No metrics snapshot at %s yet, counters start from zero", cfg.MetricsSnapshotFile)
+		} else if err != nil {
+			log.Printf("WARNING: Failed to load metrics snapshot, counters start from zero: %v", err)
+		} else {
+			log.Printf("INFO: Restored metrics from %s", cfg.MetricsSnapshotFile)
+		}
+		metricsSnapshotter = admin.NewSnapshotter(metrics, cfg.MetricsSnapshotFile, time.Duration(cfg.MetricsSnapshotInterval)*time.Second)
+	}
+
 	// Create template watcher
+	// Template content changes are recorded as reloads in metrics
 	log.Println("INFO: Creating template watcher...")
 	watcher := template.NewWatcher()
+	watcher.SetChangeHandler(metrics.RecordTemplateReload)
+	watcher.SetMaxProcessedBytes(cfg.MaxProcessedTemplateBytes)
+	watcher.SetMaxFileBytes(cfg.MaxTemplateFileBytes)
+	watcher.SetMaxExpansionBytes(cfg.MaxExpansionBytes)
+	watcher.SetChangeDebounce(cfg.ChangeDebounceCycles)
 
 	// Add templates from config
-	for prefix, templatePath := range cfg.Prefixes {
-		if err := watcher.AddTemplate(prefix, templatePath); err != nil {
-			log.Printf("WARNING: Failed to add template %s: %v", prefix, err)
-		}
+	// Prefixes with variants register one template per variant
+	for prefix, prefixCfg := range cfg.Prefixes {
+		registerTemplates(watcher, prefix, prefixCfg)
 	}
 
-	// Create shared metrics instance
-	// Both proxy, admin server, and warmup manager will use this
-	metrics := admin.NewMetrics()
 
 	// Create shared state instance for tracking llama.cpp backend state
 	// Both proxy and warmup manager will update this to track which template
 	// is currently loaded in the KV cache, allowing us to optimize save/restore
 	backendState := state.New()
+	if cfg.StateMode == config.StateModeSharedFile {
+		// Coordinate KV cache transitions with other instances on the same backend
+		backendState, err = state.NewShared(cfg.StateFile)
+		if err != nil {
+			log.Fatalf("FATAL: Failed to open shared state: %v", err)
+		}
+		log.Printf("INFO: Using shared state file %s", cfg.StateFile)
+	}
 
 	// Create shared admission controller for atomic state transitions
 	// This prevents race conditions between user requests and warmup operations
 	// Both proxy and warmup manager use this to coordinate access to llama.cpp
 	log.Println("INFO: Creating admission controller...")
 	admissionCtrl := admission.New()
+	admissionCtrl.SetCancelGrace(time.Duration(cfg.WarmupCancelGraceMs) * time.Millisecond)
+	admissionCtrl.SetGraceCompletionHandler(metrics.RecordWarmupGraceCompletion)
+	admissionCtrl.SetMaxUserQueries(cfg.MaxConcurrentUserQueries)
 
 	// Create warmup manager with metrics, state, and admission controller
 	log.Println("INFO: Creating warmup manager...")
@@ -105,10 +186,42 @@ func main() {
 	if err != nil {
 		log.Fatalf("FATAL: Failed to create proxy: %v", err)
 	}
+	p.SetLazyWarmer(warmupMgr)
+	// The warmup manager doesn't run in passthrough mode, nothing to wait for
+	if cfg.BlockUntilWarm && !cfg.PassthroughMode {
+		p.SetWarmupGate(warmupMgr)
+	}
+
+	// Spread requests over the backend pool if configured
+	var backendPool *backendpool.Pool
+	if len(cfg.Backends) > 0 {
+		backendPool = backendpool.New(cfg.Backends, &http.Client{Transport: backendTransport}, metrics)
+		backendPool.SetPathPrefix(cfg.BackendPathPrefix)
+		p.SetBackendPicker(backendPool)
+	}
+
+	// Export request traces if a collector is configured
+	var traceExporter *tracing.OTLPExporter
+	if cfg.OTLPEndpoint != "" {
+		log.Printf("INFO: Exporting traces to %s", cfg.OTLPEndpoint)
+		traceExporter = tracing.NewOTLPExporter(cfg.OTLPEndpoint, "bioproxy")
+		p.SetTracer(tracing.New(traceExporter))
+	}
 
 	// Create the admin server
 	log.Println("INFO: Creating admin server...")
-	adminServer := admin.New(cfg, metrics)
+	adminServer := admin.New(cfg, metrics, backendState)
+	adminServer.SetWatcher(watcher)
+
+	// List streaming responses in progress on /streams
+	streams := admin.NewStreamRegistry()
+	p.SetStreamRegistry(streams)
+	adminServer.SetStreams(streams)
+
+	// Maintenance mode is toggled on the admin server and enforced by the proxy
+	maintenance := admin.NewMaintenance()
+	p.SetMaintenance(maintenance)
+	adminServer.SetMaintenance(maintenance)
 
 	// Start the proxy
 	log.Println("INFO: Starting proxy server...")
@@ -122,10 +235,48 @@ func main() {
 		log.Fatalf("FATAL: Failed to start admin server: %v", err)
 	}
 
-	// Start the warmup manager
-	log.Println("INFO: Starting warmup manager...")
-	if err := warmupMgr.Start(); err != nil {
-		log.Fatalf("FATAL: Failed to start warmup manager: %v", err)
+	// Start the gRPC health service if configured
+	var grpcHealth *grpchealth.Server
+	if cfg.GRPCHealthPort > 0 {
+		backendCheck := grpchealth.BackendCheck(cfg.BackendBaseURL(cfg.BackendURL), &http.Client{Transport: backendTransport})
+		grpcHealth = grpchealth.New(fmt.Sprintf("%s:%d", cfg.AdminHost, cfg.GRPCHealthPort), func(ctx context.Context) error {
+			if !p.IsRunning() {
+				return errors.New("proxy is not running")
+			}
+			return backendCheck(ctx)
+		})
+		if err := grpcHealth.Start(); err != nil {
+			log.Fatalf("FATAL: Failed to start gRPC health server: %v", err)
+		}
+	}
+
+	// Start the warmup manager (not needed in passthrough mode)
+	if cfg.PassthroughMode {
+		log.Println("INFO: Passthrough mode, warmup manager disabled")
+	} else {
+		log.Println("INFO: Starting warmup manager...")
+		if err := warmupMgr.Start(); err != nil {
+			log.Fatalf("FATAL: Failed to start warmup manager: %v", err)
+		}
+	}
+
+	// Start probing the backend pool
+	if backendPool != nil {
+		backendPool.Start(time.Duration(cfg.BackendHealthCheckInterval) * time.Second)
+	}
+
+	// Save metrics periodically if configured
+	if metricsSnapshotter != nil {
+		metricsSnapshotter.Start()
+	}
+
+	// Start the idle monitor if configured
+	// It runs IdleCommand once no /v1/* request has arrived for IdleTimeout
+	var idleMonitor *idle.Monitor
+	if cfg.IdleTimeout > 0 {
+		log.Println("INFO: Starting idle monitor...")
+		idleMonitor = idle.New(time.Duration(cfg.IdleTimeout)*time.Second, cfg.IdleCommand, metrics.GetLastActivity)
+		idleMonitor.Start()
 	}
 
 	// Print ready message
@@ -139,6 +290,8 @@ func main() {
 	fmt.Println("Admin endpoints:")
 	fmt.Printf("  curl http://localhost:%d/health\n", cfg.AdminPort)
 	fmt.Printf("  curl http://localhost:%d/metrics\n", cfg.AdminPort)
+	fmt.Printf("  curl -X POST http://localhost:%d/state/reset\n", cfg.AdminPort)
+	fmt.Printf("  curl -X POST http://localhost:%d/templates/preview -d '{\"prefix\":\"@code\",\"message\":\"test\"}'\n", cfg.AdminPort)
 	fmt.Println()
 	fmt.Println("Press Ctrl+C to stop...")
 	fmt.Println()
@@ -148,24 +301,66 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Wait for interrupt signal
-	<-sigChan
+	// SIGHUP reloads the configuration from the original source
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	// Wait for interrupt signal, reloading config on SIGHUP in the meantime
+	for waiting := true; waiting; {
+		select {
+		case <-sigChan:
+			waiting = false
+		case <-reloadChan:
+			log.Println("INFO: SIGHUP received, reloading config...")
+			if *configPath == "-" {
+				log.Println("ERROR: Config was read from stdin and cannot be reloaded")
+				continue
+			}
+			newCfg, err := config.LoadConfigFrom(*configPath)
+			if err != nil {
+				log.Printf("ERROR: Failed to reload config, keeping current config: %v", err)
+				continue
+			}
+			applyOverrides(newCfg)
+			changes := reloadConfig(cfg, newCfg, watcher)
+			metrics.RecordConfigLoad()
+			if len(changes) == 0 {
+				log.Println("INFO: Config reloaded, no changes")
+			}
+			for _, change := range changes {
+				log.Printf("INFO: Config reload: %s", change)
+			}
+		}
+	}
 
 	// Shutdown signal received
 	fmt.Println()
 	log.Println("INFO: Shutdown signal received, stopping servers...")
 
-	// Stop the warmup manager first
-	warmupMgr.Stop()
-
-	// Stop the admin server gracefully
-	if err := adminServer.Stop(); err != nil {
-		log.Printf("ERROR: Error stopping admin server: %v", err)
+	// Stop everything within the grace period (Kubernetes sends SIGKILL after
+	// terminationGracePeriodSeconds, 30 by default)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	shutdownClient := &http.Client{Transport: backendTransport, Timeout: time.Duration(cfg.CacheOpTimeout) * time.Second}
+	shutdownKVCache := func(backendURL string) *kvcache.Client {
+		kvCache := kvcache.New(cfg.BackendBaseURL(backendURL), shutdownClient, metrics)
+		kvCache.SetAuthToken(cfg.BackendAuthToken)
+		return kvCache
 	}
-
-	// Stop the proxy gracefully
-	if err := p.Stop(); err != nil {
-		log.Printf("ERROR: Error stopping proxy: %v", err)
+	err = shutdown(ctx, cfg, components{
+		idleMonitor:   idleMonitor,
+		warmupMgr:     warmupMgr,
+		backendPool:   backendPool,
+		grpcHealth:    grpcHealth,
+		adminServer:   adminServer,
+		proxy:         p,
+		traceExporter: traceExporter,
+		backendState:  backendState,
+		snapshotter:   metricsSnapshotter,
+		kvCacheFor:    shutdownKVCache,
+	})
+	if err != nil {
+		log.Printf("ERROR: Error during shutdown: %v", err)
 		os.Exit(1)
 	}
 
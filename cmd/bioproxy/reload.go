@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/template"
+)
+
+// registerTemplates adds the templates of a single prefix to the watcher.
+// Prefixes with variants register one template per variant. The prefix's
+// tools file is watched along with each template, as warmups send it too.
+func registerTemplates(watcher *template.Watcher, prefix string, prefixCfg config.PrefixConfig) {
+	for _, ref := range prefixCfg.Templates(prefix) {
+		if err := addTemplateRef(watcher, ref, prefixCfg.Engine); err != nil {
+			log.Printf("WARNING: Failed to add template %s: %v", ref.Key, err)
+			continue
+		}
+		if prefixCfg.ToolsFile != "" {
+			if err := watcher.SetHashFiles(ref.Key, []string{prefixCfg.ToolsFile}); err != nil {
+				log.Printf("WARNING: Failed to watch tools_file of %s: %v", ref.Key, err)
+			}
+		}
+	}
+}
+
+// addTemplateRef adds a single file or inline template and its includes to the watcher
+func addTemplateRef(watcher *template.Watcher, ref config.TemplateRef, engine string) error {
+	if ref.Inline != "" {
+		return watcher.AddInlineTemplateWithIncludes(ref.Key, ref.Inline, engine, ref.Includes)
+	}
+	source := template.SourceConfig
+	if ref.FromTemplateDir {
+		source = template.SourceDir
+	}
+	return watcher.AddTemplateFromSource(ref.Key, ref.Path, engine, ref.Includes, source)
+}
+
+// reloadedFields are the config fields reloadConfig applies to the running
+// proxy; any other changed field only takes effect after a restart.
+// template_dir is applied through the prefixes it expands to.
+var reloadedFields = map[string]bool{
+	"prefixes":     true,
+	"log_level":    true,
+	"template_dir": true,
+}
+
+// secretFields are config fields whose values are not logged
+var secretFields = map[string]bool{
+	"admin_basic_password": true,
+	"backend_auth_token":   true,
+}
+
+// reloadConfig applies a freshly loaded configuration to the running one.
+//
+// Prefix changes are applied in place: templates of added or changed prefixes are
+// (re)registered with the watcher, so the warmup manager picks them up on its next
+// check, and templates of removed prefixes are dropped. The log level is applied
+// as well. Every other setting needs a restart; changes to those are only reported.
+//
+// Returns a summary of what changed, one line per change.
+func reloadConfig(cfg, newCfg *config.Config, watcher *template.Watcher) []string {
+	changes := restartRequiredChanges(cfg, newCfg)
+
+	if level := newCfg.LogLevel; level != cfg.CurrentLogLevel() {
+		changes = append(changes, fmt.Sprintf("log_level changed (%s -> %s)", cfg.CurrentLogLevel(), level))
+		cfg.SetLogLevel(level)
+	}
+
+	oldPrefixes := cfg.PrefixMap()
+	newPrefixes := newCfg.Prefixes
+
+	// Templates no longer used, removed once the new prefix map is swapped in
+	stale := make(map[string]bool)
+
+	// Removed prefixes
+	for _, prefix := range config.SortedPrefixes(oldPrefixes) {
+		if _, exists := newPrefixes[prefix]; !exists {
+			for _, ref := range oldPrefixes[prefix].Templates(prefix) {
+				stale[ref.Key] = true
+			}
+			changes = append(changes, fmt.Sprintf("removed prefix %s", prefix))
+		}
+	}
+
+	// Added and changed prefixes. Templates are registered before the new
+	// prefix map is swapped in and replace the old ones in place, so requests
+	// never see a configured prefix without its template.
+	for _, prefix := range config.SortedPrefixes(newPrefixes) {
+		newPrefixCfg := newPrefixes[prefix]
+		oldPrefixCfg, exists := oldPrefixes[prefix]
+		if exists && reflect.DeepEqual(oldPrefixCfg, newPrefixCfg) {
+			continue
+		}
+
+		if exists {
+			// Variants may have been renamed or removed
+			for _, ref := range oldPrefixCfg.Templates(prefix) {
+				stale[ref.Key] = true
+			}
+			changes = append(changes, fmt.Sprintf("updated prefix %s", prefix))
+		} else {
+			changes = append(changes, fmt.Sprintf("added prefix %s", prefix))
+		}
+		registerTemplates(watcher, prefix, newPrefixCfg)
+		for _, ref := range newPrefixCfg.Templates(prefix) {
+			delete(stale, ref.Key)
+		}
+	}
+
+	// Swap in the new prefix map, then drop templates no prefix uses anymore
+	cfg.SetPrefixes(newPrefixes)
+	for _, key := range slices.Sorted(maps.Keys(stale)) {
+		watcher.RemoveTemplate(key)
+	}
+
+	return changes
+}
+
+// restartRequiredChanges reports every field outside reloadedFields whose
+// value differs between the running and the new configuration
+func restartRequiredChanges(cfg, newCfg *config.Config) []string {
+	var changes []string
+	oldValue, newValue := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(newCfg).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "" || name == "-" || reloadedFields[name] {
+			continue
+		}
+		before, after := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		if secretFields[name] {
+			changes = append(changes, fmt.Sprintf("%s changed, restart required", name))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s changed (%v -> %v), restart required", name, before, after))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/template"
+)
+
+// TestReloadConfig tests applying a changed config to a running watcher
+func TestReloadConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	codeFile := filepath.Join(tmpDir, "code.txt")
+	debugFile := filepath.Join(tmpDir, "debug.txt")
+	reviewFile := filepath.Join(tmpDir, "review.txt")
+	os.WriteFile(codeFile, []byte("CODE: <{message}>"), 0644)
+	os.WriteFile(debugFile, []byte("DEBUG: <{message}>"), 0644)
+	os.WriteFile(reviewFile, []byte("REVIEW: <{message}>"), 0644)
+
+	cfg := config.DefaultConfig()
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@code":  {Path: codeFile},
+		"@debug": {Path: debugFile},
+	}
+	watcher := template.NewWatcher()
+	for prefix, prefixCfg := range cfg.Prefixes {
+		registerTemplates(watcher, prefix, prefixCfg)
+	}
+	watcher.MarkWarmedUp("@code")
+	watcher.MarkWarmedUp("@debug")
+
+	// Add @review, remove @debug, change the port, keep @code as is
+	newCfg := config.DefaultConfig()
+	newCfg.ProxyPort = 9000
+	newCfg.Prefixes = map[string]config.PrefixConfig{
+		"@code":   {Path: codeFile},
+		"@review": {Path: reviewFile},
+	}
+
+	changes := reloadConfig(cfg, newCfg, watcher)
+
+	expected := []string{
+		"proxy_port changed (8088 -> 9000), restart required",
+		"removed prefix @debug",
+		"added prefix @review",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+
+	// New prefix is registered and queued for warmup
+	result, err := watcher.ProcessTemplate("@review", "hi")
+	if err != nil || result != "REVIEW: hi" {
+		t.Errorf("Expected @review to be registered, got %q (err: %v)", result, err)
+	}
+	if !watcher.NeedsWarmup("@review") {
+		t.Error("Expected @review to need warmup")
+	}
+
+	// Removed prefix is no longer registered
+	if _, err := watcher.ProcessTemplate("@debug", "hi"); err == nil {
+		t.Error("Expected @debug to be removed")
+	}
+
+	// Unchanged prefix keeps its warmed up state
+	if watcher.NeedsWarmup("@code") {
+		t.Error("Expected unchanged @code to stay warmed up")
+	}
+
+	// Prefixes are swapped in, restart-only settings are not
+	if _, exists := cfg.Prefix("@review"); !exists {
+		t.Error("Expected @review in running config")
+	}
+	if cfg.ProxyPort != 8088 {
+		t.Errorf("Expected running ProxyPort to stay 8088, got %d", cfg.ProxyPort)
+	}
+
+	// Reloading the same config again only reports the pending restart
+	if changes := reloadConfig(cfg, newCfg, watcher); len(changes) != 1 {
+		t.Errorf("Expected only the pending restart change, got %v", changes)
+	}
+}
+
+// TestReloadInlineTemplate tests that editing an inline template's content
+// re-registers it for warmup
+func TestReloadInlineTemplate(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@help": {Inline: "You are a helper. <{message}>"},
+	}
+	watcher := template.NewWatcher()
+	registerTemplates(watcher, "@help", cfg.Prefixes["@help"])
+	watcher.MarkWarmedUp("@help")
+	oldHash, _ := watcher.Hash("@help")
+
+	newCfg := config.DefaultConfig()
+	newCfg.Prefixes = map[string]config.PrefixConfig{
+		"@help": {Inline: "You are a concise helper. <{message}>"},
+	}
+	changes := reloadConfig(cfg, newCfg, watcher)
+
+	if len(changes) != 1 || changes[0] != "updated prefix @help" {
+		t.Errorf("Expected @help to be updated, got %v", changes)
+	}
+	if !watcher.NeedsWarmup("@help") {
+		t.Error("Expected edited inline template to need warmup")
+	}
+	if newHash, _ := watcher.Hash("@help"); newHash == oldHash {
+		t.Error("Expected the template hash to change with the inline content")
+	}
+	result, err := watcher.ProcessTemplate("@help", "hi")
+	if err != nil || result != "You are a concise helper. hi" {
+		t.Errorf("Expected new inline content, got %q (err: %v)", result, err)
+	}
+}
+
+// TestReloadLogLevelAndRestartFields tests that the log level is applied and
+// that every other changed setting is reported as requiring a restart
+func TestReloadLogLevelAndRestartFields(t *testing.T) {
+	cfg := config.DefaultConfig()
+	watcher := template.NewWatcher()
+
+	newCfg := config.DefaultConfig()
+	newCfg.LogLevel = config.LogLevelDebug
+	newCfg.MaxTokensCap = 512
+	newCfg.BackendAuthToken = "secret-token"
+
+	changes := reloadConfig(cfg, newCfg, watcher)
+
+	expected := []string{
+		"backend_auth_token changed, restart required",
+		"max_tokens_cap changed (0 -> 512), restart required",
+		"log_level changed (info -> debug)",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+	if !cfg.Debug() {
+		t.Error("Expected the reloaded log level to enable debug logging")
+	}
+	for _, change := range changes {
+		if strings.Contains(change, "secret-token") {
+			t.Errorf("Expected the auth token to be hidden, got %q", change)
+		}
+	}
+
+	// The log level is applied, so it isn't reported again
+	if changes := reloadConfig(cfg, newCfg, watcher); len(changes) != 2 {
+		t.Errorf("Expected only the pending restarts, got %v", changes)
+	}
+}
+
+// TestReloadWhileServing tests that requests running during reloads always
+// find a configured prefix together with its template
+func TestReloadWhileServing(t *testing.T) {
+	tmpDir := t.TempDir()
+	codeFile := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(codeFile, []byte("CODE: <{message}>"), 0644)
+
+	configs := make([]*config.Config, 2)
+	for i, stop := range []string{"###", "---"} {
+		configs[i] = config.DefaultConfig()
+		configs[i].Prefixes = map[string]config.PrefixConfig{
+			"@code": {Path: codeFile, Stop: []string{stop}},
+		}
+	}
+	cfg := config.DefaultConfig()
+	cfg.Prefixes = configs[0].Prefixes
+	watcher := template.NewWatcher()
+	registerTemplates(watcher, "@code", cfg.Prefixes["@code"])
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, exists := cfg.Prefix("@code"); !exists {
+				t.Error("Expected @code to stay configured")
+				return
+			}
+			if _, err := watcher.ProcessTemplate("@code", "hi"); err != nil {
+				t.Errorf("Expected @code template during reload: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		reloadConfig(cfg, configs[(i+1)%2], watcher)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// TestRegisterTemplatesToolsFile tests that editing a prefix's tools file
+// marks its templates for warmup
+func TestRegisterTemplatesToolsFile(t *testing.T) {
+	toolsPath := filepath.Join(t.TempDir(), "tools.json")
+	os.WriteFile(toolsPath, []byte(`[{"function":{"name":"search"}}]`), 0644)
+
+	watcher := template.NewWatcher()
+	registerTemplates(watcher, "@agent", config.PrefixConfig{Inline: "Agent: <{message}>", ToolsFile: toolsPath})
+	watcher.MarkWarmedUp("@agent")
+
+	os.WriteFile(toolsPath, []byte(`[{"function":{"name":"fetch"}}]`), 0644)
+	if changed := watcher.CheckForChanges(); len(changed) != 1 || changed[0] != "@agent" {
+		t.Errorf("Expected @agent to need warmup after its tools changed, got %v", changed)
+	}
+}
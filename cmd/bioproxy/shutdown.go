@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oleksandr/bioproxy/internal/admin"
+	"github.com/oleksandr/bioproxy/internal/backendpool"
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/grpchealth"
+	"github.com/oleksandr/bioproxy/internal/idle"
+	"github.com/oleksandr/bioproxy/internal/kvcache"
+	"github.com/oleksandr/bioproxy/internal/proxy"
+	"github.com/oleksandr/bioproxy/internal/state"
+	"github.com/oleksandr/bioproxy/internal/tracing"
+	"github.com/oleksandr/bioproxy/internal/warmup"
+)
+
+// components are the parts of a running bioproxy stopped on shutdown.
+// Nil fields are skipped.
+type components struct {
+	idleMonitor   *idle.Monitor
+	warmupMgr     *warmup.Manager
+	backendPool   *backendpool.Pool
+	grpcHealth    *grpchealth.Server
+	adminServer   *admin.Server
+	proxy         *proxy.Proxy
+	traceExporter *tracing.OTLPExporter
+	backendState  *state.State
+	snapshotter   *admin.Snapshotter
+
+	// kvCacheFor returns the client saving a backend's cache when
+	// SaveCacheOnShutdown is set, for the default backend and each prefix
+	// backend override
+	kvCacheFor func(backendURL string) *kvcache.Client
+}
+
+// shutdown stops everything in order, within ctx's deadline:
+//  1. background work (idle monitor, warmup manager, backend health checks)
+//     and the admin servers
+//  2. the proxy, waiting for in-flight requests
+//  3. with SaveCacheOnShutdown, the KV cache of the prefix loaded on each
+//     backend is saved, unless KV cache operations are disabled
+//  4. the shared state file is updated and its lock released
+//  5. a final metrics snapshot is saved
+//
+// Returns the errors encountered; shutdown continues past each of them.
+func shutdown(ctx context.Context, cfg *config.Config, c components) error {
+	var errs []error
+
+	if c.idleMonitor != nil {
+		c.idleMonitor.Stop()
+	}
+	if c.warmupMgr != nil {
+		c.warmupMgr.Stop()
+	}
+	if c.backendPool != nil {
+		c.backendPool.Stop()
+	}
+	if c.grpcHealth != nil {
+		if err := c.grpcHealth.Stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.adminServer != nil {
+		if err := c.adminServer.Stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.proxy != nil {
+		if err := c.proxy.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// No requests are running anymore, so the loaded prefixes are final
+	if cfg.SaveCacheOnShutdown && !cfg.DisableKVCache && c.kvCacheFor != nil && c.backendState != nil {
+		if err := saveLoadedCache(ctx, c.backendState, c.kvCacheFor(cfg.BackendURL)); err != nil {
+			errs = append(errs, err)
+		}
+		backends := c.backendState.Backends()
+		for _, backendURL := range slices.Sorted(maps.Keys(backends)) {
+			if err := saveLoadedCache(ctx, backends[backendURL], c.kvCacheFor(backendURL)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", backendURL, err))
+			}
+		}
+	}
+
+	if c.backendState != nil {
+		c.backendState.Persist()
+		if err := c.backendState.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close state: %w", err))
+		}
+	}
+
+	// Save the final counters, nothing records metrics anymore
+	if c.snapshotter != nil {
+		c.snapshotter.Stop()
+	}
+
+	// Send spans still queued for export
+	if c.traceExporter != nil {
+		c.traceExporter.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// saveLoadedCache saves the KV cache of the prefix loaded in the backend,
+// giving up when ctx is done
+func saveLoadedCache(ctx context.Context, backendState *state.State, kvCache *kvcache.Client) error {
+	prefix := backendState.GetLastPrefix()
+	if prefix == "" {
+		return nil
+	}
+	// In shared-file mode only the lock holder may touch the cache
+	if !backendState.HoldsLock() {
+		log.Printf("INFO: Not saving KV cache for %s, another instance holds the state lock", prefix)
+		return nil
+	}
+
+	log.Printf("INFO: Saving KV cache for %s before shutdown", prefix)
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- kvCache.Save(prefix, strings.TrimPrefix(prefix, "@")+".bin")
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to save KV cache for %s: %w", prefix, err)
+		}
+		log.Printf("INFO: Saved KV cache for %s in %v", prefix, time.Since(start).Round(time.Millisecond))
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up saving KV cache for %s: %w", prefix, ctx.Err())
+	}
+}
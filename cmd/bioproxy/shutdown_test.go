@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/kvcache"
+	"github.com/oleksandr/bioproxy/internal/state"
+)
+
+// TestShutdownPersistsStateAndSavesCache tests that shutdown writes the
+// loaded prefix to the state file and saves its KV cache only when
+// SaveCacheOnShutdown is set
+func TestShutdownPersistsStateAndSavesCache(t *testing.T) {
+	for _, saveCache := range []bool{false, true} {
+		var mu sync.Mutex
+		var saved []string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("action") == "save" {
+				var body map[string]string
+				json.NewDecoder(r.Body).Decode(&body)
+				mu.Lock()
+				saved = append(saved, body["filename"])
+				mu.Unlock()
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		stateFile := filepath.Join(t.TempDir(), "bioproxy.state")
+		backendState, err := state.NewShared(stateFile)
+		if err != nil {
+			t.Fatalf("Failed to open shared state: %v", err)
+		}
+		if !backendState.HoldsLock() {
+			t.Fatal("Expected to acquire the state lock")
+		}
+		backendState.UpdatePrefix("@code")
+
+		cfg := config.DefaultConfig()
+		cfg.BackendURL = backend.URL
+		cfg.SaveCacheOnShutdown = saveCache
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = shutdown(ctx, cfg, components{
+			backendState: backendState,
+			kvCacheFor: func(string) *kvcache.Client {
+				return kvcache.New(backend.URL, &http.Client{}, nil)
+			},
+		})
+		cancel()
+		backend.Close()
+		if err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+
+		data, err := os.ReadFile(stateFile)
+		if err != nil {
+			t.Fatalf("Failed to read state file: %v", err)
+		}
+		if strings.TrimSpace(string(data)) != "@code" {
+			t.Errorf("Expected state file to contain @code, got %q", data)
+		}
+
+		if saveCache && (len(saved) != 1 || saved[0] != "code.bin") {
+			t.Errorf("Expected code.bin to be saved with SaveCacheOnShutdown, got %v", saved)
+		}
+		if !saveCache && len(saved) != 0 {
+			t.Errorf("Expected no save without SaveCacheOnShutdown, got %v", saved)
+		}
+	}
+}
+
+// TestShutdownGivesUpOnSlowSave tests that a hanging cache save doesn't hold
+// shutdown past its deadline
+func TestShutdownGivesUpOnSlowSave(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	backendState := state.New()
+	backendState.UpdatePrefix("@code")
+
+	cfg := config.DefaultConfig()
+	cfg.SaveCacheOnShutdown = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := shutdown(ctx, cfg, components{
+		backendState: backendState,
+		kvCacheFor: func(string) *kvcache.Client {
+			return kvcache.New(backend.URL, &http.Client{}, nil)
+		},
+	})
+	if err == nil {
+		t.Error("Expected an error when the cache save doesn't finish in time")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v, expected it to stop at the deadline", elapsed)
+	}
+}
+
+// TestShutdownSavesEveryBackend tests that the shutdown save covers prefix
+// backend overrides and is skipped when KV cache operations are disabled
+func TestShutdownSavesEveryBackend(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		var mu sync.Mutex
+		saved := make(map[string][]string)
+		newBackend := func(name string) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("action") == "save" {
+					var body map[string]string
+					json.NewDecoder(r.Body).Decode(&body)
+					mu.Lock()
+					saved[name] = append(saved[name], body["filename"])
+					mu.Unlock()
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+		}
+		defaultBackend := newBackend("default")
+		bigBackend := newBackend("big")
+
+		backendState := state.New()
+		backendState.UpdatePrefix("@code")
+		backendState.Backend(bigBackend.URL).UpdatePrefix("@bigcontext")
+
+		cfg := config.DefaultConfig()
+		cfg.BackendURL = defaultBackend.URL
+		cfg.SaveCacheOnShutdown = true
+		cfg.DisableKVCache = disabled
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := shutdown(ctx, cfg, components{
+			backendState: backendState,
+			kvCacheFor: func(backendURL string) *kvcache.Client {
+				return kvcache.New(backendURL, &http.Client{}, nil)
+			},
+		})
+		cancel()
+		defaultBackend.Close()
+		bigBackend.Close()
+		if err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+
+		if disabled {
+			if len(saved) != 0 {
+				t.Errorf("Expected no save with KV cache operations disabled, got %v", saved)
+			}
+			continue
+		}
+		if got := saved["default"]; len(got) != 1 || got[0] != "code.bin" {
+			t.Errorf("Expected code.bin saved on the default backend, got %v", got)
+		}
+		if got := saved["big"]; len(got) != 1 || got[0] != "bigcontext.bin" {
+			t.Errorf("Expected bigcontext.bin saved on the override backend, got %v", got)
+		}
+	}
+}
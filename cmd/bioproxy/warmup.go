@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/oleksandr/bioproxy/internal/admin"
+	"github.com/oleksandr/bioproxy/internal/admission"
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/state"
+	"github.com/oleksandr/bioproxy/internal/template"
+	"github.com/oleksandr/bioproxy/internal/warmup"
+)
+
+// runWarmupCommand implements "bioproxy warmup -once": warm up every
+// configured template against the backend, save each KV cache to disk and
+// exit, e.g. to bake warm caches into an image in CI. Returns the exit code.
+func runWarmupCommand(args []string) int {
+	flags := flag.NewFlagSet("warmup", flag.ContinueOnError)
+	configPath := flags.String("config", config.DefaultConfigPath(), "Configuration source: file path, \"-\" for stdin, or http(s):// URL")
+	backendURL := flags.String("backend", "", "URL of the llama.cpp backend server")
+	once := flags.Bool("once", false, "Warm up and save every template once, then exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !*once {
+		// Continuous warmup is what the server does
+		fmt.Fprintln(os.Stderr, "usage: bioproxy warmup -once [-config path] [-backend url]")
+		return 2
+	}
+
+	cfg, err := config.LoadConfigFrom(*configPath)
+	if err != nil {
+		log.Printf("ERROR: Failed to load config: %v", err)
+		return 1
+	}
+	if *backendURL != "" {
+		cfg.BackendURL = *backendURL
+	}
+
+	watcher := template.NewWatcher()
+	watcher.SetMaxProcessedBytes(cfg.MaxProcessedTemplateBytes)
+	watcher.SetMaxFileBytes(cfg.MaxTemplateFileBytes)
+	watcher.SetMaxExpansionBytes(cfg.MaxExpansionBytes)
+	for prefix, prefixCfg := range cfg.Prefixes {
+		registerTemplates(watcher, prefix, prefixCfg)
+	}
+
+	// Nothing else uses the backend, so local state and a fresh admission
+	// controller are enough
+	mgr := warmup.New(cfg, watcher, cfg.BackendURL, admin.NewMetrics(), state.New(), admission.New())
+
+	fmt.Printf("🔥 Warming up %d template(s) against %s\n", len(watcher.WarmupStatus()), cfg.BackendURL)
+	if err := mgr.WarmupAll(); err != nil {
+		log.Printf("ERROR: Warmup failed: %v", err)
+		fmt.Println("❌ Warmup failed")
+		return 1
+	}
+	fmt.Println("✅ All templates warmed up and saved")
+	return 0
+}
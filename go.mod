@@ -1,3 +1,3 @@
 module github.com/oleksandr/bioproxy
 
-go 1.21
+go 1.24
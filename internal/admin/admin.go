@@ -1,15 +1,28 @@
 package admin
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/state"
+	"github.com/oleksandr/bioproxy/internal/template"
 )
 
 // Server represents the admin HTTP server that provides status and metrics endpoints.
@@ -27,6 +40,24 @@ type Server struct {
 	// metrics holds the collected request metrics
 	metrics *Metrics
 
+	// backendState is the shared llama.cpp backend state tracker
+	// (can be nil, which disables /state/reset)
+	backendState *state.State
+
+	// watcher lists templates on /templates, processes them for
+	// /templates/preview, reports their included files on /templates/deps
+	// and template warmup counts on /metrics
+	// (nil until SetWatcher is called, which disables both)
+	watcher *template.Watcher
+
+	// streams lists active streaming responses on /streams
+	// (nil until SetStreams is called, which reports none)
+	streams *StreamRegistry
+
+	// maintenance is toggled via /maintenance
+	// (nil until SetMaintenance is called, which disables the endpoint)
+	maintenance *Maintenance
+
 	// mu protects concurrent access to the server state
 	mu sync.Mutex
 
@@ -51,11 +82,35 @@ type Metrics struct {
 	// StartTime records when metrics collection started
 	StartTime time.Time
 
+	// LastActivity records when the last /v1/* API request arrived
+	// Zero value means no API request has been seen yet
+	LastActivity time.Time
+
+	// StreamMismatches counts streaming requests whose backend response was not SSE
+	StreamMismatches int64
+
+	// BackendAuthFailures counts backend 401/403 responses to requests
+	// carrying BackendAuthToken
+	BackendAuthFailures int64
+
+	// BackendRequests counts requests sent to llama.cpp by source
+	// (BackendSourceUser or BackendSourceWarmup), not counting KV cache
+	// save/restore calls
+	// Structure: BackendRequests[source] = count
+	BackendRequests map[string]int64
+
 	// Warmup metrics
 
 	// WarmupChecksTotal is the total number of warmup check cycles performed
 	WarmupChecksTotal int64
 
+	// WarmupSkippedBusy counts warmup cycles skipped because all backend slots were busy
+	WarmupSkippedBusy int64
+
+	// WarmupSkippedEmpty tracks warmups skipped because the template processed to empty content
+	// Structure: WarmupSkippedEmpty[prefix] = count
+	WarmupSkippedEmpty map[string]int64
+
 	// WarmupExecutions tracks warmup executions per template prefix
 	// Structure: WarmupExecutions[prefix] = count
 	WarmupExecutions map[string]int64
@@ -74,31 +129,144 @@ type Metrics struct {
 	// KVCacheSaves tracks successful KV cache saves per template
 	KVCacheSaves map[string]int64
 
+	// KVCacheSaveDurationTotal and KVCacheSaveDurationCount track how long
+	// KV cache save calls to llama.cpp take per template (in seconds)
+	KVCacheSaveDurationTotal map[string]float64
+	KVCacheSaveDurationCount map[string]int64
+
+	// KVCacheRestoreDurationTotal and KVCacheRestoreDurationCount track how
+	// long KV cache restore calls to llama.cpp take per template (in seconds)
+	KVCacheRestoreDurationTotal map[string]float64
+	KVCacheRestoreDurationCount map[string]int64
+
 	// KVCacheRestores tracks KV cache restore attempts per template and status
 	// Structure: KVCacheRestores[prefix][status] = count
 	// Status values: "success", "not_found", "error"
 	KVCacheRestores map[string]map[string]int64
 
+	// SlotRefreshes tracks refreshes of the loaded template's KV cache
+	// before slot idle eviction (see SlotIdleEvictSeconds)
+	// Structure: SlotRefreshes[prefix][result] = count
+	// Result values: "restored", "warmed_up", "error"
+	SlotRefreshes map[string]map[string]int64
+
 	// WarmupCancellations tracks warmup operations cancelled due to user requests
 	// Structure: WarmupCancellations[prefix] = count
 	WarmupCancellations map[string]int64
+
+	// WarmupGraceCompletions tracks warmups that finished within the cancel
+	// grace period while a user request waited for them
+	// Structure: WarmupGraceCompletions[prefix] = count
+	WarmupGraceCompletions map[string]int64
+
+	// Reload metrics
+
+	// ConfigLoadTime records when the configuration was last loaded
+	// Zero value means the config load has not been recorded
+	ConfigLoadTime time.Time
+
+	// RestoredAt is when the snapshot loaded by LoadFile was saved, i.e. the
+	// counters start from that snapshot rather than zero
+	// Zero value means no snapshot was loaded
+	RestoredAt time.Time
+
+	// TemplateReloads tracks how often a template's content changed on disk
+	// Structure: TemplateReloads[prefix] = count
+	TemplateReloads map[string]int64
+
+	// TemplateVariantRequests tracks which A/B variant was selected per prefix
+	// Structure: TemplateVariantRequests[prefix][variant] = count
+	TemplateVariantRequests map[string]map[string]int64
+
+	// TemplateRequests tracks how many requests used each template
+	// Structure: TemplateRequests[template key] = count
+	TemplateRequests map[string]int64
+
+	// TemplateHashes records the processed template hash of the last
+	// successful warmup per template
+	// Structure: TemplateHashes[prefix] = sha256 hex
+	TemplateHashes map[string]string
+
+	// BackendHealthy records the last health probe result per backend of
+	// the Backends pool
+	// Structure: BackendHealthy[url] = healthy
+	BackendHealthy map[string]bool
+
+	// MaxTokensClamped counts requests whose max_tokens was reduced by MaxTokensCap
+	MaxTokensClamped int64
+
+	// MaxTokensRequested is a histogram of the max_tokens values clients
+	// asked for, before the cap. MaxTokensBuckets[i] counts values
+	// <= MaxTokensBucketBounds[i] (not cumulative); values above the last
+	// bound only count towards MaxTokensCount
+	MaxTokensBuckets []int64
+	MaxTokensSum     int64
+	MaxTokensCount   int64
+
+	// maxEndpoints caps the number of distinct endpoints in RequestCount
+	// besides the known API paths (0 means no limit)
+	maxEndpoints int
+}
+
+// OtherEndpoint is the RequestCount key for requests to endpoints beyond
+// the MaxTrackedEndpoints limit
+const OtherEndpoint = "other"
+
+// knownEndpoints are always tracked individually in RequestCount and don't
+// count towards the limit
+var knownEndpoints = map[string]bool{
+	"/health":              true,
+	"/props":               true,
+	"/slots":               true,
+	"/completion":          true,
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+	"/v1/models":           true,
 }
 
+// MaxTokensBucketBounds are the upper bounds of the requested max_tokens
+// histogram buckets
+var MaxTokensBucketBounds = []int64{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+
 // NewMetrics creates a new Metrics instance.
 func NewMetrics() *Metrics {
 	return &Metrics{
-		RequestCount:        make(map[string]map[string]int64),
-		StartTime:           time.Now(),
-		WarmupExecutions:    make(map[string]int64),
-		WarmupErrors:        make(map[string]map[string]int64),
-		WarmupDurationTotal: make(map[string]float64),
-		WarmupDurationCount: make(map[string]int64),
-		KVCacheSaves:        make(map[string]int64),
-		KVCacheRestores:     make(map[string]map[string]int64),
-		WarmupCancellations: make(map[string]int64),
+		RequestCount:                make(map[string]map[string]int64),
+		StartTime:                   time.Now(),
+		WarmupSkippedEmpty:          make(map[string]int64),
+		WarmupExecutions:            make(map[string]int64),
+		WarmupErrors:                make(map[string]map[string]int64),
+		WarmupDurationTotal:         make(map[string]float64),
+		WarmupDurationCount:         make(map[string]int64),
+		KVCacheSaves:                make(map[string]int64),
+		KVCacheSaveDurationTotal:    make(map[string]float64),
+		KVCacheSaveDurationCount:    make(map[string]int64),
+		KVCacheRestoreDurationTotal: make(map[string]float64),
+		KVCacheRestoreDurationCount: make(map[string]int64),
+		KVCacheRestores:             make(map[string]map[string]int64),
+		SlotRefreshes:               make(map[string]map[string]int64),
+		WarmupCancellations:         make(map[string]int64),
+		WarmupGraceCompletions:      make(map[string]int64),
+		BackendRequests:             make(map[string]int64),
+		TemplateReloads:             make(map[string]int64),
+		TemplateVariantRequests:     make(map[string]map[string]int64),
+		TemplateRequests:            make(map[string]int64),
+		TemplateHashes:              make(map[string]string),
+		BackendHealthy:              make(map[string]bool),
+		MaxTokensBuckets:            make([]int64, len(MaxTokensBucketBounds)),
 	}
 }
 
+// SetMaxTrackedEndpoints limits the number of distinct endpoints counted by
+// RecordRequest, besides the known API paths. Once the limit is reached,
+// requests to new endpoints are counted under OtherEndpoint. 0 means no limit.
+func (m *Metrics) SetMaxTrackedEndpoints(max int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxEndpoints = max
+}
+
 // RecordRequest increments the request counter for a given endpoint and status code.
 // This method is thread-safe and can be called concurrently.
 //
@@ -111,7 +279,11 @@ func (m *Metrics) RecordRequest(endpoint string, statusCode int) {
 	// Convert status code to string for map key
 	statusStr := fmt.Sprintf("%d", statusCode)
 
-	// Initialize the endpoint map if it doesn't exist
+	// Initialize the endpoint map if it doesn't exist, bucketing new
+	// endpoints under "other" once the limit is reached
+	if m.RequestCount[endpoint] == nil && !knownEndpoints[endpoint] && m.maxEndpoints > 0 && m.trackedEndpoints() >= m.maxEndpoints {
+		endpoint = OtherEndpoint
+	}
 	if m.RequestCount[endpoint] == nil {
 		m.RequestCount[endpoint] = make(map[string]int64)
 	}
@@ -123,6 +295,67 @@ func (m *Metrics) RecordRequest(endpoint string, statusCode int) {
 	m.TotalRequests++
 }
 
+// trackedEndpoints returns the number of endpoints in RequestCount that
+// count towards the limit. Must be called with m.mu held.
+func (m *Metrics) trackedEndpoints() int {
+	n := 0
+	for endpoint := range m.RequestCount {
+		if !knownEndpoints[endpoint] && endpoint != OtherEndpoint {
+			n++
+		}
+	}
+	return n
+}
+
+// RecordActivity records that an API (/v1/*) request arrived just now.
+// Used for idle detection.
+func (m *Metrics) RecordActivity() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.LastActivity = time.Now()
+}
+
+// GetLastActivity returns when the last API request arrived, or StartTime
+// if there has been none yet.
+func (m *Metrics) GetLastActivity() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.LastActivity.IsZero() {
+		return m.StartTime
+	}
+	return m.LastActivity
+}
+
+// RecordStreamMismatch records a stream=true request that received a
+// non-SSE response from the backend.
+func (m *Metrics) RecordStreamMismatch() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.StreamMismatches++
+}
+
+// RecordBackendAuthFailure records a backend rejecting the configured
+// backend credentials (401 or 403).
+func (m *Metrics) RecordBackendAuthFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.BackendAuthFailures++
+}
+
+// Sources of requests to llama.cpp for RecordBackendRequest
+const (
+	BackendSourceUser   = "user"
+	BackendSourceWarmup = "warmup"
+)
+
+// RecordBackendRequest records a request sent to llama.cpp on behalf of a
+// client (BackendSourceUser) or by the warmup manager (BackendSourceWarmup).
+func (m *Metrics) RecordBackendRequest(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.BackendRequests[source]++
+}
+
 // RecordWarmupCheck increments the total warmup check counter.
 // This should be called once per warmup check cycle.
 func (m *Metrics) RecordWarmupCheck() {
@@ -131,6 +364,22 @@ func (m *Metrics) RecordWarmupCheck() {
 	m.WarmupChecksTotal++
 }
 
+// RecordWarmupSkippedBusy records a warmup cycle skipped because all backend slots were busy
+func (m *Metrics) RecordWarmupSkippedBusy() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.WarmupSkippedBusy++
+}
+
+// RecordWarmupSkippedEmpty records a warmup skipped because the template
+// processed to empty content.
+// prefix: The template prefix (e.g., "@code")
+func (m *Metrics) RecordWarmupSkippedEmpty(prefix string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.WarmupSkippedEmpty[prefix]++
+}
+
 // RecordWarmupExecution records a warmup execution for a template.
 // prefix: The template prefix (e.g., "@code")
 // duration: How long the warmup took in seconds
@@ -164,6 +413,26 @@ func (m *Metrics) RecordKVCacheSave(prefix string) {
 	m.KVCacheSaves[prefix]++
 }
 
+// RecordKVCacheSaveDuration records how long a KV cache save call took.
+// prefix: The template prefix (e.g., "@code")
+// duration: Duration of the call to llama.cpp in seconds
+func (m *Metrics) RecordKVCacheSaveDuration(prefix string, duration float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.KVCacheSaveDurationTotal[prefix] += duration
+	m.KVCacheSaveDurationCount[prefix]++
+}
+
+// RecordKVCacheRestoreDuration records how long a KV cache restore call took.
+// prefix: The template prefix (e.g., "@code")
+// duration: Duration of the call to llama.cpp in seconds
+func (m *Metrics) RecordKVCacheRestoreDuration(prefix string, duration float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.KVCacheRestoreDurationTotal[prefix] += duration
+	m.KVCacheRestoreDurationCount[prefix]++
+}
+
 // RecordKVCacheRestore records a KV cache restore attempt.
 // prefix: The template prefix (e.g., "@code")
 // status: Status of the restore ("success", "not_found", "error")
@@ -177,6 +446,20 @@ func (m *Metrics) RecordKVCacheRestore(prefix string, status string) {
 	m.KVCacheRestores[prefix][status]++
 }
 
+// RecordSlotRefresh records a refresh of the loaded template's KV cache
+// before slot idle eviction.
+// prefix: The template prefix (e.g., "@code")
+// result: "restored", "warmed_up" (nothing was saved) or "error"
+func (m *Metrics) RecordSlotRefresh(prefix string, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.SlotRefreshes[prefix] == nil {
+		m.SlotRefreshes[prefix] = make(map[string]int64)
+	}
+	m.SlotRefreshes[prefix][result]++
+}
+
 // RecordWarmupCancellation records a warmup operation that was cancelled
 // because a user request arrived and needed priority.
 // prefix: The template prefix (e.g., "@code")
@@ -186,38 +469,253 @@ func (m *Metrics) RecordWarmupCancellation(prefix string) {
 	m.WarmupCancellations[prefix]++
 }
 
-// GetSnapshot returns a read-only snapshot of the current metrics.
+// RecordWarmupGraceCompletion records a warmup that finished within the
+// cancel grace period instead of being cancelled by a user request.
+// prefix: The template prefix (e.g., "@code")
+func (m *Metrics) RecordWarmupGraceCompletion(prefix string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.WarmupGraceCompletions[prefix]++
+}
+
+// RecordConfigLoad records that the configuration was (re)loaded just now.
+func (m *Metrics) RecordConfigLoad() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ConfigLoadTime = time.Now()
+}
+
+// RecordTemplateReload records that a template's processed content changed
+// and was picked up by the watcher.
+// prefix: The template prefix (e.g., "@code")
+func (m *Metrics) RecordTemplateReload(prefix string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.TemplateReloads[prefix]++
+}
+
+// RecordTemplateHash records the processed template hash a template was warmed up with.
+// prefix: The template prefix (e.g., "@code")
+// hash: The processed template hash (full sha256 hex)
+func (m *Metrics) RecordTemplateHash(prefix string, hash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.TemplateHashes[prefix] = hash
+}
+
+// RecordTemplateVariantRequest records that a request for prefix used the given variant.
+// prefix: The template prefix (e.g., "@code")
+// variant: The selected variant name (e.g., "v1")
+func (m *Metrics) RecordTemplateVariantRequest(prefix string, variant string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.TemplateVariantRequests[prefix] == nil {
+		m.TemplateVariantRequests[prefix] = make(map[string]int64)
+	}
+	m.TemplateVariantRequests[prefix][variant]++
+}
+
+// RecordTemplateRequest records that a request used the given template.
+// key: The template key (e.g., "@code", or "@code.v1" for A/B variants)
+func (m *Metrics) RecordTemplateRequest(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.TemplateRequests[key]++
+}
+
+// GetTemplateRequests returns how many requests used the given template.
+func (m *Metrics) GetTemplateRequests(key string) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.TemplateRequests[key]
+}
+
+// SetBackendHealthy records the health probe result of a pool backend.
+// url: The backend URL (e.g., "http://gpu1:8081")
+func (m *Metrics) SetBackendHealthy(url string, healthy bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.BackendHealthy[url] = healthy
+}
+
+// RecordMaxTokens records the max_tokens a client requested and whether
+// MaxTokensCap reduced it.
+func (m *Metrics) RecordMaxTokens(requested int64, clamped bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, bound := range MaxTokensBucketBounds {
+		if requested <= bound {
+			m.MaxTokensBuckets[i]++
+			break
+		}
+	}
+	m.MaxTokensSum += requested
+	m.MaxTokensCount++
+	if clamped {
+		m.MaxTokensClamped++
+	}
+}
+
+// GetSnapshot returns a read-only snapshot of the request counts.
 // This allows safe reading of metrics while they're being updated.
+// Use FullSnapshot to read all metrics consistently.
 func (m *Metrics) GetSnapshot() map[string]map[string]int64 {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	// Create a deep copy of the metrics
-	snapshot := make(map[string]map[string]int64)
-	for endpoint, statusMap := range m.RequestCount {
-		snapshot[endpoint] = make(map[string]int64)
-		for status, count := range statusMap {
-			snapshot[endpoint][status] = count
-		}
+	return cloneNested(m.RequestCount)
+}
+
+// MetricsSnapshot is a point-in-time copy of all metrics.
+// Field meanings match the corresponding Metrics fields.
+type MetricsSnapshot struct {
+	RequestCount                map[string]map[string]int64
+	TotalRequests               int64
+	StartTime                   time.Time
+	LastActivity                time.Time
+	StreamMismatches            int64
+	BackendAuthFailures         int64
+	BackendRequests             map[string]int64
+	WarmupChecksTotal           int64
+	WarmupSkippedBusy           int64
+	WarmupSkippedEmpty          map[string]int64
+	WarmupExecutions            map[string]int64
+	WarmupErrors                map[string]map[string]int64
+	WarmupDurationTotal         map[string]float64
+	WarmupDurationCount         map[string]int64
+	KVCacheSaves                map[string]int64
+	KVCacheSaveDurationTotal    map[string]float64
+	KVCacheSaveDurationCount    map[string]int64
+	KVCacheRestoreDurationTotal map[string]float64
+	KVCacheRestoreDurationCount map[string]int64
+	KVCacheRestores             map[string]map[string]int64
+	SlotRefreshes               map[string]map[string]int64
+	WarmupCancellations         map[string]int64
+	WarmupGraceCompletions      map[string]int64
+	ConfigLoadTime              time.Time
+	RestoredAt                  time.Time
+	TemplateReloads             map[string]int64
+	TemplateVariantRequests     map[string]map[string]int64
+	TemplateRequests            map[string]int64
+	TemplateHashes              map[string]string
+	BackendHealthy              map[string]bool
+	MaxTokensClamped            int64
+	MaxTokensBuckets            []int64
+	MaxTokensSum                int64
+	MaxTokensCount              int64
+}
+
+// FullSnapshot copies all metrics under a single read lock, so the result is
+// internally consistent (e.g. a warmup execution is never counted without its
+// duration). The returned maps are independent of the live metrics.
+func (m *Metrics) FullSnapshot() MetricsSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return MetricsSnapshot{
+		RequestCount:                cloneNested(m.RequestCount),
+		TotalRequests:               m.TotalRequests,
+		StartTime:                   m.StartTime,
+		LastActivity:                m.LastActivity,
+		StreamMismatches:            m.StreamMismatches,
+		BackendAuthFailures:         m.BackendAuthFailures,
+		BackendRequests:             maps.Clone(m.BackendRequests),
+		WarmupChecksTotal:           m.WarmupChecksTotal,
+		WarmupSkippedBusy:           m.WarmupSkippedBusy,
+		WarmupSkippedEmpty:          maps.Clone(m.WarmupSkippedEmpty),
+		WarmupExecutions:            maps.Clone(m.WarmupExecutions),
+		WarmupErrors:                cloneNested(m.WarmupErrors),
+		WarmupDurationTotal:         maps.Clone(m.WarmupDurationTotal),
+		WarmupDurationCount:         maps.Clone(m.WarmupDurationCount),
+		KVCacheSaves:                maps.Clone(m.KVCacheSaves),
+		KVCacheSaveDurationTotal:    maps.Clone(m.KVCacheSaveDurationTotal),
+		KVCacheSaveDurationCount:    maps.Clone(m.KVCacheSaveDurationCount),
+		KVCacheRestoreDurationTotal: maps.Clone(m.KVCacheRestoreDurationTotal),
+		KVCacheRestoreDurationCount: maps.Clone(m.KVCacheRestoreDurationCount),
+		KVCacheRestores:             cloneNested(m.KVCacheRestores),
+		SlotRefreshes:               cloneNested(m.SlotRefreshes),
+		WarmupCancellations:         maps.Clone(m.WarmupCancellations),
+		WarmupGraceCompletions:      maps.Clone(m.WarmupGraceCompletions),
+		ConfigLoadTime:              m.ConfigLoadTime,
+		RestoredAt:                  m.RestoredAt,
+		TemplateReloads:             maps.Clone(m.TemplateReloads),
+		TemplateVariantRequests:     cloneNested(m.TemplateVariantRequests),
+		TemplateRequests:            maps.Clone(m.TemplateRequests),
+		TemplateHashes:              maps.Clone(m.TemplateHashes),
+		BackendHealthy:              maps.Clone(m.BackendHealthy),
+		MaxTokensClamped:            m.MaxTokensClamped,
+		MaxTokensBuckets:            slices.Clone(m.MaxTokensBuckets),
+		MaxTokensSum:                m.MaxTokensSum,
+		MaxTokensCount:              m.MaxTokensCount,
 	}
+}
 
-	return snapshot
+// GetLastActivity returns when the last API request arrived, or StartTime
+// if there has been none yet.
+func (s MetricsSnapshot) GetLastActivity() time.Time {
+	if s.LastActivity.IsZero() {
+		return s.StartTime
+	}
+	return s.LastActivity
+}
+
+// cloneNested deep-copies a two-level counter map
+func cloneNested(m map[string]map[string]int64) map[string]map[string]int64 {
+	clone := make(map[string]map[string]int64, len(m))
+	for key, inner := range m {
+		clone[key] = maps.Clone(inner)
+	}
+	return clone
 }
 
 // New creates a new admin server instance with the given configuration.
-// The server provides /health and /metrics endpoints.
-func New(cfg *config.Config, metrics *Metrics) *Server {
+// The server provides /health, /metrics and /state/reset endpoints.
+//
+// Parameters:
+//   - cfg: Admin server configuration
+//   - metrics: Shared metrics collector
+//   - backendState: Shared backend state tracker (can be nil to disable /state/reset)
+func New(cfg *config.Config, metrics *Metrics, backendState *state.State) *Server {
 	return &Server{
-		config:  cfg,
-		metrics: metrics,
-		running: false,
+		config:       cfg,
+		metrics:      metrics,
+		backendState: backendState,
+		running:      false,
 	}
 }
 
+// SetWatcher sets the template watcher used by /templates,
+// /templates/preview, /templates/deps and the template count gauges on /metrics.
+// Must be called before Start.
+func (s *Server) SetWatcher(watcher *template.Watcher) {
+	s.watcher = watcher
+}
+
+// SetStreams sets the registry of active streams listed by /streams.
+// Must be called before Start.
+func (s *Server) SetStreams(streams *StreamRegistry) {
+	s.streams = streams
+}
+
+// SetMaintenance sets the maintenance mode toggled via /maintenance, shared
+// with the proxy. Must be called before Start.
+func (s *Server) SetMaintenance(maintenance *Maintenance) {
+	s.maintenance = maintenance
+}
+
 // Start begins the admin HTTP server on the configured admin port.
 // The server provides these endpoints:
 //   - GET /health - Health check and uptime information
 //   - GET /metrics - Prometheus-style metrics for monitoring
+//   - POST /state/reset - Forget which template is loaded in llama.cpp
+//   - GET /templates - Watched templates with their source and resolved path
+//   - POST /templates/preview - Show what a template expands to for a message
+//   - GET /templates/deps - Files each template includes
+//   - GET /streams - Streaming responses in progress
+//   - GET, POST /maintenance - Show or toggle maintenance mode
+//   - GET / - HTML status dashboard (only with EnableDashboard)
 //
 // This method is non-blocking and starts the server in a goroutine.
 func (s *Server) Start() error {
@@ -231,19 +729,15 @@ func (s *Server) Start() error {
 	// Record start time for uptime calculation
 	s.startTime = time.Now()
 
-	// Create HTTP mux and register handlers
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/metrics", s.handleMetrics)
-
 	// Build the listen address
 	addr := fmt.Sprintf("%s:%d", s.config.AdminHost, s.config.AdminPort)
 
 	// Create the HTTP server
 	s.server = &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: s.handler(),
 	}
+	s.config.AdminTimeouts.Apply(s.server)
 
 	s.running = true
 
@@ -259,6 +753,52 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// handler returns the admin routes, behind basic auth if configured
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/state/reset", s.handleStateReset)
+	mux.HandleFunc("/templates", s.handleTemplates)
+	mux.HandleFunc("/templates/preview", s.handleTemplatePreview)
+	mux.HandleFunc("/templates/deps", s.handleTemplateDeps)
+	mux.HandleFunc("/streams", s.handleStreams)
+	mux.HandleFunc("/maintenance", s.handleMaintenance)
+	if s.config.EnableDashboard {
+		mux.HandleFunc("/", s.handleDashboard)
+	}
+
+	if s.config.AdminBasicUser == "" {
+		return mux
+	}
+	return s.requireBasicAuth(mux)
+}
+
+// requireBasicAuth rejects requests without the configured Basic credentials
+// with 401. /health is let through with AdminBasicAuthExemptHealth.
+func (s *Server) requireBasicAuth(next http.Handler) http.Handler {
+	expectedUser := []byte(s.config.AdminBasicUser)
+	expectedPassword := []byte(s.config.AdminBasicPassword)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AdminBasicAuthExemptHealth && r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		// Compare both in constant time, without short-circuiting on the user
+		userMatch := subtle.ConstantTimeCompare([]byte(user), expectedUser)
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), expectedPassword)
+		if !ok || userMatch&passwordMatch != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bioproxy admin", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Stop gracefully shuts down the admin server.
 func (s *Server) Stop() error {
 	s.mu.Lock()
@@ -324,6 +864,164 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleStateReset resets the tracked backend state so the next request
+// performs a proper KV cache restore. Use this after clearing llama.cpp's
+// cache or restarting it externally.
+// POST /state/reset
+//
+// Response format:
+//
+//	{
+//	  "status": "ok",
+//	  "previous_prefix": "@code"
+//	}
+func (s *Server) handleStateReset(w http.ResponseWriter, r *http.Request) {
+	// Only allow POST requests since this modifies state
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.backendState == nil {
+		http.Error(w, "Backend state tracking not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	previous := s.backendState.Reset()
+	log.Printf("INFO: Backend state reset via admin endpoint (previous prefix: %q)", previous)
+
+	response := map[string]interface{}{
+		"status":          "ok",
+		"previous_prefix": previous,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("ERROR: Failed to encode state reset response: %v", err)
+	}
+}
+
+// templatePreviewRequest is the request body for /templates/preview
+type templatePreviewRequest struct {
+	Prefix  string `json:"prefix"`
+	Message string `json:"message"`
+}
+
+// handleTemplatePreview processes a template with the given message and
+// returns the result without sending anything to llama.cpp.
+// POST /templates/preview with {"prefix": "@code", "message": "test"}
+//
+// Response format:
+//
+//	{
+//	  "processed": "...",
+//	  "bytes": 1234,
+//	  "hash": "sha256 hex of the processed output"
+//	}
+func (s *Server) handleTemplatePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.watcher == nil {
+		http.Error(w, "Template preview not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req templatePreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if req.Prefix == "" {
+		http.Error(w, "Request must include prefix", http.StatusBadRequest)
+		return
+	}
+
+	processed, err := s.watcher.ProcessTemplate(req.Prefix, req.Message)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Template processing failed: %v", err), http.StatusNotFound)
+		return
+	}
+
+	hash := sha256.Sum256([]byte(processed))
+	response := map[string]interface{}{
+		"processed": processed,
+		"bytes":     len(processed),
+		"hash":      hex.EncodeToString(hash[:]),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("ERROR: Failed to encode template preview response: %v", err)
+	}
+}
+
+// handleTemplates lists the watched templates with where each comes from.
+// GET /templates
+//
+// Response format:
+//
+//	{
+//	  "@code": {"source": "config", "path": "templates/code.txt", "resolved_path": "/srv/templates/code.txt", "engine": "simple"},
+//	  "@chat": {"source": "inline", "engine": "simple"}
+//	}
+//
+// Sources are "config" (listed in prefixes), "dir" (found in template_dir),
+// "inline" and "runtime" (added without a config, e.g. by tools).
+func (s *Server) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.watcher == nil {
+		http.Error(w, "Template list not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(s.watcher.Templates()); err != nil {
+		log.Printf("ERROR: Failed to encode templates response: %v", err)
+	}
+}
+
+// handleTemplateDeps lists the files each template includes, as of its
+// last successful processing.
+// GET /templates/deps
+//
+// Response format:
+//
+//	{
+//	  "@code": ["/abs/path/guide.txt", "/abs/path/style.txt"],
+//	  "@chat": []
+//	}
+func (s *Server) handleTemplateDeps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.watcher == nil {
+		http.Error(w, "Template dependencies not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(s.watcher.Dependencies()); err != nil {
+		log.Printf("ERROR: Failed to encode template dependencies response: %v", err)
+	}
+}
+
 // handleMetrics responds with Prometheus-style metrics.
 // GET /metrics
 //
@@ -349,124 +1047,598 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get a snapshot of current metrics
-	snapshot := s.metrics.GetSnapshot()
+	// Metric names are "<namespace>_<name>", e.g. bioproxy_requests_total
+	ns := s.config.MetricsNamespace
+	if ns == "" {
+		ns = defaultMetricsNamespace
+	}
+
+	// Take a single consistent snapshot of all metrics; everything below
+	// is rendered from it without touching the live metrics again
+	snap := s.metrics.FullSnapshot()
 
 	// Calculate uptime
 	uptime := time.Since(s.startTime).Seconds()
 
 	// Build Prometheus text format response
 	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	// Compress on the fly when the scraper accepts gzip; sections are
+	// streamed through the gzip writer, never the whole body at once
+	var out io.Writer = w
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
 	w.WriteHeader(http.StatusOK)
 
-	// Write metric: bioproxy_requests_total (by endpoint and status)
-	fmt.Fprintf(w, "# HELP bioproxy_requests_total Total number of requests by endpoint and status code\n")
-	fmt.Fprintf(w, "# TYPE bioproxy_requests_total counter\n")
+	if s.config.InstanceLabel != "" {
+		out = &labelWriter{w: out, label: fmt.Sprintf("instance=\"%s\"", escapeLabelValue(s.config.InstanceLabel))}
+	}
+	writeMetricsSections(out, s.metricsSections(ns, snap, uptime))
+}
 
-	for endpoint, statusMap := range snapshot {
-		for status, count := range statusMap {
-			// Prometheus format: metric_name{label1="value1",label2="value2"} value
-			fmt.Fprintf(w, "bioproxy_requests_total{endpoint=\"%s\",status=\"%s\"} %d\n",
-				endpoint, status, count)
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+// (listed without q=0, or "*")
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					continue
+				}
+			}
+			return true
 		}
 	}
+	return false
+}
 
-	fmt.Fprintf(w, "\n")
+// metricsSection renders one group of metrics of the /metrics response
+type metricsSection struct {
+	// name identifies the section in logs
+	name string
 
-	// Write metric: bioproxy_requests_count (total)
-	fmt.Fprintf(w, "# HELP bioproxy_requests_count Total number of all requests\n")
-	fmt.Fprintf(w, "# TYPE bioproxy_requests_count counter\n")
-	fmt.Fprintf(w, "bioproxy_requests_count %d\n", s.metrics.TotalRequests)
+	write func(w io.Writer)
+}
 
-	fmt.Fprintf(w, "\n")
+// metricsSections returns the sections of the /metrics response, in order,
+// rendered from a single metrics snapshot
+func (s *Server) metricsSections(ns string, snap MetricsSnapshot, uptime float64) []metricsSection {
+	// Sections are rendered separately, see writeMetricsSections
+	return []metricsSection{
+		// Write metric: bioproxy_requests_total (by endpoint and status)
+		{"requests_total", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_requests_total Total number of requests by endpoint and status code\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_requests_total counter\n", ns)
+
+			for endpoint, statusMap := range snap.RequestCount {
+				for status, count := range statusMap {
+					// Prometheus format: metric_name{label1="value1",label2="value2"} value
+					fmt.Fprintf(w, "%s_requests_total{endpoint=\"%s\",status=\"%s\"} %d\n",
+						ns, endpoint, status, count)
+				}
+			}
 
-	// Write metric: bioproxy_uptime_seconds
-	fmt.Fprintf(w, "# HELP bioproxy_uptime_seconds Time since server started in seconds\n")
-	fmt.Fprintf(w, "# TYPE bioproxy_uptime_seconds gauge\n")
-	fmt.Fprintf(w, "bioproxy_uptime_seconds %.2f\n", uptime)
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_requests_by_class_total (derived from the status codes above)
+		{"requests_by_class_total", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_requests_by_class_total Total number of requests by endpoint and status class\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_requests_by_class_total counter\n", ns)
+
+			for endpoint, statusMap := range snap.RequestCount {
+				classCounts := make(map[string]int64)
+				for status, count := range statusMap {
+					classCounts[statusClass(status)] += count
+				}
+				for class, count := range classCounts {
+					fmt.Fprintf(w, "%s_requests_by_class_total{endpoint=\"%s\",class=\"%s\"} %d\n",
+						ns, endpoint, class, count)
+				}
+			}
 
-	fmt.Fprintf(w, "\n")
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_requests_count (total)
+		{"requests_count", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_requests_count Total number of all requests\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_requests_count counter\n", ns)
+			fmt.Fprintf(w, "%s_requests_count %d\n", ns, snap.TotalRequests)
+
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_stream_mismatch_total
+		{"stream_mismatch_total", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_stream_mismatch_total Streaming requests that received a non-SSE backend response\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_stream_mismatch_total counter\n", ns)
+			fmt.Fprintf(w, "%s_stream_mismatch_total %d\n", ns, snap.StreamMismatches)
+
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_backend_auth_failures_total
+		{"backend_auth_failures_total", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_backend_auth_failures_total Backend 401/403 responses to requests with backend_auth_token\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_backend_auth_failures_total counter\n", ns)
+			fmt.Fprintf(w, "%s_backend_auth_failures_total %d\n", ns, snap.BackendAuthFailures)
+
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_backend_requests_total
+		// Both sources are always written, so dashboards can compare them from the start
+		{"backend_requests_total", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_backend_requests_total Requests sent to llama.cpp by source (user or warmup), excluding KV cache save/restore\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_backend_requests_total counter\n", ns)
+			for _, source := range []string{BackendSourceUser, BackendSourceWarmup} {
+				fmt.Fprintf(w, "%s_backend_requests_total{source=\"%s\"} %d\n", ns, source, snap.BackendRequests[source])
+			}
 
-	// Write metric: bioproxy_warmup_checks_total
-	fmt.Fprintf(w, "# HELP bioproxy_warmup_checks_total Total number of warmup check cycles performed\n")
-	fmt.Fprintf(w, "# TYPE bioproxy_warmup_checks_total counter\n")
-	fmt.Fprintf(w, "bioproxy_warmup_checks_total %d\n", s.metrics.WarmupChecksTotal)
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_uptime_seconds
+		{"uptime_seconds", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_uptime_seconds Time since server started in seconds\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_uptime_seconds gauge\n", ns)
+			fmt.Fprintf(w, "%s_uptime_seconds %.2f\n", ns, uptime)
+
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_idle_since_seconds
+		{"idle_since_seconds", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_idle_since_seconds Time since the last /v1/* API request in seconds\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_idle_since_seconds gauge\n", ns)
+			fmt.Fprintf(w, "%s_idle_since_seconds %.2f\n", ns, time.Since(snap.GetLastActivity()).Seconds())
+
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_warmup_checks_total
+		{"warmup_checks_total", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_warmup_checks_total Total number of warmup check cycles performed\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_warmup_checks_total counter\n", ns)
+			fmt.Fprintf(w, "%s_warmup_checks_total %d\n", ns, snap.WarmupChecksTotal)
+
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_warmup_skipped_busy_total
+		{"warmup_skipped_busy_total", func(w io.Writer) {
+			fmt.Fprintf(w, "# HELP %s_warmup_skipped_busy_total Warmup cycles skipped because all backend slots were busy\n", ns)
+			fmt.Fprintf(w, "# TYPE %s_warmup_skipped_busy_total counter\n", ns)
+			fmt.Fprintf(w, "%s_warmup_skipped_busy_total %d\n", ns, snap.WarmupSkippedBusy)
+
+			fmt.Fprintf(w, "\n")
+		}},
+
+		// Write metric: bioproxy_warmup_skipped_empty_total
+		{"warmup_skipped_empty_total", func(w io.Writer) {
+			if len(snap.WarmupSkippedEmpty) > 0 {
+				fmt.Fprintf(w, "# HELP %s_warmup_skipped_empty_total Warmups skipped because the template processed to empty content\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_warmup_skipped_empty_total counter\n", ns)
+				for prefix, count := range snap.WarmupSkippedEmpty {
+					fmt.Fprintf(w, "%s_warmup_skipped_empty_total{prefix=\"%s\"} %d\n", ns, prefix, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_warmup_executions_total
+		{"warmup_executions_total", func(w io.Writer) {
+			if len(snap.WarmupExecutions) > 0 {
+				fmt.Fprintf(w, "# HELP %s_warmup_executions_total Number of warmup executions per template\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_warmup_executions_total counter\n", ns)
+				for prefix, count := range snap.WarmupExecutions {
+					fmt.Fprintf(w, "%s_warmup_executions_total{prefix=\"%s\"} %d\n", ns, prefix, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_warmup_errors_total
+		{"warmup_errors_total", func(w io.Writer) {
+			if len(snap.WarmupErrors) > 0 {
+				fmt.Fprintf(w, "# HELP %s_warmup_errors_total Number of warmup errors by template and error type\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_warmup_errors_total counter\n", ns)
+				for prefix, errorTypes := range snap.WarmupErrors {
+					for errorType, count := range errorTypes {
+						fmt.Fprintf(w, "%s_warmup_errors_total{prefix=\"%s\",type=\"%s\"} %d\n", ns, prefix, errorType, count)
+					}
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_warmup_duration_seconds_total
+		{"warmup_duration_seconds_total", func(w io.Writer) {
+			if len(snap.WarmupDurationTotal) > 0 {
+				fmt.Fprintf(w, "# HELP %s_warmup_duration_seconds_total Total warmup duration in seconds per template\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_warmup_duration_seconds_total counter\n", ns)
+				for prefix, duration := range snap.WarmupDurationTotal {
+					fmt.Fprintf(w, "%s_warmup_duration_seconds_total{prefix=\"%s\"} %.2f\n", ns, prefix, duration)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_warmup_duration_seconds_count
+		{"warmup_duration_seconds_count", func(w io.Writer) {
+			if len(snap.WarmupDurationCount) > 0 {
+				fmt.Fprintf(w, "# HELP %s_warmup_duration_seconds_count Number of warmup duration measurements per template\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_warmup_duration_seconds_count counter\n", ns)
+				for prefix, count := range snap.WarmupDurationCount {
+					fmt.Fprintf(w, "%s_warmup_duration_seconds_count{prefix=\"%s\"} %d\n", ns, prefix, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_kv_cache_saves_total
+		{"kv_cache_saves_total", func(w io.Writer) {
+			if len(snap.KVCacheSaves) > 0 {
+				fmt.Fprintf(w, "# HELP %s_kv_cache_saves_total Number of successful KV cache saves per template\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_kv_cache_saves_total counter\n", ns)
+				for prefix, count := range snap.KVCacheSaves {
+					fmt.Fprintf(w, "%s_kv_cache_saves_total{prefix=\"%s\"} %d\n", ns, prefix, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_kv_cache_restores_total
+		{"kv_cache_restores_total", func(w io.Writer) {
+			if len(snap.KVCacheRestores) > 0 {
+				fmt.Fprintf(w, "# HELP %s_kv_cache_restores_total Number of KV cache restore attempts per template and status\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_kv_cache_restores_total counter\n", ns)
+				for prefix, statuses := range snap.KVCacheRestores {
+					for status, count := range statuses {
+						fmt.Fprintf(w, "%s_kv_cache_restores_total{prefix=\"%s\",status=\"%s\"} %d\n", ns, prefix, status, count)
+					}
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_slot_refreshes_total
+		{"slot_refreshes_total", func(w io.Writer) {
+			if len(snap.SlotRefreshes) > 0 {
+				fmt.Fprintf(w, "# HELP %s_slot_refreshes_total Number of KV cache refreshes before slot idle eviction per template and result\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_slot_refreshes_total counter\n", ns)
+				for prefix, results := range snap.SlotRefreshes {
+					for result, count := range results {
+						fmt.Fprintf(w, "%s_slot_refreshes_total{prefix=\"%s\",result=\"%s\"} %d\n", ns, prefix, result, count)
+					}
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metrics: bioproxy_kv_cache_save_seconds and bioproxy_kv_cache_restore_seconds
+		{"kv_cache_save_seconds and kv_cache_restore_seconds", func(w io.Writer) {
+			writeDurationSummary(w, ns+"_kv_cache_save_seconds", "Duration of KV cache save calls to llama.cpp per template",
+				snap.KVCacheSaveDurationTotal, snap.KVCacheSaveDurationCount)
+			writeDurationSummary(w, ns+"_kv_cache_restore_seconds", "Duration of KV cache restore calls to llama.cpp per template",
+				snap.KVCacheRestoreDurationTotal, snap.KVCacheRestoreDurationCount)
+		}},
+
+		// Write metric: bioproxy_warmup_cancellations_total
+		{"warmup_cancellations_total", func(w io.Writer) {
+			if len(snap.WarmupCancellations) > 0 {
+				fmt.Fprintf(w, "# HELP %s_warmup_cancellations_total Number of warmup operations cancelled due to user requests\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_warmup_cancellations_total counter\n", ns)
+				for prefix, count := range snap.WarmupCancellations {
+					fmt.Fprintf(w, "%s_warmup_cancellations_total{prefix=\"%s\"} %d\n", ns, prefix, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_warmup_grace_completions_total
+		{"warmup_grace_completions_total", func(w io.Writer) {
+			if len(snap.WarmupGraceCompletions) > 0 {
+				fmt.Fprintf(w, "# HELP %s_warmup_grace_completions_total Number of warmups that finished within the cancel grace period instead of being cancelled\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_warmup_grace_completions_total counter\n", ns)
+				for prefix, count := range snap.WarmupGraceCompletions {
+					fmt.Fprintf(w, "%s_warmup_grace_completions_total{prefix=\"%s\"} %d\n", ns, prefix, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_config_load_timestamp_seconds
+		{"config_load_timestamp_seconds", func(w io.Writer) {
+			if !snap.ConfigLoadTime.IsZero() {
+				fmt.Fprintf(w, "# HELP %s_config_load_timestamp_seconds Unix timestamp of the last configuration load\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_config_load_timestamp_seconds gauge\n", ns)
+				fmt.Fprintf(w, "%s_config_load_timestamp_seconds %d\n", ns, snap.ConfigLoadTime.Unix())
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_metrics_restored_timestamp_seconds
+		{"metrics_restored_timestamp_seconds", func(w io.Writer) {
+			if !snap.RestoredAt.IsZero() {
+				fmt.Fprintf(w, "# HELP %s_metrics_restored_timestamp_seconds Unix timestamp of the metrics snapshot the counters continue from\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_metrics_restored_timestamp_seconds gauge\n", ns)
+				fmt.Fprintf(w, "%s_metrics_restored_timestamp_seconds %d\n", ns, snap.RestoredAt.Unix())
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_template_reloads_total
+		{"template_reloads_total", func(w io.Writer) {
+			if len(snap.TemplateReloads) > 0 {
+				fmt.Fprintf(w, "# HELP %s_template_reloads_total Number of detected template content changes per template\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_template_reloads_total counter\n", ns)
+				for prefix, count := range snap.TemplateReloads {
+					fmt.Fprintf(w, "%s_template_reloads_total{prefix=\"%s\"} %d\n", ns, prefix, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_template_variant_requests_total
+		{"template_variant_requests_total", func(w io.Writer) {
+			if len(snap.TemplateVariantRequests) > 0 {
+				fmt.Fprintf(w, "# HELP %s_template_variant_requests_total Number of requests per template prefix and A/B variant\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_template_variant_requests_total counter\n", ns)
+				for prefix, variants := range snap.TemplateVariantRequests {
+					for variant, count := range variants {
+						fmt.Fprintf(w, "%s_template_variant_requests_total{prefix=\"%s\",variant=\"%s\"} %d\n", ns, prefix, variant, count)
+					}
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_template_requests_total
+		{"template_requests_total", func(w io.Writer) {
+			if len(snap.TemplateRequests) > 0 {
+				fmt.Fprintf(w, "# HELP %s_template_requests_total Number of requests per template\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_template_requests_total counter\n", ns)
+				for key, count := range snap.TemplateRequests {
+					fmt.Fprintf(w, "%s_template_requests_total{prefix=\"%s\"} %d\n", ns, key, count)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metrics: bioproxy_templates_configured and bioproxy_templates_warmed
+		{"templates_configured and templates_warmed", func(w io.Writer) {
+			if s.watcher != nil {
+				configured, warmed := s.watcher.WarmupCounts()
+				fmt.Fprintf(w, "# HELP %s_templates_configured Number of configured templates\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_templates_configured gauge\n", ns)
+				fmt.Fprintf(w, "%s_templates_configured %d\n", ns, configured)
+				fmt.Fprintf(w, "\n")
+				fmt.Fprintf(w, "# HELP %s_templates_warmed Number of templates warmed up with their current content\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_templates_warmed gauge\n", ns)
+				fmt.Fprintf(w, "%s_templates_warmed %d\n", ns, warmed)
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_template_hash_info
+		{"template_hash_info", func(w io.Writer) {
+			if len(snap.TemplateHashes) > 0 {
+				fmt.Fprintf(w, "# HELP %s_template_hash_info Processed template hash (short) of the last successful warmup per template\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_template_hash_info gauge\n", ns)
+				for prefix, hash := range snap.TemplateHashes {
+					fmt.Fprintf(w, "%s_template_hash_info{prefix=\"%s\",hash=\"%s\"} 1\n", ns, prefix, shortHash(hash))
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metric: bioproxy_backend_healthy
+		{"backend_healthy", func(w io.Writer) {
+			if len(snap.BackendHealthy) > 0 {
+				fmt.Fprintf(w, "# HELP %s_backend_healthy Whether a backend of the pool passed its last health probe (1) or is ejected (0)\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_backend_healthy gauge\n", ns)
+				for url, healthy := range snap.BackendHealthy {
+					value := 0
+					if healthy {
+						value = 1
+					}
+					fmt.Fprintf(w, "%s_backend_healthy{url=\"%s\"} %d\n", ns, url, value)
+				}
+				fmt.Fprintf(w, "\n")
+			}
+		}},
+
+		// Write metrics: bioproxy_max_tokens_clamped_total and bioproxy_max_tokens_requested
+		{"max_tokens_clamped_total and max_tokens_requested", func(w io.Writer) {
+			if snap.MaxTokensCount > 0 {
+				fmt.Fprintf(w, "# HELP %s_max_tokens_clamped_total Number of requests whose max_tokens was reduced by max_tokens_cap\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_max_tokens_clamped_total counter\n", ns)
+				fmt.Fprintf(w, "%s_max_tokens_clamped_total %d\n", ns, snap.MaxTokensClamped)
+				fmt.Fprintf(w, "\n")
+
+				fmt.Fprintf(w, "# HELP %s_max_tokens_requested Histogram of max_tokens requested by clients, before the cap\n", ns)
+				fmt.Fprintf(w, "# TYPE %s_max_tokens_requested histogram\n", ns)
+				var cumulative int64
+				for i, bound := range MaxTokensBucketBounds {
+					cumulative += snap.MaxTokensBuckets[i]
+					fmt.Fprintf(w, "%s_max_tokens_requested_bucket{le=\"%d\"} %d\n", ns, bound, cumulative)
+				}
+				fmt.Fprintf(w, "%s_max_tokens_requested_bucket{le=\"+Inf\"} %d\n", ns, snap.MaxTokensCount)
+				fmt.Fprintf(w, "%s_max_tokens_requested_sum %d\n", ns, snap.MaxTokensSum)
+				fmt.Fprintf(w, "%s_max_tokens_requested_count %d\n", ns, snap.MaxTokensCount)
+				fmt.Fprintf(w, "\n")
+			}
+		}},
 
-	fmt.Fprintf(w, "\n")
+		// Write runtime metrics: go_* and process_*
+		{"runtime", func(w io.Writer) {
+			if s.config.ExposeRuntimeMetrics {
+				writeRuntimeMetrics(w, ns)
+			}
+		}},
+	}
+}
 
-	// Write metric: bioproxy_warmup_executions_total
-	s.metrics.mu.RLock()
-	if len(s.metrics.WarmupExecutions) > 0 {
-		fmt.Fprintf(w, "# HELP bioproxy_warmup_executions_total Number of warmup executions per template\n")
-		fmt.Fprintf(w, "# TYPE bioproxy_warmup_executions_total counter\n")
-		for prefix, count := range s.metrics.WarmupExecutions {
-			fmt.Fprintf(w, "bioproxy_warmup_executions_total{prefix=\"%s\"} %d\n", prefix, count)
+// writeMetricsSections renders each section into a buffer before writing it,
+// so a panic in one section (e.g. a bug in a new metric) is logged and the
+// section skipped instead of leaving the client with a truncated response
+func writeMetricsSections(w io.Writer, sections []metricsSection) {
+	var buf bytes.Buffer
+	for _, section := range sections {
+		buf.Reset()
+		if renderMetricsSection(&buf, section) {
+			w.Write(buf.Bytes())
 		}
-		fmt.Fprintf(w, "\n")
 	}
+}
 
-	// Write metric: bioproxy_warmup_errors_total
-	if len(s.metrics.WarmupErrors) > 0 {
-		fmt.Fprintf(w, "# HELP bioproxy_warmup_errors_total Number of warmup errors by template and error type\n")
-		fmt.Fprintf(w, "# TYPE bioproxy_warmup_errors_total counter\n")
-		for prefix, errorTypes := range s.metrics.WarmupErrors {
-			for errorType, count := range errorTypes {
-				fmt.Fprintf(w, "bioproxy_warmup_errors_total{prefix=\"%s\",type=\"%s\"} %d\n", prefix, errorType, count)
+// labelWriter adds a label to every metric line of the rendered sections
+// written to it. Each Write must consist of whole lines.
+type labelWriter struct {
+	w     io.Writer
+	label string
+}
+
+// Write adds the label to the sample lines of p, leaving comments and blank
+// lines alone: `name{a="b"} 1` becomes `name{label,a="b"} 1` and `name 1`
+// becomes `name{label} 1`
+func (lw *labelWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" || line == "\n" || strings.HasPrefix(line, "#") {
+			buf.WriteString(line)
+			continue
+		}
+		if name, rest, ok := strings.Cut(line, "{"); ok && !strings.ContainsAny(name, " ") {
+			if strings.HasPrefix(rest, "}") {
+				buf.WriteString(name + "{" + lw.label + rest)
+			} else {
+				buf.WriteString(name + "{" + lw.label + "," + rest)
 			}
+		} else if name, rest, ok := strings.Cut(line, " "); ok {
+			buf.WriteString(name + "{" + lw.label + "} " + rest)
+		} else {
+			buf.WriteString(line)
 		}
-		fmt.Fprintf(w, "\n")
 	}
-
-	// Write metric: bioproxy_warmup_duration_seconds_total
-	if len(s.metrics.WarmupDurationTotal) > 0 {
-		fmt.Fprintf(w, "# HELP bioproxy_warmup_duration_seconds_total Total warmup duration in seconds per template\n")
-		fmt.Fprintf(w, "# TYPE bioproxy_warmup_duration_seconds_total counter\n")
-		for prefix, duration := range s.metrics.WarmupDurationTotal {
-			fmt.Fprintf(w, "bioproxy_warmup_duration_seconds_total{prefix=\"%s\"} %.2f\n", prefix, duration)
-		}
-		fmt.Fprintf(w, "\n")
+	if _, err := lw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
 
-	// Write metric: bioproxy_warmup_duration_seconds_count
-	if len(s.metrics.WarmupDurationCount) > 0 {
-		fmt.Fprintf(w, "# HELP bioproxy_warmup_duration_seconds_count Number of warmup duration measurements per template\n")
-		fmt.Fprintf(w, "# TYPE bioproxy_warmup_duration_seconds_count counter\n")
-		for prefix, count := range s.metrics.WarmupDurationCount {
-			fmt.Fprintf(w, "bioproxy_warmup_duration_seconds_count{prefix=\"%s\"} %d\n", prefix, count)
+// renderMetricsSection renders a section into buf, reporting whether it
+// completed without panicking
+func renderMetricsSection(buf *bytes.Buffer, section metricsSection) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: Failed to render metrics section %s, skipping it: %v", section.name, r)
+			ok = false
 		}
-		fmt.Fprintf(w, "\n")
+	}()
+	section.write(buf)
+	return true
+}
+
+// writeDurationSummary writes per-prefix durations as a Prometheus summary
+// without quantiles (name_sum and name_count)
+func writeDurationSummary(w io.Writer, name, help string, total map[string]float64, count map[string]int64) {
+	if len(count) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for prefix, n := range count {
+		fmt.Fprintf(w, "%s_sum{prefix=\"%s\"} %.3f\n", name, prefix, total[prefix])
+		fmt.Fprintf(w, "%s_count{prefix=\"%s\"} %d\n", name, prefix, n)
 	}
+	fmt.Fprintf(w, "\n")
+}
 
-	// Write metric: bioproxy_kv_cache_saves_total
-	if len(s.metrics.KVCacheSaves) > 0 {
-		fmt.Fprintf(w, "# HELP bioproxy_kv_cache_saves_total Number of successful KV cache saves per template\n")
-		fmt.Fprintf(w, "# TYPE bioproxy_kv_cache_saves_total counter\n")
-		for prefix, count := range s.metrics.KVCacheSaves {
-			fmt.Fprintf(w, "bioproxy_kv_cache_saves_total{prefix=\"%s\"} %d\n", prefix, count)
-		}
-		fmt.Fprintf(w, "\n")
+// writeRuntimeMetrics writes Go runtime metrics (goroutines, heap, GC) in
+// Prometheus text format. ReadMemStats briefly stops the world, which is
+// fine at scrape frequency.
+func writeRuntimeMetrics(w io.Writer, ns string) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	// Write metric: bioproxy_goroutines
+	fmt.Fprintf(w, "# HELP %s_goroutines Number of goroutines that currently exist\n", ns)
+	fmt.Fprintf(w, "# TYPE %s_goroutines gauge\n", ns)
+	fmt.Fprintf(w, "%s_goroutines %d\n", ns, runtime.NumGoroutine())
+
+	fmt.Fprintf(w, "\n")
+
+	// Write metric: bioproxy_memstats_heap_bytes
+	fmt.Fprintf(w, "# HELP %s_memstats_heap_bytes Bytes of allocated heap objects\n", ns)
+	fmt.Fprintf(w, "# TYPE %s_memstats_heap_bytes gauge\n", ns)
+	fmt.Fprintf(w, "%s_memstats_heap_bytes %d\n", ns, mem.HeapAlloc)
+
+	fmt.Fprintf(w, "\n")
+
+	// Write metric: bioproxy_gc_cycles_total
+	fmt.Fprintf(w, "# HELP %s_gc_cycles_total Number of completed GC cycles\n", ns)
+	fmt.Fprintf(w, "# TYPE %s_gc_cycles_total counter\n", ns)
+	fmt.Fprintf(w, "%s_gc_cycles_total %d\n", ns, mem.NumGC)
+
+	fmt.Fprintf(w, "\n")
+
+	// Write metric: bioproxy_gc_pause_seconds_total
+	fmt.Fprintf(w, "# HELP %s_gc_pause_seconds_total Total time spent in GC stop-the-world pauses in seconds\n", ns)
+	fmt.Fprintf(w, "# TYPE %s_gc_pause_seconds_total counter\n", ns)
+	fmt.Fprintf(w, "%s_gc_pause_seconds_total %.6f\n", ns, float64(mem.PauseTotalNs)/1e9)
+
+	fmt.Fprintf(w, "\n")
+
+	// Write metric: bioproxy_gc_last_pause_seconds
+	// PauseNs is a circular buffer, the most recent pause is at (NumGC+255)%256
+	var lastPause uint64
+	if mem.NumGC > 0 {
+		lastPause = mem.PauseNs[(mem.NumGC+255)%256]
 	}
+	fmt.Fprintf(w, "# HELP %s_gc_last_pause_seconds Duration of the most recent GC pause in seconds\n", ns)
+	fmt.Fprintf(w, "# TYPE %s_gc_last_pause_seconds gauge\n", ns)
+	fmt.Fprintf(w, "%s_gc_last_pause_seconds %.6f\n", ns, float64(lastPause)/1e9)
 
-	// Write metric: bioproxy_kv_cache_restores_total
-	if len(s.metrics.KVCacheRestores) > 0 {
-		fmt.Fprintf(w, "# HELP bioproxy_kv_cache_restores_total Number of KV cache restore attempts per template and status\n")
-		fmt.Fprintf(w, "# TYPE bioproxy_kv_cache_restores_total counter\n")
-		for prefix, statuses := range s.metrics.KVCacheRestores {
-			for status, count := range statuses {
-				fmt.Fprintf(w, "bioproxy_kv_cache_restores_total{prefix=\"%s\",status=\"%s\"} %d\n", prefix, status, count)
-			}
-		}
-		fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "\n")
+}
+
+// defaultMetricsNamespace is the metric name prefix used when none is configured
+const defaultMetricsNamespace = "bioproxy"
+
+// shortHashLength is the number of hex characters of a template hash shown in metrics
+const shortHashLength = 12
+
+// shortHash shortens a hex hash for display
+func shortHash(hash string) string {
+	if len(hash) > shortHashLength {
+		return hash[:shortHashLength]
 	}
+	return hash
+}
 
-	// Write metric: bioproxy_warmup_cancellations_total
-	if len(s.metrics.WarmupCancellations) > 0 {
-		fmt.Fprintf(w, "# HELP bioproxy_warmup_cancellations_total Number of warmup operations cancelled due to user requests\n")
-		fmt.Fprintf(w, "# TYPE bioproxy_warmup_cancellations_total counter\n")
-		for prefix, count := range s.metrics.WarmupCancellations {
-			fmt.Fprintf(w, "bioproxy_warmup_cancellations_total{prefix=\"%s\"} %d\n", prefix, count)
-		}
-		fmt.Fprintf(w, "\n")
+// statusClass returns the class of an HTTP status code, e.g. "502" -> "5xx".
+// Codes that are not three digits starting with 1-5 are reported as "other".
+func statusClass(code string) string {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return "other"
 	}
-	s.metrics.mu.RUnlock()
+	return code[:1] + "xx"
 }
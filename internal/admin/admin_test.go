@@ -1,15 +1,26 @@
 package admin
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/state"
+	"github.com/oleksandr/bioproxy/internal/template"
 )
 
 // createTestConfig creates a minimal config for testing
@@ -74,6 +85,37 @@ func TestMetricsRecordRequest(t *testing.T) {
 	}
 }
 
+// TestMetricsMaxTrackedEndpoints tests that distinct endpoints beyond the
+// limit are counted under "other" while known API paths are always tracked
+func TestMetricsMaxTrackedEndpoints(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.SetMaxTrackedEndpoints(3)
+
+	for i := 0; i < 50; i++ {
+		metrics.RecordRequest(fmt.Sprintf("/probe/%d", i), 404)
+	}
+	metrics.RecordRequest("/v1/chat/completions", 200)
+	metrics.RecordRequest("/health", 200)
+	metrics.RecordRequest("/probe/1", 404)
+
+	snapshot := metrics.GetSnapshot()
+	if len(snapshot) != 6 {
+		t.Errorf("Expected 3 tracked, 2 known and the other endpoint, got %d: %v", len(snapshot), snapshot)
+	}
+	if snapshot[OtherEndpoint]["404"] != 47 {
+		t.Errorf("Expected 47 requests under other, got %d", snapshot[OtherEndpoint]["404"])
+	}
+	if snapshot["/probe/1"]["404"] != 2 {
+		t.Errorf("Expected already tracked endpoint to keep counting, got %d", snapshot["/probe/1"]["404"])
+	}
+	if snapshot["/v1/chat/completions"]["200"] != 1 || snapshot["/health"]["200"] != 1 {
+		t.Errorf("Expected known endpoints to be tracked, got %v", snapshot)
+	}
+	if metrics.TotalRequests != 53 {
+		t.Errorf("Expected TotalRequests to be 53, got %d", metrics.TotalRequests)
+	}
+}
+
 // TestMetricsConcurrency tests that metrics can be safely accessed concurrently
 func TestMetricsConcurrency(t *testing.T) {
 	metrics := NewMetrics()
@@ -110,7 +152,7 @@ func TestNew(t *testing.T) {
 	cfg := createTestConfig()
 	metrics := NewMetrics()
 
-	server := New(cfg, metrics)
+	server := New(cfg, metrics, nil)
 
 	if server == nil {
 		t.Fatal("Expected non-nil server")
@@ -133,7 +175,7 @@ func TestNew(t *testing.T) {
 func TestStartStop(t *testing.T) {
 	cfg := createTestConfig()
 	metrics := NewMetrics()
-	server := New(cfg, metrics)
+	server := New(cfg, metrics, nil)
 
 	// Initially should not be running
 	if server.IsRunning() {
@@ -182,7 +224,7 @@ func TestStartStop(t *testing.T) {
 func TestHandleHealth(t *testing.T) {
 	cfg := createTestConfig()
 	metrics := NewMetrics()
-	server := New(cfg, metrics)
+	server := New(cfg, metrics, nil)
 
 	// Manually set start time for testing
 	server.startTime = time.Now().Add(-10 * time.Second)
@@ -231,11 +273,233 @@ func TestHandleHealth(t *testing.T) {
 	}
 }
 
+// TestHandleStateReset tests that POST /state/reset clears the backend state
+// and reports the previous prefix
+func TestHandleStateReset(t *testing.T) {
+	cfg := createTestConfig()
+	backendState := state.New()
+	backendState.UpdatePrefix("@code")
+	server := New(cfg, NewMetrics(), backendState)
+
+	req := httptest.NewRequest("POST", "/state/reset", nil)
+	rr := httptest.NewRecorder()
+	server.handleStateReset(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if response["previous_prefix"] != "@code" {
+		t.Errorf("Expected previous_prefix '@code', got %v", response["previous_prefix"])
+	}
+
+	if got := backendState.GetLastPrefix(); got != "" {
+		t.Errorf("Expected empty prefix after reset, got %q", got)
+	}
+
+	// GET is not allowed
+	req = httptest.NewRequest("GET", "/state/reset", nil)
+	rr = httptest.NewRecorder()
+	server.handleStateReset(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, got %d", rr.Code)
+	}
+}
+
+// TestHandleTemplatePreview tests previewing a processed template
+func TestHandleTemplatePreview(t *testing.T) {
+	tmpDir := t.TempDir()
+	includePath := filepath.Join(tmpDir, "rules.txt")
+	templatePath := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(includePath, []byte("Be concise."), 0644)
+	os.WriteFile(templatePath, []byte("<{"+includePath+"}>\nQ: <{message}>"), 0644)
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddTemplate("@code", templatePath); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	server := New(createTestConfig(), NewMetrics(), nil)
+	server.SetWatcher(watcher)
+
+	req := httptest.NewRequest("POST", "/templates/preview", strings.NewReader(`{"prefix":"@code","message":"test"}`))
+	rr := httptest.NewRecorder()
+	server.handleTemplatePreview(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	expected := "Be concise.\nQ: test"
+	if response["processed"] != expected {
+		t.Errorf("Expected processed %q, got %q", expected, response["processed"])
+	}
+	if response["bytes"] != float64(len(expected)) {
+		t.Errorf("Expected bytes %d, got %v", len(expected), response["bytes"])
+	}
+	if hash, _ := response["hash"].(string); len(hash) != 64 {
+		t.Errorf("Expected sha256 hex hash, got %v", response["hash"])
+	}
+
+	// Unknown prefix
+	req = httptest.NewRequest("POST", "/templates/preview", strings.NewReader(`{"prefix":"@missing","message":"test"}`))
+	rr = httptest.NewRecorder()
+	server.handleTemplatePreview(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown prefix, got %d", rr.Code)
+	}
+
+	// GET is not allowed
+	req = httptest.NewRequest("GET", "/templates/preview", nil)
+	rr = httptest.NewRecorder()
+	server.handleTemplatePreview(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, got %d", rr.Code)
+	}
+}
+
+// TestHandleTemplates tests listing templates with their sources
+func TestHandleTemplates(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"code.txt", "review.txt", "tool.txt"} {
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("Q: <{message}>"), 0644)
+	}
+	linkPath := filepath.Join(tmpDir, "current.txt")
+	if err := os.Symlink(filepath.Join(tmpDir, "code.txt"), linkPath); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddTemplateFromSource("@code", linkPath, "", nil, template.SourceConfig); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	if err := watcher.AddTemplateFromSource("@review", filepath.Join(tmpDir, "review.txt"), "", nil, template.SourceDir); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	if err := watcher.AddInlineTemplate("@chat", "Q: <{message}>"); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	if err := watcher.AddTemplate("@tool", filepath.Join(tmpDir, "tool.txt")); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	server := New(createTestConfig(), NewMetrics(), nil)
+	server.SetWatcher(watcher)
+
+	rr := httptest.NewRecorder()
+	server.handleTemplates(rr, httptest.NewRequest("GET", "/templates", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response map[string]template.TemplateInfo
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	resolvedCode, _ := filepath.EvalSymlinks(filepath.Join(tmpDir, "code.txt"))
+	expected := map[string]template.TemplateInfo{
+		"@code":   {Source: "config", Path: linkPath, ResolvedPath: resolvedCode, Engine: "simple"},
+		"@review": {Source: "dir", Path: filepath.Join(tmpDir, "review.txt"), Engine: "simple"},
+		"@chat":   {Source: "inline", Engine: "simple"},
+		"@tool":   {Source: "runtime", Path: filepath.Join(tmpDir, "tool.txt"), Engine: "simple"},
+	}
+	if len(response) != len(expected) {
+		t.Errorf("Expected %d templates, got %v", len(expected), response)
+	}
+	for prefix, want := range expected {
+		got := response[prefix]
+		if want.ResolvedPath == "" {
+			// Only compared for the symlinked template
+			got.ResolvedPath = ""
+		}
+		if got != want {
+			t.Errorf("%s: expected %+v, got %+v", prefix, want, response[prefix])
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	server.handleTemplates(rr, httptest.NewRequest("POST", "/templates", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for POST, got %d", rr.Code)
+	}
+}
+
+// TestHandleTemplateDeps tests listing the files each template includes
+func TestHandleTemplateDeps(t *testing.T) {
+	tmpDir := t.TempDir()
+	rulesPath := filepath.Join(tmpDir, "rules.txt")
+	stylePath := filepath.Join(tmpDir, "style.txt")
+	templatePath := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(rulesPath, []byte("Be concise."), 0644)
+	os.WriteFile(stylePath, []byte("Use tabs."), 0644)
+	os.WriteFile(templatePath, []byte("<{"+rulesPath+"}>\n<{"+stylePath+"}>\nQ: <{message}>"), 0644)
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddTemplate("@code", templatePath); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	if err := watcher.AddInlineTemplate("@chat", "Q: <{message}>"); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	server := New(createTestConfig(), NewMetrics(), nil)
+
+	// Without a watcher the endpoint is unavailable
+	req := httptest.NewRequest("GET", "/templates/deps", nil)
+	rr := httptest.NewRecorder()
+	server.handleTemplateDeps(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without a watcher, got %d", rr.Code)
+	}
+
+	server.SetWatcher(watcher)
+
+	req = httptest.NewRequest("GET", "/templates/deps", nil)
+	rr = httptest.NewRecorder()
+	server.handleTemplateDeps(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response map[string][]string
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	deps := response["@code"]
+	if len(deps) != 2 || deps[0] != rulesPath || deps[1] != stylePath {
+		t.Errorf("Expected @code deps [%s %s], got %v", rulesPath, stylePath, deps)
+	}
+	if deps, ok := response["@chat"]; !ok || len(deps) != 0 {
+		t.Errorf("Expected empty @chat deps, got %v (present: %v)", deps, ok)
+	}
+
+	// POST is not allowed
+	req = httptest.NewRequest("POST", "/templates/deps", nil)
+	rr = httptest.NewRecorder()
+	server.handleTemplateDeps(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for POST, got %d", rr.Code)
+	}
+}
+
 // TestHandleHealthMethodNotAllowed tests that non-GET requests are rejected
 func TestHandleHealthMethodNotAllowed(t *testing.T) {
 	cfg := createTestConfig()
 	metrics := NewMetrics()
-	server := New(cfg, metrics)
+	server := New(cfg, metrics, nil)
 
 	methods := []string{"POST", "PUT", "DELETE", "PATCH"}
 
@@ -257,13 +521,16 @@ func TestHandleHealthMethodNotAllowed(t *testing.T) {
 func TestHandleMetrics(t *testing.T) {
 	cfg := createTestConfig()
 	metrics := NewMetrics()
-	server := New(cfg, metrics)
+	server := New(cfg, metrics, nil)
 
 	// Record some test metrics
 	metrics.RecordRequest("/health", 200)
 	metrics.RecordRequest("/health", 200)
 	metrics.RecordRequest("/v1/chat/completions", 200)
 	metrics.RecordRequest("/v1/chat/completions", 500)
+	metrics.RecordBackendRequest(BackendSourceUser)
+	metrics.RecordBackendRequest(BackendSourceUser)
+	metrics.RecordBackendRequest(BackendSourceWarmup)
 
 	// Set start time
 	server.startTime = time.Now().Add(-30 * time.Second)
@@ -304,6 +571,9 @@ func TestHandleMetrics(t *testing.T) {
 		"# HELP bioproxy_requests_count",
 		"# TYPE bioproxy_requests_count counter",
 		"bioproxy_requests_count 4",
+		"# TYPE bioproxy_backend_requests_total counter",
+		`bioproxy_backend_requests_total{source="user"} 2`,
+		`bioproxy_backend_requests_total{source="warmup"} 1`,
 		"# HELP bioproxy_uptime_seconds",
 		"# TYPE bioproxy_uptime_seconds gauge",
 		"bioproxy_uptime_seconds",
@@ -316,11 +586,146 @@ func TestHandleMetrics(t *testing.T) {
 	}
 }
 
+// TestHandleMetricsReloads tests that config load and template reload metrics are emitted
+func TestHandleMetricsReloads(t *testing.T) {
+	cfg := createTestConfig()
+	metrics := NewMetrics()
+	server := New(cfg, metrics, nil)
+	server.startTime = time.Now()
+
+	metrics.RecordConfigLoad()
+	metrics.RecordTemplateReload("@code")
+	metrics.RecordTemplateReload("@code")
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+
+	bodyStr := rr.Body.String()
+	expectedStrings := []string{
+		"# TYPE bioproxy_config_load_timestamp_seconds gauge",
+		fmt.Sprintf("bioproxy_config_load_timestamp_seconds %d", metrics.ConfigLoadTime.Unix()),
+		"# TYPE bioproxy_template_reloads_total counter",
+		`bioproxy_template_reloads_total{prefix="@code"} 2`,
+	}
+	for _, expected := range expectedStrings {
+		if !strings.Contains(bodyStr, expected) {
+			t.Errorf("Expected response to contain '%s', got:\n%s", expected, bodyStr)
+		}
+	}
+}
+
+// TestHandleMetricsTemplateHash tests the template hash info metric
+func TestHandleMetricsTemplateHash(t *testing.T) {
+	cfg := createTestConfig()
+	metrics := NewMetrics()
+	server := New(cfg, metrics, nil)
+	server.startTime = time.Now()
+
+	metrics.RecordTemplateHash("@code", "0123456789abcdef0123456789abcdef")
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+
+	bodyStr := rr.Body.String()
+	expected := `bioproxy_template_hash_info{prefix="@code",hash="0123456789ab"} 1`
+	if !strings.Contains(bodyStr, expected) {
+		t.Errorf("Expected response to contain '%s', got:\n%s", expected, bodyStr)
+	}
+}
+
+// TestHandleMetricsNamespace tests that a custom namespace prefixes every metric name
+func TestHandleMetricsNamespace(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.MetricsNamespace = "bioproxy_dev"
+	metrics := NewMetrics()
+	server := New(cfg, metrics, nil)
+	server.startTime = time.Now()
+
+	metrics.RecordRequest("/health", 200)
+	metrics.RecordWarmupExecution("@code", 1.5)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+
+	bodyStr := rr.Body.String()
+	expectedStrings := []string{
+		"# TYPE bioproxy_dev_requests_total counter",
+		`bioproxy_dev_requests_total{endpoint="/health",status="200"} 1`,
+		"bioproxy_dev_uptime_seconds",
+		`bioproxy_dev_warmup_executions_total{prefix="@code"} 1`,
+	}
+	for _, expected := range expectedStrings {
+		if !strings.Contains(bodyStr, expected) {
+			t.Errorf("Expected response to contain '%s', got:\n%s", expected, bodyStr)
+		}
+	}
+
+	// Every metric line uses the namespace
+	for _, line := range strings.Split(strings.TrimSpace(bodyStr), "\n") {
+		name := strings.TrimPrefix(strings.TrimPrefix(line, "# HELP "), "# TYPE ")
+		if line != "" && !strings.HasPrefix(name, "bioproxy_dev_") {
+			t.Errorf("Expected metric line to use namespace, got %q", line)
+		}
+	}
+}
+
+// TestHandleMetricsStatusClass tests the derived per-status-class request totals
+func TestHandleMetricsStatusClass(t *testing.T) {
+	cfg := createTestConfig()
+	metrics := NewMetrics()
+	server := New(cfg, metrics, nil)
+	server.startTime = time.Now()
+
+	metrics.RecordRequest("/v1/chat/completions", 200)
+	metrics.RecordRequest("/v1/chat/completions", 200)
+	metrics.RecordRequest("/v1/chat/completions", 502)
+	metrics.RecordRequest("/v1/chat/completions", 503)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+
+	bodyStr := rr.Body.String()
+	expectedStrings := []string{
+		"# TYPE bioproxy_requests_by_class_total counter",
+		`bioproxy_requests_by_class_total{endpoint="/v1/chat/completions",class="2xx"} 2`,
+		`bioproxy_requests_by_class_total{endpoint="/v1/chat/completions",class="5xx"} 2`,
+	}
+	for _, expected := range expectedStrings {
+		if !strings.Contains(bodyStr, expected) {
+			t.Errorf("Expected response to contain '%s', got:\n%s", expected, bodyStr)
+		}
+	}
+	if strings.Contains(bodyStr, `class="4xx"`) {
+		t.Errorf("Expected no 4xx class without 4xx requests, got:\n%s", bodyStr)
+	}
+}
+
+// TestStatusClass tests mapping status codes to classes
+func TestStatusClass(t *testing.T) {
+	tests := map[string]string{
+		"200": "2xx",
+		"304": "3xx",
+		"404": "4xx",
+		"502": "5xx",
+		"99":  "other",
+		"600": "other",
+	}
+	for code, expected := range tests {
+		if got := statusClass(code); got != expected {
+			t.Errorf("statusClass(%q) = %q, expected %q", code, got, expected)
+		}
+	}
+}
+
 // TestHandleMetricsMethodNotAllowed tests that non-GET requests are rejected
 func TestHandleMetricsMethodNotAllowed(t *testing.T) {
 	cfg := createTestConfig()
 	metrics := NewMetrics()
-	server := New(cfg, metrics)
+	server := New(cfg, metrics, nil)
 
 	methods := []string{"POST", "PUT", "DELETE", "PATCH"}
 
@@ -342,7 +747,7 @@ func TestHandleMetricsMethodNotAllowed(t *testing.T) {
 func TestHandleMetricsEmpty(t *testing.T) {
 	cfg := createTestConfig()
 	metrics := NewMetrics()
-	server := New(cfg, metrics)
+	server := New(cfg, metrics, nil)
 	server.startTime = time.Now()
 
 	req := httptest.NewRequest("GET", "/metrics", nil)
@@ -386,3 +791,596 @@ func TestMetricsSnapshot(t *testing.T) {
 		t.Error("New entry in snapshot affected original metrics")
 	}
 }
+
+// TestMetricsFullSnapshotConsistency tests that FullSnapshot never observes
+// a partially recorded update while metrics are written concurrently
+func TestMetricsFullSnapshotConsistency(t *testing.T) {
+	metrics := NewMetrics()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					metrics.RecordWarmupExecution("@code", 1.0)
+					metrics.RecordRequest("/v1/chat/completions", 200)
+					metrics.RecordRequest("/health", 500)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 1000; i++ {
+		snap := metrics.FullSnapshot()
+
+		if snap.WarmupExecutions["@code"] != snap.WarmupDurationCount["@code"] {
+			t.Fatalf("Inconsistent snapshot: %d executions, %d durations",
+				snap.WarmupExecutions["@code"], snap.WarmupDurationCount["@code"])
+		}
+		if snap.WarmupDurationTotal["@code"] != float64(snap.WarmupDurationCount["@code"]) {
+			t.Fatalf("Inconsistent snapshot: duration total %.0f for %d durations",
+				snap.WarmupDurationTotal["@code"], snap.WarmupDurationCount["@code"])
+		}
+
+		var sum int64
+		for _, statusMap := range snap.RequestCount {
+			for _, count := range statusMap {
+				sum += count
+			}
+		}
+		if sum != snap.TotalRequests {
+			t.Fatalf("Inconsistent snapshot: per-endpoint counts sum to %d, total is %d", sum, snap.TotalRequests)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// The snapshot is independent of the live metrics
+	metrics.RecordRequest("/health", 500)
+	snap := metrics.FullSnapshot()
+	snap.WarmupExecutions["@code"] = -1
+	snap.RequestCount["/health"]["500"] = -1
+	if again := metrics.FullSnapshot(); again.WarmupExecutions["@code"] == -1 || again.RequestCount["/health"]["500"] == -1 {
+		t.Error("Modifying the snapshot affected the live metrics")
+	}
+}
+
+// TestHandleMetricsRuntime tests that Go runtime metrics are only exposed when enabled
+func TestHandleMetricsRuntime(t *testing.T) {
+	runtimeMetrics := []string{
+		"# TYPE bioproxy_goroutines gauge",
+		"bioproxy_goroutines ",
+		"bioproxy_memstats_heap_bytes ",
+		"bioproxy_gc_cycles_total ",
+		"bioproxy_gc_pause_seconds_total ",
+		"bioproxy_gc_last_pause_seconds ",
+	}
+
+	for _, enabled := range []bool{true, false} {
+		cfg := createTestConfig()
+		cfg.ExposeRuntimeMetrics = enabled
+		server := New(cfg, NewMetrics(), nil)
+		server.startTime = time.Now()
+
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		rr := httptest.NewRecorder()
+		server.handleMetrics(rr, req)
+
+		bodyStr := rr.Body.String()
+		for _, metric := range runtimeMetrics {
+			if strings.Contains(bodyStr, metric) != enabled {
+				t.Errorf("ExposeRuntimeMetrics=%v: expected presence of %q to be %v, got:\n%s", enabled, metric, enabled, bodyStr)
+			}
+		}
+	}
+}
+
+func TestKVCacheDurationMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.RecordKVCacheSaveDuration("@code", 0.5)
+	metrics.RecordKVCacheSaveDuration("@code", 0.25)
+	metrics.RecordKVCacheRestoreDuration("@code", 1.5)
+	metrics.RecordKVCacheRestoreDuration("@debug", 0.125)
+
+	snap := metrics.FullSnapshot()
+	if snap.KVCacheSaveDurationTotal["@code"] != 0.75 || snap.KVCacheSaveDurationCount["@code"] != 2 {
+		t.Errorf("Expected save sum 0.75 over 2 calls, got %v over %d",
+			snap.KVCacheSaveDurationTotal["@code"], snap.KVCacheSaveDurationCount["@code"])
+	}
+	if snap.KVCacheRestoreDurationTotal["@code"] != 1.5 || snap.KVCacheRestoreDurationCount["@code"] != 1 {
+		t.Errorf("Expected restore sum 1.5 over 1 call, got %v over %d",
+			snap.KVCacheRestoreDurationTotal["@code"], snap.KVCacheRestoreDurationCount["@code"])
+	}
+
+	server := New(createTestConfig(), metrics, nil)
+	server.startTime = time.Now()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+
+	bodyStr := rr.Body.String()
+	expected := []string{
+		"# TYPE bioproxy_kv_cache_save_seconds summary",
+		`bioproxy_kv_cache_save_seconds_sum{prefix="@code"} 0.750`,
+		`bioproxy_kv_cache_save_seconds_count{prefix="@code"} 2`,
+		"# TYPE bioproxy_kv_cache_restore_seconds summary",
+		`bioproxy_kv_cache_restore_seconds_sum{prefix="@code"} 1.500`,
+		`bioproxy_kv_cache_restore_seconds_count{prefix="@debug"} 1`,
+	}
+	for _, metric := range expected {
+		if !strings.Contains(bodyStr, metric) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", metric, bodyStr)
+		}
+	}
+}
+
+func TestHandleMetricsTemplateCounts(t *testing.T) {
+	tmpDir := t.TempDir()
+	watcher := template.NewWatcher()
+	for _, prefix := range []string{"@code", "@debug"} {
+		path := filepath.Join(tmpDir, prefix[1:]+".txt")
+		os.WriteFile(path, []byte("<{message}>"), 0644)
+		if err := watcher.AddTemplate(prefix, path); err != nil {
+			t.Fatalf("Failed to add template: %v", err)
+		}
+	}
+	watcher.MarkWarmedUp("@code")
+
+	server := New(createTestConfig(), NewMetrics(), nil)
+	server.startTime = time.Now()
+	server.SetWatcher(watcher)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+
+	bodyStr := rr.Body.String()
+	for _, metric := range []string{
+		"# TYPE bioproxy_templates_configured gauge",
+		"bioproxy_templates_configured 2\n",
+		"# TYPE bioproxy_templates_warmed gauge",
+		"bioproxy_templates_warmed 1\n",
+	} {
+		if !strings.Contains(bodyStr, metric) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", metric, bodyStr)
+		}
+	}
+}
+
+// TestAdminServerTimeouts tests that a client sending its headers too slowly
+// is disconnected
+func TestAdminServerTimeouts(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cfg := createTestConfig()
+	cfg.AdminPort = port
+	cfg.AdminTimeouts = config.ServerTimeouts{ReadHeader: 1}
+	server := New(cfg, NewMetrics(), nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	// The server listens asynchronously
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Send part of the request and stall
+	start := time.Now()
+	conn.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(conn)
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected slow client to be disconnected after ~1s, took %v", elapsed)
+	}
+}
+
+// TestMaxTokensMetrics tests the clamp counter and the cumulative
+// requested max_tokens histogram on /metrics
+func TestMaxTokensMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.RecordMaxTokens(100, false)
+	metrics.RecordMaxTokens(128, false)
+	metrics.RecordMaxTokens(3000, true)
+	metrics.RecordMaxTokens(50000, true)
+
+	server := New(createTestConfig(), metrics, nil)
+	server.startTime = time.Now()
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	bodyStr := rr.Body.String()
+	expected := []string{
+		"bioproxy_max_tokens_clamped_total 2",
+		"# TYPE bioproxy_max_tokens_requested histogram",
+		`bioproxy_max_tokens_requested_bucket{le="64"} 0`,
+		`bioproxy_max_tokens_requested_bucket{le="128"} 2`,
+		`bioproxy_max_tokens_requested_bucket{le="2048"} 2`,
+		`bioproxy_max_tokens_requested_bucket{le="4096"} 3`,
+		`bioproxy_max_tokens_requested_bucket{le="16384"} 3`,
+		`bioproxy_max_tokens_requested_bucket{le="+Inf"} 4`,
+		"bioproxy_max_tokens_requested_sum 53228",
+		"bioproxy_max_tokens_requested_count 4",
+	}
+	for _, metric := range expected {
+		if !strings.Contains(bodyStr, metric) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", metric, bodyStr)
+		}
+	}
+}
+
+// TestAdminBasicAuth tests that admin endpoints require the configured
+// Basic credentials, optionally except /health
+func TestAdminBasicAuth(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.AdminBasicUser = "ops"
+	cfg.AdminBasicPassword = "s3cret"
+	server := New(cfg, NewMetrics(), nil)
+	server.startTime = time.Now()
+	handler := server.handler()
+
+	tests := []struct {
+		name           string
+		user, password string
+		sendAuth       bool
+		expectedStatus int
+	}{
+		{"missing credentials", "", "", false, http.StatusUnauthorized},
+		{"wrong password", "ops", "guess", true, http.StatusUnauthorized},
+		{"wrong user", "root", "s3cret", true, http.StatusUnauthorized},
+		{"correct credentials", "ops", "s3cret", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range []string{"/metrics", "/health"} {
+				req := httptest.NewRequest("GET", path, nil)
+				if tt.sendAuth {
+					req.SetBasicAuth(tt.user, tt.password)
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				if rr.Code != tt.expectedStatus {
+					t.Errorf("%s: expected status %d, got %d", path, tt.expectedStatus, rr.Code)
+				}
+				if tt.expectedStatus == http.StatusUnauthorized && !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Basic ") {
+					t.Errorf("%s: expected a Basic WWW-Authenticate challenge, got %q", path, rr.Header().Get("WWW-Authenticate"))
+				}
+			}
+		})
+	}
+
+	// Probes can reach /health without credentials when exempted
+	cfg.AdminBasicAuthExemptHealth = true
+	handler = server.handler()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected exempt /health to answer 200, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected /metrics to still require credentials, got %d", rr.Code)
+	}
+}
+
+// TestMetricsSectionPanic tests that a panicking metrics section is skipped
+// and logged while the other sections still render
+func TestMetricsSectionPanic(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.RecordRequest("/health", 200)
+
+	server := New(createTestConfig(), metrics, nil)
+	server.startTime = time.Now()
+	sections := server.metricsSections("bioproxy", metrics.FullSnapshot(), 1)
+
+	var broken map[string]int64
+	brokenSection := metricsSection{"broken", func(w io.Writer) {
+		fmt.Fprintf(w, "# HELP bioproxy_broken A section with a bug\n")
+		broken["x"]++ // assignment to entry in nil map
+	}}
+	sections = append(sections[:1], append([]metricsSection{brokenSection}, sections[1:]...)...)
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	var out bytes.Buffer
+	writeMetricsSections(&out, sections)
+
+	body := out.String()
+	for _, metric := range []string{`bioproxy_requests_total{endpoint="/health",status="200"} 1`, "bioproxy_requests_count 1", "bioproxy_uptime_seconds"} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", metric, body)
+		}
+	}
+	if strings.Contains(body, "bioproxy_broken") {
+		t.Errorf("Expected the partial output of the broken section to be dropped, got:\n%s", body)
+	}
+	if !strings.HasSuffix(body, "\n") {
+		t.Error("Expected the response to end with a newline")
+	}
+	if !strings.Contains(logOutput.String(), "Failed to render metrics section broken") {
+		t.Errorf("Expected the panic to be logged, got: %s", logOutput.String())
+	}
+}
+
+// TestMetricsFileRoundTrip tests that saved counters are added to a new
+// Metrics on load and reported on /metrics as continuing from the snapshot
+func TestMetricsFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	metrics := NewMetrics()
+	metrics.RecordRequest("/v1/chat/completions", 200)
+	metrics.RecordRequest("/v1/chat/completions", 200)
+	metrics.RecordWarmupExecution("@code", 1.5)
+	metrics.RecordWarmupError("@code", "save_failed")
+	metrics.RecordKVCacheRestore("@code", "success")
+	metrics.RecordMaxTokens(100, true)
+	metrics.SetBackendHealthy("http://gpu1:8081", true)
+	if err := metrics.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile failed: %v", err)
+	}
+
+	// A restarted process records some requests before loading
+	restored := NewMetrics()
+	restored.RecordRequest("/v1/chat/completions", 200)
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+
+	snap := restored.FullSnapshot()
+	if snap.RequestCount["/v1/chat/completions"]["200"] != 3 || snap.TotalRequests != 3 {
+		t.Errorf("Expected 3 requests, got %v (total %d)", snap.RequestCount, snap.TotalRequests)
+	}
+	if snap.WarmupExecutions["@code"] != 1 || snap.WarmupDurationTotal["@code"] != 1.5 {
+		t.Errorf("Expected restored warmup counters, got %v %v", snap.WarmupExecutions, snap.WarmupDurationTotal)
+	}
+	if snap.WarmupErrors["@code"]["save_failed"] != 1 || snap.KVCacheRestores["@code"]["success"] != 1 {
+		t.Errorf("Expected restored error and restore counters, got %v %v", snap.WarmupErrors, snap.KVCacheRestores)
+	}
+	if snap.MaxTokensClamped != 1 || snap.MaxTokensCount != 1 {
+		t.Errorf("Expected restored max_tokens counters, got %d clamped, %d count", snap.MaxTokensClamped, snap.MaxTokensCount)
+	}
+	if len(snap.BackendHealthy) != 0 {
+		t.Errorf("Expected gauges not to be restored, got %v", snap.BackendHealthy)
+	}
+	if snap.RestoredAt.IsZero() {
+		t.Error("Expected RestoredAt to be set")
+	}
+
+	server := New(createTestConfig(), restored, nil)
+	server.startTime = time.Now()
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, expected := range []string{
+		`bioproxy_requests_count 3`,
+		`bioproxy_warmup_executions_total{prefix="@code"} 1`,
+		`bioproxy_metrics_restored_timestamp_seconds `,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in metrics output", expected)
+		}
+	}
+
+	if err := restored.LoadFile(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not-exist error for a missing snapshot, got %v", err)
+	}
+}
+
+// TestSnapshotterSavesOnStop tests that stopping the snapshotter saves the
+// latest counters
+func TestSnapshotterSavesOnStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	metrics := NewMetrics()
+	snapshotter := NewSnapshotter(metrics, path, time.Hour)
+	snapshotter.Start()
+	metrics.RecordRequest("/health", 200)
+	snapshotter.Stop()
+
+	restored := NewMetrics()
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if restored.FullSnapshot().TotalRequests != 1 {
+		t.Errorf("Expected 1 restored request, got %d", restored.FullSnapshot().TotalRequests)
+	}
+}
+
+// TestMetricsGzip tests that /metrics is gzip-compressed when the scraper
+// accepts it, with the same content as the uncompressed response
+func TestMetricsGzip(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.RecordRequest("/health", 200)
+	metrics.RecordWarmupExecution("@code", 1.5)
+
+	server := New(createTestConfig(), metrics, nil)
+	server.startTime = time.Now()
+
+	// Uptime changes between scrapes, compare everything else
+	withoutUptime := func(body string) string {
+		var lines []string
+		for _, line := range strings.Split(body, "\n") {
+			if !strings.Contains(line, "uptime_seconds ") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected no Content-Encoding without Accept-Encoding, got %q", rr.Header().Get("Content-Encoding"))
+	}
+	plain := rr.Body.String()
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip")
+	rr = httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected Content-Encoding gzip, got %q", rr.Header().Get("Content-Encoding"))
+	}
+
+	reader, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("Failed to open gzip response: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decompress response: %v", err)
+	}
+	if withoutUptime(string(decompressed)) != withoutUptime(plain) {
+		t.Errorf("Decompressed metrics differ from uncompressed ones:\n%s\n---\n%s", decompressed, plain)
+	}
+
+	// gzip;q=0 refuses gzip
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rr = httptest.NewRecorder()
+	server.handleMetrics(rr, req)
+	if rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected no Content-Encoding for gzip;q=0, got %q", rr.Header().Get("Content-Encoding"))
+	}
+}
+
+// TestMetricsInstanceLabel tests that InstanceLabel is added to every metric line
+func TestMetricsInstanceLabel(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.RecordRequest("/health", 200)
+	metrics.RecordWarmupExecution("@code", 1.5)
+	metrics.RecordKVCacheSaveDuration("@code", 0.2)
+	metrics.RecordMaxTokens(100, false)
+	metrics.RecordConfigLoad()
+
+	cfg := createTestConfig()
+	cfg.InstanceLabel = "gpu-1"
+	cfg.ExposeRuntimeMetrics = true
+	server := New(cfg, metrics, nil)
+	server.startTime = time.Now()
+	rr := httptest.NewRecorder()
+	server.handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	samples := 0
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		samples++
+		if !strings.Contains(line, `{instance="gpu-1"`) {
+			t.Errorf("Expected instance label on %q", line)
+		}
+	}
+	if samples == 0 {
+		t.Fatal("Expected metric lines")
+	}
+
+	for _, metric := range []string{
+		`bioproxy_requests_count{instance="gpu-1"} 1`,
+		`bioproxy_requests_total{instance="gpu-1",endpoint="/health",status="200"} 1`,
+		`bioproxy_max_tokens_requested_bucket{instance="gpu-1",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), metric) {
+			t.Errorf("Expected metrics to contain %q", metric)
+		}
+	}
+}
+
+// TestEscapeLabelValue tests escaping of Prometheus label values
+func TestEscapeLabelValue(t *testing.T) {
+	if got := escapeLabelValue("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("Unexpected escaped value %q", got)
+	}
+}
+
+// TestHandleMaintenance tests toggling maintenance mode via /maintenance
+func TestHandleMaintenance(t *testing.T) {
+	server := New(createTestConfig(), NewMetrics(), nil)
+	handler := server.handler()
+
+	// Not available until SetMaintenance is called
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/maintenance", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without maintenance, got %d", rr.Code)
+	}
+
+	maintenance := NewMaintenance()
+	server.SetMaintenance(maintenance)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/maintenance", strings.NewReader(body)))
+		return rr
+	}
+
+	rr = post(`{"enabled":true,"message":"back at 5pm"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if enabled, message := maintenance.Enabled(); !enabled || message != "back at 5pm" {
+		t.Errorf("Expected maintenance enabled with the message, got %v %q", enabled, message)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/maintenance", nil))
+	var status MaintenanceStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if !status.Enabled || status.Message != "back at 5pm" || status.Since == nil {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// The admin server keeps working during maintenance
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected /health status 200 during maintenance, got %d", rr.Code)
+	}
+
+	// Without a message the default one is used
+	post(`{"enabled":true}`)
+	if _, message := maintenance.Enabled(); message != defaultMaintenanceMessage {
+		t.Errorf("Expected the default message, got %q", message)
+	}
+
+	post(`{"enabled":false}`)
+	if enabled, _ := maintenance.Enabled(); enabled {
+		t.Error("Expected maintenance disabled")
+	}
+
+	if rr := post(`not json`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid body, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("DELETE", "/maintenance", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for DELETE, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardRefreshSeconds is how often the dashboard page reloads itself
+const dashboardRefreshSeconds = 5
+
+// dashboardTemplate renders the status dashboard. html/template escapes all
+// values, so prefixes and paths from the config are safe to show.
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>bioproxy status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.warm { color: #2a7a2a; }
+.cold { color: #b05a00; }
+</style>
+</head>
+<body>
+<h1>bioproxy</h1>
+<p>Uptime: {{.Uptime}} (since {{.StartTime}})</p>
+<p>Loaded prefix: {{if .LoadedPrefix}}{{.LoadedPrefix}}{{else}}none{{end}}</p>
+<p>Total requests: {{.TotalRequests}}</p>
+
+<h2>Templates</h2>
+{{if .Templates}}
+<table>
+<tr><th>Prefix</th><th>Status</th><th>Requests</th><th>Warmups</th></tr>
+{{range .Templates}}<tr><td>{{.Prefix}}</td><td class="{{if .Warm}}warm">warm{{else}}cold">cold{{end}}</td><td>{{.Requests}}</td><td>{{.Warmups}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No templates configured.</p>
+{{end}}
+
+<h2>Requests</h2>
+{{if .Endpoints}}
+<table>
+<tr><th>Endpoint</th><th>Requests</th></tr>
+{{range .Endpoints}}<tr><td>{{.Endpoint}}</td><td>{{.Requests}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No requests yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// dashboardTemplateRow is one template in the dashboard
+type dashboardTemplateRow struct {
+	Prefix   string
+	Warm     bool
+	Requests int64
+	Warmups  int64
+}
+
+// dashboardEndpointRow is one endpoint's request count in the dashboard
+type dashboardEndpointRow struct {
+	Endpoint string
+	Requests int64
+}
+
+// dashboardData is the data rendered by dashboardTemplate
+type dashboardData struct {
+	Refresh       int
+	Uptime        time.Duration
+	StartTime     string
+	LoadedPrefix  string
+	TotalRequests int64
+	Templates     []dashboardTemplateRow
+	Endpoints     []dashboardEndpointRow
+}
+
+// handleDashboard renders a minimal HTML status page for humans, built from
+// the same metrics snapshot as /metrics.
+// GET /
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	// "/" matches every unregistered path
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snap := s.metrics.FullSnapshot()
+	data := dashboardData{
+		Refresh:       dashboardRefreshSeconds,
+		Uptime:        time.Since(s.startTime).Round(time.Second),
+		StartTime:     s.startTime.Format(time.RFC3339),
+		TotalRequests: snap.TotalRequests,
+	}
+	if s.backendState != nil {
+		data.LoadedPrefix = s.backendState.GetLastPrefix()
+	}
+
+	if s.watcher != nil {
+		for prefix, warm := range s.watcher.WarmupStatus() {
+			data.Templates = append(data.Templates, dashboardTemplateRow{
+				Prefix:   prefix,
+				Warm:     warm,
+				Requests: snap.TemplateRequests[prefix],
+				Warmups:  snap.WarmupExecutions[prefix],
+			})
+		}
+		sort.Slice(data.Templates, func(i, j int) bool { return data.Templates[i].Prefix < data.Templates[j].Prefix })
+	}
+
+	for endpoint, statusMap := range snap.RequestCount {
+		var total int64
+		for _, count := range statusMap {
+			total += count
+		}
+		data.Endpoints = append(data.Endpoints, dashboardEndpointRow{Endpoint: endpoint, Requests: total})
+	}
+	sort.Slice(data.Endpoints, func(i, j int) bool { return data.Endpoints[i].Endpoint < data.Endpoints[j].Endpoint })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Printf("ERROR: Failed to render dashboard: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oleksandr/bioproxy/internal/state"
+	"github.com/oleksandr/bioproxy/internal/template"
+)
+
+// TestHandleDashboard tests that the dashboard shows uptime, the loaded
+// prefix and each template with its warmup status
+func TestHandleDashboard(t *testing.T) {
+	tmpDir := t.TempDir()
+	watcher := template.NewWatcher()
+	for _, prefix := range []string{"@code", "@debug"} {
+		path := filepath.Join(tmpDir, prefix[1:]+".txt")
+		os.WriteFile(path, []byte("<{message}>"), 0644)
+		if err := watcher.AddTemplate(prefix, path); err != nil {
+			t.Fatalf("Failed to add template: %v", err)
+		}
+	}
+	watcher.MarkWarmedUp("@code")
+
+	backendState := state.New()
+	backendState.UpdatePrefix("@code")
+	metrics := NewMetrics()
+	metrics.RecordRequest("/v1/chat/completions", 200)
+	metrics.RecordTemplateRequest("@code")
+
+	cfg := createTestConfig()
+	cfg.EnableDashboard = true
+	server := New(cfg, metrics, backendState)
+	server.startTime = time.Now().Add(-90 * time.Second)
+	server.SetWatcher(watcher)
+
+	rr := httptest.NewRecorder()
+	server.handleDashboard(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("Expected HTML, got %q", contentType)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"Uptime: 1m30s",
+		"Loaded prefix: @code",
+		`<td>@code</td><td class="warm">warm</td><td>1</td>`,
+		`<td>@debug</td><td class="cold">cold</td>`,
+		"<td>/v1/chat/completions</td><td>1</td>",
+		`http-equiv="refresh"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected dashboard to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	// Other paths are not the dashboard
+	rr = httptest.NewRecorder()
+	server.handleDashboard(rr, httptest.NewRequest("GET", "/unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown path, got %d", rr.Code)
+	}
+}
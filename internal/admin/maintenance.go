@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultMaintenanceMessage is returned to clients when maintenance mode is
+// enabled without a message
+const defaultMaintenanceMessage = "Service under maintenance, please retry later"
+
+// Maintenance is the maintenance mode toggled via POST /maintenance. While it
+// is enabled the proxy rejects chat completions with 503 and its message;
+// the admin server and metrics stay up. It is not persisted across restarts.
+// Thread-safe for concurrent use.
+type Maintenance struct {
+	mu      sync.RWMutex
+	enabled bool
+	message string
+	since   time.Time
+}
+
+// MaintenanceStatus is the GET and POST /maintenance response
+type MaintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// maintenanceRequest is the request body for POST /maintenance
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// NewMaintenance creates a maintenance mode that is disabled
+func NewMaintenance() *Maintenance {
+	return &Maintenance{}
+}
+
+// Set enables or disables maintenance mode. An empty message uses a
+// default one.
+func (m *Maintenance) Set(enabled bool, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !enabled {
+		m.enabled = false
+		m.message = ""
+		m.since = time.Time{}
+		return
+	}
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if !m.enabled {
+		m.since = time.Now()
+	}
+	m.enabled = true
+	m.message = message
+}
+
+// Enabled reports whether maintenance mode is on, and the message for clients
+func (m *Maintenance) Enabled() (bool, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.enabled, m.message
+}
+
+// Status returns the current maintenance mode
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := MaintenanceStatus{Enabled: m.enabled, Message: m.message}
+	if m.enabled {
+		since := m.since
+		status.Since = &since
+	}
+	return status
+}
+
+// handleMaintenance shows or toggles maintenance mode.
+// GET /maintenance
+// POST /maintenance with {"enabled": true, "message": "back at 5pm"}
+//
+// Response format:
+//
+//	{
+//	  "enabled": true,
+//	  "message": "back at 5pm",
+//	  "since": "2024-01-01T12:00:00Z"
+//	}
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.maintenance == nil {
+		http.Error(w, "Maintenance mode not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		s.maintenance.Set(req.Enabled, req.Message)
+		if req.Enabled {
+			log.Printf("INFO: Maintenance mode enabled via admin endpoint (message: %q)", req.Message)
+		} else {
+			log.Printf("INFO: Maintenance mode disabled via admin endpoint")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.maintenance.Status()); err != nil {
+		log.Printf("ERROR: Failed to encode maintenance status: %v", err)
+	}
+}
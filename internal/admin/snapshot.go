@@ -0,0 +1,254 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// metricsFile is the on-disk form of the counters saved by SaveFile.
+// Gauges and timestamps (uptime, last activity, backend health, template
+// hashes) describe the running process and are not saved.
+type metricsFile struct {
+	// SavedAt is when the snapshot was written
+	SavedAt time.Time `json:"saved_at"`
+
+	RequestCount                map[string]map[string]int64 `json:"request_count"`
+	TotalRequests               int64                       `json:"total_requests"`
+	StreamMismatches            int64                       `json:"stream_mismatches"`
+	BackendAuthFailures         int64                       `json:"backend_auth_failures"`
+	BackendRequests             map[string]int64            `json:"backend_requests"`
+	WarmupChecksTotal           int64                       `json:"warmup_checks_total"`
+	WarmupSkippedBusy           int64                       `json:"warmup_skipped_busy"`
+	WarmupSkippedEmpty          map[string]int64            `json:"warmup_skipped_empty"`
+	WarmupExecutions            map[string]int64            `json:"warmup_executions"`
+	WarmupErrors                map[string]map[string]int64 `json:"warmup_errors"`
+	WarmupDurationTotal         map[string]float64          `json:"warmup_duration_total"`
+	WarmupDurationCount         map[string]int64            `json:"warmup_duration_count"`
+	KVCacheSaves                map[string]int64            `json:"kv_cache_saves"`
+	KVCacheSaveDurationTotal    map[string]float64          `json:"kv_cache_save_duration_total"`
+	KVCacheSaveDurationCount    map[string]int64            `json:"kv_cache_save_duration_count"`
+	KVCacheRestoreDurationTotal map[string]float64          `json:"kv_cache_restore_duration_total"`
+	KVCacheRestoreDurationCount map[string]int64            `json:"kv_cache_restore_duration_count"`
+	KVCacheRestores             map[string]map[string]int64 `json:"kv_cache_restores"`
+	SlotRefreshes               map[string]map[string]int64 `json:"slot_refreshes"`
+	WarmupCancellations         map[string]int64            `json:"warmup_cancellations"`
+	WarmupGraceCompletions      map[string]int64            `json:"warmup_grace_completions"`
+	TemplateReloads             map[string]int64            `json:"template_reloads"`
+	TemplateVariantRequests     map[string]map[string]int64 `json:"template_variant_requests"`
+	TemplateRequests            map[string]int64            `json:"template_requests"`
+	MaxTokensClamped            int64                       `json:"max_tokens_clamped"`
+	MaxTokensBuckets            []int64                     `json:"max_tokens_buckets"`
+	MaxTokensSum                int64                       `json:"max_tokens_sum"`
+	MaxTokensCount              int64                       `json:"max_tokens_count"`
+}
+
+// SaveFile writes the counters to path as JSON, replacing the file
+// atomically so a crash mid-write never leaves a truncated snapshot
+func (m *Metrics) SaveFile(path string) error {
+	snap := m.FullSnapshot()
+	data, err := json.Marshal(metricsFile{
+		SavedAt:                     time.Now(),
+		RequestCount:                snap.RequestCount,
+		TotalRequests:               snap.TotalRequests,
+		StreamMismatches:            snap.StreamMismatches,
+		BackendAuthFailures:         snap.BackendAuthFailures,
+		BackendRequests:             snap.BackendRequests,
+		WarmupChecksTotal:           snap.WarmupChecksTotal,
+		WarmupSkippedBusy:           snap.WarmupSkippedBusy,
+		WarmupSkippedEmpty:          snap.WarmupSkippedEmpty,
+		WarmupExecutions:            snap.WarmupExecutions,
+		WarmupErrors:                snap.WarmupErrors,
+		WarmupDurationTotal:         snap.WarmupDurationTotal,
+		WarmupDurationCount:         snap.WarmupDurationCount,
+		KVCacheSaves:                snap.KVCacheSaves,
+		KVCacheSaveDurationTotal:    snap.KVCacheSaveDurationTotal,
+		KVCacheSaveDurationCount:    snap.KVCacheSaveDurationCount,
+		KVCacheRestoreDurationTotal: snap.KVCacheRestoreDurationTotal,
+		KVCacheRestoreDurationCount: snap.KVCacheRestoreDurationCount,
+		KVCacheRestores:             snap.KVCacheRestores,
+		SlotRefreshes:               snap.SlotRefreshes,
+		WarmupCancellations:         snap.WarmupCancellations,
+		WarmupGraceCompletions:      snap.WarmupGraceCompletions,
+		TemplateReloads:             snap.TemplateReloads,
+		TemplateVariantRequests:     snap.TemplateVariantRequests,
+		TemplateRequests:            snap.TemplateRequests,
+		MaxTokensClamped:            snap.MaxTokensClamped,
+		MaxTokensBuckets:            snap.MaxTokensBuckets,
+		MaxTokensSum:                snap.MaxTokensSum,
+		MaxTokensCount:              snap.MaxTokensCount,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create metrics snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace metrics snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadFile adds the counters saved by SaveFile to the current ones, so they
+// continue from where the previous process left off. Counters recorded
+// after the last save before a crash are lost; Prometheus sees that as a
+// counter reset, which rate() handles. The snapshot time is reported as
+// bioproxy_metrics_restored_timestamp_seconds.
+func (m *Metrics) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var saved metricsFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse metrics snapshot %s: %w", path, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addNested(m.RequestCount, saved.RequestCount)
+	m.TotalRequests += saved.TotalRequests
+	m.StreamMismatches += saved.StreamMismatches
+	m.BackendAuthFailures += saved.BackendAuthFailures
+	addCounts(m.BackendRequests, saved.BackendRequests)
+	m.WarmupChecksTotal += saved.WarmupChecksTotal
+	m.WarmupSkippedBusy += saved.WarmupSkippedBusy
+	addCounts(m.WarmupSkippedEmpty, saved.WarmupSkippedEmpty)
+	addCounts(m.WarmupExecutions, saved.WarmupExecutions)
+	addNested(m.WarmupErrors, saved.WarmupErrors)
+	addCounts(m.WarmupDurationTotal, saved.WarmupDurationTotal)
+	addCounts(m.WarmupDurationCount, saved.WarmupDurationCount)
+	addCounts(m.KVCacheSaves, saved.KVCacheSaves)
+	addCounts(m.KVCacheSaveDurationTotal, saved.KVCacheSaveDurationTotal)
+	addCounts(m.KVCacheSaveDurationCount, saved.KVCacheSaveDurationCount)
+	addCounts(m.KVCacheRestoreDurationTotal, saved.KVCacheRestoreDurationTotal)
+	addCounts(m.KVCacheRestoreDurationCount, saved.KVCacheRestoreDurationCount)
+	addNested(m.KVCacheRestores, saved.KVCacheRestores)
+	addNested(m.SlotRefreshes, saved.SlotRefreshes)
+	addCounts(m.WarmupCancellations, saved.WarmupCancellations)
+	addCounts(m.WarmupGraceCompletions, saved.WarmupGraceCompletions)
+	addCounts(m.TemplateReloads, saved.TemplateReloads)
+	addNested(m.TemplateVariantRequests, saved.TemplateVariantRequests)
+	addCounts(m.TemplateRequests, saved.TemplateRequests)
+	m.MaxTokensClamped += saved.MaxTokensClamped
+	// Buckets only line up if the bounds didn't change between versions
+	if len(saved.MaxTokensBuckets) == len(m.MaxTokensBuckets) {
+		for i, count := range saved.MaxTokensBuckets {
+			m.MaxTokensBuckets[i] += count
+		}
+		m.MaxTokensSum += saved.MaxTokensSum
+		m.MaxTokensCount += saved.MaxTokensCount
+	}
+	m.RestoredAt = saved.SavedAt
+	return nil
+}
+
+// addCounts adds every count of src to dst
+func addCounts[V int64 | float64](dst, src map[string]V) {
+	for key, value := range src {
+		dst[key] += value
+	}
+}
+
+// addNested adds every count of src to dst, creating inner maps as needed
+func addNested(dst, src map[string]map[string]int64) {
+	for key, counts := range src {
+		if dst[key] == nil {
+			dst[key] = make(map[string]int64)
+		}
+		addCounts(dst[key], counts)
+	}
+}
+
+// Snapshotter periodically saves metrics to a file with Metrics.SaveFile,
+// and once more when stopped, so counters survive restarts
+type Snapshotter struct {
+	metrics  *Metrics
+	path     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	running bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// NewSnapshotter creates a snapshotter saving metrics to path every interval
+func NewSnapshotter(metrics *Metrics, path string, interval time.Duration) *Snapshotter {
+	return &Snapshotter{
+		metrics:  metrics,
+		path:     path,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Start begins saving snapshots in the background
+func (s *Snapshotter) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return
+	}
+	s.running = true
+
+	log.Printf("Saving metrics to %s every %v", s.path, s.interval)
+	go s.saveLoop()
+}
+
+// Stop stops the background loop and saves a final snapshot
+func (s *Snapshotter) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	s.mu.Unlock()
+
+	close(s.stopCh)
+	<-s.doneCh
+	s.save()
+}
+
+// saveLoop saves a snapshot every interval until stopped
+func (s *Snapshotter) saveLoop() {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.save()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// save writes a snapshot, logging failures
+func (s *Snapshotter) save() {
+	if err := s.metrics.SaveFile(s.path); err != nil {
+		log.Printf("WARNING: Failed to save metrics snapshot: %v", err)
+	}
+}
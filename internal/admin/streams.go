@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamRegistry tracks the streaming responses currently being sent to
+// clients, for diagnosing stuck streams via GET /streams.
+// Thread-safe for concurrent use.
+type StreamRegistry struct {
+	mu      sync.Mutex
+	nextID  int64
+	streams map[int64]*ActiveStream
+}
+
+// ActiveStream is a streaming response in progress, see StreamRegistry.Add
+type ActiveStream struct {
+	id        int64
+	registry  *StreamRegistry
+	prefix    string
+	path      string
+	startTime time.Time
+	bytes     atomic.Int64
+}
+
+// StreamInfo describes an active stream in the GET /streams response
+type StreamInfo struct {
+	ID              int64     `json:"id"`
+	Prefix          string    `json:"prefix,omitempty"`
+	Path            string    `json:"path"`
+	StartTime       time.Time `json:"start_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Bytes           int64     `json:"bytes"`
+}
+
+// NewStreamRegistry creates an empty stream registry
+func NewStreamRegistry() *StreamRegistry {
+	return &StreamRegistry{streams: make(map[int64]*ActiveStream)}
+}
+
+// Add registers a stream that starts now. Call Done on the result when the
+// stream completes or the client disconnects.
+// prefix: The template used (empty for none)
+// path: The request path (e.g., "/v1/chat/completions")
+func (r *StreamRegistry) Add(prefix, path string) *ActiveStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	stream := &ActiveStream{
+		id:        r.nextID,
+		registry:  r,
+		prefix:    prefix,
+		path:      path,
+		startTime: time.Now(),
+	}
+	r.streams[stream.id] = stream
+	return stream
+}
+
+// AddBytes records n more bytes sent to the client
+func (s *ActiveStream) AddBytes(n int) {
+	s.bytes.Add(int64(n))
+}
+
+// Done removes the stream from the registry
+func (s *ActiveStream) Done() {
+	s.registry.mu.Lock()
+	defer s.registry.mu.Unlock()
+	delete(s.registry.streams, s.id)
+}
+
+// List returns the active streams, oldest first
+func (r *StreamRegistry) List() []StreamInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	infos := make([]StreamInfo, 0, len(r.streams))
+	for _, stream := range r.streams {
+		infos = append(infos, StreamInfo{
+			ID:              stream.id,
+			Prefix:          stream.prefix,
+			Path:            stream.path,
+			StartTime:       stream.startTime,
+			DurationSeconds: now.Sub(stream.startTime).Seconds(),
+			Bytes:           stream.bytes.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// handleStreams lists the active streaming responses as JSON
+// GET /streams
+func (s *Server) handleStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	streams := []StreamInfo{}
+	if s.streams != nil {
+		streams = s.streams.List()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"streams": streams}); err != nil {
+		log.Printf("ERROR: Failed to encode streams: %v", err)
+	}
+}
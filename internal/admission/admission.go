@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"sync"
+	"time"
 )
 
 // RequestType represents the type of request currently using llama.cpp
@@ -45,6 +46,10 @@ func (r RequestType) String() string {
 // - User request: IDLE→USER_QUERY, USER_QUERY→USER_QUERY (allow), WARMUP_QUERY→USER_QUERY (cancel warmup)
 // - Warmup request: IDLE→WARMUP_QUERY, USER_QUERY→skip, WARMUP_QUERY→skip
 // - Request complete: Any→IDLE (if no other requests)
+//
+// A user request may wait up to a grace period for the warmup to finish
+// before cancelling it, see SetCancelGrace. A warmup acquired without a
+// cancel function, such as a KV cache save, is waited for until it ends.
 type Controller struct {
 	mu sync.Mutex
 
@@ -57,9 +62,27 @@ type Controller struct {
 	// warmupPrefix holds the prefix being warmed up (for logging)
 	warmupPrefix string
 
+	// warmupDone is closed when the active warmup ends (released or cancelled)
+	warmupDone chan struct{}
+
 	// userQueryCount tracks number of concurrent user queries
 	// We allow multiple user queries (llama.cpp queues them)
 	userQueryCount int
+
+	// maxUserQueries limits concurrent user queries (0 means no limit)
+	maxUserQueries int
+
+	// cancelGrace is how long a user request waits for an active warmup to
+	// finish before cancelling it (0 cancels immediately)
+	cancelGrace time.Duration
+
+	// graceWaiters counts user requests waiting out the grace period.
+	// New warmups are not started while any are waiting.
+	graceWaiters int
+
+	// onGraceCompletion is called with the prefix of a warmup that finished
+	// while user requests were waiting for it
+	onGraceCompletion func(prefix string)
 }
 
 // New creates a new admission controller
@@ -69,21 +92,59 @@ func New() *Controller {
 	}
 }
 
+// SetCancelGrace sets how long a user request waits for an in-flight warmup
+// to finish before cancelling it. A warmup that is almost done is cheaper to
+// finish than to redo; llama.cpp would only make the user request wait
+// briefly. 0 (the default) cancels immediately.
+func (c *Controller) SetCancelGrace(grace time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelGrace = grace
+}
+
+// SetMaxUserQueries limits how many user queries may run at once. Once the
+// limit is reached AcquireUserQuery rejects new ones instead of letting
+// them queue in llama.cpp. 0 (the default) means no limit.
+func (c *Controller) SetMaxUserQueries(limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxUserQueries = limit
+}
+
+// SetGraceCompletionHandler registers a function called with the prefix of a
+// warmup that finished within the cancel grace period instead of being cancelled
+func (c *Controller) SetGraceCompletionHandler(handler func(prefix string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onGraceCompletion = handler
+}
+
 // AcquireUserQuery attempts to acquire permission to run a user query.
 // This is called at the start of every user request.
 //
 // Returns:
-//   - true if the request should proceed
-//   - false if the request should be rejected (shouldn't happen in current design)
+//   - true if the request should proceed (call ReleaseUserQuery when done)
+//   - false if the request should be rejected (too many concurrent user queries)
 //
 // Behavior:
 //   - If IDLE: transition to USER_QUERY, allow
-//   - If USER_QUERY: increment counter, allow (llama.cpp queues)
+//   - If USER_QUERY: increment counter, allow (llama.cpp queues),
+//     unless the SetMaxUserQueries limit is reached
 //   - If WARMUP_QUERY: cancel warmup, transition to USER_QUERY, allow
+//
+// With a cancel grace period, a request arriving during a warmup first waits
+// up to the grace period for the warmup to finish on its own.
 func (c *Controller) AcquireUserQuery() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.currentState == WARMUP_QUERY && c.warmupCancelFunc == nil {
+		// Can't be cancelled, e.g. a KV cache save; wait for it to end
+		c.waitForWarmup(0)
+	} else if c.currentState == WARMUP_QUERY && c.cancelGrace > 0 {
+		c.waitForWarmup(c.cancelGrace)
+	}
+
 	switch c.currentState {
 	case IDLE:
 		// Transition from idle to user query
@@ -93,6 +154,11 @@ func (c *Controller) AcquireUserQuery() bool {
 		return true
 
 	case USER_QUERY:
+		if c.maxUserQueries > 0 && c.userQueryCount >= c.maxUserQueries {
+			log.Printf("Admission: USER_QUERY (rejecting user request, %d running, limit %d)", c.userQueryCount, c.maxUserQueries)
+			return false
+		}
+
 		// Already running user query, allow another (llama.cpp queues)
 		c.userQueryCount++
 		log.Printf("Admission: USER_QUERY → USER_QUERY (concurrent user request, count=%d)", c.userQueryCount)
@@ -106,8 +172,7 @@ func (c *Controller) AcquireUserQuery() bool {
 		}
 		c.currentState = USER_QUERY
 		c.userQueryCount = 1
-		c.warmupCancelFunc = nil
-		c.warmupPrefix = ""
+		c.endWarmup()
 		return true
 
 	default:
@@ -117,6 +182,43 @@ func (c *Controller) AcquireUserQuery() bool {
 	}
 }
 
+// waitForWarmup waits up to timeout for the active warmup to end, or until
+// it ends if timeout is 0. Must be called with c.mu held; the lock is
+// released while waiting.
+func (c *Controller) waitForWarmup(timeout time.Duration) {
+	done := c.warmupDone
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+		log.Printf("Admission: WARMUP_QUERY (waiting up to %v for warmup of %s to finish)", timeout, c.warmupPrefix)
+	} else {
+		log.Printf("Admission: WARMUP_QUERY (waiting for %s to finish)", c.warmupPrefix)
+	}
+	c.graceWaiters++
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-expired:
+	}
+
+	c.mu.Lock()
+	c.graceWaiters--
+}
+
+// endWarmup clears the active warmup and wakes requests waiting for it.
+// Must be called with c.mu held.
+func (c *Controller) endWarmup() {
+	if c.warmupDone != nil {
+		close(c.warmupDone)
+	}
+	c.warmupDone = nil
+	c.warmupCancelFunc = nil
+	c.warmupPrefix = ""
+}
+
 // ReleaseUserQuery releases a user query, potentially transitioning back to IDLE
 func (c *Controller) ReleaseUserQuery() {
 	c.mu.Lock()
@@ -146,18 +248,30 @@ func (c *Controller) ReleaseUserQuery() {
 //
 // Behavior:
 //   - If IDLE: transition to WARMUP_QUERY, return true
+//     (unless user requests are still waiting for the previous warmup)
 //   - If USER_QUERY: return false (skip warmup, user has priority)
 //   - If WARMUP_QUERY: return false (already warming, shouldn't happen)
+//
+// cancelFunc is called when a user request preempts the warmup. Operations
+// that can't be interrupted, such as KV cache saves, pass nil: user requests
+// then wait for them to finish (call ReleaseWarmup when done).
 func (c *Controller) AcquireWarmup(prefix string, cancelFunc context.CancelFunc) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	switch c.currentState {
 	case IDLE:
+		// User requests waiting for the previous warmup go first
+		if c.graceWaiters > 0 {
+			log.Printf("Admission: IDLE (skipping warmup for %s, user requests waiting)", prefix)
+			return false
+		}
+
 		// Transition from idle to warmup
 		c.currentState = WARMUP_QUERY
 		c.warmupPrefix = prefix
 		c.warmupCancelFunc = cancelFunc
+		c.warmupDone = make(chan struct{})
 		log.Printf("Admission: IDLE → WARMUP_QUERY (warmup for %s acquired)", prefix)
 		return true
 
@@ -190,9 +304,16 @@ func (c *Controller) ReleaseWarmup() {
 		return
 	}
 
+	// The warmup finished on its own while user requests waited for it
+	if c.graceWaiters > 0 && c.warmupCancelFunc != nil {
+		log.Printf("Admission: warmup for %s finished within the cancel grace period", c.warmupPrefix)
+		if c.onGraceCompletion != nil {
+			c.onGraceCompletion(c.warmupPrefix)
+		}
+	}
+
 	c.currentState = IDLE
-	c.warmupCancelFunc = nil
-	c.warmupPrefix = ""
+	c.endWarmup()
 	log.Printf("Admission: WARMUP_QUERY → IDLE (warmup completed)")
 }
 
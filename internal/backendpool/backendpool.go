@@ -0,0 +1,212 @@
+// Package backendpool spreads requests over a weighted pool of llama.cpp
+// servers, ejecting backends that fail their health probe until they recover.
+package backendpool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oleksandr/bioproxy/internal/admin"
+	"github.com/oleksandr/bioproxy/internal/config"
+)
+
+// ErrNoHealthyBackend is returned by Pick when every backend is ejected
+var ErrNoHealthyBackend = errors.New("no healthy backend")
+
+// probeTimeout bounds a single /health probe
+const probeTimeout = 5 * time.Second
+
+// Pool is a weighted set of backends with periodic health probing.
+// All backends start healthy, so requests are routed before the first probe.
+type Pool struct {
+	// backends are the pool members with normalized weights
+	backends []config.BackendConfig
+
+	// client sends the health probes
+	client *http.Client
+
+	// metrics receives the probe results (can be nil)
+	metrics *admin.Metrics
+
+	// pathPrefix is prepended to the probe path, see SetPathPrefix
+	pathPrefix string
+
+	mu      sync.RWMutex
+	healthy map[string]bool
+	running bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// New creates a pool of the given backends.
+// Parameters:
+//   - backends: Pool members (weights <= 0 count as 1)
+//   - client: HTTP client for health probes
+//   - metrics: Optional metrics collector (can be nil)
+func New(backends []config.BackendConfig, client *http.Client, metrics *admin.Metrics) *Pool {
+	p := &Pool{
+		client:  client,
+		metrics: metrics,
+		healthy: make(map[string]bool),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	for _, backend := range backends {
+		if backend.Weight <= 0 {
+			backend.Weight = 1
+		}
+		p.backends = append(p.backends, backend)
+		p.healthy[backend.URL] = true
+		if metrics != nil {
+			metrics.SetBackendHealthy(backend.URL, true)
+		}
+	}
+	return p
+}
+
+// SetPathPrefix probes each backend's /health under the given path prefix
+// (config BackendPathPrefix, e.g. "/llm" probes /llm/health).
+// Must be called before Start.
+func (p *Pool) SetPathPrefix(prefix string) {
+	p.pathPrefix = prefix
+}
+
+// Start probes every backend right away and then at the given interval
+func (p *Pool) Start(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.running {
+		return
+	}
+	p.running = true
+
+	log.Printf("Starting backend health checks for %d backend(s) (interval: %v)", len(p.backends), interval)
+	go p.checkLoop(interval)
+}
+
+// Stop stops the background health checks
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return
+	}
+	p.running = false
+	p.mu.Unlock()
+
+	close(p.stopCh)
+	<-p.doneCh
+}
+
+// checkLoop probes the backends until Stop is called
+func (p *Pool) checkLoop(interval time.Duration) {
+	defer close(p.doneCh)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.CheckNow()
+	for {
+		select {
+		case <-ticker.C:
+			p.CheckNow()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// CheckNow probes every backend concurrently and updates the healthy set.
+// Ejected backends keep being probed, so they rejoin once they recover.
+func (p *Pool) CheckNow() {
+	results := make([]bool, len(p.backends))
+	var wg sync.WaitGroup
+	for i, backend := range p.backends {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			results[i] = p.probe(url)
+		}(i, backend.URL)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, backend := range p.backends {
+		healthy := results[i]
+		if p.healthy[backend.URL] != healthy {
+			if healthy {
+				log.Printf("INFO: Backend %s recovered, adding it back to rotation", backend.URL)
+			} else {
+				log.Printf("WARNING: Backend %s failed its health check, ejecting it from rotation", backend.URL)
+			}
+		}
+		p.healthy[backend.URL] = healthy
+		if p.metrics != nil {
+			p.metrics.SetBackendHealthy(backend.URL, healthy)
+		}
+	}
+}
+
+// probe reports whether the backend's /health answers 200
+// (llama.cpp answers 503 while the model is loading)
+func (p *Pool) probe(url string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+p.pathPrefix+"/health", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode == http.StatusOK
+}
+
+// Healthy reports whether the backend is in rotation
+func (p *Pool) Healthy(url string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.healthy[url]
+}
+
+// Pick chooses a healthy backend at random, proportionally to the weights.
+// r is a random number in [0, 1). Returns ErrNoHealthyBackend if all
+// backends are ejected.
+func (p *Pool) Pick(r float64) (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	total := 0.0
+	var candidates []config.BackendConfig
+	for _, backend := range p.backends {
+		if p.healthy[backend.URL] {
+			candidates = append(candidates, backend)
+			total += backend.Weight
+		}
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoHealthyBackend
+	}
+
+	target := r * total
+	for _, backend := range candidates {
+		if target < backend.Weight {
+			return backend.URL, nil
+		}
+		target -= backend.Weight
+	}
+
+	// Guard against floating point rounding on the upper edge
+	return candidates[len(candidates)-1].URL, nil
+}
@@ -0,0 +1,132 @@
+package backendpool
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oleksandr/bioproxy/internal/admin"
+	"github.com/oleksandr/bioproxy/internal/config"
+)
+
+// newMockBackend returns a backend whose /health status can be switched
+func newMockBackend(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	status := &atomic.Int32{}
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(server.Close)
+	return server, status
+}
+
+// TestEjectionAndRecovery tests that a backend failing its health check is
+// ejected from rotation and added back once it recovers
+func TestEjectionAndRecovery(t *testing.T) {
+	first, _ := newMockBackend(t)
+	second, secondStatus := newMockBackend(t)
+
+	metrics := admin.NewMetrics()
+	pool := New([]config.BackendConfig{{URL: first.URL}, {URL: second.URL}}, &http.Client{}, metrics)
+
+	// Unhealthy (llama.cpp answers 503 while loading the model)
+	secondStatus.Store(http.StatusServiceUnavailable)
+	pool.CheckNow()
+	if pool.Healthy(second.URL) {
+		t.Error("Expected second backend to be ejected")
+	}
+	for _, r := range []float64{0, 0.5, 0.99} {
+		if picked, _ := pool.Pick(r); picked != first.URL {
+			t.Errorf("Pick(%v) = %s, expected the healthy backend %s", r, picked, first.URL)
+		}
+	}
+	if snap := metrics.FullSnapshot(); snap.BackendHealthy[first.URL] != true || snap.BackendHealthy[second.URL] != false {
+		t.Errorf("Unexpected backend health metrics %v", snap.BackendHealthy)
+	}
+
+	// Recovered
+	secondStatus.Store(http.StatusOK)
+	pool.CheckNow()
+	if picked, _ := pool.Pick(0.99); picked != second.URL {
+		t.Errorf("Expected recovered backend %s to be picked, got %s", second.URL, picked)
+	}
+
+	// Unreachable backends are ejected too
+	first.Close()
+	second.Close()
+	pool.CheckNow()
+	if _, err := pool.Pick(0.5); err != ErrNoHealthyBackend {
+		t.Errorf("Expected ErrNoHealthyBackend, got %v", err)
+	}
+}
+
+// TestPickWeighted tests that selection follows the weights
+func TestPickWeighted(t *testing.T) {
+	pool := New([]config.BackendConfig{
+		{URL: "http://a", Weight: 3},
+		{URL: "http://b", Weight: 1},
+		{URL: "http://c"}, // weight 1
+	}, &http.Client{}, nil)
+
+	tests := []struct {
+		r        float64
+		expected string
+	}{
+		{0, "http://a"},
+		{0.59, "http://a"},
+		{0.61, "http://b"},
+		{0.81, "http://c"},
+		{0.999, "http://c"},
+	}
+	for _, tt := range tests {
+		if picked, _ := pool.Pick(tt.r); picked != tt.expected {
+			t.Errorf("Pick(%v) = %s, expected %s", tt.r, picked, tt.expected)
+		}
+	}
+}
+
+// TestStartProbesImmediately tests that Start ejects unhealthy backends
+// without waiting for the first interval
+func TestStartProbesImmediately(t *testing.T) {
+	backend, status := newMockBackend(t)
+	status.Store(http.StatusInternalServerError)
+
+	pool := New([]config.BackendConfig{{URL: backend.URL}}, &http.Client{}, nil)
+	pool.Start(time.Hour)
+	defer pool.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.Healthy(backend.URL) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pool.Healthy(backend.URL) {
+		t.Error("Expected backend to be ejected by the initial probe")
+	}
+}
+
+// TestPathPrefix tests that backends behind a gateway are probed under the
+// path prefix, while Pick returns the backend URL without it
+func TestPathPrefix(t *testing.T) {
+	var probed atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed.Store(r.URL.Path)
+		if r.URL.Path != "/llm/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	pool := New([]config.BackendConfig{{URL: backend.URL}}, &http.Client{}, nil)
+	pool.SetPathPrefix("/llm")
+	pool.CheckNow()
+
+	if path := probed.Load(); path != "/llm/health" {
+		t.Errorf("Expected probe of /llm/health, got %v", path)
+	}
+	if picked, err := pool.Pick(0.5); err != nil || picked != backend.URL {
+		t.Errorf("Expected %s to stay in rotation, got %q (err: %v)", backend.URL, picked, err)
+	}
+}
@@ -1,10 +1,23 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Config represents the bioproxy configuration
@@ -31,44 +44,1196 @@ type Config struct {
 	// Default: 8089
 	AdminPort int `json:"admin_port"`
 
+	// EnableDashboard serves a minimal auto-refreshing HTML status page at
+	// GET / on the admin server, for humans without a metrics setup
+	// Default: false
+	EnableDashboard bool `json:"enable_dashboard"`
+
+	// SaveCacheOnShutdown saves the KV cache of the prefix loaded in each
+	// backend (the default one and prefix backend overrides) when bioproxy
+	// shuts down (SIGTERM/SIGINT), so a restarted instance restores it
+	// instead of warming up from scratch. Ignored with DisableKVCache.
+	// Default: false
+	SaveCacheOnShutdown bool `json:"save_cache_on_shutdown"`
+
+	// ShutdownTimeout bounds the whole shutdown sequence in seconds: waiting
+	// for in-flight requests, saving the cache and persisting state. Keep it
+	// below the orchestrator's grace period (30s in Kubernetes by default)
+	// Default: 25
+	ShutdownTimeout int `json:"shutdown_timeout"`
+
+	// GRPCHealthPort is the port of an optional gRPC health service
+	// (grpc.health.v1.Health) on AdminHost. It reports SERVING while the
+	// proxy is running and the backend's /health answers 200.
+	// Default: 0 (disabled)
+	GRPCHealthPort int `json:"grpc_health_port"`
+
+	// ProxyTimeouts are the HTTP server timeouts of the proxy (seconds, 0 = none).
+	// Read and Write stay unlimited by default: request bodies and streamed
+	// responses can take arbitrarily long
+	// Default: {"read_header": 10, "read": 0, "write": 0, "idle": 120}
+	ProxyTimeouts ServerTimeouts `json:"proxy_timeouts"`
+
+	// AllowedMethods lists the HTTP methods the proxy accepts; other methods
+	// (e.g. TRACE, CONNECT) are rejected with 405 without contacting the
+	// backend. Methods are case-insensitive. An empty list allows every method.
+	// Default: ["GET", "POST", "OPTIONS", "HEAD"]
+	AllowedMethods []string `json:"allowed_methods"`
+
+	// AdminTimeouts are the HTTP server timeouts of the admin server
+	// (seconds, 0 = none), so slow clients cannot tie up admin handlers
+	// Default: {"read_header": 5, "read": 10, "write": 30, "idle": 60}
+	AdminTimeouts ServerTimeouts `json:"admin_timeouts"`
+
+	// AdminBasicUser and AdminBasicPassword, when set, require HTTP Basic
+	// credentials on every admin endpoint. Both must be set together.
+	// Default: "" (no authentication)
+	AdminBasicUser     string `json:"admin_basic_user"`
+	AdminBasicPassword string `json:"admin_basic_password"`
+
+	// AdminBasicAuthExemptHealth leaves /health open with basic auth enabled,
+	// for liveness probes that can't send credentials
+	// Default: false
+	AdminBasicAuthExemptHealth bool `json:"admin_basic_auth_exempt_health"`
+
 	// BackendURL is the URL of the llama.cpp server to proxy to
 	// Default: http://localhost:8081
 	BackendURL string `json:"backend_url"`
 
+	// BackendPathPrefix is prepended to the path of every llama.cpp API
+	// request (proxied requests, warmups, slot save/restore, health probes),
+	// for backends behind a gateway, e.g. "/llm" sends /v1/chat/completions
+	// to /llm/v1/chat/completions. Normalized to a leading and no trailing slash
+	// Default: "" (paths are forwarded as is)
+	BackendPathPrefix string `json:"backend_path_prefix"`
+
+	// Backends is an optional weighted pool of llama.cpp servers for requests
+	// whose prefix has no backend of its own. Each backend's /health is probed
+	// every BackendHealthCheckInterval seconds; unhealthy backends are ejected
+	// from rotation until they recover. Templates are only warmed up on
+	// BackendURL, include it in the pool to keep it in rotation.
+	// Default: empty (all requests go to BackendURL)
+	Backends []BackendConfig `json:"backends,omitempty"`
+
+	// BackendHealthCheckInterval is how often each backend of the pool is
+	// probed (seconds)
+	// Default: 5
+	BackendHealthCheckInterval int `json:"backend_health_check_interval"`
+
 	// WarmupCheckInterval is how often to check templates for changes (seconds)
 	// The warmup manager checks templates at this interval and warms up changed ones
 	// Default: 30
 	WarmupCheckInterval int `json:"warmup_check_interval"`
 
-	// Prefixes maps message prefixes to template file paths
+	// WarmupUsageWeighted makes the warmup manager check each template for
+	// changes at its own interval, scaled inversely with the template's recent
+	// request rate: busy templates are checked (and re-warmed) more often than
+	// idle ones. Intervals are bounded by WarmupMinInterval and WarmupMaxInterval,
+	// and WarmupCheckInterval is not used
+	// Default: false
+	WarmupUsageWeighted bool `json:"warmup_usage_weighted"`
+
+	// WarmupMinInterval is the shortest per-template check interval with
+	// WarmupUsageWeighted (seconds)
+	// Default: 5
+	WarmupMinInterval int `json:"warmup_min_interval"`
+
+	// WarmupMaxInterval is the per-template check interval for templates
+	// without recent traffic with WarmupUsageWeighted (seconds)
+	// Default: 300
+	WarmupMaxInterval int `json:"warmup_max_interval"`
+
+	// MinWarmupInterval is the shortest time between two background warmups
+	// of the same template (seconds). A template that changes again sooner,
+	// e.g. while being edited, stays pending until the interval has passed,
+	// so rapid edits are coalesced into one warmup. Unlike WarmupMinInterval
+	// it limits warmups, not checks; on-demand warmups are not limited.
+	// Default: 0 (no limit)
+	MinWarmupInterval int `json:"min_warmup_interval"`
+
+	// SlotIdleEvictSeconds is the idle time after which the llama.cpp setup
+	// drops a slot's KV cache from memory (seconds). When set, the KV cache of
+	// the template loaded in the default backend is restored again from its
+	// saved file shortly before it would be evicted, so it stays hot.
+	// Default: 0 (disabled)
+	SlotIdleEvictSeconds int `json:"slot_idle_evict_seconds"`
+
+	// WarmupCheckSlots makes the warmup manager query llama.cpp's GET /slots
+	// before warming up and skip the cycle if all slots are busy, so warmups
+	// don't queue behind user requests at the backend
+	// Default: false
+	WarmupCheckSlots bool `json:"warmup_check_slots"`
+
+	// WarmupEndpoint is the backend path warmup requests are sent to,
+	// e.g. "/v1/chat/completions", "/v1/completions" or llama.cpp's native "/completion"
+	// Default: "/v1/chat/completions"
+	WarmupEndpoint string `json:"warmup_endpoint"`
+
+	// WarmupRequestFormat selects the warmup request body shape:
+	// "chat" sends {"messages": [...]}, "prompt" sends a flat {"prompt": "..."}.
+	// Empty means "chat" for endpoints ending in "/chat/completions", "prompt" otherwise.
+	// Default: "" (derived from WarmupEndpoint)
+	WarmupRequestFormat string `json:"warmup_request_format"`
+
+	// WarmupEmptyPlaceholder is sent as warmup content for templates that
+	// process to empty (or whitespace-only) content without a message,
+	// e.g. a template that is just <{message}>. Empty means such warmups are skipped.
+	// Default: "" (skip)
+	WarmupEmptyPlaceholder string `json:"warmup_empty_placeholder"`
+
+	// WarmupCancelGraceMs is how long a user request arriving during a warmup
+	// waits for the warmup to finish before cancelling it (milliseconds).
+	// Finishing an almost-done warmup is cheaper than redoing it later
+	// Default: 0 (cancel immediately)
+	WarmupCancelGraceMs int `json:"warmup_cancel_grace_ms"`
+
+	// MaxConcurrentUserQueries limits how many chat completions run at once.
+	// Requests over the limit get 503 Service Unavailable with a JSON error
+	// body and a Retry-After header instead of queueing in llama.cpp
+	// Default: 0 (no limit)
+	MaxConcurrentUserQueries int `json:"max_concurrent_user_queries"`
+
+	// SaveEveryNRequests saves the KV cache of the template loaded in the
+	// default backend once that many requests used it without a switch,
+	// the next time the backend is idle. Without it a long session on one
+	// template only saves its evolving cache when switching away
+	// Default: 0 (save on switch only)
+	SaveEveryNRequests int `json:"save_every_n_requests"`
+
+	// WarmupCompletionTimeout bounds a single warmup completion request (seconds)
+	// Default: 60
+	WarmupCompletionTimeout int `json:"warmup_completion_timeout"`
+
+	// WarmupStopTimeout bounds how long stopping the warmup manager waits for
+	// the warmup loop to exit (seconds). An in-progress warmup is cancelled on
+	// stop; this covers a KV cache save or restore that doesn't return.
+	// Default: 10
+	WarmupStopTimeout int `json:"warmup_stop_timeout"`
+
+	// BlockUntilWarm makes the proxy answer /v1/* requests with 503 Service
+	// Unavailable and a Retry-After header until the warmup manager's initial
+	// warmup check has finished, so load balancers don't send traffic to an
+	// instance with cold caches. Other paths (e.g. /health) are not blocked.
+	// Ignored in passthrough mode
+	// Default: false
+	BlockUntilWarm bool `json:"block_until_warm"`
+
+	// WarmupReportFile, if set, gets one JSON line appended per warmup with
+	// its prefix, timestamp, duration, cache hit/miss, outcome and prompt
+	// token count, for offline analysis. If the file can't be opened the
+	// report is disabled with a single warning.
+	// Default: "" (no report)
+	WarmupReportFile string `json:"warmup_report_file"`
+
+	// CacheOpTimeout bounds a single warmup KV cache save or restore (seconds).
+	// Cache operations use their own HTTP client, so a hung save cannot delay
+	// the warmup completion or its cancellation.
+	// Default: 60
+	CacheOpTimeout int `json:"cache_op_timeout"`
+
+	// DisableKVCache turns off all KV cache save/restore calls, e.g. when
+	// llama.cpp runs without --slot-save-path. Warmups still send the
+	// completion to prime the in-memory cache, and the loaded template is
+	// still tracked
+	// Default: false
+	DisableKVCache bool `json:"disable_kv_cache"`
+
+	// BackendAuthToken, when set, replaces the Authorization header of proxied
+	// requests with "Bearer <token>", whatever the client sent. Warmups and
+	// KV cache operations send it too. Use it when llama.cpp runs with
+	// --api-key and clients use their own keys.
+	// Default: "" (the client's Authorization header is forwarded as is)
+	BackendAuthToken string `json:"backend_auth_token"`
+
+	// BackendAuthFailure is what the client gets when the backend rejects a
+	// request carrying BackendAuthToken with 401 or 403: "passthrough"
+	// forwards the backend's response, "error" replaces it with a 502
+	// pointing at the backend credentials, so misconfigured backend auth is
+	// not mistaken for the client's own. Either way the rejection is counted
+	// in bioproxy_backend_auth_failures_total.
+	// Default: "passthrough"
+	BackendAuthFailure string `json:"backend_auth_failure"`
+
+	// BackendMaxIdleConns is the maximum number of idle (keep-alive) connections
+	// to the backend kept in the proxy's connection pool
+	// Default: 100
+	BackendMaxIdleConns int `json:"backend_max_idle_conns"`
+
+	// BackendMaxIdleConnsPerHost is the maximum number of idle connections kept
+	// per backend host. Go's default of 2 is low for a single busy backend.
+	// Default: 10
+	BackendMaxIdleConnsPerHost int `json:"backend_max_idle_conns_per_host"`
+
+	// BackendIdleConnTimeout is how long an idle backend connection is kept (seconds)
+	// Default: 90
+	BackendIdleConnTimeout int `json:"backend_idle_conn_timeout"`
+
+	// BackendForceHTTP1 disables HTTP/2 to the backend
+	// SSE streaming can misbehave over some HTTP/2 setups
+	// Default: false
+	BackendForceHTTP1 bool `json:"backend_force_http1"`
+
+	// BackendTLSCACert is a PEM file of CA certificates trusted for https://
+	// backends in addition to the system ones, e.g. a private CA fronting
+	// llama.cpp
+	// Default: "" (system CAs only)
+	BackendTLSCACert string `json:"backend_tls_ca_cert"`
+
+	// BackendTLSInsecureSkipVerify disables verification of backend TLS
+	// certificates. Only meant for testing, prefer BackendTLSCACert
+	// Default: false
+	BackendTLSInsecureSkipVerify bool `json:"backend_tls_insecure_skip_verify"`
+
+	// WrapNonSSEErrors wraps non-SSE backend responses to stream=true requests
+	// (e.g. a JSON error body) into a single SSE "data:" frame
+	// Default: false
+	WrapNonSSEErrors bool `json:"wrap_non_sse_errors"`
+
+	// SSEHeartbeatInterval, when positive, makes streaming chat completions
+	// respond with a 200 event stream right away and send an SSE comment
+	// (": heartbeat") every that many seconds until the backend sends its
+	// first bytes, so intermediaries don't close the connection during a
+	// KV cache restore, a lazy warmup or a long prompt. Clients ignore
+	// comments. Heartbeats stop once data flows; errors after the early
+	// headers are sent as a "data:" frame (seconds)
+	// Default: 0 (disabled)
+	SSEHeartbeatInterval int `json:"sse_heartbeat_interval"`
+
+	// StripResponseHeaders lists backend response headers (case-insensitive)
+	// that are removed before the response reaches clients, e.g. "Server"
+	// or internal debug headers
+	// Default: none
+	StripResponseHeaders []string `json:"strip_response_headers"`
+
+	// ResponseRewrite lists named transforms applied, in order, to non-streaming
+	// chat completion responses before they are forwarded (e.g. ["strip_think"]).
+	// Streaming responses are never rewritten.
+	// Default: none
+	ResponseRewrite []string `json:"response_rewrite"`
+
+	// ExposePrefixesAsModels adds one pseudo-model per backend model and prefix
+	// to /v1/models (e.g. "local-llama+code" for @code). Chat completions using
+	// such a model get the prefix's template and the real model ID.
+	// Default: false
+	ExposePrefixesAsModels bool `json:"expose_prefixes_as_models"`
+
+	// PassthroughMode turns bioproxy into a pure reverse proxy for debugging:
+	// no template injection, no KV cache save/restore, no state tracking and
+	// no warmup. Requests are only forwarded and counted in metrics.
+	// Default: false
+	PassthroughMode bool `json:"passthrough_mode"`
+
+	// AccessLogFormat selects the per-request access log format:
+	// "text" keeps the human-readable log lines only, "json" additionally writes
+	// one JSON object per completed request to stdout (method, path, status,
+	// duration_ms, prefix, bytes, request_id, streaming)
+	// Default: "text"
+	AccessLogFormat string `json:"access_log_format"`
+
+	// LogRequests logs INFO lines for every proxied request (forwarding,
+	// backend status, template selection). Turn off on busy proxies to keep
+	// startup, warmup and error logs readable; warnings and errors are
+	// still logged.
+	// Default: true
+	LogRequests bool `json:"log_requests"`
+
+	// LogLevel is "info" or "debug". "debug" adds DEBUG lines for diagnosing
+	// template selection, e.g. which prefixes were checked and what matched.
+	// Applied on config reload; read it with Debug.
+	// Default: "info"
+	LogLevel string `json:"log_level"`
+
+	// OTLPEndpoint is the OpenTelemetry collector that receives a trace span per
+	// chat completion (OTLP/HTTP with JSON encoding, e.g. "http://localhost:4318";
+	// "/v1/traces" is appended when the URL has no path). Incoming traceparent
+	// headers are continued and propagated to the backend.
+	// Default: "" (tracing disabled)
+	OTLPEndpoint string `json:"otlp_endpoint"`
+
+	// ChangeDebounceCycles is how many additional warmup check cycles a changed
+	// template must stay unchanged before it is warmed up. Avoids warming up
+	// half-written files when an editor saves in several steps.
+	// Default: 0 (warm up on the first check that sees the change)
+	ChangeDebounceCycles int `json:"change_debounce_cycles"`
+
+	// MaxProcessedTemplateBytes limits the size of a processed template
+	// (including all file includes). Larger templates fail with a clear error
+	// instead of being sent to llama.cpp.
+	// Default: 0 (no limit)
+	MaxProcessedTemplateBytes int `json:"max_processed_template_bytes"`
+
+	// MaxTemplateFileBytes limits the size of each template file and each
+	// file it includes. It is checked while reading, so a prefix pointing at
+	// a huge file or a device such as /dev/zero fails with a clear error
+	// instead of hanging at startup.
+	// Default: 0 (no limit)
+	MaxTemplateFileBytes int `json:"max_template_file_bytes"`
+
+	// MaxExpansionBytes limits the total size of the files a template
+	// includes (fragments, <{file}> and {{File}} includes) in one processing.
+	// Processing stops as soon as the budget is exceeded, so a template with
+	// hundreds of large includes fails before the whole expansion is built.
+	// Default: 0 (no limit)
+	MaxExpansionBytes int `json:"max_expansion_bytes"`
+
+	// PrefixCheckRoles lists the message roles scanned for a template prefix.
+	// For each role only its latest message is checked; if several match,
+	// the latest one wins. Useful for frameworks that put the prefix on the
+	// system message (e.g. ["user", "system"]).
+	// Default: ["user"]
+	PrefixCheckRoles []string `json:"prefix_check_roles"`
+
+	// EnablePromptCache adds "cache_prompt": true to forwarded chat requests
+	// and warmup requests, so llama.cpp reuses the prompt KV cache that
+	// warmups and restores load. A cache_prompt sent by the client is kept.
+	// Default: false
+	EnablePromptCache bool `json:"enable_prompt_cache"`
+
+	// MaxTokensCap limits max_tokens, max_completion_tokens and n_predict of
+	// forwarded chat completion requests, including values set by a
+	// template's request_overrides, so a single client can't hold the
+	// backend with a huge generation. Larger, negative and non-numeric
+	// values are replaced by the cap and requests without any of them get
+	// max_tokens set to the cap. 0 disables the cap.
+	// Default: 0
+	MaxTokensCap int `json:"max_tokens_cap"`
+
+	// UnknownPrefixBehavior is what happens when a message starts with an
+	// @prefix that isn't configured (e.g. "@foo ..." or a prefix removed by a
+	// reload), or the X-Bioproxy-Template header names one: "passthrough"
+	// forwards the message unchanged, including the @prefix, so @mentions
+	// don't break normal chat; "error" rejects the request with 400 Bad
+	// Request to surface typos early.
+	// Default: "passthrough"
+	UnknownPrefixBehavior string `json:"unknown_prefix_behavior"`
+
+	// TemplateSelectionPriority decides which template is used when the
+	// X-Bioproxy-Template request header and the message prefix name
+	// different templates: "header" or "message". A prefix in the message is
+	// stripped either way.
+	// Default: "header"
+	TemplateSelectionPriority string `json:"template_selection_priority"`
+
+	// TrimMessageWhitespace trims leading and trailing whitespace from the user
+	// message after the prefix is stripped, before it is substituted into the template
+	// Default: false (the message is used exactly as written after "<prefix> ")
+	TrimMessageWhitespace bool `json:"trim_message_whitespace"`
+
+	// VerifyPassthrough checks every chat completion request after template injection
+	// and logs a warning if any top-level field was dropped or changed. Fields the
+	// proxy rewrites on purpose are skipped: "messages", "stop", "tools", "stream",
+	// "model", "max_tokens", "max_completion_tokens", "n_predict" (see
+	// passthroughExemptFields in the proxy) and any field set by the prefix's
+	// request_overrides. Meant for debugging, it costs an extra parse per request.
+	// Default: false
+	VerifyPassthrough bool `json:"verify_passthrough"`
+
+	// IdleTimeout is how long without /v1/* requests before bioproxy is
+	// considered idle (seconds). When reached, IdleCommand is run once.
+	// Default: 0 (idle detection disabled)
+	IdleTimeout int `json:"idle_timeout"`
+
+	// IdleCommand is a shell command run when the idle timeout is reached,
+	// e.g. to scale down the GPU. Empty means only log.
+	IdleCommand string `json:"idle_command"`
+
+	// StickyPrefix keeps applying the last prefix used in a conversation to later
+	// turns without a prefix. Conversations are identified by the client-supplied
+	// X-Conversation-ID header; requests without it are unaffected.
+	// Default: false
+	StickyPrefix bool `json:"sticky_prefix"`
+
+	// StickyPrefixMaxConversations bounds how many conversations are remembered
+	// (least recently used are evicted first)
+	// Default: 1000
+	StickyPrefixMaxConversations int `json:"sticky_prefix_max_conversations"`
+
+	// WarmupWindows restricts background warmups to the given local-time windows.
+	// Outside all windows, template changes are still detected but their warmup
+	// is deferred until a window opens. The initial startup warmup always runs.
+	// Example: [{"start": "02:00", "end": "05:00"}]
+	// Default: empty (warmups may run at any time)
+	WarmupWindows []WarmupWindow `json:"warmup_windows,omitempty"`
+
+	// StateMode selects how the backend state (which template is loaded in
+	// the KV cache) is tracked:
+	//   - "local": each instance tracks it on its own
+	//   - "shared-file": instances in front of the same backend coordinate
+	//     through a lock on StateFile; only the lock holder saves and restores
+	//     KV caches, the others defer. Requires file locking (unix), startup
+	//     fails on other platforms
+	// Default: "local"
+	StateMode string `json:"state_mode"`
+
+	// StateFile is the lock file shared by instances with StateMode
+	// "shared-file". It must be on a filesystem all instances can lock
+	// Default: empty
+	StateFile string `json:"state_file"`
+
+	// MetricsNamespace is the prefix of every metric name on /metrics,
+	// e.g. "bioproxy_dev" yields bioproxy_dev_requests_total
+	// Default: "bioproxy"
+	MetricsNamespace string `json:"metrics_namespace"`
+
+	// InstanceLabel, if set, adds an instance="..." label to every metric
+	// on /metrics, to tell instances apart when they are scraped into one
+	// Prometheus without relabeling
+	// Default: "" (no label)
+	InstanceLabel string `json:"instance_label"`
+
+	// MaxTrackedEndpoints caps the number of distinct request paths counted
+	// in requests_total; requests to further paths are counted under "other".
+	// Known API paths are always tracked. Protects against unbounded metrics
+	// growth from clients hitting many distinct paths. 0 means no limit.
+	// Default: 100
+	MaxTrackedEndpoints int `json:"max_tracked_endpoints"`
+
+	// MetricsSnapshotFile, if set, is where the metric counters are saved
+	// every MetricsSnapshotInterval seconds and on shutdown. They are loaded
+	// from it on startup, so counters continue across restarts.
+	// Default: "" (counters start from zero on every start)
+	MetricsSnapshotFile string `json:"metrics_snapshot_file"`
+
+	// MetricsSnapshotInterval is how often metrics are saved to
+	// MetricsSnapshotFile (seconds)
+	// Default: 60
+	MetricsSnapshotInterval int `json:"metrics_snapshot_interval"`
+
+	// ExposeRuntimeMetrics adds Go runtime metrics (goroutines, heap, GC pauses)
+	// to /metrics, e.g. to catch goroutine leaks from abandoned streams
+	// Default: false
+	ExposeRuntimeMetrics bool `json:"expose_runtime_metrics"`
+
+	// TemplateDir is a directory scanned for *.txt templates, each registered
+	// as prefix "@<basename>" (e.g. review.txt -> @review). Explicit Prefixes
+	// entries win on conflict. The directory is rescanned on config reload
+	// Default: empty (no directory)
+	TemplateDir string `json:"template_dir"`
+
+	// Prefixes maps message prefixes to template configuration
 	// When a user message starts with a key, the corresponding template is used
+	// Each value is either a template path or an object with extra options
 	// Example: {"@code": "/path/to/code_template.txt"}
-	Prefixes map[string]string `json:"prefixes"`
+	// Example: {"@code": {"path": "/path/to/code_template.txt", "stop": ["###"]}}
+	// Replaced on config reload; read it with PrefixMap once running.
+	Prefixes map[string]PrefixConfig `json:"prefixes"`
+
+	// reloadedPrefixes is the prefix map set by SetPrefixes (nil until the
+	// first reload, Prefixes is current until then)
+	reloadedPrefixes atomic.Pointer[map[string]PrefixConfig]
+
+	// reloadedLogLevel is the log level set by SetLogLevel (nil until the
+	// first reload, LogLevel is current until then)
+	reloadedLogLevel atomic.Pointer[string]
+
+	// toolsMu protects toolsFiles
+	toolsMu sync.Mutex
+
+	// toolsFiles caches the tools files read by ToolsFor, keyed by path
+	toolsFiles map[string]toolsFile
+}
+
+// toolsFile is a tools file as last read by ToolsFor
+type toolsFile struct {
+	modTime time.Time
+	size    int64
+	tools   []map[string]interface{}
+}
+
+// PrefixMap returns the current prefix configuration: Prefixes, or the map
+// set by the last SetPrefixes. The map must not be modified. Look up all
+// prefixes of a request in one PrefixMap result, so a concurrent reload
+// cannot mix two configurations.
+func (c *Config) PrefixMap() map[string]PrefixConfig {
+	if prefixes := c.reloadedPrefixes.Load(); prefixes != nil {
+		return *prefixes
+	}
+	return c.Prefixes
+}
+
+// Prefix returns the current configuration of a prefix
+func (c *Config) Prefix(prefix string) (PrefixConfig, bool) {
+	prefixCfg, exists := c.PrefixMap()[prefix]
+	return prefixCfg, exists
+}
+
+// SetPrefixes replaces the prefix configuration of a running proxy. Safe to
+// call while requests are served; Prefixes keeps the configuration loaded
+// at startup.
+func (c *Config) SetPrefixes(prefixes map[string]PrefixConfig) {
+	c.reloadedPrefixes.Store(&prefixes)
+}
+
+// SetLogLevel changes the log level of a running proxy (LogLevelInfo or
+// LogLevelDebug). Safe to call while requests are served.
+func (c *Config) SetLogLevel(level string) {
+	c.reloadedLogLevel.Store(&level)
+}
+
+// CurrentLogLevel returns LogLevel, or the level set by the last SetLogLevel
+func (c *Config) CurrentLogLevel() string {
+	if level := c.reloadedLogLevel.Load(); level != nil {
+		return *level
+	}
+	return c.LogLevel
+}
+
+// Debug reports whether DEBUG lines are logged
+func (c *Config) Debug() bool {
+	return c.CurrentLogLevel() == LogLevelDebug
+}
+
+// SortedPrefixes returns the prefixes of a prefix map in sorted order
+func SortedPrefixes(prefixes map[string]PrefixConfig) []string {
+	return slices.Sorted(maps.Keys(prefixes))
+}
+
+// WarmupWindow is a daily local-time window in "HH:MM" format.
+// A window whose end is before its start spans midnight (e.g. 22:00-02:00).
+type WarmupWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Contains returns true if the time of day of t falls within the window.
+// The start is inclusive and the end is exclusive.
+func (w WarmupWindow) Contains(t time.Time) bool {
+	start, end, err := w.parse()
+	if err != nil {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	// Window spans midnight
+	return minute >= start || minute < end
+}
+
+// parse converts the window bounds to minutes since midnight
+func (w WarmupWindow) parse() (start, end int, err error) {
+	startTime, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid warmup window start %q (expected HH:MM)", w.Start)
+	}
+	endTime, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid warmup window end %q (expected HH:MM)", w.End)
+	}
+	return startTime.Hour()*60 + startTime.Minute(), endTime.Hour()*60 + endTime.Minute(), nil
+}
+
+// InWarmupWindow returns true if background warmups are allowed at time t.
+// Always true when no warmup windows are configured.
+func (c *Config) InWarmupWindow(t time.Time) bool {
+	if len(c.WarmupWindows) == 0 {
+		return true
+	}
+	for _, window := range c.WarmupWindows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrefixConfig holds the configuration for a single template prefix
+type PrefixConfig struct {
+	// Path is the path to the template file
+	Path string `json:"path"`
+
+	// Inline is the template text itself, used instead of Path for short
+	// templates, e.g. "You are a helper. <{message}>"
+	Inline string `json:"inline,omitempty"`
+
+	// Includes lists fragment files (e.g. persona, guidelines, examples)
+	// prepended in order to the processed template, like <{a}><{b}> at the
+	// start of the template but reorderable without editing it. Fragments
+	// are included verbatim and checked for changes like the template.
+	Includes []string `json:"includes,omitempty"`
+
+	// Stop lists stop sequences merged into the request's "stop" array
+	// whenever this prefix matches. Client-provided stops are preserved.
+	Stop []string `json:"stop,omitempty"`
+
+	// RequestOverrides is merged into the request body whenever this prefix
+	// matches, e.g. {"temperature": 0} for a deterministic template. Nested
+	// objects are merged key by key; values the client sent win unless
+	// ForceOverrides is set. It can't override "messages".
+	RequestOverrides map[string]interface{} `json:"request_overrides,omitempty"`
+
+	// ForceOverrides makes RequestOverrides replace values the client sent
+	ForceOverrides bool `json:"force_overrides,omitempty"`
+
+	// ToolsFile is a JSON file holding an array of OpenAI tool definitions
+	// ({"type": "function", "function": {"name": ...}}) merged into the
+	// request's "tools" array whenever this prefix matches. Client tools are
+	// preserved and win over file tools with the same function name. The
+	// file is read and validated when the config is loaded, and re-read when
+	// it changes; warmups send the tools too, and editing the file re-warms
+	// the prefix's templates.
+	ToolsFile string `json:"tools_file,omitempty"`
+
+	// Tools holds the tool definitions read from ToolsFile when the config
+	// was loaded; ToolsFor returns the current ones
+	Tools []map[string]interface{} `json:"-"`
+
+	// Engine selects the template engine: "simple" (default, <{...}> placeholders)
+	// or "go-template" (Go text/template with .Message and File helper)
+	Engine string `json:"engine,omitempty"`
+
+	// Position controls where the processed template lands in the messages array:
+	// "inplace" (default) replaces the last user message, "prepend-system" and
+	// "prepend-user" insert it as a new first system/user message and keep the
+	// last user message with the prefix stripped
+	Position string `json:"position,omitempty"`
+
+	// Backend is the llama.cpp server URL used for this prefix's requests and
+	// warmups instead of BackendURL, e.g. to pin a large-context template to a
+	// high-memory backend. KV cache state is tracked separately per backend.
+	Backend string `json:"backend,omitempty"`
+
+	// Variants lists alternative templates for A/B testing, used instead of Path.
+	// One variant is picked per request by weighted random selection.
+	// Each variant is warmed up and cached separately.
+	Variants []VariantConfig `json:"variants,omitempty"`
+
+	// Warmup selects when the template is warmed up: "eager" (default) from
+	// the background warmup loop, or "lazy" on the first request that uses it,
+	// for rarely used templates
+	Warmup string `json:"warmup,omitempty"`
+
+	// CacheKey names the KV cache of this prefix's templates instead of the
+	// prefix itself. Prefixes sharing a CacheKey share one cache file (e.g.
+	// templates with a long common prefix), so switching between them
+	// triggers no save or restore and only one of them is warmed up per cycle.
+	CacheKey string `json:"cache_key,omitempty"`
+
+	// Priority orders warmups when several templates need one at once:
+	// higher priorities are warmed up first (default 0, may be negative)
+	Priority int `json:"priority,omitempty"`
+
+	// DependsOn lists prefixes whose templates are warmed up before this
+	// one's when several need a warmup at once, whatever their priority,
+	// e.g. ["@base"] for a template extending @base's text, so its warmup
+	// reuses the cached common prefix. Cycles are rejected.
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// FromTemplateDir is set for prefixes found in TemplateDir rather than
+	// listed in the config
+	FromTemplateDir bool `json:"-"`
+}
+
+// loadToolsFile reads a JSON array of tool definitions, checking that each
+// one names its function and that names are unique
+func loadToolsFile(path string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tools []map[string]interface{}
+	if err := json.Unmarshal(data, &tools); err != nil {
+		return nil, fmt.Errorf("failed to parse %s (expected a JSON array of tool objects): %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, tool := range tools {
+		function, _ := tool["function"].(map[string]interface{})
+		name, _ := function["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("tool %d in %s has no function name", i, path)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate tool %q in %s", name, path)
+		}
+		seen[name] = true
+	}
+	return tools, nil
+}
+
+// ToolsFor returns the current tool definitions of a prefix: its ToolsFile
+// as last read, re-read whenever the file's size or modification time
+// changes. If the file can no longer be read or is invalid, the last valid
+// tools are kept. Prefixes without ToolsFile return their Tools as is.
+func (c *Config) ToolsFor(prefixCfg PrefixConfig) []map[string]interface{} {
+	path := prefixCfg.ToolsFile
+	if path == "" {
+		return prefixCfg.Tools
+	}
+
+	c.toolsMu.Lock()
+	defer c.toolsMu.Unlock()
+
+	cached, exists := c.toolsFiles[path]
+	if !exists {
+		cached.tools = prefixCfg.Tools
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("WARNING: Failed to check tools_file %s, keeping the last tools: %v", path, err)
+		return cached.tools
+	}
+	if exists && info.ModTime().Equal(cached.modTime) && info.Size() == cached.size {
+		return cached.tools
+	}
+
+	tools, err := loadToolsFile(path)
+	if err != nil {
+		log.Printf("WARNING: Invalid tools_file %s, keeping the last tools: %v", path, err)
+		return cached.tools
+	}
+	if c.toolsFiles == nil {
+		c.toolsFiles = make(map[string]toolsFile)
+	}
+	c.toolsFiles[path] = toolsFile{modTime: info.ModTime(), size: info.Size(), tools: tools}
+	return tools
+}
+
+// ToolsForTemplate returns the current tool definitions of the prefix of
+// the template with the given watcher key (see ToolsFor)
+func (c *Config) ToolsForTemplate(key string) []map[string]interface{} {
+	prefixCfg, _ := c.prefixConfigForTemplate(key)
+	return c.ToolsFor(prefixCfg)
+}
+
+// BackendPath returns the backend path of a request path: path with
+// BackendPathPrefix prepended
+func (c *Config) BackendPath(path string) string {
+	if c.BackendPathPrefix == "" {
+		return path
+	}
+	return c.BackendPathPrefix + "/" + strings.TrimPrefix(path, "/")
+}
+
+// BackendBaseURL returns the URL llama.cpp API paths are appended to for
+// backend: the backend URL followed by BackendPathPrefix
+func (c *Config) BackendBaseURL(backend string) string {
+	return strings.TrimSuffix(backend, "/") + c.BackendPathPrefix
+}
+
+// BackendTransport returns a new HTTP transport for requests to llama.cpp:
+// Go's default transport with the backend TLS settings applied. The CA file
+// is checked when the config is loaded, so an error means it changed since.
+func (c *Config) BackendTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.BackendTLSCACert == "" && !c.BackendTLSInsecureSkipVerify {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.BackendTLSInsecureSkipVerify}
+	if c.BackendTLSCACert != "" {
+		pem, err := os.ReadFile(c.BackendTLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backend_tls_ca_cert: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid backend_tls_ca_cert %s (no PEM certificates found)", c.BackendTLSCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// BackendFor returns the backend URL for a template prefix:
+// the prefix's Backend if set, BackendURL otherwise
+func (c *Config) BackendFor(prefix string) string {
+	if prefixCfg, exists := c.Prefix(prefix); exists && prefixCfg.Backend != "" {
+		return prefixCfg.Backend
+	}
+	return c.BackendURL
+}
+
+// BackendForTemplate returns the backend URL for a template watcher key
+// (a prefix, or a prefix variant such as "@code.v2")
+func (c *Config) BackendForTemplate(key string) string {
+	if prefixCfg, ok := c.prefixConfigForTemplate(key); ok && prefixCfg.Backend != "" {
+		return prefixCfg.Backend
+	}
+	return c.BackendURL
+}
+
+// LazyWarmup reports whether the template with the given watcher key is
+// warmed up on first use rather than by the background loop
+func (c *Config) LazyWarmup(key string) bool {
+	prefixCfg, ok := c.prefixConfigForTemplate(key)
+	return ok && prefixCfg.Warmup == WarmupLazy
+}
+
+// CacheKeyFor returns the KV cache identity of the template with the given
+// watcher key: its prefix's CacheKey if set, the key itself otherwise.
+// It is what backend state tracks and names the cache file.
+func (c *Config) CacheKeyFor(key string) string {
+	if prefixCfg, ok := c.prefixConfigForTemplate(key); ok && prefixCfg.CacheKey != "" {
+		return prefixCfg.CacheKey
+	}
+	return key
+}
+
+// WarmupPriority returns the warmup priority of the template with the given
+// watcher key (0 if unknown)
+func (c *Config) WarmupPriority(key string) int {
+	prefixCfg, _ := c.prefixConfigForTemplate(key)
+	return prefixCfg.Priority
+}
+
+// WarmupDependencies returns the watcher keys of the templates that must be
+// warmed up before the template with the given watcher key (see DependsOn)
+func (c *Config) WarmupDependencies(key string) []string {
+	prefixes := c.PrefixMap()
+	prefix, _ := prefixForTemplate(prefixes, key)
+	var keys []string
+	for _, dependency := range prefixes[prefix].DependsOn {
+		for _, ref := range prefixes[dependency].Templates(dependency) {
+			keys = append(keys, ref.Key)
+		}
+	}
+	return keys
+}
+
+// checkDependencies verifies that every DependsOn entry names a configured
+// prefix and that the dependencies contain no cycle
+func (c *Config) checkDependencies() error {
+	// Depth-first search; a prefix reached again while still being
+	// visited closes a cycle
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	status := make(map[string]int)
+	var visit func(prefix string, path []string) error
+	visit = func(prefix string, path []string) error {
+		switch status[prefix] {
+		case visiting:
+			return fmt.Errorf("depends_on cycle: %s", strings.Join(append(path, prefix), " -> "))
+		case visited:
+			return nil
+		}
+		status[prefix] = visiting
+		for _, dependency := range c.Prefixes[prefix].DependsOn {
+			if _, exists := c.Prefixes[dependency]; !exists {
+				return fmt.Errorf("prefix %s depends_on unknown prefix %s", prefix, dependency)
+			}
+			if err := visit(dependency, append(path, prefix)); err != nil {
+				return err
+			}
+		}
+		status[prefix] = visited
+		return nil
+	}
+
+	for _, prefix := range SortedPrefixes(c.Prefixes) {
+		if err := visit(prefix, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixConfigForTemplate returns the current configuration of the prefix
+// that registers the template with the given watcher key
+func (c *Config) prefixConfigForTemplate(key string) (PrefixConfig, bool) {
+	prefixes := c.PrefixMap()
+	prefix, ok := prefixForTemplate(prefixes, key)
+	return prefixes[prefix], ok
+}
+
+// prefixForTemplate returns the prefix of a prefix map that registers the
+// template with the given watcher key
+func prefixForTemplate(prefixes map[string]PrefixConfig, key string) (string, bool) {
+	for prefix, prefixCfg := range prefixes {
+		for _, ref := range prefixCfg.Templates(prefix) {
+			if ref.Key == key {
+				return prefix, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ServerTimeouts configures the timeouts of an HTTP server in seconds.
+// Zero means no timeout. Fields missing from the config keep their defaults.
+type ServerTimeouts struct {
+	// ReadHeader bounds reading the request headers (slow-loris protection)
+	ReadHeader int `json:"read_header"`
+
+	// Read bounds reading the entire request, including the body
+	Read int `json:"read"`
+
+	// Write bounds writing the response; must be 0 where responses stream
+	Write int `json:"write"`
+
+	// Idle bounds how long a keep-alive connection waits for the next request
+	Idle int `json:"idle"`
+}
+
+// Apply sets the timeouts on server
+func (t ServerTimeouts) Apply(server *http.Server) {
+	server.ReadHeaderTimeout = time.Duration(t.ReadHeader) * time.Second
+	server.ReadTimeout = time.Duration(t.Read) * time.Second
+	server.WriteTimeout = time.Duration(t.Write) * time.Second
+	server.IdleTimeout = time.Duration(t.Idle) * time.Second
+}
+
+// validate checks that no timeout is negative
+func (t ServerTimeouts) validate(name string) error {
+	if t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 {
+		return fmt.Errorf("invalid %s: timeouts must not be negative", name)
+	}
+	return nil
+}
+
+// State tracking modes for StateMode
+const (
+	// StateModeLocal tracks the backend state per instance
+	StateModeLocal = "local"
+
+	// StateModeSharedFile coordinates instances through a lock on StateFile
+	StateModeSharedFile = "shared-file"
+)
+
+// Log levels for LogLevel
+const (
+	// LogLevelInfo logs INFO, WARNING and ERROR lines
+	LogLevelInfo = "info"
+
+	// LogLevelDebug additionally logs DEBUG lines
+	LogLevelDebug = "debug"
+)
+
+// Handling of unconfigured prefixes for UnknownPrefixBehavior
+const (
+	// UnknownPrefixPassthrough forwards the message as if it had no prefix
+	UnknownPrefixPassthrough = "passthrough"
+
+	// UnknownPrefixError rejects the request with 400 Bad Request
+	UnknownPrefixError = "error"
+)
+
+// Handling of backend auth rejections for BackendAuthFailure
+const (
+	// BackendAuthFailurePassthrough forwards the backend's 401/403 response
+	BackendAuthFailurePassthrough = "passthrough"
+
+	// BackendAuthFailureError replaces the backend's 401/403 response with
+	// a 502 Bad Gateway naming the backend credentials
+	BackendAuthFailureError = "error"
+)
+
+// Template selection priorities for TemplateSelectionPriority
+const (
+	// TemplateSelectionHeader prefers the X-Bioproxy-Template header
+	TemplateSelectionHeader = "header"
+
+	// TemplateSelectionMessage prefers the prefix in the message
+	TemplateSelectionMessage = "message"
+)
+
+// Warmup request body shapes for WarmupRequestFormat
+const (
+	// WarmupFormatChat sends the template as a single user message
+	WarmupFormatChat = "chat"
+
+	// WarmupFormatPrompt sends the template as a flat prompt
+	WarmupFormatPrompt = "prompt"
+)
+
+// WarmupFormat returns the effective warmup request format,
+// deriving it from the warmup endpoint if not set explicitly
+func (c *Config) WarmupFormat() string {
+	if c.WarmupRequestFormat != "" {
+		return c.WarmupRequestFormat
+	}
+	if c.WarmupEndpoint == "" || strings.HasSuffix(c.WarmupEndpoint, "/chat/completions") {
+		return WarmupFormatChat
+	}
+	return WarmupFormatPrompt
+}
+
+// PrefixRoles returns the message roles scanned for a template prefix.
+// An empty PrefixCheckRoles means only user messages are scanned.
+func (c *Config) PrefixRoles() []string {
+	if len(c.PrefixCheckRoles) == 0 {
+		return []string{"user"}
+	}
+	return c.PrefixCheckRoles
+}
+
+// Template injection positions for PrefixConfig.Position
+const (
+	// PositionInplace replaces the content of the last user message
+	PositionInplace = "inplace"
+
+	// PositionPrependSystem inserts the template as a new first system message
+	PositionPrependSystem = "prepend-system"
+
+	// PositionPrependUser inserts the template as a new first user message
+	PositionPrependUser = "prepend-user"
+)
+
+// Warmup modes for PrefixConfig.Warmup
+const (
+	// WarmupEager warms the template up from the background warmup loop
+	WarmupEager = "eager"
+
+	// WarmupLazy skips the background loop and warms the template up
+	// synchronously on the first request that uses it
+	WarmupLazy = "lazy"
+)
+
+// BackendConfig describes one weighted backend of the Backends pool
+type BackendConfig struct {
+	// URL is the llama.cpp server URL. A path, e.g. behind a gateway, is
+	// kept in front of the request path
+	URL string `json:"url"`
+
+	// Weight is the relative selection weight
+	// Default: 1 (also used for zero or negative values)
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// VariantConfig describes one weighted template variant of a prefix
+type VariantConfig struct {
+	// Name identifies the variant in metrics and cache filenames
+	// Default: "v1", "v2", ... by position
+	Name string `json:"name,omitempty"`
+
+	// Path is the path to the variant's template file
+	Path string `json:"path"`
+
+	// Weight is the relative selection weight
+	// Default: 1 (also used for zero or negative values)
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// TemplateRef is a single template registered with the template watcher.
+// A plain prefix yields one TemplateRef keyed by the prefix itself;
+// a prefix with variants yields one TemplateRef per variant.
+type TemplateRef struct {
+	// Key is the template watcher key, also used for KV cache state tracking
+	// and the cache filename (e.g. "@code" or "@code.v2")
+	Key string
+
+	// Variant is the variant name, empty for prefixes without variants
+	Variant string
+
+	// Path is the path to the template file
+	Path string
+
+	// Inline is the template text for inline templates (Path is then empty)
+	Inline string
+
+	// Includes lists the fragment files prepended to the template
+	Includes []string
+
+	// Weight is the relative selection weight (always positive)
+	Weight float64
+
+	// FromTemplateDir is set for templates found in TemplateDir
+	FromTemplateDir bool
+}
+
+// Templates returns the templates to register for this prefix
+func (p PrefixConfig) Templates(prefix string) []TemplateRef {
+	if len(p.Variants) == 0 {
+		return []TemplateRef{{Key: prefix, Path: p.Path, Inline: p.Inline, Includes: p.Includes, Weight: 1, FromTemplateDir: p.FromTemplateDir}}
+	}
+
+	refs := make([]TemplateRef, 0, len(p.Variants))
+	for i, variant := range p.Variants {
+		name := variant.Name
+		if name == "" {
+			name = fmt.Sprintf("v%d", i+1)
+		}
+		weight := variant.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		refs = append(refs, TemplateRef{
+			Key:      prefix + "." + name,
+			Variant:  name,
+			Path:     variant.Path,
+			Includes: p.Includes,
+			Weight:   weight,
+		})
+	}
+	return refs
+}
+
+// UnmarshalJSON accepts either the short form (a plain template path string)
+// or the object form with additional per-prefix options
+func (p *PrefixConfig) UnmarshalJSON(data []byte) error {
+	// Short form: "@code": "/path/to/template.txt"
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*p = PrefixConfig{Path: path}
+		return nil
+	}
+
+	// Object form: "@code": {"path": "...", ...}
+	// Use an alias type to avoid recursing into this method
+	type prefixConfigObject PrefixConfig
+	var obj prefixConfigObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return fmt.Errorf("prefix must be a template path or an object: %w", err)
+	}
+	*p = PrefixConfig(obj)
+	return nil
 }
 
 // DefaultConfig returns a Config with sensible default values
 func DefaultConfig() *Config {
 	return &Config{
-		ProxyHost:           "localhost",
-		ProxyPort:           8088,
-		AdminHost:           "localhost",
-		AdminPort:           8089,
-		BackendURL:          "http://localhost:8081",
-		WarmupCheckInterval: 30,
-		Prefixes:            make(map[string]string),
+		ProxyHost:                    "localhost",
+		ProxyPort:                    8088,
+		AdminHost:                    "localhost",
+		AdminPort:                    8089,
+		ProxyTimeouts:                ServerTimeouts{ReadHeader: 10, Idle: 120},
+		AllowedMethods:               []string{"GET", "POST", "OPTIONS", "HEAD"},
+		AdminTimeouts:                ServerTimeouts{ReadHeader: 5, Read: 10, Write: 30, Idle: 60},
+		BackendURL:                   "http://localhost:8081",
+		BackendHealthCheckInterval:   5,
+		WarmupCheckInterval:          30,
+		WarmupMinInterval:            5,
+		WarmupMaxInterval:            300,
+		WarmupEndpoint:               "/v1/chat/completions",
+		WarmupCompletionTimeout:      60,
+		CacheOpTimeout:               60,
+		WarmupStopTimeout:            10,
+		BackendMaxIdleConns:          100,
+		BackendMaxIdleConnsPerHost:   10,
+		BackendIdleConnTimeout:       90,
+		AccessLogFormat:              "text",
+		LogLevel:                     LogLevelInfo,
+		UnknownPrefixBehavior:        UnknownPrefixPassthrough,
+		TemplateSelectionPriority:    TemplateSelectionHeader,
+		BackendAuthFailure:           BackendAuthFailurePassthrough,
+		LogRequests:                  true,
+		MetricsNamespace:             "bioproxy",
+		MaxTrackedEndpoints:          100,
+		MetricsSnapshotInterval:      60,
+		ShutdownTimeout:              25,
+		StateMode:                    StateModeLocal,
+		StickyPrefixMaxConversations: 1000,
+		PrefixCheckRoles:             []string{"user"},
+		Prefixes:                     make(map[string]PrefixConfig),
 	}
 }
 
+// configFetchTimeout bounds how long fetching a config from a URL may take
+const configFetchTimeout = 30 * time.Second
+
 // LoadConfig loads configuration from a JSON file
 // It starts with default values and overrides them with values from the file
 func LoadConfig(configPath string) (*Config, error) {
-	// Start with defaults
-	cfg := DefaultConfig()
-
 	// If config file doesn't exist, return defaults
 	// This allows running without a config file
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return cfg, nil
+		return DefaultConfig(), nil
 	}
 
 	// Read the config file
@@ -77,11 +1242,324 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	return parseConfig(data)
+}
+
+// LoadConfigFrom loads configuration from a file path, stdin or a URL
+// Supported sources:
+//   - "-": read JSON from stdin
+//   - "http://..." or "https://...": fetch JSON over HTTP (with a timeout)
+//   - anything else: file path, same as LoadConfig
+//
+// Defaults are applied for all sources, values from the source override them
+func LoadConfigFrom(source string) (*Config, error) {
+	switch {
+	case source == "-":
+		return LoadConfigFromReader(os.Stdin)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		return loadConfigFromURL(source)
+	default:
+		return LoadConfig(source)
+	}
+}
+
+// LoadConfigFromReader loads configuration JSON from r
+// It starts with default values and overrides them with values from the reader
+func LoadConfigFromReader(r io.Reader) (*Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return parseConfig(data)
+}
+
+// loadConfigFromURL fetches configuration JSON from an HTTP(S) URL
+func loadConfigFromURL(url string) (*Config, error) {
+	client := &http.Client{Timeout: configFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config from %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch config from %s: unexpected status %d", url, resp.StatusCode)
+	}
+
+	return LoadConfigFromReader(resp.Body)
+}
+
+// addTemplateDir registers every *.txt file in TemplateDir as "@<basename>",
+// unless the prefix is already configured explicitly
+func (c *Config) addTemplateDir() error {
+	if _, err := os.Stat(c.TemplateDir); err != nil {
+		return fmt.Errorf("invalid template_dir: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(c.TemplateDir, "*.txt"))
+	if err != nil {
+		return fmt.Errorf("invalid template_dir %q: %w", c.TemplateDir, err)
+	}
+
+	if c.Prefixes == nil {
+		c.Prefixes = make(map[string]PrefixConfig)
+	}
+	for _, path := range paths {
+		prefix := "@" + strings.TrimSuffix(filepath.Base(path), ".txt")
+		if _, exists := c.Prefixes[prefix]; exists {
+			continue
+		}
+		c.Prefixes[prefix] = PrefixConfig{Path: path, FromTemplateDir: true}
+	}
+	return nil
+}
+
+// normalizePrefixes trims surrounding whitespace from prefix keys, which
+// would otherwise never match (messages are matched on prefix + " "), and
+// warns about prefixes that don't start with "@"
+func (c *Config) normalizePrefixes() error {
+	for prefix, prefixCfg := range c.Prefixes {
+		trimmed := strings.TrimSpace(prefix)
+		if trimmed == prefix {
+			continue
+		}
+		if trimmed == "" {
+			return fmt.Errorf("invalid prefix %q (empty after trimming whitespace)", prefix)
+		}
+		if _, exists := c.Prefixes[trimmed]; exists {
+			return fmt.Errorf("prefix %q duplicates %q after trimming whitespace", prefix, trimmed)
+		}
+		log.Printf("WARNING: Prefix %q has surrounding whitespace, using %q", prefix, trimmed)
+		delete(c.Prefixes, prefix)
+		c.Prefixes[trimmed] = prefixCfg
+	}
+	for prefix := range c.Prefixes {
+		if !strings.HasPrefix(prefix, "@") {
+			log.Printf("WARNING: Prefix %q does not start with @", prefix)
+		}
+	}
+	return nil
+}
+
+// metricsNamespacePattern matches valid Prometheus metric name prefixes
+var metricsNamespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseConfig parses JSON configuration data on top of the defaults
+func parseConfig(data []byte) (*Config, error) {
+	// Start with defaults
+	cfg := DefaultConfig()
+
 	// Parse JSON and override defaults
 	if err := json.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config JSON: %w", err)
 	}
 
+	if cfg.AccessLogFormat != "text" && cfg.AccessLogFormat != "json" {
+		return nil, fmt.Errorf("invalid access_log_format %q (expected \"text\" or \"json\")", cfg.AccessLogFormat)
+	}
+
+	if (cfg.AdminBasicUser == "") != (cfg.AdminBasicPassword == "") {
+		return nil, fmt.Errorf("admin_basic_user and admin_basic_password must be set together")
+	}
+
+	for i, method := range cfg.AllowedMethods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			return nil, fmt.Errorf("allowed_methods has an empty entry")
+		}
+		cfg.AllowedMethods[i] = method
+	}
+
+	if cfg.LogLevel != LogLevelInfo && cfg.LogLevel != LogLevelDebug {
+		return nil, fmt.Errorf("invalid log_level %q (expected \"info\" or \"debug\")", cfg.LogLevel)
+	}
+
+	if cfg.UnknownPrefixBehavior != UnknownPrefixPassthrough && cfg.UnknownPrefixBehavior != UnknownPrefixError {
+		return nil, fmt.Errorf("invalid unknown_prefix_behavior %q (expected \"passthrough\" or \"error\")", cfg.UnknownPrefixBehavior)
+	}
+
+	if cfg.TemplateSelectionPriority != TemplateSelectionHeader && cfg.TemplateSelectionPriority != TemplateSelectionMessage {
+		return nil, fmt.Errorf("invalid template_selection_priority %q (expected \"header\" or \"message\")", cfg.TemplateSelectionPriority)
+	}
+
+	if cfg.BackendAuthFailure != BackendAuthFailurePassthrough && cfg.BackendAuthFailure != BackendAuthFailureError {
+		return nil, fmt.Errorf("invalid backend_auth_failure %q (expected \"passthrough\" or \"error\")", cfg.BackendAuthFailure)
+	}
+
+	// A token that can't be sent as a header would fail every request with
+	// a generic error, reject it upfront instead of forwarding without auth
+	if strings.ContainsAny(cfg.BackendAuthToken, "\r\n") {
+		return nil, fmt.Errorf("invalid backend_auth_token (must not contain line breaks)")
+	}
+
+	if cfg.BackendPathPrefix != "" {
+		if strings.ContainsAny(cfg.BackendPathPrefix, "?#") {
+			return nil, fmt.Errorf("invalid backend_path_prefix %q (expected a path without query or fragment)", cfg.BackendPathPrefix)
+		}
+		// "llm", "/llm/" and "/llm" all mean /llm; "/" means no prefix
+		cfg.BackendPathPrefix = strings.TrimSuffix("/"+strings.Trim(cfg.BackendPathPrefix, "/"), "/")
+	}
+
+	if _, err := cfg.BackendTransport(); err != nil {
+		return nil, err
+	}
+
+	if cfg.SSEHeartbeatInterval < 0 {
+		return nil, fmt.Errorf("invalid sse_heartbeat_interval %d (must not be negative)", cfg.SSEHeartbeatInterval)
+	}
+
+	if cfg.MaxTokensCap < 0 {
+		return nil, fmt.Errorf("invalid max_tokens_cap %d (must not be negative)", cfg.MaxTokensCap)
+	}
+
+	if cfg.SlotIdleEvictSeconds < 0 {
+		return nil, fmt.Errorf("invalid slot_idle_evict_seconds %d (must not be negative)", cfg.SlotIdleEvictSeconds)
+	}
+
+	if cfg.MaxTemplateFileBytes < 0 {
+		return nil, fmt.Errorf("invalid max_template_file_bytes %d (must not be negative)", cfg.MaxTemplateFileBytes)
+	}
+
+	if cfg.SaveEveryNRequests < 0 {
+		return nil, fmt.Errorf("invalid save_every_n_requests %d (must not be negative)", cfg.SaveEveryNRequests)
+	}
+
+	if cfg.MaxConcurrentUserQueries < 0 {
+		return nil, fmt.Errorf("invalid max_concurrent_user_queries %d (must not be negative)", cfg.MaxConcurrentUserQueries)
+	}
+
+	if cfg.MaxExpansionBytes < 0 {
+		return nil, fmt.Errorf("invalid max_expansion_bytes %d (must not be negative)", cfg.MaxExpansionBytes)
+	}
+
+	if cfg.MinWarmupInterval < 0 {
+		return nil, fmt.Errorf("invalid min_warmup_interval %d (must not be negative)", cfg.MinWarmupInterval)
+	}
+
+	if cfg.WarmupStopTimeout <= 0 {
+		return nil, fmt.Errorf("invalid warmup_stop_timeout %d (must be positive)", cfg.WarmupStopTimeout)
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		return nil, fmt.Errorf("invalid shutdown_timeout %d (must be positive)", cfg.ShutdownTimeout)
+	}
+
+	if cfg.GRPCHealthPort < 0 || cfg.GRPCHealthPort > 65535 {
+		return nil, fmt.Errorf("invalid grpc_health_port %d", cfg.GRPCHealthPort)
+	}
+
+	if cfg.MaxTrackedEndpoints < 0 {
+		return nil, fmt.Errorf("invalid max_tracked_endpoints %d (must not be negative)", cfg.MaxTrackedEndpoints)
+	}
+
+	if cfg.MetricsSnapshotFile != "" && cfg.MetricsSnapshotInterval <= 0 {
+		return nil, fmt.Errorf("invalid metrics_snapshot_interval %d (must be positive)", cfg.MetricsSnapshotInterval)
+	}
+
+	if !metricsNamespacePattern.MatchString(cfg.MetricsNamespace) {
+		return nil, fmt.Errorf("invalid metrics_namespace %q (letters, digits and underscores, not starting with a digit)", cfg.MetricsNamespace)
+	}
+
+	if err := cfg.ProxyTimeouts.validate("proxy_timeouts"); err != nil {
+		return nil, err
+	}
+	if err := cfg.AdminTimeouts.validate("admin_timeouts"); err != nil {
+		return nil, err
+	}
+
+	switch cfg.StateMode {
+	case StateModeLocal:
+	case StateModeSharedFile:
+		if cfg.StateFile == "" {
+			return nil, fmt.Errorf("state_mode %q requires state_file", cfg.StateMode)
+		}
+	default:
+		return nil, fmt.Errorf("invalid state_mode %q (expected \"local\" or \"shared-file\")", cfg.StateMode)
+	}
+
+	switch cfg.WarmupRequestFormat {
+	case "", WarmupFormatChat, WarmupFormatPrompt:
+	default:
+		return nil, fmt.Errorf("invalid warmup_request_format %q (expected \"chat\" or \"prompt\")", cfg.WarmupRequestFormat)
+	}
+
+	if cfg.WarmupUsageWeighted && (cfg.WarmupMinInterval <= 0 || cfg.WarmupMaxInterval < cfg.WarmupMinInterval) {
+		return nil, fmt.Errorf("invalid warmup intervals: warmup_min_interval (%d) must be positive and at most warmup_max_interval (%d)", cfg.WarmupMinInterval, cfg.WarmupMaxInterval)
+	}
+
+	if err := cfg.normalizePrefixes(); err != nil {
+		return nil, err
+	}
+
+	if cfg.TemplateDir != "" {
+		if err := cfg.addTemplateDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	for prefix, prefixCfg := range cfg.Prefixes {
+		switch prefixCfg.Position {
+		case "", PositionInplace, PositionPrependSystem, PositionPrependUser:
+		default:
+			return nil, fmt.Errorf("invalid position %q for prefix %s", prefixCfg.Position, prefix)
+		}
+		switch prefixCfg.Warmup {
+		case "", WarmupEager, WarmupLazy:
+		default:
+			return nil, fmt.Errorf("invalid warmup %q for prefix %s (expected \"eager\" or \"lazy\")", prefixCfg.Warmup, prefix)
+		}
+		if prefixCfg.Inline != "" && (prefixCfg.Path != "" || len(prefixCfg.Variants) > 0) {
+			return nil, fmt.Errorf("prefix %s has both inline and a path or variants", prefix)
+		}
+		if slices.Contains(prefixCfg.Includes, "") {
+			return nil, fmt.Errorf("prefix %s has an empty includes entry", prefix)
+		}
+		if _, exists := prefixCfg.RequestOverrides["messages"]; exists {
+			return nil, fmt.Errorf("prefix %s request_overrides can't override messages", prefix)
+		}
+		if prefixCfg.ToolsFile != "" {
+			tools, err := loadToolsFile(prefixCfg.ToolsFile)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tools_file for prefix %s: %w", prefix, err)
+			}
+			prefixCfg.Tools = tools
+			cfg.Prefixes[prefix] = prefixCfg
+		}
+		if prefixCfg.Backend != "" {
+			if u, err := url.Parse(prefixCfg.Backend); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("invalid backend %q for prefix %s (expected an http:// or https:// URL)", prefixCfg.Backend, prefix)
+			}
+		}
+	}
+
+	if err := cfg.checkDependencies(); err != nil {
+		return nil, err
+	}
+
+	seenBackends := make(map[string]bool)
+	for i, backend := range cfg.Backends {
+		backend.URL = strings.TrimSuffix(backend.URL, "/")
+		if u, err := url.Parse(backend.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid backends URL %q (expected an http:// or https:// URL)", backend.URL)
+		}
+		if seenBackends[backend.URL] {
+			return nil, fmt.Errorf("duplicate backends URL %q", backend.URL)
+		}
+		seenBackends[backend.URL] = true
+		if backend.Weight <= 0 {
+			backend.Weight = 1
+		}
+		cfg.Backends[i] = backend
+	}
+	if len(cfg.Backends) > 0 && cfg.BackendHealthCheckInterval <= 0 {
+		return nil, fmt.Errorf("invalid backend_health_check_interval %d (must be positive)", cfg.BackendHealthCheckInterval)
+	}
+
+	for _, window := range cfg.WarmupWindows {
+		if _, _, err := window.parse(); err != nil {
+			return nil, err
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -1,9 +1,15 @@
 package config
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestDefaultConfig verifies that DefaultConfig returns expected defaults
@@ -88,12 +94,12 @@ func TestLoadConfigValid(t *testing.T) {
 		t.Errorf("Expected 2 prefixes, got %d", len(cfg.Prefixes))
 	}
 
-	if cfg.Prefixes["@test"] != "/tmp/test.txt" {
-		t.Errorf("Expected @test -> /tmp/test.txt, got %s", cfg.Prefixes["@test"])
+	if cfg.Prefixes["@test"].Path != "/tmp/test.txt" {
+		t.Errorf("Expected @test -> /tmp/test.txt, got %s", cfg.Prefixes["@test"].Path)
 	}
 
-	if cfg.Prefixes["@code"] != "/tmp/code.txt" {
-		t.Errorf("Expected @code -> /tmp/code.txt, got %s", cfg.Prefixes["@code"])
+	if cfg.Prefixes["@code"].Path != "/tmp/code.txt" {
+		t.Errorf("Expected @code -> /tmp/code.txt, got %s", cfg.Prefixes["@code"].Path)
 	}
 }
 
@@ -149,8 +155,8 @@ func TestLoadConfigWithProxySettings(t *testing.T) {
 		t.Errorf("Expected 1 prefix, got %d", len(cfg.Prefixes))
 	}
 
-	if cfg.Prefixes["@custom"] != "/path/to/template.txt" {
-		t.Errorf("Expected @custom -> /path/to/template.txt, got %s", cfg.Prefixes["@custom"])
+	if cfg.Prefixes["@custom"].Path != "/path/to/template.txt" {
+		t.Errorf("Expected @custom -> /path/to/template.txt, got %s", cfg.Prefixes["@custom"].Path)
 	}
 }
 
@@ -211,6 +217,319 @@ func TestLoadConfigInvalidJSON(t *testing.T) {
 	}
 }
 
+// TestLoadConfigFromReader tests loading config from an in-memory reader
+func TestLoadConfigFromReader(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{
+		"proxy_port": 7000,
+		"prefixes": {"@code": "/tmp/code.txt"}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+
+	if cfg.ProxyPort != 7000 {
+		t.Errorf("Expected ProxyPort 7000, got %d", cfg.ProxyPort)
+	}
+	if cfg.Prefixes["@code"].Path != "/tmp/code.txt" {
+		t.Errorf("Expected @code -> /tmp/code.txt, got %s", cfg.Prefixes["@code"].Path)
+	}
+
+	// Defaults are preserved for fields not in the source
+	if cfg.AdminPort != 8089 {
+		t.Errorf("Expected default AdminPort 8089, got %d", cfg.AdminPort)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader("not json")); err == nil {
+		t.Error("Expected error for invalid JSON")
+	}
+}
+
+// TestLoadConfigFromURL tests fetching config from an HTTP server
+func TestLoadConfigFromURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"backend_url": "http://remote-llama:8081"}`))
+	}))
+	defer server.Close()
+
+	cfg, err := LoadConfigFrom(server.URL + "/config.json")
+	if err != nil {
+		t.Fatalf("LoadConfigFrom failed: %v", err)
+	}
+
+	if cfg.BackendURL != "http://remote-llama:8081" {
+		t.Errorf("Expected BackendURL 'http://remote-llama:8081', got %q", cfg.BackendURL)
+	}
+	if cfg.ProxyPort != 8088 {
+		t.Errorf("Expected default ProxyPort 8088, got %d", cfg.ProxyPort)
+	}
+
+	// Non-200 responses are errors, not silently defaulted
+	if _, err := LoadConfigFrom(server.URL + "/missing.json"); err == nil {
+		t.Error("Expected error for 404 config URL")
+	}
+}
+
+// TestWarmupWindows tests warmup window parsing and time-of-day matching
+func TestWarmupWindows(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{
+		"warmup_windows": [{"start": "02:00", "end": "05:00"}, {"start": "23:00", "end": "01:00"}]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2025, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		t        time.Time
+		expected bool
+	}{
+		{at(1, 59), false},
+		{at(2, 0), true},
+		{at(4, 59), true},
+		{at(5, 0), false},
+		{at(14, 0), false},
+		{at(23, 30), true}, // Window spanning midnight
+		{at(0, 30), true},
+	}
+	for _, tt := range tests {
+		if got := cfg.InWarmupWindow(tt.t); got != tt.expected {
+			t.Errorf("InWarmupWindow(%s) = %v, expected %v", tt.t.Format("15:04"), got, tt.expected)
+		}
+	}
+
+	// No windows configured - always allowed
+	if !DefaultConfig().InWarmupWindow(at(14, 0)) {
+		t.Error("Expected warmups to be allowed when no windows are configured")
+	}
+
+	// Invalid window is rejected at load time
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"warmup_windows": [{"start": "2am", "end": "05:00"}]}`)); err == nil {
+		t.Error("Expected error for invalid warmup window")
+	}
+}
+
+// TestAccessLogFormat tests access log format defaults and validation
+func TestAccessLogFormat(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.AccessLogFormat != "text" {
+		t.Errorf("Expected default AccessLogFormat text, got %q", cfg.AccessLogFormat)
+	}
+
+	cfg, err = LoadConfigFromReader(strings.NewReader(`{"access_log_format": "json"}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.AccessLogFormat != "json" {
+		t.Errorf("Expected AccessLogFormat json, got %q", cfg.AccessLogFormat)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"access_log_format": "xml"}`)); err == nil {
+		t.Error("Expected error for unknown access log format")
+	}
+}
+
+// TestLogLevel tests log level defaults and validation
+func TestLogLevel(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.LogLevel != LogLevelInfo {
+		t.Errorf("Expected default LogLevel info, got %q", cfg.LogLevel)
+	}
+
+	cfg, err = LoadConfigFromReader(strings.NewReader(`{"log_level": "debug"}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.LogLevel != LogLevelDebug {
+		t.Errorf("Expected LogLevel debug, got %q", cfg.LogLevel)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"log_level": "trace"}`)); err == nil {
+		t.Error("Expected error for unknown log level")
+	}
+}
+
+// TestUnknownPrefixBehavior tests the default and validation of unknown_prefix_behavior
+func TestUnknownPrefixBehavior(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.UnknownPrefixBehavior != UnknownPrefixPassthrough {
+		t.Errorf("Expected default UnknownPrefixBehavior passthrough, got %q", cfg.UnknownPrefixBehavior)
+	}
+
+	cfg, err = LoadConfigFromReader(strings.NewReader(`{"unknown_prefix_behavior": "error"}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.UnknownPrefixBehavior != UnknownPrefixError {
+		t.Errorf("Expected UnknownPrefixBehavior error, got %q", cfg.UnknownPrefixBehavior)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"unknown_prefix_behavior": "ignore"}`)); err == nil {
+		t.Error("Expected error for unknown unknown_prefix_behavior")
+	}
+}
+
+// TestTemplateSelectionPriority tests the default and validation of template_selection_priority
+func TestTemplateSelectionPriority(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.TemplateSelectionPriority != TemplateSelectionHeader {
+		t.Errorf("Expected default TemplateSelectionPriority header, got %q", cfg.TemplateSelectionPriority)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"template_selection_priority": "message"}`)); err != nil {
+		t.Errorf("Expected message priority to be valid, got %v", err)
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"template_selection_priority": "model"}`)); err == nil {
+		t.Error("Expected error for unknown template_selection_priority")
+	}
+}
+
+// TestBackendAuthFailure tests the default and validation of BackendAuthFailure
+// and that unsendable backend tokens are rejected
+func TestBackendAuthFailure(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.BackendAuthFailure != BackendAuthFailurePassthrough {
+		t.Errorf("Expected default BackendAuthFailure passthrough, got %q", cfg.BackendAuthFailure)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"backend_auth_failure": "error"}`)); err != nil {
+		t.Errorf("Expected error mode to be valid, got %v", err)
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"backend_auth_failure": "retry"}`)); err == nil {
+		t.Error("Expected error for unknown backend_auth_failure")
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"backend_auth_token": "secret\nX-Injected: 1"}`)); err == nil {
+		t.Error("Expected error for backend_auth_token with a line break")
+	}
+}
+
+// TestBackends tests parsing and validation of the backend pool
+func TestBackends(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{
+		"backends": [{"url": "http://gpu1:8081/", "weight": 2}, {"url": "http://gpu2:8081"}]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	expected := []BackendConfig{{URL: "http://gpu1:8081", Weight: 2}, {URL: "http://gpu2:8081", Weight: 1}}
+	if !reflect.DeepEqual(cfg.Backends, expected) {
+		t.Errorf("Expected backends %v, got %v", expected, cfg.Backends)
+	}
+	if cfg.BackendHealthCheckInterval != 5 {
+		t.Errorf("Expected default BackendHealthCheckInterval 5, got %d", cfg.BackendHealthCheckInterval)
+	}
+
+	invalid := []string{
+		`{"backends": [{"url": "gpu1:8081"}]}`,
+		`{"backends": [{"url": "http://gpu1:8081"}, {"url": "http://gpu1:8081/"}]}`,
+		`{"backends": [{"url": "http://gpu1:8081"}], "backend_health_check_interval": 0}`,
+	}
+	for _, data := range invalid {
+		if _, err := LoadConfigFromReader(strings.NewReader(data)); err == nil {
+			t.Errorf("Expected error for %s", data)
+		}
+	}
+}
+
+// TestAdminBasicAuthConfig tests that basic auth user and password are
+// required together
+func TestAdminBasicAuthConfig(t *testing.T) {
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"admin_basic_user": "ops", "admin_basic_password": "s3cret"}`)); err != nil {
+		t.Errorf("Expected user and password to be accepted: %v", err)
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"admin_basic_user": "ops"}`)); err == nil {
+		t.Error("Expected error for a user without a password")
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"admin_basic_password": "s3cret"}`)); err == nil {
+		t.Error("Expected error for a password without a user")
+	}
+}
+
+// TestPrefixPosition tests parsing and validation of the per-prefix position
+func TestPrefixPosition(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{
+		"prefixes": {"@code": {"path": "/tmp/code.txt", "position": "prepend-system"}}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.Prefixes["@code"].Position != PositionPrependSystem {
+		t.Errorf("Expected position prepend-system, got %q", cfg.Prefixes["@code"].Position)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{
+		"prefixes": {"@code": {"path": "/tmp/code.txt", "position": "append"}}
+	}`)); err == nil {
+		t.Error("Expected error for unknown position")
+	}
+}
+
+// TestWarmupFormat tests deriving the warmup request format from the endpoint
+func TestWarmupFormat(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		format   string
+		expected string
+	}{
+		{"", "", WarmupFormatChat},
+		{"/v1/chat/completions", "", WarmupFormatChat},
+		{"/completion", "", WarmupFormatPrompt},
+		{"/v1/completions", "", WarmupFormatPrompt},
+		{"/completion", WarmupFormatChat, WarmupFormatChat},
+	}
+	for _, tt := range tests {
+		cfg := &Config{WarmupEndpoint: tt.endpoint, WarmupRequestFormat: tt.format}
+		if got := cfg.WarmupFormat(); got != tt.expected {
+			t.Errorf("WarmupFormat(%q, %q) = %q, expected %q", tt.endpoint, tt.format, got, tt.expected)
+		}
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"warmup_request_format": "raw"}`)); err == nil {
+		t.Error("Expected error for unknown warmup request format")
+	}
+}
+
+// TestMetricsNamespace tests the metrics namespace default and validation
+func TestMetricsNamespace(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"metrics_namespace": "bioproxy_dev"}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.MetricsNamespace != "bioproxy_dev" {
+		t.Errorf("Expected namespace bioproxy_dev, got %q", cfg.MetricsNamespace)
+	}
+	if DefaultConfig().MetricsNamespace != "bioproxy" {
+		t.Errorf("Expected default namespace bioproxy, got %q", DefaultConfig().MetricsNamespace)
+	}
+
+	for _, invalid := range []string{"", "1bioproxy", "bio-proxy"} {
+		body := fmt.Sprintf(`{"metrics_namespace": %q}`, invalid)
+		if _, err := LoadConfigFromReader(strings.NewReader(body)); err == nil {
+			t.Errorf("Expected error for namespace %q", invalid)
+		}
+	}
+}
+
 // TestDefaultConfigPath verifies the default config path format
 func TestDefaultConfigPath(t *testing.T) {
 	path := DefaultConfigPath()
@@ -237,3 +556,488 @@ func endsWithPath(path, suffix string) bool {
 	return filepath.Base(path) == filepath.Base(suffix) &&
 		filepath.Base(filepath.Dir(path)) == filepath.Base(filepath.Dir(suffix))
 }
+
+// TestPrefixBackend tests per-prefix backend parsing, validation and lookup
+func TestPrefixBackend(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{
+		"backend_url": "http://localhost:8081",
+		"prefixes": {
+			"@bigcontext": {"path": "/tmp/big.txt", "backend": "http://big-gpu:8081"},
+			"@ab": {"variants": [{"path": "/tmp/a.txt"}, {"path": "/tmp/b.txt"}], "backend": "http://quick:8081"},
+			"@code": "/tmp/code.txt"
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"@bigcontext", "http://big-gpu:8081"},
+		{"@code", "http://localhost:8081"},
+		{"@ab.v2", "http://quick:8081"},
+		{"@unknown", "http://localhost:8081"},
+	}
+	for _, tt := range tests {
+		if got := cfg.BackendForTemplate(tt.key); got != tt.expected {
+			t.Errorf("BackendForTemplate(%q) = %q, expected %q", tt.key, got, tt.expected)
+		}
+	}
+	if got := cfg.BackendFor("@bigcontext"); got != "http://big-gpu:8081" {
+		t.Errorf("BackendFor(@bigcontext) = %q, expected http://big-gpu:8081", got)
+	}
+
+	for _, backend := range []string{"big-gpu:8081", "ftp://big-gpu", "http://", "://bad"} {
+		_, err := LoadConfigFromReader(strings.NewReader(`{
+			"prefixes": {"@code": {"path": "/tmp/code.txt", "backend": "` + backend + `"}}
+		}`))
+		if err == nil {
+			t.Errorf("Expected error for invalid backend %q", backend)
+		}
+	}
+}
+
+// TestStateMode tests parsing and validation of the state mode
+func TestStateMode(t *testing.T) {
+	if DefaultConfig().StateMode != StateModeLocal {
+		t.Errorf("Expected default state mode local, got %q", DefaultConfig().StateMode)
+	}
+
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"state_mode": "shared-file", "state_file": "/tmp/bioproxy.state"}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.StateMode != StateModeSharedFile || cfg.StateFile != "/tmp/bioproxy.state" {
+		t.Errorf("Expected shared-file mode with state file, got %q / %q", cfg.StateMode, cfg.StateFile)
+	}
+
+	for _, invalid := range []string{`{"state_mode": "shared-file"}`, `{"state_mode": "redis"}`} {
+		if _, err := LoadConfigFromReader(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected error for %s", invalid)
+		}
+	}
+}
+
+// TestTemplateDir tests deriving prefixes from a template directory
+func TestTemplateDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"review.txt", "code.txt", "notes.md"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("<{message}>"), 0644)
+	}
+
+	body := fmt.Sprintf(`{"template_dir": %q, "prefixes": {"@code": "/explicit/code.txt"}}`, dir)
+	cfg, err := LoadConfigFromReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+
+	if len(cfg.Prefixes) != 2 {
+		t.Errorf("Expected 2 prefixes, got %v", cfg.Prefixes)
+	}
+	if got := cfg.Prefixes["@review"].Path; got != filepath.Join(dir, "review.txt") {
+		t.Errorf("Expected derived @review prefix, got %q", got)
+	}
+	if got := cfg.Prefixes["@code"].Path; got != "/explicit/code.txt" {
+		t.Errorf("Expected explicit @code to win, got %q", got)
+	}
+	if refs := cfg.Prefixes["@review"].Templates("@review"); !refs[0].FromTemplateDir {
+		t.Error("Expected @review to be marked as found in template_dir")
+	}
+	if refs := cfg.Prefixes["@code"].Templates("@code"); refs[0].FromTemplateDir {
+		t.Error("Expected explicit @code not to be marked as found in template_dir")
+	}
+
+	body = fmt.Sprintf(`{"template_dir": %q}`, filepath.Join(dir, "missing"))
+	if _, err := LoadConfigFromReader(strings.NewReader(body)); err == nil {
+		t.Error("Expected error for missing template_dir")
+	}
+}
+
+// TestPrefixWhitespace tests that padded prefix keys are trimmed
+func TestPrefixWhitespace(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"@code ": "/templates/code.txt", "debug": "/templates/debug.txt"}}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if got := cfg.Prefixes["@code"].Path; got != "/templates/code.txt" {
+		t.Errorf("Expected \"@code \" to be trimmed to @code, got prefixes %v", cfg.Prefixes)
+	}
+	if _, ok := cfg.Prefixes["@code "]; ok {
+		t.Error("Expected padded prefix key to be removed")
+	}
+	// Prefixes without @ are only warned about
+	if _, ok := cfg.Prefixes["debug"]; !ok {
+		t.Error("Expected prefix without @ to be kept")
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"@code": "/a.txt", " @code": "/b.txt"}}`)); err == nil {
+		t.Error("Expected error for prefixes equal after trimming")
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"  ": "/a.txt"}}`)); err == nil {
+		t.Error("Expected error for blank prefix")
+	}
+}
+
+// TestPrefixWarmup tests parsing and validation of the per-prefix warmup mode
+func TestPrefixWarmup(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {
+		"@lazy": {"path": "/lazy.txt", "warmup": "lazy"},
+		"@ab": {"variants": [{"name": "a", "path": "/a.txt"}], "warmup": "lazy"},
+		"@code": "/code.txt"
+	}}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if !cfg.LazyWarmup("@lazy") || !cfg.LazyWarmup("@ab.a") {
+		t.Error("Expected lazy prefixes and their variants to warm up lazily")
+	}
+	if cfg.LazyWarmup("@code") || cfg.LazyWarmup("@unknown") {
+		t.Error("Expected eager warmup by default")
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"@code": {"path": "/code.txt", "warmup": "sometimes"}}}`)); err == nil {
+		t.Error("Expected error for invalid warmup mode")
+	}
+}
+
+// TestCacheKeyFor tests resolving the cache key of templates
+func TestCacheKeyFor(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {
+		"@review": {"path": "/review.txt", "cache_key": "code"},
+		"@ab": {"variants": [{"name": "a", "path": "/a.txt"}], "cache_key": "code"},
+		"@debug": "/debug.txt"
+	}}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	for key, expected := range map[string]string{"@review": "code", "@ab.a": "code", "@debug": "@debug", "": ""} {
+		if got := cfg.CacheKeyFor(key); got != expected {
+			t.Errorf("Expected cache key %q for %q, got %q", expected, key, got)
+		}
+	}
+}
+
+// TestPrefixInline tests parsing and validation of inline templates
+func TestPrefixInline(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"@help": {"inline": "You are a helper. <{message}>"}}}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	refs := cfg.Prefixes["@help"].Templates("@help")
+	if len(refs) != 1 || refs[0].Inline != "You are a helper. <{message}>" || refs[0].Path != "" {
+		t.Errorf("Expected one inline template, got %+v", refs)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"@help": {"inline": "x", "path": "/tmp/x.txt"}}}`)); err == nil {
+		t.Error("Expected error for inline together with path")
+	}
+}
+
+// TestRequestOverrides tests parsing of per-prefix request overrides
+func TestRequestOverrides(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {
+		"@det": {"path": "/det.txt", "request_overrides": {"temperature": 0, "grammar": {"root": "x"}}, "force_overrides": true}
+	}}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	prefixCfg := cfg.Prefixes["@det"]
+	expected := map[string]interface{}{"temperature": float64(0), "grammar": map[string]interface{}{"root": "x"}}
+	if !reflect.DeepEqual(prefixCfg.RequestOverrides, expected) || !prefixCfg.ForceOverrides {
+		t.Errorf("Expected forced overrides %v, got %v (force: %v)", expected, prefixCfg.RequestOverrides, prefixCfg.ForceOverrides)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"@det": {"path": "/det.txt", "request_overrides": {"messages": []}}}}`)); err == nil {
+		t.Error("Expected error for overriding messages")
+	}
+}
+
+// TestBackendPathPrefix tests normalization of BackendPathPrefix and the
+// paths and URLs built from it
+func TestBackendPathPrefix(t *testing.T) {
+	for _, prefix := range []string{"/llm", "llm", "/llm/", "llm/"} {
+		cfg, err := LoadConfigFromReader(strings.NewReader(fmt.Sprintf(`{"backend_path_prefix": %q}`, prefix)))
+		if err != nil {
+			t.Fatalf("LoadConfigFromReader failed for %q: %v", prefix, err)
+		}
+		if cfg.BackendPathPrefix != "/llm" {
+			t.Errorf("Expected %q to be normalized to /llm, got %q", prefix, cfg.BackendPathPrefix)
+		}
+		if path := cfg.BackendPath("/v1/chat/completions"); path != "/llm/v1/chat/completions" {
+			t.Errorf("Expected /llm/v1/chat/completions, got %s", path)
+		}
+		if url := cfg.BackendBaseURL("http://gw/"); url != "http://gw/llm" {
+			t.Errorf("Expected http://gw/llm, got %s", url)
+		}
+	}
+
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"backend_path_prefix": "/"}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.BackendPathPrefix != "" || cfg.BackendPath("/slots/0") != "/slots/0" {
+		t.Errorf("Expected / to mean no prefix, got %q", cfg.BackendPathPrefix)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"backend_path_prefix": "/llm?x=1"}`)); err == nil {
+		t.Error("Expected error for a backend_path_prefix with a query")
+	}
+}
+
+// TestMaxConcurrentUserQueries tests validation of MaxConcurrentUserQueries
+func TestMaxConcurrentUserQueries(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"max_concurrent_user_queries": 4}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.MaxConcurrentUserQueries != 4 {
+		t.Errorf("Expected MaxConcurrentUserQueries 4, got %d", cfg.MaxConcurrentUserQueries)
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"max_concurrent_user_queries": -1}`)); err == nil {
+		t.Error("Expected error for a negative max_concurrent_user_queries")
+	}
+}
+
+// TestMaxExpansionBytes tests parsing and validation of MaxExpansionBytes
+func TestMaxExpansionBytes(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"max_expansion_bytes": 1048576}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.MaxExpansionBytes != 1048576 {
+		t.Errorf("Expected MaxExpansionBytes 1048576, got %d", cfg.MaxExpansionBytes)
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"max_expansion_bytes": -1}`)); err == nil {
+		t.Error("Expected error for a negative max_expansion_bytes")
+	}
+}
+
+// TestBackendTLSCACert tests that the backend CA file is checked at load time
+func TestBackendTLSCACert(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	for _, path := range []string{notPEM, filepath.Join(dir, "missing.pem")} {
+		if _, err := LoadConfigFromReader(strings.NewReader(fmt.Sprintf(`{"backend_tls_ca_cert": %q}`, path))); err == nil {
+			t.Errorf("Expected error for backend_tls_ca_cert %s", path)
+		}
+	}
+
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"backend_tls_insecure_skip_verify": true}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	transport, err := cfg.BackendTransport()
+	if err != nil {
+		t.Fatalf("BackendTransport failed: %v", err)
+	}
+	if transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("Expected InsecureSkipVerify, got %+v", transport.TLSClientConfig)
+	}
+}
+
+// TestToolsFile tests loading and validation of per-prefix tool definitions
+func TestToolsFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTools := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write tools file: %v", err)
+		}
+		return path
+	}
+	loadWithTools := func(path string) (*Config, error) {
+		return LoadConfigFromReader(strings.NewReader(fmt.Sprintf(`{"prefixes": {"@agent": {"path": "/agent.txt", "tools_file": %q}}}`, path)))
+	}
+
+	path := writeTools("tools.json", `[{"type": "function", "function": {"name": "search", "parameters": {"type": "object"}}}]`)
+	cfg, err := loadWithTools(path)
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	tools := cfg.Prefixes["@agent"].Tools
+	if len(tools) != 1 || tools[0]["function"].(map[string]interface{})["name"] != "search" {
+		t.Errorf("Expected the search tool, got %v", tools)
+	}
+
+	invalid := map[string]string{
+		"not an array":  `{"type": "function"}`,
+		"no name":       `[{"type": "function", "function": {}}]`,
+		"duplicate":     `[{"function": {"name": "a"}}, {"function": {"name": "a"}}]`,
+		"malformed":     `[{"function": `,
+		"not an object": `["search"]`,
+	}
+	for name, content := range invalid {
+		if _, err := loadWithTools(writeTools(strings.ReplaceAll(name, " ", "_")+".json", content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := loadWithTools(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected error for a missing tools_file")
+	}
+}
+
+// TestToolsFor tests that an edited tools file is re-read, while an invalid
+// edit keeps the last valid tools
+func TestToolsFor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tools.json")
+	os.WriteFile(path, []byte(`[{"type": "function", "function": {"name": "search"}}]`), 0644)
+	cfg, err := LoadConfigFromReader(strings.NewReader(fmt.Sprintf(`{"prefixes": {"@agent": {"path": "/agent.txt", "tools_file": %q}}}`, path)))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	toolName := func() interface{} {
+		tools := cfg.ToolsForTemplate("@agent")
+		if len(tools) != 1 {
+			t.Fatalf("Expected one tool, got %v", tools)
+		}
+		return tools[0]["function"].(map[string]interface{})["name"]
+	}
+
+	if name := toolName(); name != "search" {
+		t.Errorf("Expected search, got %v", name)
+	}
+
+	os.WriteFile(path, []byte(`[{"type": "function", "function": {"name": "fetch"}}]`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if name := toolName(); name != "fetch" {
+		t.Errorf("Expected the edited tool fetch, got %v", name)
+	}
+
+	os.WriteFile(path, []byte(`[{"function": `), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if name := toolName(); name != "fetch" {
+		t.Errorf("Expected an invalid edit to keep fetch, got %v", name)
+	}
+
+	if tools := cfg.ToolsFor(PrefixConfig{Path: "/plain.txt"}); tools != nil {
+		t.Errorf("Expected no tools without tools_file, got %v", tools)
+	}
+}
+
+// TestMetricsSnapshotConfig tests the default and validation of the metrics
+// snapshot interval
+func TestMetricsSnapshotConfig(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"metrics_snapshot_file": "/var/lib/bioproxy/metrics.json"}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.MetricsSnapshotInterval != 60 {
+		t.Errorf("Expected default MetricsSnapshotInterval 60, got %d", cfg.MetricsSnapshotInterval)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"metrics_snapshot_file": "/m.json", "metrics_snapshot_interval": 0}`)); err == nil {
+		t.Error("Expected error for a zero metrics_snapshot_interval")
+	}
+}
+
+// TestAllowedMethods tests the default and normalization of AllowedMethods
+func TestAllowedMethods(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	expected := []string{"GET", "POST", "OPTIONS", "HEAD"}
+	if !reflect.DeepEqual(cfg.AllowedMethods, expected) {
+		t.Errorf("Expected default AllowedMethods %v, got %v", expected, cfg.AllowedMethods)
+	}
+
+	cfg, err = LoadConfigFromReader(strings.NewReader(`{"allowed_methods": ["post", " Get "]}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.AllowedMethods, []string{"POST", "GET"}) {
+		t.Errorf("Expected upper-cased methods, got %v", cfg.AllowedMethods)
+	}
+
+	cfg, err = LoadConfigFromReader(strings.NewReader(`{"allowed_methods": []}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if len(cfg.AllowedMethods) != 0 {
+		t.Errorf("Expected an empty list to allow every method, got %v", cfg.AllowedMethods)
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"allowed_methods": ["GET", ""]}`)); err == nil {
+		t.Error("Expected error for an empty allowed_methods entry")
+	}
+}
+
+// TestSSEHeartbeatInterval tests the validation of SSEHeartbeatInterval
+func TestSSEHeartbeatInterval(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"sse_heartbeat_interval": 15}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	if cfg.SSEHeartbeatInterval != 15 {
+		t.Errorf("Expected SSEHeartbeatInterval 15, got %d", cfg.SSEHeartbeatInterval)
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"sse_heartbeat_interval": -1}`)); err == nil {
+		t.Error("Expected error for a negative sse_heartbeat_interval")
+	}
+}
+
+// TestDependsOn tests validation of per-prefix warmup dependencies
+func TestDependsOn(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {
+		"@base": {"path": "/base.txt"},
+		"@ab": {"variants": [{"name": "a", "path": "/a.txt"}, {"name": "b", "path": "/b.txt"}]},
+		"@extended": {"path": "/extended.txt", "depends_on": ["@base", "@ab"]}
+	}}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	expected := []string{"@base", "@ab.a", "@ab.b"}
+	if deps := cfg.WarmupDependencies("@extended"); !reflect.DeepEqual(deps, expected) {
+		t.Errorf("Expected dependencies %v, got %v", expected, deps)
+	}
+	if deps := cfg.WarmupDependencies("@base"); len(deps) != 0 {
+		t.Errorf("Expected no dependencies for @base, got %v", deps)
+	}
+
+	invalid := map[string]string{
+		"cycle": `{"prefixes": {
+			"@a": {"path": "/a.txt", "depends_on": ["@c"]},
+			"@b": {"path": "/b.txt", "depends_on": ["@a"]},
+			"@c": {"path": "/c.txt", "depends_on": ["@b"]}
+		}}`,
+		"self":    `{"prefixes": {"@a": {"path": "/a.txt", "depends_on": ["@a"]}}}`,
+		"unknown": `{"prefixes": {"@a": {"path": "/a.txt", "depends_on": ["@missing"]}}}`,
+	}
+	for name, data := range invalid {
+		if _, err := LoadConfigFromReader(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		} else if name == "cycle" && !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("Expected cycle error, got %v", err)
+		}
+	}
+}
+
+// TestPrefixIncludes tests that includes are passed to every template of a prefix
+func TestPrefixIncludes(t *testing.T) {
+	cfg, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {
+		"@code": {"path": "/code.txt", "includes": ["/persona.txt", "/guidelines.txt"]},
+		"@ab": {"variants": [{"name": "a", "path": "/a.txt"}, {"name": "b", "path": "/b.txt"}], "includes": ["/persona.txt"]}
+	}}`))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	refs := cfg.Prefixes["@code"].Templates("@code")
+	if len(refs) != 1 || !reflect.DeepEqual(refs[0].Includes, []string{"/persona.txt", "/guidelines.txt"}) {
+		t.Errorf("Expected includes in order, got %+v", refs)
+	}
+	for _, ref := range cfg.Prefixes["@ab"].Templates("@ab") {
+		if !reflect.DeepEqual(ref.Includes, []string{"/persona.txt"}) {
+			t.Errorf("Expected variant %s to have the prefix includes, got %v", ref.Key, ref.Includes)
+		}
+	}
+
+	if _, err := LoadConfigFromReader(strings.NewReader(`{"prefixes": {"@code": {"path": "/code.txt", "includes": [""]}}}`)); err == nil {
+		t.Error("Expected error for an empty includes entry")
+	}
+}
@@ -0,0 +1,160 @@
+// Package diag implements the self-test/diagnostic checks behind `bioproxy -selftest`.
+// Each check is a standalone function so it can be tested against mocks;
+// Run composes them into a single report.
+package diag
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/kvcache"
+	"github.com/oleksandr/bioproxy/internal/template"
+)
+
+// selftestCacheFilename is the slot file used for the trial save/restore.
+// It is deliberately distinct from any "<prefix>.bin" cache file.
+const selftestCacheFilename = "bioproxy-selftest.bin"
+
+// Result is the outcome of a single diagnostic check
+type Result struct {
+	// Name is a short human-readable name of the check
+	Name string
+
+	// Err is nil if the check passed
+	Err error
+}
+
+// Passed returns true if the check succeeded
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+// CheckConfig loads the configuration from configPath (file, "-" or URL).
+// Returns the loaded config (nil on failure) along with the check result.
+func CheckConfig(configPath string) (*config.Config, Result) {
+	cfg, err := config.LoadConfigFrom(configPath)
+	return cfg, Result{Name: fmt.Sprintf("load config %s", configPath), Err: err}
+}
+
+// CheckTemplates verifies that every configured template can be loaded and processed.
+// Returns one result per template (one per variant for A/B prefixes),
+// sorted by prefix for stable output.
+func CheckTemplates(cfg *config.Config) []Result {
+	prefixes := make([]string, 0, len(cfg.Prefixes))
+	for prefix := range cfg.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	watcher := template.NewWatcher()
+	watcher.SetMaxProcessedBytes(cfg.MaxProcessedTemplateBytes)
+	watcher.SetMaxFileBytes(cfg.MaxTemplateFileBytes)
+	watcher.SetMaxExpansionBytes(cfg.MaxExpansionBytes)
+	results := make([]Result, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		prefixCfg := cfg.Prefixes[prefix]
+		for _, ref := range prefixCfg.Templates(prefix) {
+			name := fmt.Sprintf("template %s", ref.Key)
+			add := watcher.AddTemplateWithIncludes
+			source := ref.Path
+			if ref.Inline != "" {
+				add, source = watcher.AddInlineTemplateWithIncludes, ref.Inline
+			}
+			if err := add(ref.Key, source, prefixCfg.Engine, ref.Includes); err != nil {
+				results = append(results, Result{Name: name, Err: err})
+				continue
+			}
+			_, err := watcher.ProcessTemplate(ref.Key, "")
+			results = append(results, Result{Name: name, Err: err})
+		}
+	}
+	return results
+}
+
+// CheckBackend verifies that the llama.cpp backend is reachable and healthy
+// by issuing GET /health. backendURL is the base URL llama.cpp API paths are
+// appended to, including any path prefix.
+func CheckBackend(client *http.Client, backendURL string) Result {
+	name := fmt.Sprintf("backend reachable at %s", backendURL)
+	url := strings.TrimSuffix(backendURL, "/") + "/health"
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return Result{Name: name, Err: fmt.Errorf("request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Result{Name: name, Err: fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))}
+	}
+	return Result{Name: name}
+}
+
+// CheckSlotSaveRestore verifies that llama.cpp was started with --slot-save-path
+// by doing a trial save followed by a restore of slot 0 on cfg's backend,
+// with cfg's backend credentials.
+func CheckSlotSaveRestore(client *http.Client, cfg *config.Config) Result {
+	name := "slot save/restore (--slot-save-path)"
+	kvCache := kvcache.New(cfg.BackendBaseURL(cfg.BackendURL), client, nil)
+	kvCache.SetAuthToken(cfg.BackendAuthToken)
+
+	if err := kvCache.Save("selftest", selftestCacheFilename); err != nil {
+		return Result{Name: name, Err: fmt.Errorf("save failed: %w", err)}
+	}
+	if err := kvCache.Restore("selftest", selftestCacheFilename); err != nil {
+		return Result{Name: name, Err: fmt.Errorf("restore failed: %w", err)}
+	}
+	return Result{Name: name}
+}
+
+// Run executes all diagnostic checks in order and returns their results.
+// Backend checks are skipped if the config cannot be loaded.
+func Run(configPath string, overrides func(*config.Config)) []Result {
+	cfg, result := CheckConfig(configPath)
+	results := []Result{result}
+	if cfg == nil {
+		return results
+	}
+	if overrides != nil {
+		overrides(cfg)
+	}
+
+	results = append(results, CheckTemplates(cfg)...)
+
+	// Backend requests use the same TLS settings as the proxy
+	transport, err := cfg.BackendTransport()
+	if err != nil {
+		return append(results, Result{Name: "backend TLS settings", Err: err})
+	}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	backendResult := CheckBackend(client, cfg.BackendBaseURL(cfg.BackendURL))
+	results = append(results, backendResult)
+	if !backendResult.Passed() {
+		// No point trying slot operations on an unreachable backend
+		return results
+	}
+
+	results = append(results, CheckSlotSaveRestore(client, cfg))
+	return results
+}
+
+// PrintReport writes a pass/fail line per check to w.
+// Returns true if all checks passed.
+func PrintReport(w io.Writer, results []Result) bool {
+	allPassed := true
+	for _, r := range results {
+		if r.Passed() {
+			fmt.Fprintf(w, "  PASS  %s\n", r.Name)
+		} else {
+			allPassed = false
+			fmt.Fprintf(w, "  FAIL  %s: %v\n", r.Name, r.Err)
+		}
+	}
+	return allPassed
+}
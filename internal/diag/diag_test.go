@@ -0,0 +1,195 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oleksandr/bioproxy/internal/config"
+)
+
+// newMockBackend creates a mock llama.cpp server.
+// slotStatus is the status code returned for /slots/0 requests.
+func newMockBackend(healthStatus, slotStatus int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(healthStatus)
+	})
+	mux.HandleFunc("/slots/0", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(slotStatus)
+	})
+	return httptest.NewServer(mux)
+}
+
+// TestCheckConfig tests loading valid and invalid config files
+func TestCheckConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	validPath := filepath.Join(tmpDir, "valid.json")
+	os.WriteFile(validPath, []byte(`{"proxy_port": 9000}`), 0644)
+
+	cfg, result := CheckConfig(validPath)
+	if !result.Passed() {
+		t.Errorf("Expected valid config to pass, got: %v", result.Err)
+	}
+	if cfg == nil || cfg.ProxyPort != 9000 {
+		t.Errorf("Expected loaded config with ProxyPort 9000, got %+v", cfg)
+	}
+
+	invalidPath := filepath.Join(tmpDir, "invalid.json")
+	os.WriteFile(invalidPath, []byte(`not json`), 0644)
+
+	cfg, result = CheckConfig(invalidPath)
+	if result.Passed() {
+		t.Error("Expected invalid config to fail")
+	}
+	if cfg != nil {
+		t.Error("Expected nil config on failure")
+	}
+}
+
+// TestCheckTemplates tests that missing templates are reported per prefix
+func TestCheckTemplates(t *testing.T) {
+	tmpDir := t.TempDir()
+	goodPath := filepath.Join(tmpDir, "good.txt")
+	os.WriteFile(goodPath, []byte("Hello <{message}>"), 0644)
+
+	cfg := config.DefaultConfig()
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@good":    {Path: goodPath},
+		"@missing": {Path: filepath.Join(tmpDir, "missing.txt")},
+	}
+
+	results := CheckTemplates(cfg)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	// Results are sorted by prefix
+	if !results[0].Passed() || !strings.Contains(results[0].Name, "@good") {
+		t.Errorf("Expected @good to pass, got %+v", results[0])
+	}
+	if results[1].Passed() || !strings.Contains(results[1].Name, "@missing") {
+		t.Errorf("Expected @missing to fail, got %+v", results[1])
+	}
+}
+
+// TestCheckBackend tests healthy, unhealthy and unreachable backends
+func TestCheckBackend(t *testing.T) {
+	healthy := newMockBackend(http.StatusOK, http.StatusOK)
+	defer healthy.Close()
+
+	if result := CheckBackend(http.DefaultClient, healthy.URL); !result.Passed() {
+		t.Errorf("Expected healthy backend to pass, got: %v", result.Err)
+	}
+
+	unhealthy := newMockBackend(http.StatusServiceUnavailable, http.StatusOK)
+	defer unhealthy.Close()
+
+	if result := CheckBackend(http.DefaultClient, unhealthy.URL); result.Passed() {
+		t.Error("Expected unhealthy backend to fail")
+	}
+
+	if result := CheckBackend(http.DefaultClient, "http://127.0.0.1:1"); result.Passed() {
+		t.Error("Expected unreachable backend to fail")
+	}
+}
+
+// TestCheckSlotSaveRestore tests the trial save/restore against a mock backend
+func TestCheckSlotSaveRestore(t *testing.T) {
+	working := newMockBackend(http.StatusOK, http.StatusOK)
+	defer working.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.BackendURL = working.URL
+	if result := CheckSlotSaveRestore(http.DefaultClient, cfg); !result.Passed() {
+		t.Errorf("Expected slot save/restore to pass, got: %v", result.Err)
+	}
+
+	// llama.cpp without --slot-save-path rejects slot actions
+	unsupported := newMockBackend(http.StatusOK, http.StatusNotImplemented)
+	defer unsupported.Close()
+
+	cfg.BackendURL = unsupported.URL
+	if result := CheckSlotSaveRestore(http.DefaultClient, cfg); result.Passed() {
+		t.Error("Expected slot save/restore to fail when unsupported")
+	}
+}
+
+// TestRunBackendPathPrefix tests that the backend checks of a config with
+// backend_path_prefix reach the backend under the prefix
+func TestRunBackendPathPrefix(t *testing.T) {
+	mock := newMockBackend(http.StatusOK, http.StatusOK)
+	defer mock.Close()
+	gateway := httptest.NewServer(http.StripPrefix("/llm", mock.Config.Handler))
+	defer gateway.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"backend_url": "`+gateway.URL+`", "backend_path_prefix": "/llm"}`), 0644)
+
+	results := Run(configPath, nil)
+	if len(results) != 3 {
+		t.Fatalf("Expected config, backend and slot results, got %+v", results)
+	}
+	for _, result := range results {
+		if !result.Passed() {
+			t.Errorf("Expected %s to pass, got %v", result.Name, result.Err)
+		}
+	}
+}
+
+// TestRunBackendTLSCACert tests that the backend checks trust
+// backend_tls_ca_cert, like the proxy
+func TestRunBackendTLSCACert(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/slots/0", func(w http.ResponseWriter, r *http.Request) {})
+	backend := httptest.NewTLSServer(mux)
+	defer backend.Close()
+
+	tmpDir := t.TempDir()
+	caPath := filepath.Join(tmpDir, "ca.pem")
+	os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0644)
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"backend_url": "`+backend.URL+`", "backend_tls_ca_cert": "`+caPath+`"}`), 0644)
+
+	results := Run(configPath, nil)
+	if len(results) != 3 {
+		t.Fatalf("Expected config, backend and slot results, got %+v", results)
+	}
+	for _, result := range results {
+		if !result.Passed() {
+			t.Errorf("Expected %s to pass, got %v", result.Name, result.Err)
+		}
+	}
+}
+
+// TestPrintReport tests the report output and overall pass/fail status
+func TestPrintReport(t *testing.T) {
+	var buf bytes.Buffer
+	passed := PrintReport(&buf, []Result{
+		{Name: "first"},
+		{Name: "second", Err: os.ErrNotExist},
+	})
+
+	if passed {
+		t.Error("Expected report with a failure to return false")
+	}
+	output := buf.String()
+	if !strings.Contains(output, "PASS  first") {
+		t.Errorf("Expected PASS line for first check, got: %s", output)
+	}
+	if !strings.Contains(output, "FAIL  second") {
+		t.Errorf("Expected FAIL line for second check, got: %s", output)
+	}
+
+	buf.Reset()
+	if !PrintReport(&buf, []Result{{Name: "only"}}) {
+		t.Error("Expected report with no failures to return true")
+	}
+}
@@ -0,0 +1,260 @@
+// Package grpchealth serves the standard gRPC health checking protocol
+// (grpc.health.v1.Health) for orchestrators that probe over gRPC instead of
+// HTTP.
+//
+// Only the unary Check method is implemented, over unencrypted HTTP/2 (h2c)
+// with the standard library: the two protobuf messages involved have a single
+// field each and are encoded by hand. Watch returns UNIMPLEMENTED.
+package grpchealth
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ServingStatus is the HealthCheckResponse status
+type ServingStatus int
+
+const (
+	StatusUnknown        ServingStatus = 0
+	StatusServing        ServingStatus = 1
+	StatusNotServing     ServingStatus = 2
+	StatusServiceUnknown ServingStatus = 3
+)
+
+// gRPC status codes used by the health service
+const (
+	codeOK            = 0
+	codeInvalidArg    = 3
+	codeNotFound      = 5
+	codeUnimplemented = 12
+)
+
+// Method paths of the grpc.health.v1.Health service
+const (
+	checkPath = "/grpc.health.v1.Health/Check"
+	watchPath = "/grpc.health.v1.Health/Watch"
+)
+
+// ServiceName is the service name accepted in addition to "" (the whole server)
+const ServiceName = "bioproxy"
+
+// checkTimeout bounds a single health check
+const checkTimeout = 5 * time.Second
+
+// Server serves grpc.health.v1.Health on its own port
+type Server struct {
+	// addr is the listen address (host:port)
+	addr string
+
+	// check returns nil when bioproxy can serve requests
+	check func(ctx context.Context) error
+
+	server *http.Server
+
+	mu      sync.Mutex
+	running bool
+}
+
+// New creates a gRPC health server listening on addr.
+// check is called for every Check request and reports SERVING when it
+// returns nil, NOT_SERVING otherwise.
+func New(addr string, check func(ctx context.Context) error) *Server {
+	return &Server{addr: addr, check: check}
+}
+
+// Start binds the listen address and serves health checks in a goroutine.
+// Returns an error if the port can't be bound or if already running.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return fmt.Errorf("gRPC health server is already running")
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	// gRPC clients speak HTTP/2 with prior knowledge on plaintext ports
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(checkPath, s.handleCheck)
+	mux.HandleFunc(watchPath, func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, nil, codeUnimplemented, "Watch is not implemented")
+	})
+	s.server = &http.Server{
+		Handler:           mux,
+		Protocols:         &protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.running = true
+
+	log.Printf("INFO: Starting gRPC health server on %s", s.addr)
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("ERROR: gRPC health server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop shuts down the server
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return fmt.Errorf("gRPC health server is not running")
+	}
+	log.Printf("INFO: Stopping gRPC health server")
+	if err := s.server.Shutdown(context.Background()); err != nil {
+		return fmt.Errorf("failed to shutdown gRPC health server: %w", err)
+	}
+	s.running = false
+	return nil
+}
+
+// handleCheck answers grpc.health.v1.Health/Check
+func (s *Server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	message, err := readMessage(r.Body)
+	if err != nil {
+		writeResponse(w, nil, codeInvalidArg, err.Error())
+		return
+	}
+	service, err := parseHealthCheckRequest(message)
+	if err != nil {
+		writeResponse(w, nil, codeInvalidArg, err.Error())
+		return
+	}
+	if service != "" && service != ServiceName {
+		writeResponse(w, nil, codeNotFound, "unknown service "+service)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+	status := StatusServing
+	if err := s.check(ctx); err != nil {
+		log.Printf("WARNING: gRPC health check reports NOT_SERVING: %v", err)
+		status = StatusNotServing
+	}
+	writeResponse(w, encodeHealthCheckResponse(status), codeOK, "")
+}
+
+// BackendCheck returns a check reporting whether the llama.cpp server at
+// backendURL is healthy, i.e. its /health endpoint answers 200
+// (llama.cpp answers 503 while the model is loading). backendURL is the
+// base URL llama.cpp API paths are appended to, including any path prefix.
+func BackendCheck(backendURL string, client *http.Client) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, backendURL+"/health", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("backend unreachable: %w", err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("backend health returned status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// readMessage reads a single length-prefixed gRPC message
+func readMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, fmt.Errorf("invalid gRPC message: %w", err)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > 4096 {
+		return nil, fmt.Errorf("message too large (%d bytes)", length)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, fmt.Errorf("invalid gRPC message: %w", err)
+	}
+	return message, nil
+}
+
+// writeResponse writes an optional message followed by the gRPC status trailers
+func writeResponse(w http.ResponseWriter, message []byte, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	if message != nil {
+		var header [5]byte
+		binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+		w.Write(header[:])
+		w.Write(message)
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", msg)
+	}
+}
+
+// parseHealthCheckRequest decodes a HealthCheckRequest protobuf message
+// (field 1: string service), skipping unknown fields
+func parseHealthCheckRequest(message []byte) (string, error) {
+	service := ""
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 {
+			return "", errors.New("invalid HealthCheckRequest")
+		}
+		message = message[n:]
+
+		switch tag & 7 {
+		case 0: // varint
+			_, n = binary.Uvarint(message)
+			if n <= 0 {
+				return "", errors.New("invalid HealthCheckRequest")
+			}
+			message = message[n:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return "", errors.New("invalid HealthCheckRequest")
+			}
+			if tag>>3 == 1 {
+				service = string(message[n : n+int(length)])
+			}
+			message = message[n+int(length):]
+		default:
+			return "", errors.New("invalid HealthCheckRequest")
+		}
+	}
+	return service, nil
+}
+
+// encodeHealthCheckResponse encodes a HealthCheckResponse protobuf message
+// (field 1: enum status)
+func encodeHealthCheckResponse(status ServingStatus) []byte {
+	return []byte{0x08, byte(status)}
+}
@@ -0,0 +1,162 @@
+package grpchealth
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// healthClient is a minimal grpc.health.v1.Health client over h2c
+type healthClient struct {
+	client *http.Client
+	addr   string
+}
+
+func newHealthClient(addr string) *healthClient {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &healthClient{
+		client: &http.Client{Transport: &http.Transport{Protocols: &protocols}},
+		addr:   addr,
+	}
+}
+
+// check calls Check for service and returns the serving status and gRPC status code
+func (c *healthClient) check(t *testing.T, service string) (ServingStatus, string) {
+	t.Helper()
+
+	// HealthCheckRequest{service}
+	message := []byte{0x0a, byte(len(service))}
+	message = append(message, service...)
+	body := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(message)))
+	body = append(body, message...)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+c.addr+checkPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got %s", resp.Proto)
+	}
+
+	reply, _ := io.ReadAll(resp.Body)
+	code := resp.Trailer.Get("Grpc-Status")
+	if code != "0" {
+		return StatusUnknown, code
+	}
+	if len(reply) != 7 || reply[5] != 0x08 {
+		t.Fatalf("Unexpected HealthCheckResponse %x", reply)
+	}
+	return ServingStatus(reply[6]), code
+}
+
+// startServer starts a health server on a free port
+func startServer(t *testing.T, check func(ctx context.Context) error) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server := New(addr, check)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	return addr
+}
+
+// TestCheckFollowsBackend tests that Check reports SERVING while the backend
+// is healthy and NOT_SERVING otherwise
+func TestCheckFollowsBackend(t *testing.T) {
+	var mu sync.Mutex
+	backendStatus := http.StatusOK
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(backendStatus)
+	}))
+	defer backend.Close()
+
+	addr := startServer(t, BackendCheck(backend.URL, &http.Client{}))
+	client := newHealthClient(addr)
+
+	if status, code := client.check(t, ""); status != StatusServing {
+		t.Errorf("Expected SERVING with a healthy backend, got %d (grpc-status %s)", status, code)
+	}
+	if status, _ := client.check(t, ServiceName); status != StatusServing {
+		t.Errorf("Expected SERVING for service %q, got %d", ServiceName, status)
+	}
+
+	// llama.cpp answers 503 while loading the model
+	mu.Lock()
+	backendStatus = http.StatusServiceUnavailable
+	mu.Unlock()
+	if status, _ := client.check(t, ""); status != StatusNotServing {
+		t.Errorf("Expected NOT_SERVING with an unhealthy backend, got %d", status)
+	}
+
+	// An unreachable backend
+	backend.Close()
+	if status, _ := client.check(t, ""); status != StatusNotServing {
+		t.Errorf("Expected NOT_SERVING with an unreachable backend, got %d", status)
+	}
+}
+
+// TestCheckBackendPathPrefix tests that a backend behind a gateway is
+// checked under its path prefix
+func TestCheckBackendPathPrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/llm/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	if err := BackendCheck(backend.URL+"/llm", &http.Client{})(context.Background()); err != nil {
+		t.Errorf("Expected the backend to be healthy under /llm, got %v", err)
+	}
+	if err := BackendCheck(backend.URL, &http.Client{})(context.Background()); err == nil {
+		t.Error("Expected /health without the prefix to fail")
+	}
+}
+
+// TestCheckUnknownService tests that unknown services get NOT_FOUND
+func TestCheckUnknownService(t *testing.T) {
+	addr := startServer(t, func(ctx context.Context) error { return nil })
+	client := newHealthClient(addr)
+
+	if _, code := client.check(t, "other"); code != fmt.Sprint(codeNotFound) {
+		t.Errorf("Expected grpc-status %d for an unknown service, got %q", codeNotFound, code)
+	}
+}
+
+// TestParseHealthCheckRequest tests decoding with unknown fields
+func TestParseHealthCheckRequest(t *testing.T) {
+	// field 2 varint, then field 1 "abc"
+	service, err := parseHealthCheckRequest([]byte{0x10, 0x05, 0x0a, 0x03, 'a', 'b', 'c'})
+	if err != nil || service != "abc" {
+		t.Errorf("Expected service abc, got %q (%v)", service, err)
+	}
+	if _, err := parseHealthCheckRequest([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Error("Expected error for truncated message")
+	}
+}
@@ -0,0 +1,160 @@
+// Package idle detects periods without API traffic so external tooling
+// can scale down llama.cpp (and the GPU) when bioproxy is not in use.
+package idle
+
+import (
+	"log"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Monitor periodically checks the time since the last API request and fires
+// an idle hook once per idle period. A new request ends the idle period, so
+// the hook fires again after the next stretch of inactivity.
+type Monitor struct {
+	// timeout is how long without activity before we're considered idle
+	timeout time.Duration
+
+	// lastActivity returns the time of the last API request
+	lastActivity func() time.Time
+
+	// onIdle is called when the idle timeout is reached
+	onIdle func()
+
+	// now returns the current time (replaceable in tests)
+	now func() time.Time
+
+	mu      sync.Mutex
+	idle    bool
+	running bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// New creates a new idle monitor.
+// Parameters:
+//   - timeout: Inactivity duration after which the hook fires
+//   - command: Shell command to run when idle (empty string only logs)
+//   - lastActivity: Returns the time of the last API request
+func New(timeout time.Duration, command string, lastActivity func() time.Time) *Monitor {
+	return &Monitor{
+		timeout:      timeout,
+		lastActivity: lastActivity,
+		onIdle:       func() { runCommand(command) },
+		now:          time.Now,
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+}
+
+// Start begins the background idle check loop
+func (m *Monitor) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running {
+		return
+	}
+	m.running = true
+
+	log.Printf("Starting idle monitor (timeout: %v)", m.timeout)
+	go m.checkLoop()
+}
+
+// Stop stops the background idle check loop
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return
+	}
+	m.running = false
+	m.mu.Unlock()
+
+	close(m.stopCh)
+	<-m.doneCh
+}
+
+// IsIdle returns true if the idle timeout has been reached and no request
+// arrived since
+func (m *Monitor) IsIdle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.idle
+}
+
+// Check compares the time since the last request with the timeout.
+// The idle hook fires on the transition into idle; activity resets the state.
+// Returns true if currently idle.
+func (m *Monitor) Check() bool {
+	inactive := m.now().Sub(m.lastActivity())
+
+	m.mu.Lock()
+	if inactive < m.timeout {
+		if m.idle {
+			log.Printf("INFO: Activity resumed, no longer idle")
+		}
+		m.idle = false
+		m.mu.Unlock()
+		return false
+	}
+
+	if m.idle {
+		// Already fired for this idle period
+		m.mu.Unlock()
+		return true
+	}
+	m.idle = true
+	m.mu.Unlock()
+
+	log.Printf("INFO: No API requests for %v, running idle hook", inactive.Round(time.Second))
+	m.onIdle()
+	return true
+}
+
+// checkLoop periodically runs Check until stopped
+func (m *Monitor) checkLoop() {
+	defer close(m.doneCh)
+
+	// Check often enough to fire reasonably close to the timeout
+	interval := m.timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			m.Check()
+		}
+	}
+}
+
+// runCommand runs the idle command through the system shell in the background
+func runCommand(command string) {
+	if command == "" {
+		return
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	go func() {
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Printf("ERROR: Idle command failed: %v (output: %s)", err, string(output))
+			return
+		}
+		log.Printf("INFO: Idle command completed")
+	}()
+}
@@ -0,0 +1,64 @@
+package idle
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMonitorFiresAndResets tests that the idle hook fires once after the
+// timeout and that a new request resets the idle state
+func TestMonitorFiresAndResets(t *testing.T) {
+	clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	lastRequest := clock
+
+	m := New(5*time.Minute, "", func() time.Time { return lastRequest })
+	m.now = func() time.Time { return clock }
+
+	fired := 0
+	m.onIdle = func() { fired++ }
+
+	// Not idle yet
+	clock = clock.Add(4 * time.Minute)
+	if m.Check() || fired != 0 {
+		t.Fatalf("Expected not idle before timeout (fired=%d)", fired)
+	}
+
+	// Timeout reached - hook fires
+	clock = clock.Add(2 * time.Minute)
+	if !m.Check() || fired != 1 {
+		t.Fatalf("Expected idle hook to fire once, fired=%d", fired)
+	}
+	if !m.IsIdle() {
+		t.Error("Expected IsIdle to be true")
+	}
+
+	// Still idle - hook does not fire again
+	clock = clock.Add(10 * time.Minute)
+	if !m.Check() || fired != 1 {
+		t.Errorf("Expected hook to fire only once per idle period, fired=%d", fired)
+	}
+
+	// A request arrives - idle state resets
+	lastRequest = clock
+	if m.Check() {
+		t.Error("Expected not idle after a request")
+	}
+	if m.IsIdle() {
+		t.Error("Expected IsIdle to be false after a request")
+	}
+
+	// Next idle period fires the hook again
+	clock = clock.Add(6 * time.Minute)
+	if !m.Check() || fired != 2 {
+		t.Errorf("Expected hook to fire again after new idle period, fired=%d", fired)
+	}
+}
+
+// TestMonitorStartStop tests the background loop lifecycle
+func TestMonitorStartStop(t *testing.T) {
+	m := New(time.Hour, "", time.Now)
+	m.Start()
+	m.Start() // Second start is a no-op
+	m.Stop()
+	m.Stop() // Second stop is a no-op
+}
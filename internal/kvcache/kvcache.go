@@ -5,19 +5,40 @@ package kvcache
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/oleksandr/bioproxy/internal/admin"
 )
 
+// ErrCacheNotFound is returned by Restore when llama.cpp has no cache file
+// with the requested name (e.g. on the first warmup of a template).
+var ErrCacheNotFound = errors.New("cache file not found")
+
+// BackendError is returned when llama.cpp answers with an unexpected status.
+// Use errors.As to inspect the status code and response body.
+type BackendError struct {
+	Status int
+	Body   string
+}
+
+// Error implements the error interface
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.Status, e.Body)
+}
+
 // Client handles KV cache operations with llama.cpp backend.
 type Client struct {
 	backendURL string
 	httpClient *http.Client
 	metrics    *admin.Metrics
+
+	// authToken is sent as a bearer token with every request (empty sends none)
+	authToken string
 }
 
 // New creates a new KV cache client.
@@ -33,6 +54,26 @@ func New(backendURL string, httpClient *http.Client, metrics *admin.Metrics) *Cl
 	}
 }
 
+// SetAuthToken makes every request carry "Authorization: Bearer <token>",
+// for llama.cpp started with --api-key. Backend 401/403 responses are then
+// counted as backend auth failures. An empty token sends no credentials.
+func (c *Client) SetAuthToken(token string) {
+	c.authToken = token
+}
+
+// do sends a request to llama.cpp with the configured credentials
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.authToken)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err == nil && c.authToken != "" && c.metrics != nil &&
+		(resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		c.metrics.RecordBackendAuthFailure()
+	}
+	return resp, err
+}
+
 // Restore restores KV cache from file via llama.cpp API.
 // Parameters:
 //   - prefix: Template prefix for metrics tracking (e.g., "@code")
@@ -40,7 +81,8 @@ func New(backendURL string, httpClient *http.Client, metrics *admin.Metrics) *Cl
 //
 // Returns:
 //   - nil on success
-//   - Error with 404 status if cache file doesn't exist
+//   - ErrCacheNotFound if cache file doesn't exist
+//   - *BackendError on other unexpected statuses
 //   - Error on other failures
 func (c *Client) Restore(prefix, filename string) error {
 	url := fmt.Sprintf("%s/slots/0?action=restore", c.backendURL)
@@ -66,7 +108,8 @@ func (c *Client) Restore(prefix, filename string) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	start := time.Now()
+	resp, err := c.do(req)
 	if err != nil {
 		if c.metrics != nil {
 			c.metrics.RecordKVCacheRestore(prefix, "error")
@@ -77,19 +120,22 @@ func (c *Client) Restore(prefix, filename string) error {
 
 	// Read response body for logging
 	body, _ := io.ReadAll(resp.Body)
+	if c.metrics != nil {
+		c.metrics.RecordKVCacheRestoreDuration(prefix, time.Since(start).Seconds())
+	}
 
 	if resp.StatusCode == http.StatusNotFound {
 		if c.metrics != nil {
 			c.metrics.RecordKVCacheRestore(prefix, "not_found")
 		}
-		return fmt.Errorf("cache file not found (404)")
+		return fmt.Errorf("%w: %s", ErrCacheNotFound, filename)
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		if c.metrics != nil {
 			c.metrics.RecordKVCacheRestore(prefix, "error")
 		}
-		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+		return &BackendError{Status: resp.StatusCode, Body: string(body)}
 	}
 
 	if c.metrics != nil {
@@ -106,7 +152,8 @@ func (c *Client) Restore(prefix, filename string) error {
 //
 // Returns:
 //   - nil on success
-//   - Error on failure
+//   - *BackendError if llama.cpp answers with an unexpected status
+//   - Error on other failures
 func (c *Client) Save(prefix, filename string) error {
 	url := fmt.Sprintf("%s/slots/0?action=save", c.backendURL)
 
@@ -125,7 +172,8 @@ func (c *Client) Save(prefix, filename string) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	start := time.Now()
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -133,9 +181,12 @@ func (c *Client) Save(prefix, filename string) error {
 
 	// Read response body for logging
 	body, _ := io.ReadAll(resp.Body)
+	if c.metrics != nil {
+		c.metrics.RecordKVCacheSaveDuration(prefix, time.Since(start).Seconds())
+	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+		return &BackendError{Status: resp.StatusCode, Body: string(body)}
 	}
 
 	if c.metrics != nil {
@@ -144,3 +195,58 @@ func (c *Client) Save(prefix, filename string) error {
 	log.Printf("KV cache saved for %s", filename)
 	return nil
 }
+
+// slotInfo is the subset of a llama.cpp /slots entry needed to tell whether a
+// slot is busy. Newer llama.cpp versions report "is_processing", older ones
+// report "state" (0 = idle).
+type slotInfo struct {
+	ID           int   `json:"id"`
+	IsProcessing *bool `json:"is_processing"`
+	State        *int  `json:"state"`
+}
+
+// busy returns true if the slot is currently processing a request
+func (s slotInfo) busy() bool {
+	if s.IsProcessing != nil {
+		return *s.IsProcessing
+	}
+	return s.State != nil && *s.State != 0
+}
+
+// HasIdleSlot queries llama.cpp's GET /slots endpoint and reports whether at
+// least one slot is idle.
+//
+// Returns:
+//   - true if any slot is idle, false if all slots are busy
+//   - Error if the endpoint is unavailable (e.g. llama.cpp started with --no-slots)
+func (c *Client) HasIdleSlot() (bool, error) {
+	url := fmt.Sprintf("%s/slots", c.backendURL)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return false, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return false, &BackendError{Status: resp.StatusCode, Body: string(body)}
+	}
+
+	var slots []slotInfo
+	if err := json.Unmarshal(body, &slots); err != nil {
+		return false, fmt.Errorf("failed to parse slots response: %w", err)
+	}
+
+	for _, slot := range slots {
+		if !slot.busy() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Access log formats
+const (
+	// AccessLogText keeps the human-readable per-request log lines only
+	AccessLogText = "text"
+
+	// AccessLogJSON additionally writes one JSON object per completed request
+	AccessLogJSON = "json"
+)
+
+// requestIDHeader is the request header used as the access log request_id.
+// If absent, a random ID is generated.
+const requestIDHeader = "X-Request-ID"
+
+// accessLogEntry is a single JSON access log line
+type accessLogEntry struct {
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Prefix     string  `json:"prefix"`
+	Bytes      int64   `json:"bytes"`
+	RequestID  string  `json:"request_id"`
+	Streaming  bool    `json:"streaming"`
+}
+
+// accessLogWriter wraps a ResponseWriter to capture the status code and
+// number of body bytes written. It forwards Flush so SSE streaming keeps working.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status code
+func (w *accessLogWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write counts the bytes written (an implicit 200 if no status was set)
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter if it supports flushing
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter (used by http.ResponseController)
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logAccess writes a JSON access log line for a completed request
+func (p *Proxy) logAccess(r *http.Request, w *accessLogWriter, start time.Time, prefix string, streaming bool) {
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	entry := accessLogEntry{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     w.status,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Prefix:     prefix,
+		Bytes:      w.bytes,
+		RequestID:  requestID,
+		Streaming:  streaming,
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("ERROR: Failed to marshal access log entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	p.accessLogMu.Lock()
+	defer p.accessLogMu.Unlock()
+	if _, err := p.accessLog.Write(line); err != nil {
+		log.Printf("ERROR: Failed to write access log: %v", err)
+	}
+}
+
+// newRequestID returns a random 16-character hex ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
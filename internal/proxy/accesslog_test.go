@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/oleksandr/bioproxy/internal/admission"
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/template"
+)
+
+// TestAccessLogJSON tests that JSON access log lines are written for both
+// chat completions and passthrough requests
+func TestAccessLogJSON(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/test_template.txt"
+	os.WriteFile(templateFile, []byte("Template: <{message}>"), 0644)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/chat/completions" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\":[]}\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@test", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.AccessLogFormat = AccessLogJSON
+	cfg.Prefixes = map[string]config.PrefixConfig{"@test": {Path: templateFile}}
+	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	var accessLog bytes.Buffer
+	proxy.accessLog = &accessLog
+
+	// Streaming chat completion with a prefix and a client-supplied request ID
+	requestBody := `{"messages":[{"role":"user","content":"@test hello"}],"stream":true}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	req.Header.Set("X-Request-ID", "req-123")
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	// Passthrough request without a request ID
+	req = httptest.NewRequest("GET", "/v1/unknown", nil)
+	rr = httptest.NewRecorder()
+	proxy.handlePassthrough(rr, req)
+
+	lines := strings.Split(strings.TrimSpace(accessLog.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 access log lines, got %d: %q", len(lines), accessLog.String())
+	}
+
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Access log line is not valid JSON: %v (%q)", err, line)
+		}
+		for _, field := range []string{"method", "path", "status", "duration_ms", "prefix", "bytes", "request_id", "streaming"} {
+			if _, exists := entry[field]; !exists {
+				t.Errorf("Expected field %s in access log line %q", field, line)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	chat := entries[0]
+	if chat["method"] != "POST" || chat["path"] != "/v1/chat/completions" || chat["status"] != float64(200) {
+		t.Errorf("Unexpected chat completion entry: %v", chat)
+	}
+	if chat["prefix"] != "@test" || chat["request_id"] != "req-123" || chat["streaming"] != true {
+		t.Errorf("Unexpected chat completion entry: %v", chat)
+	}
+	if chat["bytes"] != float64(len("data: {\"choices\":[]}\n\n")) {
+		t.Errorf("Expected bytes to match response size, got %v", chat["bytes"])
+	}
+
+	passthrough := entries[1]
+	if passthrough["method"] != "GET" || passthrough["path"] != "/v1/unknown" || passthrough["status"] != float64(404) {
+		t.Errorf("Unexpected passthrough entry: %v", passthrough)
+	}
+	if passthrough["prefix"] != "" || passthrough["streaming"] != false || passthrough["request_id"] == "" {
+		t.Errorf("Unexpected passthrough entry: %v", passthrough)
+	}
+}
+
+// TestAccessLogText tests that no JSON lines are written in text mode
+func TestAccessLogText(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.AccessLogFormat = AccessLogText
+	proxy, err := New(cfg, template.NewWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	var accessLog bytes.Buffer
+	proxy.accessLog = &accessLog
+
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	proxy.handlePassthrough(httptest.NewRecorder(), req)
+
+	if accessLog.Len() != 0 {
+		t.Errorf("Expected no access log output in text mode, got %q", accessLog.String())
+	}
+}
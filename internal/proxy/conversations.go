@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+)
+
+// conversationIDHeader is the request header identifying a conversation
+// for sticky prefixes
+const conversationIDHeader = "X-Conversation-ID"
+
+// defaultMaxConversations is used when no positive capacity is configured
+const defaultMaxConversations = 1000
+
+// conversationLRU is a bounded, thread-safe map of conversation ID to the
+// last template prefix used in that conversation. When full, the least
+// recently used conversation is evicted.
+type conversationLRU struct {
+	mu       sync.Mutex
+	capacity int
+
+	// order holds conversation entries, most recently used at the front
+	order *list.List
+
+	// entries maps conversation ID to its element in order
+	entries map[string]*list.Element
+}
+
+// conversationEntry is the value stored in each list element
+type conversationEntry struct {
+	id     string
+	prefix string
+}
+
+// newConversationLRU creates an LRU holding at most capacity conversations
+func newConversationLRU(capacity int) *conversationLRU {
+	if capacity <= 0 {
+		capacity = defaultMaxConversations
+	}
+	return &conversationLRU{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the prefix remembered for a conversation and marks it as recently used
+func (c *conversationLRU) Get(id string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*conversationEntry).prefix, true
+}
+
+// Put remembers the prefix for a conversation, evicting the least recently
+// used conversation if the LRU is full
+func (c *conversationLRU) Put(id, prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		elem.Value.(*conversationEntry).prefix = prefix
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[id] = c.order.PushFront(&conversationEntry{id: id, prefix: prefix})
+
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*conversationEntry).id)
+	}
+}
+
+// Len returns the number of remembered conversations
+func (c *conversationLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import "testing"
+
+// TestConversationLRU tests basic get/put and least-recently-used eviction
+func TestConversationLRU(t *testing.T) {
+	lru := newConversationLRU(2)
+
+	lru.Put("a", "@code")
+	lru.Put("b", "@debug")
+
+	if prefix, ok := lru.Get("a"); !ok || prefix != "@code" {
+		t.Errorf("Expected a -> @code, got %q (found=%v)", prefix, ok)
+	}
+
+	// "b" is now least recently used and gets evicted
+	lru.Put("c", "@code")
+
+	if _, ok := lru.Get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if _, ok := lru.Get("a"); !ok {
+		t.Error("Expected a to still be present")
+	}
+	if lru.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", lru.Len())
+	}
+
+	// Updating an existing conversation replaces its prefix
+	lru.Put("a", "@debug")
+	if prefix, _ := lru.Get("a"); prefix != "@debug" {
+		t.Errorf("Expected a -> @debug after update, got %q", prefix)
+	}
+}
@@ -527,7 +527,7 @@ func TestManualTemplateInjection(t *testing.T) {
 		ProxyHost:  "localhost",
 		ProxyPort:  manualProxyPort,
 		BackendURL: llamaCppURL,
-		Prefixes:   map[string]string{"@test": templateFile},
+		Prefixes:   map[string]config.PrefixConfig{"@test": {Path: templateFile}},
 	}
 
 	proxy, err := New(cfg, watcher, nil, state.New(), admission.New())
@@ -642,7 +642,7 @@ func TestManualTemplateInjectionWithStreaming(t *testing.T) {
 		ProxyHost:  "localhost",
 		ProxyPort:  manualProxyPort,
 		BackendURL: llamaCppURL,
-		Prefixes:   map[string]string{"@count": templateFile},
+		Prefixes:   map[string]config.PrefixConfig{"@count": {Path: templateFile}},
 	}
 
 	proxy, err := New(cfg, watcher, nil, state.New(), admission.New())
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oleksandr/bioproxy/internal/admin"
+	"github.com/oleksandr/bioproxy/internal/config"
+)
+
+// modelPrefixSeparator joins a backend model ID and a template name into a
+// pseudo-model ID, e.g. "local-llama+code" for prefix @code
+const modelPrefixSeparator = "+"
+
+// prefixModelName returns the name a prefix is exposed under in pseudo-model IDs
+// ("@code" -> "code")
+func prefixModelName(prefix string) string {
+	return strings.TrimPrefix(prefix, "@")
+}
+
+// splitPrefixModel splits a pseudo-model ID into the backend model ID and the
+// prefix of prefixes it selects. Returns false if the model isn't a pseudo-model.
+func (p *Proxy) splitPrefixModel(prefixes map[string]config.PrefixConfig, model string) (string, string, bool) {
+	i := strings.LastIndex(model, modelPrefixSeparator)
+	if i < 0 {
+		return "", "", false
+	}
+	base, name := model[:i], model[i+len(modelPrefixSeparator):]
+	for prefix := range prefixes {
+		if prefixModelName(prefix) == name {
+			return base, prefix, true
+		}
+	}
+	return "", "", false
+}
+
+// handleModels serves /v1/models. With ExposePrefixesAsModels, the backend's
+// model list is extended with one pseudo-model per backend model and prefix
+// (e.g. "local-llama+code"), so clients can pick a template from their model
+// dropdown. Otherwise the request is passed through unchanged.
+func (p *Proxy) handleModels(w http.ResponseWriter, r *http.Request) {
+	if !p.config.ExposePrefixesAsModels || p.config.PassthroughMode || r.Method != http.MethodGet {
+		p.handlePassthrough(w, r)
+		return
+	}
+
+	if p.metrics != nil {
+		p.metrics.RecordActivity()
+	}
+
+	if p.config.AccessLogFormat == AccessLogJSON {
+		start := time.Now()
+		alw := &accessLogWriter{ResponseWriter: w}
+		w = alw
+		defer func() { p.logAccess(r, alw, start, "", false) }()
+	}
+
+	backendURL := *p.backend
+	backendURL.Path = strings.TrimSuffix(p.backend.Path, "/") + p.config.BackendPath(r.URL.Path)
+	backendURL.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, backendURL.String(), nil)
+	if err != nil {
+		log.Printf("ERROR: Failed to create backend request: %v", err)
+		http.Error(w, "Failed to forward request", http.StatusInternalServerError)
+		return
+	}
+	req.Header = r.Header.Clone()
+	// The body is parsed below, let the transport handle compression
+	req.Header.Del("Accept-Encoding")
+	p.setBackendAuth(req.Header)
+
+	if p.metrics != nil {
+		p.metrics.RecordBackendRequest(admin.BackendSourceUser)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("ERROR: Backend request failed: %v", err)
+		if p.metrics != nil {
+			p.metrics.RecordRequest(r.URL.Path, http.StatusBadGateway)
+		}
+		http.Error(w, "Backend server unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if p.checkBackendAuth(resp.StatusCode) {
+		if p.metrics != nil {
+			p.metrics.RecordRequest(r.URL.Path, http.StatusBadGateway)
+		}
+		writeBackendAuthError(w)
+		return
+	}
+
+	if p.metrics != nil {
+		p.metrics.RecordRequest(r.URL.Path, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("ERROR: Failed to read backend response: %v", err)
+		http.Error(w, "Failed to read backend response", http.StatusBadGateway)
+		return
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		if merged, err := p.addPrefixModels(body); err != nil {
+			log.Printf("WARNING: Could not add prefix models, forwarding backend response: %v", err)
+		} else {
+			body = merged
+		}
+	}
+
+	p.stripResponseHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := w.Write(body); err != nil {
+		log.Printf("ERROR: Failed to write response: %v", err)
+	}
+}
+
+// addPrefixModels appends a pseudo-model for every backend model and
+// configured prefix to an OpenAI-style {"data": [...]} model list.
+// Each pseudo-model is a copy of its backend model with the ID replaced.
+func (p *Proxy) addPrefixModels(body []byte) ([]byte, error) {
+	var models map[string]interface{}
+	if err := json.Unmarshal(body, &models); err != nil {
+		return nil, fmt.Errorf("failed to parse models response: %w", err)
+	}
+	data, ok := models["data"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("models response has no data array")
+	}
+
+	prefixes := config.SortedPrefixes(p.config.PrefixMap())
+
+	merged := data
+	for _, entry := range data {
+		model, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, ok := model["id"].(string)
+		if !ok {
+			continue
+		}
+		for _, prefix := range prefixes {
+			pseudo := make(map[string]interface{}, len(model))
+			for key, value := range model {
+				pseudo[key] = value
+			}
+			pseudo["id"] = id + modelPrefixSeparator + prefixModelName(prefix)
+			merged = append(merged, pseudo)
+		}
+	}
+	models["data"] = merged
+
+	return json.Marshal(models)
+}
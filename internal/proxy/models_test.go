@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/oleksandr/bioproxy/internal/admission"
+	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/template"
+)
+
+const testModelsResponse = `{"object":"list","data":[{"id":"local-llama","object":"model","owned_by":"llamacpp"}]}`
+
+// TestHandleModels tests that /v1/models is extended with one pseudo-model per prefix
+func TestHandleModels(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testModelsResponse))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.ExposePrefixesAsModels = true
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@code":  {Path: "/tmp/code.txt"},
+		"@debug": {Path: "/tmp/debug.txt"},
+	}
+	proxy, err := New(cfg, template.NewWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	proxy.handleModels(rr, httptest.NewRequest("GET", "/v1/models", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	var models struct {
+		Object string                   `json:"object"`
+		Data   []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &models); err != nil {
+		t.Fatalf("Response is not valid JSON: %v (%q)", err, rr.Body.String())
+	}
+
+	var ids []string
+	for _, model := range models.Data {
+		ids = append(ids, model["id"].(string))
+		if model["owned_by"] != "llamacpp" {
+			t.Errorf("Expected pseudo-model to keep backend fields, got %v", model)
+		}
+	}
+	expected := "local-llama,local-llama+code,local-llama+debug"
+	if strings.Join(ids, ",") != expected {
+		t.Errorf("Expected models %s, got %s", expected, strings.Join(ids, ","))
+	}
+	if models.Object != "list" {
+		t.Errorf("Expected other fields to be preserved, got object %q", models.Object)
+	}
+
+	// Disabled: backend response passes through unchanged
+	cfg.ExposePrefixesAsModels = false
+	rr = httptest.NewRecorder()
+	proxy.handleModels(rr, httptest.NewRequest("GET", "/v1/models", nil))
+	if rr.Body.String() != testModelsResponse {
+		t.Errorf("Expected unchanged backend response when disabled, got %s", rr.Body.String())
+	}
+}
+
+// TestHandleModelsBackendPath tests that /v1/models is requested under the
+// path of backend_url and under backend_path_prefix, like chat completions
+func TestHandleModelsBackendPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		urlPath    string
+		pathPrefix string
+		expected   string
+	}{
+		{"backend url path", "/llm", "", "/llm/v1/models"},
+		{"backend path prefix", "", "/gw", "/gw/v1/models"},
+		{"both", "/llm/", "/gw", "/llm/gw/v1/models"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requestedPath string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestedPath = r.URL.Path
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(testModelsResponse))
+			}))
+			defer backend.Close()
+
+			cfg := createTestConfig(backend.URL + tt.urlPath)
+			cfg.BackendPathPrefix = tt.pathPrefix
+			cfg.ExposePrefixesAsModels = true
+			cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: "/tmp/code.txt"}}
+			proxy, err := New(cfg, template.NewWatcher(), nil, createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			proxy.handleModels(rr, httptest.NewRequest("GET", "/v1/models", nil))
+			if requestedPath != tt.expected {
+				t.Errorf("Expected backend path %s, got %s", tt.expected, requestedPath)
+			}
+			if !strings.Contains(rr.Body.String(), "local-llama+code") {
+				t.Errorf("Expected the pseudo-model in the response, got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+// TestPrefixModelRequest tests that a chat completion with a prefix pseudo-model
+// triggers template injection and sends the real model ID to the backend
+func TestPrefixModelRequest(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CODE: <{message}>"), 0644)
+
+	var mu sync.Mutex
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/chat/completions" {
+			bodyBytes, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			receivedRequest = nil
+			json.Unmarshal(bodyBytes, &receivedRequest)
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.ExposePrefixesAsModels = true
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile}}
+	backendState := createTestState()
+	proxy, err := New(cfg, watcher, nil, backendState, admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	tests := []struct {
+		model           string
+		expectedModel   string
+		expectedContent string
+	}{
+		{"local-llama+code", "local-llama", "CODE: hello"},
+		{"local-llama+unknown", "local-llama+unknown", "hello"},
+		{"local-llama", "local-llama", "hello"},
+	}
+
+	for _, tt := range tests {
+		requestBody := `{"model":"` + tt.model + `","messages":[{"role":"user","content":"hello"}]}`
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("model %s: expected status 200, got %d", tt.model, rr.Code)
+		}
+
+		mu.Lock()
+		if receivedRequest["model"] != tt.expectedModel {
+			t.Errorf("model %s: expected backend model %q, got %v", tt.model, tt.expectedModel, receivedRequest["model"])
+		}
+		content := receivedRequest["messages"].([]interface{})[0].(map[string]interface{})["content"]
+		if content != tt.expectedContent {
+			t.Errorf("model %s: expected content %q, got %v", tt.model, tt.expectedContent, content)
+		}
+		mu.Unlock()
+	}
+}
@@ -3,15 +3,27 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/oleksandr/bioproxy/internal/admission"
 	"github.com/oleksandr/bioproxy/internal/admin"
@@ -19,6 +31,7 @@ import (
 	"github.com/oleksandr/bioproxy/internal/kvcache"
 	"github.com/oleksandr/bioproxy/internal/state"
 	"github.com/oleksandr/bioproxy/internal/template"
+	"github.com/oleksandr/bioproxy/internal/tracing"
 )
 
 // Proxy represents the reverse proxy server that forwards requests to llama.cpp.
@@ -40,6 +53,13 @@ type Proxy struct {
 	// watcher monitors templates and processes them for injection
 	watcher *template.Watcher
 
+	// transport is the pooled connection transport to the backend,
+	// shared by the reverse proxy and the chat completion client
+	transport *http.Transport
+
+	// client is the HTTP client used for chat completions and KV cache operations
+	client *http.Client
+
 	// kvCache handles KV cache operations with llama.cpp
 	kvCache *kvcache.Client
 
@@ -54,6 +74,41 @@ type Proxy struct {
 	// Ensures atomic state transitions to prevent race conditions
 	admissionCtrl *admission.Controller
 
+	// conversations remembers the last prefix per conversation ID
+	// (nil unless StickyPrefix is enabled)
+	conversations *conversationLRU
+
+	// rewriters transform non-streaming chat completion responses
+	// (resolved from Config.ResponseRewrite, empty by default)
+	rewriters []ResponseRewriter
+
+	// accessLog receives JSON access log lines when AccessLogFormat is "json"
+	// (os.Stdout by default, kept separate from the human-readable log on stderr)
+	accessLog io.Writer
+
+	// accessLogMu serializes writes to accessLog
+	accessLogMu sync.Mutex
+
+	// tracer records a span per chat completion (nil unless OTLPEndpoint is set)
+	tracer *tracing.Tracer
+
+	// lazyWarmer warms up lazy templates on their first use (nil disables)
+	lazyWarmer LazyWarmer
+
+	// warmupGate holds back /v1/* requests until the initial warmup is done
+	// (nil disables)
+	warmupGate WarmupGate
+
+	// backendPicker chooses the backend for requests whose prefix has no
+	// backend of its own (nil sends them to BackendURL)
+	backendPicker BackendPicker
+
+	// streams registers streaming responses in progress (nil disables)
+	streams *admin.StreamRegistry
+
+	// maintenance rejects chat completions while enabled (nil disables)
+	maintenance *admin.Maintenance
+
 	// mu protects concurrent access to the proxy state
 	mu sync.Mutex
 
@@ -71,7 +126,8 @@ type Proxy struct {
 //   - backendState: Shared state tracker for llama.cpp backend (required)
 //   - admissionCtrl: Admission controller for coordinating access to llama.cpp (required)
 //
-// Returns an error if the backend URL is invalid.
+// Returns an error if the backend URL is invalid or a configured response
+// rewriter is unknown.
 func New(cfg *config.Config, watcher *template.Watcher, metrics *admin.Metrics, backendState *state.State, admissionCtrl *admission.Controller) (*Proxy, error) {
 	// Parse the backend URL to ensure it's valid
 	backend, err := url.Parse(cfg.BackendURL)
@@ -79,35 +135,90 @@ func New(cfg *config.Config, watcher *template.Watcher, metrics *admin.Metrics,
 		return nil, fmt.Errorf("invalid backend URL %s: %w", cfg.BackendURL, err)
 	}
 
+	// Resolve response rewriters by name
+	rewriters, err := lookupResponseRewriters(cfg.ResponseRewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a dedicated transport so connection pooling can be tuned
+	transport, err := newBackendTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: transport}
+
 	// Create the proxy instance
 	p := &Proxy{
 		config:        cfg,
 		backend:       backend,
 		watcher:       watcher,
-		kvCache:       kvcache.New(cfg.BackendURL, http.DefaultClient, metrics),
+		transport:     transport,
+		client:        client,
 		metrics:       metrics,
 		backendState:  backendState,
 		admissionCtrl: admissionCtrl,
+		rewriters:     rewriters,
+		accessLog:     os.Stdout,
 		running:       false,
 	}
+	p.kvCache = p.newKVCache(cfg.BackendURL)
+
+	// Remember prefixes per conversation if sticky prefixes are enabled
+	if cfg.StickyPrefix {
+		p.conversations = newConversationLRU(cfg.StickyPrefixMaxConversations)
+	}
 
 	// Create the reverse proxy using stdlib's httputil.ReverseProxy.
 	// This handles all the complexity of forwarding requests, copying headers,
 	// managing connections, etc.
 	p.reverseProxy = httputil.NewSingleHostReverseProxy(backend)
+	p.reverseProxy.Transport = transport
 
 	// Customize the Director function to add logging and prepare the request.
 	// Director is called before each request is sent to the backend.
 	originalDirector := p.reverseProxy.Director
 	p.reverseProxy.Director = func(req *http.Request) {
+		clientPath, clientRawPath := req.URL.Path, req.URL.RawPath
+
+		// Forward under BackendPathPrefix, e.g. for a backend behind a gateway
+		req.URL.Path = cfg.BackendPath(req.URL.Path)
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = cfg.BackendPath(req.URL.RawPath)
+		}
+
 		// Call the original director to set up the request properly
 		originalDirector(req)
 
+		// Send it to the pool member handlePassthrough picked, if any,
+		// under the member URL's path like BackendURL's
+		if picked, ok := req.Context().Value(pickedBackendKey{}).(*url.URL); ok {
+			req.URL.Scheme = picked.Scheme
+			req.URL.Host = picked.Host
+			req.URL.Path = strings.TrimSuffix(picked.Path, "/") + cfg.BackendPath(clientPath)
+			req.URL.RawPath = ""
+			if clientRawPath != "" {
+				req.URL.RawPath = strings.TrimSuffix(picked.EscapedPath(), "/") + cfg.BackendPath(clientRawPath)
+			}
+		}
+
+		// Use the backend's own credentials instead of the client's
+		p.setBackendAuth(req.Header)
+
+		// API traffic counts as activity for idle detection
+		if p.metrics != nil && strings.HasPrefix(clientPath, "/v1/") {
+			p.metrics.RecordActivity()
+		}
+		if p.metrics != nil {
+			p.metrics.RecordBackendRequest(admin.BackendSourceUser)
+		}
+
 		// Log the incoming request for debugging and monitoring
-		log.Printf("INFO: Proxying %s %s -> %s%s",
+		p.logRequestf("INFO: Proxying %s %s -> %s://%s%s",
 			req.Method,
-			req.URL.Path,
-			p.backend.String(),
+			clientPath,
+			req.URL.Scheme,
+			req.URL.Host,
 			req.URL.Path,
 		)
 	}
@@ -137,17 +248,24 @@ func New(cfg *config.Config, watcher *template.Watcher, metrics *admin.Metrics,
 	//
 	// Validation: TestManualStreamingChat verifies SSE streaming works correctly.
 	p.reverseProxy.ModifyResponse = func(resp *http.Response) error {
-		log.Printf("INFO: Backend responded with status %d for %s %s",
+		p.logRequestf("INFO: Backend responded with status %d for %s %s",
 			resp.StatusCode,
 			resp.Request.Method,
 			resp.Request.URL.Path,
 		)
 
+		// Replaced by the ErrorHandler with BackendAuthFailure "error"
+		if p.checkBackendAuth(resp.StatusCode) {
+			return errBackendAuth
+		}
+
 		// Record metrics if enabled
 		if p.metrics != nil {
-			p.metrics.RecordRequest(resp.Request.URL.Path, resp.StatusCode)
+			p.metrics.RecordRequest(p.clientPath(resp.Request.URL.Path), resp.StatusCode)
 		}
 
+		p.stripResponseHeaders(resp.Header)
+
 		return nil
 	}
 
@@ -161,7 +279,12 @@ func New(cfg *config.Config, watcher *template.Watcher, metrics *admin.Metrics,
 
 		// Record error metric if enabled
 		if p.metrics != nil {
-			p.metrics.RecordRequest(r.URL.Path, http.StatusBadGateway)
+			p.metrics.RecordRequest(p.clientPath(r.URL.Path), http.StatusBadGateway)
+		}
+
+		if errors.Is(err, errBackendAuth) {
+			writeBackendAuthError(w)
+			return
 		}
 
 		// Return a 502 Bad Gateway when the backend is unavailable
@@ -178,7 +301,9 @@ func New(cfg *config.Config, watcher *template.Watcher, metrics *admin.Metrics,
 //   - POST /v1/chat/completions -> handleChatCompletion (with template injection)
 //   - All other requests -> reverseProxy (direct passthrough)
 //
-// Returns an error if the server fails to start or if already running.
+// The port is bound before Start returns; serving happens in the background.
+//
+// Returns an error if the port can't be bound (e.g. already in use) or if already running.
 func (p *Proxy) Start() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -191,26 +316,19 @@ func (p *Proxy) Start() error {
 	// Build the listen address from config
 	addr := fmt.Sprintf("%s:%d", p.config.ProxyHost, p.config.ProxyPort)
 
-	// Create a custom ServeMux for routing
-	// This allows us to intercept specific endpoints while passing through others
-	mux := http.NewServeMux()
-
-	// Route chat completion requests to our custom handler for template injection
-	mux.HandleFunc("/v1/chat/completions", p.handleChatCompletion)
-
-	// Route all other requests to the reverse proxy for direct passthrough
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Only use reverse proxy for non-chat-completion requests
-		if r.URL.Path != "/v1/chat/completions" {
-			p.reverseProxy.ServeHTTP(w, r)
-		}
-	})
+	// Bind the port synchronously so errors like "address already in use"
+	// are returned to the caller instead of being logged from the goroutine
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
 
-	// Create the HTTP server with our custom mux
+	// Create the HTTP server with our custom routing
 	p.server = &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: p.handler(),
 	}
+	p.config.ProxyTimeouts.Apply(p.server)
 
 	p.running = true
 
@@ -218,11 +336,15 @@ func (p *Proxy) Start() error {
 		addr,
 		p.backend.String(),
 	)
-	log.Printf("INFO: Template injection enabled for /v1/chat/completions")
+	if p.config.PassthroughMode {
+		log.Printf("INFO: Passthrough mode, template injection and KV cache disabled")
+	} else {
+		log.Printf("INFO: Template injection enabled for /v1/chat/completions")
+	}
 
-	// Start the server in a goroutine so we can handle shutdown gracefully
+	// Serve in a goroutine so we can handle shutdown gracefully
 	go func() {
-		if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Printf("ERROR: Proxy server error: %v", err)
 		}
 	}()
@@ -235,6 +357,12 @@ func (p *Proxy) Start() error {
 //
 // Returns an error if the server fails to shut down or if not running.
 func (p *Proxy) Stop() error {
+	return p.Shutdown(context.Background())
+}
+
+// Shutdown is like Stop but gives up waiting for active connections
+// (e.g. long streams) when ctx is done.
+func (p *Proxy) Shutdown(ctx context.Context) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -244,13 +372,16 @@ func (p *Proxy) Stop() error {
 
 	log.Printf("INFO: Stopping proxy server")
 
-	// Shutdown gracefully
-	// Use context.Background() for a clean shutdown without timeout.
-	// Future: Could accept context parameter to allow caller to specify timeout.
-	if err := p.server.Shutdown(context.Background()); err != nil {
+	// Shutdown gracefully, waiting for active requests until ctx is done
+	if err := p.server.Shutdown(ctx); err != nil {
+		p.server.Close()
+		p.running = false
 		return fmt.Errorf("failed to shutdown proxy server: %w", err)
 	}
 
+	// Release pooled keep-alive connections to the backend
+	p.transport.CloseIdleConnections()
+
 	p.running = false
 	return nil
 }
@@ -262,6 +393,205 @@ func (p *Proxy) IsRunning() bool {
 	return p.running
 }
 
+// LazyWarmer warms up templates configured with lazy warmup the first time
+// a request uses them. Implemented by warmup.Manager.
+type LazyWarmer interface {
+	WarmupOnFirstUse(ctx context.Context, prefix string) error
+}
+
+// SetLazyWarmer sets the warmer used for lazy templates.
+// Must be called before Start.
+func (p *Proxy) SetLazyWarmer(warmer LazyWarmer) {
+	p.lazyWarmer = warmer
+}
+
+// WarmupGate reports whether the initial warmup has finished.
+// Implemented by warmup.Manager.
+type WarmupGate interface {
+	InitialWarmupDone() bool
+}
+
+// SetWarmupGate makes the proxy answer /v1/* requests with 503 until gate
+// reports the initial warmup done, for BlockUntilWarm.
+// Must be called before Start.
+func (p *Proxy) SetWarmupGate(gate WarmupGate) {
+	p.warmupGate = gate
+}
+
+// BackendPicker chooses a backend from a pool for each request.
+// Implemented by backendpool.Pool.
+type BackendPicker interface {
+	// Pick returns a backend URL; r is a random number in [0, 1)
+	Pick(r float64) (string, error)
+}
+
+// SetBackendPicker routes requests whose prefix has no backend of its own
+// through picker instead of BackendURL.
+// Must be called before Start.
+func (p *Proxy) SetBackendPicker(picker BackendPicker) {
+	p.backendPicker = picker
+}
+
+// SetStreamRegistry registers streaming responses in progress with streams,
+// for the admin /streams endpoint.
+// Must be called before Start.
+func (p *Proxy) SetStreamRegistry(streams *admin.StreamRegistry) {
+	p.streams = streams
+}
+
+// SetMaintenance makes chat completions fail with 503 and the maintenance
+// message while maintenance mode is enabled via the admin server.
+// Must be called before Start.
+func (p *Proxy) SetMaintenance(maintenance *admin.Maintenance) {
+	p.maintenance = maintenance
+}
+
+// SetTracer enables tracing of chat completion requests.
+// Must be called before Start; a nil tracer disables tracing.
+func (p *Proxy) SetTracer(tracer *tracing.Tracer) {
+	p.tracer = tracer
+}
+
+// handler returns the proxy's HTTP handler:
+//   - methods not in AllowedMethods are rejected with 405
+//   - /v1/* requests get 503 until the initial warmup is done, with a warmup gate
+//   - OPTIONS probes on /v1/* are answered locally instead of reaching llama.cpp
+//   - /v1/chat/completions and /v1/models have their own handlers
+//   - everything else is passed through to the backend
+func (p *Proxy) handler() http.Handler {
+	// Create a custom ServeMux for routing
+	// This allows us to intercept specific endpoints while passing through others
+	mux := http.NewServeMux()
+
+	// Route chat completion requests to our custom handler for template injection
+	mux.HandleFunc("/v1/chat/completions", p.handleChatCompletion)
+
+	// Model list, optionally extended with one pseudo-model per prefix
+	mux.HandleFunc("/v1/models", p.handleModels)
+
+	// Route all other requests to the reverse proxy for direct passthrough
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Only use reverse proxy for non-chat-completion requests
+		if r.URL.Path != "/v1/chat/completions" {
+			p.handlePassthrough(w, r)
+		}
+	})
+
+	return p.restrictMethods(p.blockUntilWarm(handleOptions(mux)))
+}
+
+// warmupRetryAfter is the Retry-After value (seconds) of requests rejected
+// while the initial warmup is in progress
+const warmupRetryAfter = "5"
+
+// blockUntilWarm answers /v1/* requests with 503 Service Unavailable until
+// the warmup gate reports the initial warmup done. Other paths, such as
+// health checks passed through to the backend, are not blocked.
+func (p *Proxy) blockUntilWarm(next http.Handler) http.Handler {
+	if p.warmupGate == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/") && !p.warmupGate.InitialWarmupDone() {
+			p.logRequestf("INFO: Rejected %s %s, initial warmup in progress", r.Method, r.URL.Path)
+			if p.metrics != nil {
+				p.metrics.RecordRequest(r.URL.Path, http.StatusServiceUnavailable)
+			}
+			w.Header().Set("Retry-After", warmupRetryAfter)
+			http.Error(w, "Initial warmup in progress", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// restrictMethods rejects requests whose method is not in AllowedMethods
+// with 405 Method Not Allowed, without calling the backend. An empty
+// AllowedMethods allows every method.
+func (p *Proxy) restrictMethods(next http.Handler) http.Handler {
+	if len(p.config.AllowedMethods) == 0 {
+		return next
+	}
+	allow := strings.Join(p.config.AllowedMethods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(p.config.AllowedMethods, r.Method) {
+			p.logRequestf("WARNING: Rejected %s %s, method not allowed", r.Method, r.URL.Path)
+			if p.metrics != nil {
+				p.metrics.RecordRequest(r.URL.Path, http.StatusMethodNotAllowed)
+			}
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedMethods lists the methods advertised in the Allow header of OPTIONS
+// responses, by path ("" for any other /v1/* path)
+var allowedMethods = map[string]string{
+	"/v1/chat/completions": "POST, OPTIONS",
+	"/v1/models":           "GET, OPTIONS",
+	"":                     "GET, POST, OPTIONS",
+}
+
+// handleOptions answers OPTIONS requests on /v1/* with 204 No Content and an
+// Allow header, without calling the backend. Some OpenAI client SDKs send
+// them to probe capabilities and llama.cpp may answer 404.
+// Other requests are passed to next.
+func handleOptions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allow, ok := allowedMethods[r.URL.Path]
+		if !ok {
+			allow = allowedMethods[""]
+		}
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// pickedBackendKey is the request context key of the pool member
+// handlePassthrough picked, read by the reverse proxy's Director
+type pickedBackendKey struct{}
+
+// handlePassthrough forwards a request to the backend unchanged via the reverse proxy
+func (p *Proxy) handlePassthrough(w http.ResponseWriter, r *http.Request) {
+	// Spread passthrough requests over the backend pool, if any, rejecting
+	// them like chat completions when no member is healthy
+	if p.backendPicker != nil {
+		picked, err := p.backendPicker.Pick(rand.Float64())
+		if err == nil {
+			var pickedURL *url.URL
+			if pickedURL, err = url.Parse(picked); err == nil {
+				r = r.WithContext(context.WithValue(r.Context(), pickedBackendKey{}, pickedURL))
+			}
+		}
+		if err != nil {
+			log.Printf("ERROR: Failed to pick a backend: %v", err)
+			if p.metrics != nil {
+				p.metrics.RecordRequest(r.URL.Path, http.StatusServiceUnavailable)
+			}
+			http.Error(w, "No healthy backend available", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if p.config.AccessLogFormat != AccessLogJSON {
+		p.reverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	alw := &accessLogWriter{ResponseWriter: w}
+	p.reverseProxy.ServeHTTP(alw, r)
+	streaming := isEventStream(alw.Header().Get("Content-Type"))
+	p.logAccess(r, alw, start, "", streaming)
+}
+
 // handleChatCompletion is a custom handler for /v1/chat/completions that performs
 // template injection when a user message starts with a configured prefix.
 //
@@ -283,11 +613,77 @@ func (p *Proxy) IsRunning() bool {
 //
 // Template injection only affects request; responses stream through unchanged.
 func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
-	// ADMISSION CONTROL: Acquire permission to run user query
-	// This atomically transitions state and cancels any warmup if needed
-	// The admission controller ensures no race conditions
-	p.admissionCtrl.AcquireUserQuery()
-	defer p.admissionCtrl.ReleaseUserQuery()
+	// Passthrough mode skips all template and cache logic
+	if p.config.PassthroughMode {
+		p.handlePassthrough(w, r)
+		return
+	}
+
+	// Only JSON bodies can be parsed for template injection.
+	// A missing Content-Type is treated as JSON for lenient clients.
+	// Checked before admission so rejected requests don't cancel warmups.
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			log.Printf("ERROR: Unsupported Content-Type for chat completion: %q", contentType)
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	// Record activity for idle detection
+	if p.metrics != nil {
+		p.metrics.RecordActivity()
+	}
+
+	// Track which prefix is used for this request (empty string if none)
+	// and whether the client asked for streaming, for the access log
+	requestPrefix := ""
+	streaming := false
+
+	// Backend override of the matched prefix (empty means the default backend)
+	requestBackend := ""
+
+	// Fields set by the matched prefix's request_overrides, which
+	// VerifyPassthrough doesn't report
+	var overriddenFields []string
+	if p.config.AccessLogFormat == AccessLogJSON {
+		start := time.Now()
+		alw := &accessLogWriter{ResponseWriter: w}
+		w = alw
+		defer func() { p.logAccess(r, alw, start, requestPrefix, streaming) }()
+	}
+
+	// Trace the request when a tracer is configured; the span is finished
+	// after the response has been fully written
+	requestModel := ""
+	var span *tracing.Span
+	if p.tracer != nil {
+		var ctx context.Context
+		ctx, span = p.tracer.StartRequest(r, "chat.completions")
+		r = r.WithContext(ctx)
+		tw := &accessLogWriter{ResponseWriter: w}
+		w = tw
+		defer func() {
+			span.SetAttribute("bioproxy.prefix", requestPrefix)
+			span.SetAttribute("gen_ai.request.model", requestModel)
+			span.SetAttribute("bioproxy.streaming", streaming)
+			span.SetAttribute("http.response.status_code", tw.status)
+			span.Finish()
+		}()
+	}
+
+	// During maintenance nothing is sent to the backend
+	if p.maintenance != nil {
+		if enabled, message := p.maintenance.Enabled(); enabled {
+			p.logRequestf("INFO: Rejected %s %s, maintenance mode", r.Method, r.URL.Path)
+			if p.metrics != nil {
+				p.metrics.RecordRequest(r.URL.Path, http.StatusServiceUnavailable)
+			}
+			writeUnavailableError(w, message, "maintenance")
+			return
+		}
+	}
 
 	// Read the entire request body
 	// This is safe because chat completion requests are typically small (< 100KB)
@@ -308,6 +704,24 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// One snapshot of the prefix configuration for the whole request, a
+	// config reload may replace it meanwhile
+	prefixes := p.config.PrefixMap()
+
+	requestModel, _ = requestMap["model"].(string)
+
+	// A pseudo-model like "local-llama+code" selects the @code template;
+	// the backend gets the real model ID
+	modelPrefix := ""
+	if p.config.ExposePrefixesAsModels {
+		if model, ok := requestMap["model"].(string); ok {
+			if base, prefix, ok := p.splitPrefixModel(prefixes, model); ok {
+				requestMap["model"] = base
+				modelPrefix = prefix
+			}
+		}
+	}
+
 	// Extract the messages array from the map
 	messagesInterface, hasMessages := requestMap["messages"]
 	if !hasMessages {
@@ -324,87 +738,287 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find the last user message for template injection
-	// We check the last one because in multi-turn conversations,
-	// only the most recent user input should trigger template selection
-	lastUserIndex := -1
-	for i := len(messagesArray) - 1; i >= 0; i-- {
-		messageMap, ok := messagesArray[i].(map[string]interface{})
-		if !ok {
-			continue
+	// Find the messages to check for a template prefix: the last message of
+	// each configured role (only the last user message by default).
+	// We check the last ones because in multi-turn conversations,
+	// only the most recent input should trigger template selection
+	candidates := lastMessagesByRole(messagesArray, p.config.PrefixRoles())
+
+	// If there's a candidate message, check for template prefix
+	if len(candidates) > 0 {
+		// The latest candidate receives the template unless an earlier one
+		// carries the prefix (e.g. a system message followed by a plain user turn)
+		lastUserIndex := candidates[0]
+		matchedPrefix := ""
+		messageWithoutPrefix := ""
+		for i, index := range candidates {
+			messageMap := messagesArray[index].(map[string]interface{})
+			userMessage, ok := messageMap["content"].(string)
+			if !ok {
+				log.Printf("ERROR: User message content is not a string")
+				http.Error(w, "Message content must be a string", http.StatusBadRequest)
+				return
+			}
+			if i == 0 {
+				messageWithoutPrefix = userMessage
+			}
+
+			// Check each configured prefix to see if the message starts with it
+			for prefix := range prefixes {
+				// Check if message starts with the prefix followed by a space
+				// Example: "@code how do I..." matches prefix "@code"
+				prefixWithSpace := prefix + prefixSeparator
+				if strings.HasPrefix(userMessage, prefixWithSpace) {
+					// Extract the actual message without the prefix
+					matchedPrefix = prefix
+					messageWithoutPrefix = strings.TrimPrefix(userMessage, prefixWithSpace)
+					lastUserIndex = index
+					p.logRequestf("INFO: Detected template prefix %s in %s message, processing template", prefix, messageMap["role"])
+					break // Only process the first matching prefix
+				}
+			}
+			if matchedPrefix != "" {
+				break
+			}
 		}
-		if role, ok := messageMap["role"].(string); ok && role == "user" {
-			lastUserIndex = i
-			break
+		if p.debugEnabled() {
+			if matchedPrefix != "" {
+				p.debugf("Prefix match: checked %v in %d message(s), matched %s with separator %q, %d bytes left after stripping",
+					config.SortedPrefixes(prefixes), len(candidates), matchedPrefix, prefixSeparator, len(messageWithoutPrefix))
+			} else {
+				p.debugf("Prefix match: checked %v in %d message(s), no match", config.SortedPrefixes(prefixes), len(candidates))
+			}
 		}
-	}
 
-	// Track which prefix is used for this request (empty string if none)
-	requestPrefix := ""
+		// The template header selects a template as well; if it disagrees
+		// with the message prefix, template_selection_priority decides
+		if headerPrefix := strings.TrimSpace(r.Header.Get(templateHeader)); headerPrefix != "" {
+			if _, configured := prefixes[headerPrefix]; !configured {
+				if p.config.UnknownPrefixBehavior == config.UnknownPrefixError {
+					log.Printf("WARNING: Rejecting request with unknown template %s in %s header", headerPrefix, templateHeader)
+					http.Error(w, fmt.Sprintf("Unknown template prefix %s", headerPrefix), http.StatusBadRequest)
+					return
+				}
+				log.Printf("WARNING: Ignoring unknown template %s in %s header", headerPrefix, templateHeader)
+			} else if matchedPrefix == "" {
+				matchedPrefix = headerPrefix
+				p.logRequestf("INFO: Using template prefix %s selected by %s header", headerPrefix, templateHeader)
+			} else if headerPrefix != matchedPrefix {
+				if p.config.TemplateSelectionPriority != config.TemplateSelectionMessage {
+					p.debugf("Template header %s and message prefix %s disagree, using the header", headerPrefix, matchedPrefix)
+					matchedPrefix = headerPrefix
+				} else {
+					p.debugf("Template header %s and message prefix %s disagree, using the message", headerPrefix, matchedPrefix)
+				}
+			}
+		}
 
-	// If there's a user message, check for template prefix
-	if lastUserIndex >= 0 {
-		messageMap := messagesArray[lastUserIndex].(map[string]interface{})
-		userMessage, ok := messageMap["content"].(string)
-		if !ok {
-			log.Printf("ERROR: User message content is not a string")
-			http.Error(w, "Message content must be a string", http.StatusBadRequest)
-			return
+		// A message starting with an @prefix that isn't configured (a typo,
+		// or a prefix removed by a reload) is forwarded as is unless
+		// unknown_prefix_behavior is "error"
+		if matchedPrefix == "" && p.config.UnknownPrefixBehavior == config.UnknownPrefixError {
+			for _, index := range candidates {
+				content, _ := messagesArray[index].(map[string]interface{})["content"].(string)
+				if unknown := leadingPrefix(content); unknown != "" {
+					log.Printf("WARNING: Rejecting request with unknown template prefix %s", unknown)
+					http.Error(w, fmt.Sprintf("Unknown template prefix %s", unknown), http.StatusBadRequest)
+					return
+				}
+			}
 		}
 
-		// Check each configured prefix to see if the message starts with it
-		for prefix := range p.config.Prefixes {
-			// Check if message starts with the prefix followed by a space
-			// Example: "@code how do I..." matches prefix "@code"
-			prefixWithSpace := prefix + " "
-			if strings.HasPrefix(userMessage, prefixWithSpace) {
-				// Extract the actual message without the prefix
-				messageWithoutPrefix := strings.TrimPrefix(userMessage, prefixWithSpace)
+		// The model's prefix applies unless the message names one itself
+		if matchedPrefix == "" && modelPrefix != "" {
+			matchedPrefix = modelPrefix
+			p.logRequestf("INFO: Using template prefix %s selected by model %s", modelPrefix, requestMap["model"])
+		}
 
-				log.Printf("INFO: Detected template prefix %s, processing template", prefix)
+		// Sticky prefixes: remember the prefix per conversation and keep
+		// applying it to later turns that don't specify one
+		if p.conversations != nil {
+			if conversationID := r.Header.Get(conversationIDHeader); conversationID != "" {
+				if matchedPrefix != "" {
+					p.conversations.Put(conversationID, matchedPrefix)
+				} else if sticky, ok := p.conversations.Get(conversationID); ok {
+					if _, configured := prefixes[sticky]; configured {
+						matchedPrefix = sticky
+						p.logRequestf("INFO: Applying sticky prefix %s for conversation %s", sticky, conversationID)
+					}
+				}
+			}
+		}
 
-				// Process the template with the user's message
-				processedTemplate, err := p.watcher.ProcessTemplate(prefix, messageWithoutPrefix)
-				if err != nil {
-					log.Printf("ERROR: Failed to process template %s: %v", prefix, err)
-					http.Error(w, fmt.Sprintf("Template processing failed: %v", err), http.StatusInternalServerError)
-					return
+		if matchedPrefix != "" {
+			prefix := matchedPrefix
+			prefixCfg := prefixes[prefix]
+
+			if p.config.TrimMessageWhitespace {
+				messageWithoutPrefix = strings.TrimSpace(messageWithoutPrefix)
+			}
+
+			// Pick the template to use - for A/B prefixes this is a weighted
+			// random choice between variants, each with its own KV cache
+			templateRef := pickWeighted(prefixCfg.Templates(prefix), rand.Float64())
+			if templateRef.Variant != "" {
+				p.logRequestf("INFO: Selected variant %s for %s", templateRef.Variant, prefix)
+				if p.metrics != nil {
+					p.metrics.RecordTemplateVariantRequest(prefix, templateRef.Variant)
 				}
+			}
+			if p.metrics != nil {
+				p.metrics.RecordTemplateRequest(templateRef.Key)
+			}
 
-				// Replace the message content with the processed template
-				messageMap["content"] = processedTemplate
-				requestPrefix = prefix // Track that we're using this prefix
+			// Process the template with the user's message
+			processedTemplate, err := p.watcher.ProcessTemplateWithHistory(templateRef.Key, messageWithoutPrefix, messageHistory(messagesArray[:lastUserIndex]))
+			if err != nil {
+				log.Printf("ERROR: Failed to process template %s: %v", templateRef.Key, err)
+				http.Error(w, fmt.Sprintf("Template processing failed: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			// Place the processed template in the messages array
+			injectTemplate(requestMap, lastUserIndex, prefixCfg.Position, processedTemplate, messageWithoutPrefix)
+			requestPrefix = templateRef.Key // Track that we're using this template
+			requestBackend = prefixCfg.Backend
 
-				log.Printf("INFO: Template %s processed successfully (%d bytes)", prefix, len(processedTemplate))
-				break // Only process the first matching prefix
+			// Merge template-defined stop sequences with any client-provided ones
+			if stops := prefixCfg.Stop; len(stops) > 0 {
+				mergeStopSequences(requestMap, stops)
 			}
+
+			// Merge template-defined tools with any client-provided ones
+			if tools := p.config.ToolsFor(prefixCfg); len(tools) > 0 {
+				mergeTools(requestMap, tools)
+			}
+
+			// Apply template-defined request fields, e.g. a fixed temperature
+			if overrides := prefixCfg.RequestOverrides; len(overrides) > 0 {
+				mergeRequestOverrides(requestMap, overrides, prefixCfg.ForceOverrides)
+				overriddenFields = slices.Collect(maps.Keys(overrides))
+			}
+
+			p.logRequestf("INFO: Template %s processed successfully (%d bytes)", prefix, len(processedTemplate))
+		}
+	}
+
+	// Capped after the template's request_overrides, which can't bypass it,
+	// and streaming is known only once they may have set it
+	p.capMaxTokens(requestMap)
+	normalizeStream(requestMap)
+	streaming, _ = requestMap["stream"].(bool)
+
+	// Route to the prefix's own backend if it has one, otherwise spread
+	// requests over the healthy backends of the pool, if configured. Each
+	// backend has its own KV cache and therefore its own state. Picked
+	// before admission, so a request without a healthy backend neither
+	// takes a slot nor cancels a warmup
+	pooled := false
+	if requestBackend == "" && p.backendPicker != nil {
+		picked, err := p.backendPicker.Pick(rand.Float64())
+		if err != nil {
+			log.Printf("ERROR: Failed to pick a backend: %v", err)
+			if p.metrics != nil {
+				p.metrics.RecordRequest(r.URL.Path, http.StatusServiceUnavailable)
+			}
+			writeUnavailableError(w, "No healthy backend available", "backend_unavailable")
+			return
+		}
+		requestBackend = picked
+		pooled = true
+	}
+
+	// Streaming clients get the SSE headers and heartbeats right away, as
+	// everything from here on may take long before the backend's first
+	// byte: the admission grace wait, a lazy warmup, the KV cache restore
+	// and a backend sending its headers only with the first token
+	if streaming && p.config.SSEHeartbeatInterval > 0 {
+		if early := startEarlySSE(w, time.Duration(p.config.SSEHeartbeatInterval)*time.Second); early != nil {
+			w = early
+			defer early.finish()
+		}
+	}
+
+	// ADMISSION CONTROL: Acquire permission to run user query
+	// This atomically transitions state and cancels any warmup if needed
+	// The admission controller ensures no race conditions
+	if !p.admissionCtrl.AcquireUserQuery() {
+		p.logRequestf("WARNING: Rejected %s %s, too many concurrent requests", r.Method, r.URL.Path)
+		if p.metrics != nil {
+			p.metrics.RecordRequest(r.URL.Path, http.StatusServiceUnavailable)
+		}
+		writeBusyError(w)
+		return
+	}
+	defer p.admissionCtrl.ReleaseUserQuery()
+
+	backend, backendState, kvCache, err := p.backendFor(requestBackend)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(w, "Invalid backend for prefix", http.StatusInternalServerError)
+		return
+	}
+
+	// Lazy templates are warmed up before their first request is forwarded;
+	// the request already holds the backend, so this blocks only this request.
+	// Warmups only reach BackendURL and per-prefix backends, so requests picked
+	// for another pool member are not held up by a warmup they can't use
+	warmable := !pooled || backend == p.backend
+	if requestPrefix != "" && p.lazyWarmer != nil && warmable {
+		if err := p.lazyWarmer.WarmupOnFirstUse(r.Context(), requestPrefix); err != nil {
+			log.Printf("WARNING: Lazy warmup of %s failed, forwarding anyway: %v", requestPrefix, err)
 		}
 	}
 
 	// BEFORE sending the request to llama.cpp:
-	// Perform KV cache save/restore operations based on state transitions
+	// Perform KV cache save/restore operations based on state transitions.
+	// State tracks cache keys, which prefixes sharing a cache have in common.
+	cacheKey := p.config.CacheKeyFor(requestPrefix)
+
+	// With KV cache operations disabled, state is still tracked but no
+	// save/restore calls are made
+	if !p.config.DisableKVCache {
+		// Step 1: Save old KV cache if we're switching away from a different template
+		if backendState.ShouldSave(cacheKey) {
+			oldPrefix := backendState.GetLastPrefix()
+			oldFilename := strings.TrimPrefix(oldPrefix, "@") + ".bin"
+			log.Printf("Saving KV cache for %s before switching to %s", oldPrefix, cacheKey)
+			_, saveSpan := p.tracer.Start(r.Context(), "kv_cache.save", tracing.SpanKindClient)
+			saveSpan.SetAttribute("bioproxy.prefix", oldPrefix)
+			if err := kvCache.Save(oldPrefix, oldFilename); err != nil {
+				log.Printf("WARNING: Failed to save KV cache for %s: %v", oldPrefix, err)
+				saveSpan.SetError(err)
+				// Don't fail the request - continue
+			}
+			saveSpan.Finish()
+		}
 
-	// Step 1: Save old KV cache if we're switching away from a different template
-	if p.backendState.ShouldSave(requestPrefix) {
-		oldPrefix := p.backendState.GetLastPrefix()
-		oldFilename := strings.TrimPrefix(oldPrefix, "@") + ".bin"
-		log.Printf("Saving KV cache for %s before switching to %s", oldPrefix, requestPrefix)
-		if err := p.kvCache.Save(oldPrefix, oldFilename); err != nil {
-			log.Printf("WARNING: Failed to save KV cache for %s: %v", oldPrefix, err)
-			// Don't fail the request - continue
+		// Step 2: Restore new KV cache if we're switching to a different template
+		if backendState.ShouldRestore(cacheKey) {
+			cacheFilename := strings.TrimPrefix(cacheKey, "@") + ".bin"
+			log.Printf("Restoring KV cache for %s", cacheKey)
+			_, restoreSpan := p.tracer.Start(r.Context(), "kv_cache.restore", tracing.SpanKindClient)
+			restoreSpan.SetAttribute("bioproxy.prefix", cacheKey)
+			if err := kvCache.Restore(cacheKey, cacheFilename); errors.Is(err, kvcache.ErrCacheNotFound) {
+				// Not warmed up yet - llama.cpp processes the full prompt
+				p.logRequestf("INFO: No saved KV cache for %s yet", cacheKey)
+				restoreSpan.SetAttribute("bioproxy.cache_found", false)
+			} else if err != nil {
+				log.Printf("WARNING: Failed to restore KV cache for %s: %v", cacheKey, err)
+				restoreSpan.SetError(err)
+				// Don't fail the request - llama.cpp can handle it without cache
+			}
+			restoreSpan.Finish()
+		} else if cacheKey != "" {
+			p.logRequestf("Skipping KV cache restore for %s (already loaded)", cacheKey)
 		}
 	}
 
-	// Step 2: Restore new KV cache if we're switching to a different template
-	if p.backendState.ShouldRestore(requestPrefix) {
-		cacheFilename := strings.TrimPrefix(requestPrefix, "@") + ".bin"
-		log.Printf("Restoring KV cache for %s", requestPrefix)
-		if err := p.kvCache.Restore(requestPrefix, cacheFilename); err != nil {
-			log.Printf("WARNING: Failed to restore KV cache for %s: %v", requestPrefix, err)
-			// Don't fail the request - llama.cpp can handle it without cache
+	// Let llama.cpp reuse the loaded prompt cache, unless the client decided
+	if p.config.EnablePromptCache {
+		if _, set := requestMap["cache_prompt"]; !set {
+			requestMap["cache_prompt"] = true
 		}
-	} else if requestPrefix != "" {
-		log.Printf("Skipping KV cache restore for %s (already loaded)", requestPrefix)
 	}
 
 	// Marshal the (possibly modified) request back to JSON
@@ -416,10 +1030,17 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optionally verify that injection only touched the fields it is meant to
+	if p.config.VerifyPassthrough {
+		for _, problem := range checkPassthrough(bodyBytes, modifiedBody, overriddenFields...) {
+			log.Printf("WARNING: Request passthrough check: %s", problem)
+		}
+	}
+
 	// Create a new request to forward to llama.cpp
 	// Clone the original request but with our modified body
-	backendURL := *p.backend
-	backendURL.Path = r.URL.Path
+	backendURL := *backend
+	backendURL.Path = strings.TrimSuffix(backend.Path, "/") + p.config.BackendPath(r.URL.Path)
 	backendURL.RawQuery = r.URL.RawQuery
 
 	proxyReq, err := http.NewRequest(r.Method, backendURL.String(), bytes.NewReader(modifiedBody))
@@ -431,16 +1052,27 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 
 	// Copy headers from original request
 	proxyReq.Header = r.Header.Clone()
+	p.setBackendAuth(proxyReq.Header)
 	// Update Content-Length since body might have changed
 	proxyReq.ContentLength = int64(len(modifiedBody))
 
-	log.Printf("INFO: Forwarding chat completion request to %s", backendURL.String())
+	// The backend call span covers streaming the response back; its ID is
+	// propagated so the backend continues the trace
+	_, backendSpan := p.tracer.Start(r.Context(), "backend.chat_completions", tracing.SpanKindClient)
+	defer backendSpan.Finish()
+	backendSpan.Inject(proxyReq.Header)
+
+	p.logRequestf("INFO: Forwarding chat completion request to %s", backendURL.String())
+	if p.metrics != nil {
+		p.metrics.RecordBackendRequest(admin.BackendSourceUser)
+	}
 
 	// Forward the request to llama.cpp and stream response back
-	// We use the default HTTP client which supports streaming
-	resp, err := http.DefaultClient.Do(proxyReq)
+	// The pooled client reuses keep-alive connections and supports streaming
+	resp, err := p.client.Do(proxyReq)
 	if err != nil {
 		log.Printf("ERROR: Backend request failed: %v", err)
+		backendSpan.SetError(err)
 		if p.metrics != nil {
 			p.metrics.RecordRequest(r.URL.Path, http.StatusBadGateway)
 		}
@@ -449,19 +1081,52 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
-	log.Printf("INFO: Backend responded with status %d", resp.StatusCode)
+	p.logRequestf("INFO: Backend responded with status %d", resp.StatusCode)
+	backendSpan.SetAttribute("http.response.status_code", resp.StatusCode)
+
+	if p.checkBackendAuth(resp.StatusCode) {
+		if p.metrics != nil {
+			p.metrics.RecordRequest(r.URL.Path, http.StatusBadGateway)
+		}
+		writeBackendAuthError(w)
+		return
+	}
 
 	// Update state to reflect that this prefix is now loaded
 	// We do this AFTER the request succeeds, but BEFORE streaming the response
-	// We do NOT save the KV cache here - we only save when switching away
-	p.backendState.UpdatePrefix(requestPrefix)
+	// We do NOT save the KV cache here - we only save when switching away,
+	// or from the warmup loop after SaveEveryNRequests requests
+	backendState.UpdatePrefix(cacheKey)
+	backendState.CountRequest(cacheKey)
 
 	// Record metrics
 	if p.metrics != nil {
 		p.metrics.RecordRequest(r.URL.Path, resp.StatusCode)
 	}
 
+	// Detect a non-SSE response to a streaming request
+	// (e.g. llama.cpp returning a JSON error body with 200)
+	if streaming && !isEventStream(resp.Header.Get("Content-Type")) {
+		log.Printf("WARNING: Client requested stream=true but backend responded with Content-Type %q",
+			resp.Header.Get("Content-Type"))
+		if p.metrics != nil {
+			p.metrics.RecordStreamMismatch()
+		}
+		if p.config.WrapNonSSEErrors {
+			p.writeAsSSE(w, resp)
+			return
+		}
+	}
+
+	// Optionally transform complete (non-streaming) JSON responses.
+	// Streaming responses are never buffered and always pass through untouched.
+	if !streaming && len(p.rewriters) > 0 && resp.StatusCode == http.StatusOK && isJSON(resp.Header.Get("Content-Type")) {
+		p.writeRewritten(w, resp)
+		return
+	}
+
 	// Copy response headers to client
+	p.stripResponseHeaders(resp.Header)
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
@@ -475,6 +1140,13 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 	// This supports both regular responses and Server-Sent Events (SSE) streaming.
 	// For SSE, each chunk is flushed immediately as it arrives from llama.cpp.
 	if flusher, ok := w.(http.Flusher); ok {
+		// Streams stay listed until they complete or the client disconnects
+		var activeStream *admin.ActiveStream
+		if streaming && p.streams != nil {
+			activeStream = p.streams.Add(requestPrefix, r.URL.Path)
+			defer activeStream.Done()
+		}
+
 		// ResponseWriter supports flushing - enable streaming
 		buf := make([]byte, 32*1024) // 32KB buffer
 		for {
@@ -485,6 +1157,9 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 				flusher.Flush() // Immediately send data to client
+				if activeStream != nil {
+					activeStream.AddBytes(n)
+				}
 			}
 			if err == io.EOF {
 				break
@@ -500,3 +1175,643 @@ func (p *Proxy) handleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		io.Copy(w, resp.Body)
 	}
 }
+
+// sseHeartbeat is an SSE comment line, ignored by clients
+const sseHeartbeat = ": heartbeat\n\n"
+
+// startSSEHeartbeat writes sseHeartbeat to w every interval until the
+// returned stop function is called. stop waits for a heartbeat being
+// written, so w is free to use once it returns, and may be called again.
+func startSSEHeartbeat(w io.Writer, flusher http.Flusher, interval time.Duration) (stop func()) {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := io.WriteString(w, sseHeartbeat); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopCh)
+			<-doneCh
+		})
+	}
+}
+
+// earlySSEWriter is the ResponseWriter of a streaming chat completion whose
+// SSE headers were sent before the request was forwarded (see
+// startEarlySSE). The status can't change anymore, so an event stream
+// written to it is passed through, stopping the heartbeat, while any other
+// response (an error from bioproxy or the backend) is sent as a single
+// "data:" frame by finish.
+type earlySSEWriter struct {
+	w             http.ResponseWriter
+	flusher       http.Flusher
+	stopHeartbeat func()
+
+	// header, status and body are those of the response written after the
+	// early headers; body is only kept when it isn't an event stream
+	header      http.Header
+	status      int
+	passthrough bool
+	body        bytes.Buffer
+}
+
+// startEarlySSE sends a 200 text/event-stream response header to w and
+// starts the heartbeat. Returns nil if w can't stream.
+func startEarlySSE(w http.ResponseWriter, interval time.Duration) *earlySSEWriter {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &earlySSEWriter{
+		w:             w,
+		flusher:       flusher,
+		stopHeartbeat: startSSEHeartbeat(w, flusher, interval),
+		header:        make(http.Header),
+	}
+}
+
+// Header returns the headers of the response written after the early
+// headers, which are not sent
+func (e *earlySSEWriter) Header() http.Header {
+	return e.header
+}
+
+// WriteHeader records the status and whether the response is an event stream
+func (e *earlySSEWriter) WriteHeader(statusCode int) {
+	if e.status != 0 {
+		return
+	}
+	e.status = statusCode
+	e.passthrough = isEventStream(e.header.Get("Content-Type"))
+}
+
+// Write passes event streams through and keeps anything else for finish
+func (e *earlySSEWriter) Write(b []byte) (int, error) {
+	if e.status == 0 {
+		e.WriteHeader(http.StatusOK)
+	}
+	if !e.passthrough {
+		return e.body.Write(b)
+	}
+	e.stopHeartbeat()
+	return e.w.Write(b)
+}
+
+// Flush flushes a passed through event stream
+func (e *earlySSEWriter) Flush() {
+	if e.passthrough {
+		e.flusher.Flush()
+	}
+}
+
+// finish stops the heartbeat and sends a response that isn't an event
+// stream as a "data:" frame: a JSON body as is, anything else as an
+// OpenAI-style error with the response status
+func (e *earlySSEWriter) finish() {
+	e.stopHeartbeat()
+	if e.passthrough || e.status == 0 {
+		return
+	}
+
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, e.body.Bytes()); err != nil {
+		payload.Reset()
+		json.NewEncoder(&payload).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": strings.TrimSpace(e.body.String()),
+				"code":    e.status,
+			},
+		})
+	}
+	if _, err := fmt.Fprintf(e.w, "data: %s\n\n", bytes.TrimSpace(payload.Bytes())); err != nil {
+		log.Printf("ERROR: Failed to write response: %v", err)
+		return
+	}
+	e.flusher.Flush()
+}
+
+// isEventStream reports whether a Content-Type header denotes Server-Sent Events
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// writeAsSSE wraps a non-streaming backend response into a single SSE "data:" frame
+// so streaming clients can handle it gracefully. The body is read fully, which is
+// safe here because it is not an event stream.
+func (p *Proxy) writeAsSSE(w http.ResponseWriter, resp *http.Response) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("ERROR: Failed to read backend response: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(resp.StatusCode)
+
+	// Multi-line payloads become one "data:" line per line, which SSE
+	// clients join back together with newlines
+	var frame strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(string(body), "\r\n"), "\n") {
+		frame.WriteString("data: ")
+		frame.WriteString(strings.TrimSuffix(line, "\r"))
+		frame.WriteString("\n")
+	}
+	frame.WriteString("\n")
+
+	if _, err := io.WriteString(w, frame.String()); err != nil {
+		log.Printf("ERROR: Failed to write response: %v", err)
+	}
+}
+
+// newBackendTransport creates the HTTP transport used for all proxy traffic to
+// the backend, starting from the config's backend transport (Go's default
+// with the backend TLS settings) and applying the pool settings from config.
+// Zero values keep Go's defaults.
+func newBackendTransport(cfg *config.Config) (*http.Transport, error) {
+	transport, err := cfg.BackendTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.BackendMaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.BackendMaxIdleConns
+	}
+	if cfg.BackendMaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.BackendMaxIdleConnsPerHost
+	}
+	if cfg.BackendIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(cfg.BackendIdleConnTimeout) * time.Second
+	}
+	if cfg.BackendForceHTTP1 {
+		// A non-nil empty TLSNextProto map disables HTTP/2 negotiation
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return transport, nil
+}
+
+// backendFor returns the URL, state tracker and KV cache client of a prefix's
+// backend override. An empty override (or one equal to BackendURL) means the
+// default backend.
+func (p *Proxy) backendFor(backend string) (*url.URL, *state.State, *kvcache.Client, error) {
+	backend = strings.TrimSuffix(backend, "/")
+	if backend == "" || backend == strings.TrimSuffix(p.config.BackendURL, "/") {
+		return p.backend, p.backendState, p.kvCache, nil
+	}
+
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid backend URL %s: %w", backend, err)
+	}
+	return backendURL, p.backendState.Backend(backend), p.newKVCache(backend), nil
+}
+
+// newKVCache returns a KV cache client for a backend, sending
+// BackendAuthToken like proxied requests
+func (p *Proxy) newKVCache(backend string) *kvcache.Client {
+	kvCache := kvcache.New(p.config.BackendBaseURL(backend), p.client, p.metrics)
+	kvCache.SetAuthToken(p.config.BackendAuthToken)
+	return kvCache
+}
+
+// clientPath returns the path a client requested, given the path of the
+// backend request the reverse proxy made for it (with BackendPathPrefix)
+func (p *Proxy) clientPath(backendPath string) string {
+	if p.config.BackendPathPrefix == "" {
+		return backendPath
+	}
+	return strings.TrimPrefix(backendPath, p.config.BackendPathPrefix)
+}
+
+// setBackendAuth replaces the Authorization header of a backend request with
+// BackendAuthToken, if configured, so client credentials never reach llama.cpp
+func (p *Proxy) setBackendAuth(header http.Header) {
+	if p.config.BackendAuthToken != "" {
+		header.Set("Authorization", "Bearer "+p.config.BackendAuthToken)
+	}
+}
+
+// errBackendAuth is returned by ModifyResponse when the backend rejected
+// BackendAuthToken and BackendAuthFailure is "error"
+var errBackendAuth = errors.New("backend rejected backend_auth_token")
+
+// checkBackendAuth counts a backend 401/403 response to a request carrying
+// BackendAuthToken, and reports whether it should be replaced with
+// writeBackendAuthError (BackendAuthFailure "error"). Without a token the
+// client's own credentials were rejected, which is not counted.
+func (p *Proxy) checkBackendAuth(statusCode int) bool {
+	if p.config.BackendAuthToken == "" || (statusCode != http.StatusUnauthorized && statusCode != http.StatusForbidden) {
+		return false
+	}
+	log.Printf("WARNING: Backend rejected backend_auth_token with status %d", statusCode)
+	if p.metrics != nil {
+		p.metrics.RecordBackendAuthFailure()
+	}
+	return p.config.BackendAuthFailure == config.BackendAuthFailureError
+}
+
+// busyRetryAfter is the Retry-After value (seconds) of requests rejected by
+// admission control
+const busyRetryAfter = "1"
+
+// writeBusyError responds with a 503 and an OpenAI-style JSON error body to
+// a request rejected by admission control, so clients can back off
+func writeBusyError(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", busyRetryAfter)
+	writeUnavailableError(w, "Too many concurrent requests, retry later", "server_busy")
+}
+
+// writeUnavailableError responds with a 503 and an OpenAI-style JSON error
+// body with the given message and error type
+func writeUnavailableError(w http.ResponseWriter, message, errorType string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    errorType,
+			"code":    http.StatusServiceUnavailable,
+		},
+	})
+}
+
+// writeBackendAuthError responds with a 502 telling the client the backend
+// rejected bioproxy's credentials rather than theirs
+func writeBackendAuthError(w http.ResponseWriter) {
+	http.Error(w, "Backend rejected proxy credentials (check backend_auth_token)", http.StatusBadGateway)
+}
+
+// stripResponseHeaders removes the configured StripResponseHeaders from
+// backend response headers before they are forwarded to the client
+func (p *Proxy) stripResponseHeaders(header http.Header) {
+	for _, name := range p.config.StripResponseHeaders {
+		header.Del(name)
+	}
+}
+
+// templateHeader is the request header selecting a template by prefix,
+// as an alternative to a prefix in the message, e.g. "@code"
+const templateHeader = "X-Bioproxy-Template"
+
+// prefixSeparator separates a template prefix from the message, e.g. "@code how..."
+const prefixSeparator = " "
+
+// logRequestf logs a per-request INFO line unless LogRequests is off.
+// Warnings and errors are logged regardless.
+func (p *Proxy) logRequestf(format string, args ...interface{}) {
+	if p.config.LogRequests {
+		log.Printf(format, args...)
+	}
+}
+
+// debugEnabled reports whether DEBUG lines are logged (LogLevel "debug")
+func (p *Proxy) debugEnabled() bool {
+	return p.config.Debug()
+}
+
+// debugf logs a DEBUG line when LogLevel is "debug"
+func (p *Proxy) debugf(format string, args ...interface{}) {
+	if p.debugEnabled() {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
+
+// leadingPrefix returns the @prefix a message starts with, e.g. "@foo" for
+// "@foo how...", or "" if it doesn't start with one
+func leadingPrefix(message string) string {
+	token, _, found := strings.Cut(message, prefixSeparator)
+	if !found || len(token) < 2 || !strings.HasPrefix(token, "@") {
+		return ""
+	}
+	return token
+}
+
+// lastMessagesByRole returns the index of the last message of each of the given
+// roles, latest first. Messages that are not objects are ignored.
+func lastMessagesByRole(messages []interface{}, roles []string) []int {
+	var indexes []int
+	seen := make(map[string]bool)
+	for i := len(messages) - 1; i >= 0; i-- {
+		messageMap, ok := messages[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, ok := messageMap["role"].(string)
+		if !ok || seen[role] {
+			continue
+		}
+		for _, r := range roles {
+			if role == r {
+				seen[role] = true
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+	return indexes
+}
+
+// messageHistory converts chat messages into the history substituted for
+// <{history}>. Messages without a string role and content are skipped.
+func messageHistory(messages []interface{}) []template.Message {
+	var history []template.Message
+	for _, msg := range messages {
+		messageMap, ok := msg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, roleOK := messageMap["role"].(string)
+		content, contentOK := messageMap["content"].(string)
+		if !roleOK || !contentOK {
+			continue
+		}
+		history = append(history, template.Message{Role: role, Content: content})
+	}
+	return history
+}
+
+// injectTemplate places the processed template into the request's messages array
+// according to position (see config.PrefixConfig.Position):
+//   - inplace (or empty): the last user message content becomes the template
+//   - prepend-system/prepend-user: the template is inserted as a new first
+//     message with that role; the last user message keeps its text without the prefix
+func injectTemplate(requestMap map[string]interface{}, userIndex int, position, processedTemplate, message string) {
+	messages := requestMap["messages"].([]interface{})
+	userMessage := messages[userIndex].(map[string]interface{})
+
+	var role string
+	switch position {
+	case config.PositionPrependSystem:
+		role = "system"
+	case config.PositionPrependUser:
+		role = "user"
+	default:
+		userMessage["content"] = processedTemplate
+		return
+	}
+
+	userMessage["content"] = message
+	injected := map[string]interface{}{"role": role, "content": processedTemplate}
+	requestMap["messages"] = append([]interface{}{injected}, messages...)
+}
+
+// normalizeStream converts a string "stream" value ("true"/"false", as sent
+// by some buggy SDKs) to a boolean, so llama.cpp and the proxy agree on
+// whether the response is streamed. Other values are left alone.
+func normalizeStream(requestMap map[string]interface{}) {
+	value, ok := requestMap["stream"].(string)
+	if !ok {
+		return
+	}
+	stream, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("WARNING: Request has non-boolean stream value %q, forwarding as is", value)
+		return
+	}
+	log.Printf("INFO: Normalized string stream value %q to %t", value, stream)
+	requestMap["stream"] = stream
+}
+
+// tokenLimitFields are the request fields limiting the generated tokens:
+// OpenAI's max_tokens and max_completion_tokens, and llama.cpp's n_predict
+var tokenLimitFields = []string{"max_tokens", "max_completion_tokens", "n_predict"}
+
+// capMaxTokens applies MaxTokensCap to every token limit field of the
+// request and records the largest requested limit in metrics. Values sent
+// as strings are parsed; negative values (n_predict -1 is unlimited) and
+// values that aren't numbers are replaced by the cap as well. Requests
+// without any token limit get max_tokens set to the cap.
+func (p *Proxy) capMaxTokens(requestMap map[string]interface{}) {
+	limit := p.config.MaxTokensCap
+	requested, hasRequested, hasLimit, clamped := 0.0, false, false, false
+	for _, field := range tokenLimitFields {
+		value, set := requestMap[field]
+		if !set {
+			continue
+		}
+		hasLimit = true
+		n, numeric := tokenLimit(value)
+		if numeric && n >= 0 && (!hasRequested || n > requested) {
+			requested, hasRequested = n, true
+		}
+		if limit > 0 && (!numeric || n < 0 || n > float64(limit)) {
+			p.logRequestf("INFO: Reducing %s from %v to the cap of %d", field, value, limit)
+			requestMap[field] = limit
+			clamped = true
+		}
+	}
+
+	if hasRequested && p.metrics != nil {
+		p.metrics.RecordMaxTokens(int64(requested), clamped)
+	}
+	if limit > 0 && !hasLimit {
+		requestMap["max_tokens"] = limit
+	}
+}
+
+// tokenLimit returns the numeric value of a token limit field, which
+// clients may send as a number or a string
+func tokenLimit(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// mergeStopSequences adds the given stop sequences to the request's "stop" field.
+// Client-provided stops are preserved and duplicates are skipped.
+// The OpenAI API allows "stop" to be either a single string or an array of strings,
+// so both forms are accepted; the result is always written back as an array.
+func mergeStopSequences(requestMap map[string]interface{}, stops []string) {
+	var merged []interface{}
+	seen := make(map[string]bool)
+
+	switch existing := requestMap["stop"].(type) {
+	case string:
+		merged = append(merged, existing)
+		seen[existing] = true
+	case []interface{}:
+		for _, item := range existing {
+			merged = append(merged, item)
+			if str, ok := item.(string); ok {
+				seen[str] = true
+			}
+		}
+	}
+
+	for _, stop := range stops {
+		if !seen[stop] {
+			merged = append(merged, stop)
+			seen[stop] = true
+		}
+	}
+
+	requestMap["stop"] = merged
+}
+
+// mergeTools appends a prefix's tool definitions to the request's "tools"
+// array, skipping those whose function name a client tool already uses.
+// Tools are copied, so requests never share them.
+func mergeTools(requestMap map[string]interface{}, tools []map[string]interface{}) {
+	existing, _ := requestMap["tools"].([]interface{})
+	merged := slices.Clone(existing)
+	seen := make(map[string]bool)
+	for _, tool := range existing {
+		if name := toolName(tool); name != "" {
+			seen[name] = true
+		}
+	}
+
+	for _, tool := range tools {
+		name := toolName(tool)
+		if seen[name] {
+			continue
+		}
+		merged = append(merged, copyJSONValue(tool))
+		seen[name] = true
+	}
+
+	requestMap["tools"] = merged
+}
+
+// toolName returns the function name of an OpenAI tool definition, or ""
+func toolName(tool interface{}) string {
+	object, _ := tool.(map[string]interface{})
+	function, _ := object["function"].(map[string]interface{})
+	name, _ := function["name"].(string)
+	return name
+}
+
+// mergeRequestOverrides deep-merges a prefix's RequestOverrides into the
+// request. Objects present on both sides are merged key by key; any other
+// value (including arrays) is set only if the client didn't send it, unless
+// force is set. Override values are copied, so requests never share them.
+func mergeRequestOverrides(requestMap map[string]interface{}, overrides map[string]interface{}, force bool) {
+	for key, value := range overrides {
+		existing, exists := requestMap[key]
+		existingObject, existingIsObject := existing.(map[string]interface{})
+		overrideObject, overrideIsObject := value.(map[string]interface{})
+		if existingIsObject && overrideIsObject {
+			mergeRequestOverrides(existingObject, overrideObject, force)
+			continue
+		}
+		if !exists || force {
+			requestMap[key] = copyJSONValue(value)
+		}
+	}
+}
+
+// copyJSONValue deep-copies a decoded JSON value
+func copyJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = copyJSONValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyJSONValue(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// passthroughExemptFields are top-level request fields that template injection
+// modifies on purpose and are therefore skipped by checkPassthrough
+var passthroughExemptFields = map[string]bool{
+	"messages":              true, // Template injection rewrites the user message
+	"stop":                  true, // Template stop sequences are merged in
+	"tools":                 true, // Template tools are merged in
+	"stream":                true, // String values are normalized to booleans
+	"model":                 true, // Prefix pseudo-models are replaced by the real model
+	"max_tokens":            true, // Reduced to MaxTokensCap
+	"max_completion_tokens": true, // Reduced to MaxTokensCap
+	"n_predict":             true, // Reduced to MaxTokensCap
+}
+
+// checkPassthrough compares the top-level fields of the original and the
+// forwarded request body. It returns a description of every field that was
+// dropped or changed, ignoring fields listed in passthroughExemptFields and
+// exempt (e.g. those set by a prefix's request_overrides).
+// Values are compared after decoding, so formatting and key order don't matter.
+func checkPassthrough(original, modified []byte, exempt ...string) []string {
+	var originalFields, modifiedFields map[string]json.RawMessage
+	if err := json.Unmarshal(original, &originalFields); err != nil {
+		return []string{fmt.Sprintf("failed to parse original request: %v", err)}
+	}
+	if err := json.Unmarshal(modified, &modifiedFields); err != nil {
+		return []string{fmt.Sprintf("failed to parse forwarded request: %v", err)}
+	}
+
+	var problems []string
+	for key, originalRaw := range originalFields {
+		if passthroughExemptFields[key] || slices.Contains(exempt, key) {
+			continue
+		}
+		modifiedRaw, exists := modifiedFields[key]
+		if !exists {
+			problems = append(problems, fmt.Sprintf("field %q was dropped", key))
+			continue
+		}
+		var originalValue, modifiedValue interface{}
+		json.Unmarshal(originalRaw, &originalValue)
+		json.Unmarshal(modifiedRaw, &modifiedValue)
+		if !reflect.DeepEqual(originalValue, modifiedValue) {
+			problems = append(problems, fmt.Sprintf("field %q was changed", key))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// pickWeighted selects one template from refs by weight.
+// r must be in [0, 1); callers pass rand.Float64() (tests pass fixed values).
+// With a single ref it is always returned.
+func pickWeighted(refs []config.TemplateRef, r float64) config.TemplateRef {
+	total := 0.0
+	for _, ref := range refs {
+		total += ref.Weight
+	}
+
+	target := r * total
+	for _, ref := range refs {
+		if target < ref.Weight {
+			return ref
+		}
+		target -= ref.Weight
+	}
+
+	// Guard against floating point rounding on the upper edge
+	return refs[len(refs)-1]
+}
@@ -1,19 +1,33 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/oleksandr/bioproxy/internal/admin"
 	"github.com/oleksandr/bioproxy/internal/admission"
+	"github.com/oleksandr/bioproxy/internal/backendpool"
 	"github.com/oleksandr/bioproxy/internal/config"
 	"github.com/oleksandr/bioproxy/internal/state"
 	"github.com/oleksandr/bioproxy/internal/template"
+	"github.com/oleksandr/bioproxy/internal/tracing"
 )
 
 // createTestConfig creates a minimal config for testing
@@ -22,7 +36,7 @@ func createTestConfig(backendURL string) *config.Config {
 		ProxyHost:  "localhost",
 		ProxyPort:  0, // Let the OS assign a port for testing
 		BackendURL: backendURL,
-		Prefixes:   make(map[string]string), // Empty template mapping
+		Prefixes:   make(map[string]config.PrefixConfig), // Empty template mapping
 	}
 }
 
@@ -463,7 +477,7 @@ func TestTemplateInjection(t *testing.T) {
 
 	// Create proxy with the watcher
 	cfg := createTestConfig(backend.URL)
-	cfg.Prefixes = map[string]string{"@test": templateFile}
+	cfg.Prefixes = map[string]config.PrefixConfig{"@test": {Path: templateFile}}
 	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
 	if err != nil {
 		t.Fatalf("Failed to create proxy: %v", err)
@@ -560,7 +574,7 @@ func TestTemplateInjectionMultiTurn(t *testing.T) {
 
 	// Create proxy
 	cfg := createTestConfig(backend.URL)
-	cfg.Prefixes = map[string]string{"@test": templateFile}
+	cfg.Prefixes = map[string]config.PrefixConfig{"@test": {Path: templateFile}}
 	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
 	if err != nil {
 		t.Fatalf("Failed to create proxy: %v", err)
@@ -618,3 +632,2931 @@ func TestTemplateInjectionInvalidJSON(t *testing.T) {
 		t.Errorf("Expected status 400 for invalid JSON, got %d", rr.Code)
 	}
 }
+
+// TestTemplateStopSequences tests that per-prefix stop sequences are merged
+// into the forwarded request and that non-matching requests are left untouched
+func TestTemplateStopSequences(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/test_template.txt"
+	if err := os.WriteFile(templateFile, []byte("Template: <{message}>"), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	// Track what the backend receives
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequest = nil
+		json.NewDecoder(r.Body).Decode(&receivedRequest)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddTemplate("@test", templateFile); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	cfg := createTestConfig(backend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@test": {Path: templateFile, Stop: []string{"###", "END"}},
+	}
+	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	// Matching prefix with a client-provided stop that overlaps the template's
+	requestBody := `{"messages":[{"role":"user","content":"@test hello"}],"stop":["\n\n","###"]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	stops, ok := receivedRequest["stop"].([]interface{})
+	if !ok {
+		t.Fatalf("Expected stop array in backend request, got: %v", receivedRequest["stop"])
+	}
+	expected := []string{"\n\n", "###", "END"}
+	if len(stops) != len(expected) {
+		t.Fatalf("Expected stops %q, got %v", expected, stops)
+	}
+	for i, stop := range expected {
+		if stops[i] != stop {
+			t.Errorf("Expected stop[%d] = %q, got %v", i, stop, stops[i])
+		}
+	}
+
+	// Non-matching request should keep the client's stop field as-is
+	requestBody = `{"messages":[{"role":"user","content":"hello"}],"stop":"\n\n"}`
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr = httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if receivedRequest["stop"] != "\n\n" {
+		t.Errorf("Expected stop to be untouched for non-matching request, got: %v", receivedRequest["stop"])
+	}
+
+	// Non-matching request without stop should not gain one
+	requestBody = `{"messages":[{"role":"user","content":"hello"}]}`
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr = httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if _, exists := receivedRequest["stop"]; exists {
+		t.Errorf("Expected no stop field for non-matching request, got: %v", receivedRequest["stop"])
+	}
+}
+
+// TestRequestOverrides tests that per-prefix request overrides are merged
+// into the forwarded request, respecting client values unless forced
+func TestRequestOverrides(t *testing.T) {
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequest = nil
+		json.NewDecoder(r.Body).Decode(&receivedRequest)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	overrides := map[string]interface{}{
+		"temperature":     float64(0),
+		"top_k":           float64(1),
+		"response_format": map[string]interface{}{"type": "json_object", "strict": true},
+	}
+	requestBody := `{"messages":[{"role":"user","content":"@det hello"}],"temperature":0.8,"response_format":{"type":"text"}}`
+
+	tests := []struct {
+		name     string
+		force    bool
+		expected map[string]interface{}
+	}{
+		{"client values win", false, map[string]interface{}{
+			"temperature":     0.8,
+			"top_k":           float64(1),
+			"response_format": map[string]interface{}{"type": "text", "strict": true},
+		}},
+		{"forced", true, map[string]interface{}{
+			"temperature":     float64(0),
+			"top_k":           float64(1),
+			"response_format": map[string]interface{}{"type": "json_object", "strict": true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watcher := template.NewWatcher()
+			if err := watcher.AddInlineTemplate("@det", "Answer: <{message}>"); err != nil {
+				t.Fatalf("Failed to add template: %v", err)
+			}
+			cfg := createTestConfig(backend.URL)
+			cfg.Prefixes = map[string]config.PrefixConfig{
+				"@det": {Inline: "Answer: <{message}>", RequestOverrides: overrides, ForceOverrides: tt.force},
+			}
+			proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			// Twice, so a request modifying shared override values would show
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+				proxy.handleChatCompletion(httptest.NewRecorder(), req)
+
+				for key, want := range tt.expected {
+					if !reflect.DeepEqual(receivedRequest[key], want) {
+						t.Errorf("Expected %s = %v, got %v", key, want, receivedRequest[key])
+					}
+				}
+			}
+
+			// Requests without the prefix are untouched
+			req := httptest.NewRequest("POST", "/v1/chat/completions",
+				strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`))
+			proxy.handleChatCompletion(httptest.NewRecorder(), req)
+			if _, exists := receivedRequest["top_k"]; exists {
+				t.Errorf("Expected no overrides without the prefix, got %v", receivedRequest)
+			}
+		})
+	}
+
+	if overrides["response_format"].(map[string]interface{})["type"] != "json_object" {
+		t.Errorf("Expected configured overrides to be unchanged, got %v", overrides)
+	}
+}
+
+// TestPrefixTools tests that a prefix's tools are merged into the request's
+// tools array, keeping client tools and deduplicating by function name
+func TestPrefixTools(t *testing.T) {
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequest = nil
+		json.NewDecoder(r.Body).Decode(&receivedRequest)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddInlineTemplate("@agent", "Use tools: <{message}>"); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	cfg := createTestConfig(backend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@agent": {Inline: "Use tools: <{message}>", Tools: []map[string]interface{}{
+			{"type": "function", "function": map[string]interface{}{"name": "search", "description": "from config"}},
+			{"type": "function", "function": map[string]interface{}{"name": "fetch"}},
+		}},
+	}
+	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	toolNames := func() []string {
+		var names []string
+		tools, _ := receivedRequest["tools"].([]interface{})
+		for _, tool := range tools {
+			names = append(names, toolName(tool))
+		}
+		return names
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"prefix tools only", `{"messages":[{"role":"user","content":"@agent find it"}]}`, []string{"search", "fetch"}},
+		{"merged with client tools",
+			`{"messages":[{"role":"user","content":"@agent find it"}],"tools":[{"type":"function","function":{"name":"search","description":"from client"}},{"type":"function","function":{"name":"calc"}}]}`,
+			[]string{"search", "calc", "fetch"}},
+		{"no prefix", `{"messages":[{"role":"user","content":"find it"}]}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body))
+			proxy.handleChatCompletion(httptest.NewRecorder(), req)
+			if names := toolNames(); !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("Expected tools %v, got %v", tt.expected, names)
+			}
+		})
+	}
+
+	// The client's definition of a tool wins over the prefix's
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tests[1].body))
+	proxy.handleChatCompletion(httptest.NewRecorder(), req)
+	search := receivedRequest["tools"].([]interface{})[0]
+	if description := search.(map[string]interface{})["function"].(map[string]interface{})["description"]; description != "from client" {
+		t.Errorf("Expected the client's search tool to be kept, got description %v", description)
+	}
+}
+
+// TestPickWeightedDistribution tests that weighted variant selection follows the weights
+func TestPickWeightedDistribution(t *testing.T) {
+	prefixCfg := config.PrefixConfig{
+		Variants: []config.VariantConfig{
+			{Name: "a", Path: "a.txt", Weight: 3},
+			{Name: "b", Path: "b.txt", Weight: 1},
+		},
+	}
+	refs := prefixCfg.Templates("@code")
+
+	// Sweep r uniformly over [0, 1) - selections should split 3:1
+	counts := make(map[string]int)
+	const steps = 1000
+	for i := 0; i < steps; i++ {
+		ref := pickWeighted(refs, float64(i)/steps)
+		counts[ref.Variant]++
+	}
+
+	if counts["a"] != 750 || counts["b"] != 250 {
+		t.Errorf("Expected 750/250 split, got a=%d b=%d", counts["a"], counts["b"])
+	}
+
+	// Variant templates are keyed separately so each gets its own cache file
+	if refs[0].Key != "@code.a" || refs[1].Key != "@code.b" {
+		t.Errorf("Expected variant keys @code.a and @code.b, got %s and %s", refs[0].Key, refs[1].Key)
+	}
+
+	// A plain prefix always resolves to itself
+	plain := config.PrefixConfig{Path: "code.txt"}.Templates("@code")
+	if ref := pickWeighted(plain, 0.99); ref.Key != "@code" || ref.Variant != "" {
+		t.Errorf("Expected plain prefix to resolve to @code, got %+v", ref)
+	}
+}
+
+// TestTemplateVariantInjection tests that a request for a prefix with variants
+// uses one of the variant templates and records the variant metric
+func TestTemplateVariantInjection(t *testing.T) {
+	tmpDir := t.TempDir()
+	variantA := tmpDir + "/a.txt"
+	variantB := tmpDir + "/b.txt"
+	os.WriteFile(variantA, []byte("Variant A: <{message}>"), 0644)
+	os.WriteFile(variantB, []byte("Variant B: <{message}>"), 0644)
+
+	var receivedBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@ab": {Variants: []config.VariantConfig{
+			{Name: "a", Path: variantA},
+			{Name: "b", Path: variantB},
+		}},
+	}
+
+	watcher := template.NewWatcher()
+	for _, ref := range cfg.Prefixes["@ab"].Templates("@ab") {
+		if err := watcher.AddTemplate(ref.Key, ref.Path); err != nil {
+			t.Fatalf("Failed to add template: %v", err)
+		}
+	}
+
+	metrics := admin.NewMetrics()
+	backendState := createTestState()
+	proxy, err := New(cfg, watcher, metrics, backendState, admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	requestBody := `{"messages":[{"role":"user","content":"@ab hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	usedA := strings.Contains(receivedBody, "Variant A: hello")
+	usedB := strings.Contains(receivedBody, "Variant B: hello")
+	if usedA == usedB {
+		t.Fatalf("Expected exactly one variant to be used, got: %s", receivedBody)
+	}
+
+	// State tracks the variant key so each variant has its own KV cache
+	expectedKey := "@ab.a"
+	if usedB {
+		expectedKey = "@ab.b"
+	}
+	if got := backendState.GetLastPrefix(); got != expectedKey {
+		t.Errorf("Expected state prefix %s, got %s", expectedKey, got)
+	}
+
+	total := metrics.TemplateVariantRequests["@ab"]["a"] + metrics.TemplateVariantRequests["@ab"]["b"]
+	if total != 1 {
+		t.Errorf("Expected 1 variant request recorded, got %d", total)
+	}
+}
+
+// TestChatCompletionContentType tests that non-JSON content types are rejected
+// with 415 before reaching the backend, while JSON and missing types are accepted
+func TestChatCompletionContentType(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	testCases := []struct {
+		contentType    string
+		expectedStatus int
+	}{
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"multipart/form-data; boundary=xyz", http.StatusUnsupportedMediaType},
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.contentType, func(t *testing.T) {
+			requestBody := `{"messages":[{"role":"user","content":"hello"}]}`
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+
+			rr := httptest.NewRecorder()
+			proxy.handleChatCompletion(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+
+	// Only the accepted requests should have reached the backend
+	if backendCalls != 3 {
+		t.Errorf("Expected 3 backend calls, got %d", backendCalls)
+	}
+}
+
+// TestBackendTransportPooling tests that the configured transport is used for
+// both the reverse proxy and chat completions, and that connections are reused
+func TestBackendTransportPooling(t *testing.T) {
+	var mu sync.Mutex
+	newConns := 0
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	// Count new TCP connections accepted by the backend
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			newConns++
+			mu.Unlock()
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.BackendMaxIdleConns = 7
+	cfg.BackendMaxIdleConnsPerHost = 3
+	cfg.BackendIdleConnTimeout = 42
+	cfg.BackendForceHTTP1 = true
+
+	proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	// Pool settings come from config
+	if proxy.transport.MaxIdleConns != 7 || proxy.transport.MaxIdleConnsPerHost != 3 {
+		t.Errorf("Expected pool sizes 7/3, got %d/%d", proxy.transport.MaxIdleConns, proxy.transport.MaxIdleConnsPerHost)
+	}
+	if proxy.transport.IdleConnTimeout != 42*time.Second {
+		t.Errorf("Expected idle timeout 42s, got %v", proxy.transport.IdleConnTimeout)
+	}
+	if proxy.transport.ForceAttemptHTTP2 || proxy.transport.TLSNextProto == nil {
+		t.Error("Expected HTTP/2 to be disabled")
+	}
+
+	// The same transport is used for passthrough and chat completions
+	if proxy.reverseProxy.Transport != proxy.transport {
+		t.Error("Reverse proxy does not use the configured transport")
+	}
+	if proxy.client.Transport != proxy.transport {
+		t.Error("Chat completion client does not use the configured transport")
+	}
+
+	// Sequential requests should reuse a single keep-alive connection
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+
+		req = httptest.NewRequest("GET", "/health", nil)
+		rr = httptest.NewRecorder()
+		proxy.reverseProxy.ServeHTTP(rr, req)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if newConns != 1 {
+		t.Errorf("Expected 1 backend connection to be reused, got %d new connections", newConns)
+	}
+}
+
+// TestSSEHeartbeat tests that heartbeat comments are streamed while the
+// backend has sent nothing yet, and stop once data flows
+func TestSSEHeartbeat(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		// A long prompt delays the first token
+		time.Sleep(1300 * time.Millisecond)
+		w.Write([]byte("data: {\"choices\":[]}\n\n"))
+		w.(http.Flusher).Flush()
+
+		// A pause after data started must not get heartbeats
+		time.Sleep(1100 * time.Millisecond)
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.SSEHeartbeatInterval = 1
+	proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hello"}],"stream":true}`))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	expected := ": heartbeat\n\ndata: {\"choices\":[]}\n\ndata: [DONE]\n\n"
+	if rr.Body.String() != expected {
+		t.Errorf("Expected body %q, got %q", expected, rr.Body.String())
+	}
+}
+
+// TestSSEHeartbeatBeforeBackendHeaders tests that heartbeats start before
+// the request is forwarded, for a backend sending its headers only with the
+// first token, and that errors after the early headers become a data frame
+func TestSSEHeartbeatBeforeBackendHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(1300 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+
+	streamRequest := `{"messages":[{"role":"user","content":"hello"}],"stream":true}`
+
+	t.Run("delayed headers", func(t *testing.T) {
+		cfg := createTestConfig(backend.URL)
+		cfg.SSEHeartbeatInterval = 1
+		proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(streamRequest)))
+
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/event-stream" {
+			t.Errorf("Expected an early 200 event stream, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+		}
+		expected := ": heartbeat\n\ndata: [DONE]\n\n"
+		if rr.Body.String() != expected {
+			t.Errorf("Expected body %q, got %q", expected, rr.Body.String())
+		}
+	})
+
+	t.Run("backend unavailable", func(t *testing.T) {
+		cfg := createTestConfig("http://127.0.0.1:1")
+		cfg.SSEHeartbeatInterval = 1
+		proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(streamRequest)))
+
+		expected := "data: {\"error\":{\"code\":502,\"message\":\"Backend server unavailable\"}}\n\n"
+		if rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("Expected the error as a data frame, got %d %q", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+// TestStreamMismatch tests a backend returning JSON with 200 for a stream=true request
+func TestStreamMismatch(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{\"error\":\n{\"message\":\"context overflow\"}}\n"))
+	}))
+	defer backend.Close()
+
+	streamRequest := `{"messages":[{"role":"user","content":"hello"}],"stream":true}`
+
+	t.Run("passthrough", func(t *testing.T) {
+		metrics := admin.NewMetrics()
+		cfg := createTestConfig(backend.URL)
+		proxy, err := New(cfg, createTestWatcher(), metrics, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(streamRequest))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+
+		if metrics.StreamMismatches != 1 {
+			t.Errorf("Expected 1 stream mismatch, got %d", metrics.StreamMismatches)
+		}
+		if metrics.LastActivity.IsZero() {
+			t.Error("Expected chat completion to record activity")
+		}
+		// Without wrapping the body is forwarded unchanged
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected application/json, got %s", ct)
+		}
+		if !strings.HasPrefix(rr.Body.String(), `{"error":`) {
+			t.Errorf("Expected raw JSON body, got: %s", rr.Body.String())
+		}
+	})
+
+	t.Run("wrapped", func(t *testing.T) {
+		metrics := admin.NewMetrics()
+		cfg := createTestConfig(backend.URL)
+		cfg.WrapNonSSEErrors = true
+		proxy, err := New(cfg, createTestWatcher(), metrics, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(streamRequest))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+
+		if metrics.StreamMismatches != 1 {
+			t.Errorf("Expected 1 stream mismatch, got %d", metrics.StreamMismatches)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Expected text/event-stream, got %s", ct)
+		}
+		expected := "data: {\"error\":\ndata: {\"message\":\"context overflow\"}}\n\n"
+		if rr.Body.String() != expected {
+			t.Errorf("Expected SSE frame %q, got %q", expected, rr.Body.String())
+		}
+	})
+
+	t.Run("non-streaming request", func(t *testing.T) {
+		metrics := admin.NewMetrics()
+		cfg := createTestConfig(backend.URL)
+		cfg.WrapNonSSEErrors = true
+		proxy, err := New(cfg, createTestWatcher(), metrics, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+
+		if metrics.StreamMismatches != 0 {
+			t.Errorf("Expected no stream mismatch for non-streaming request, got %d", metrics.StreamMismatches)
+		}
+	})
+}
+
+// TestStickyPrefix tests that a prefix set in one turn keeps applying to later
+// turns of the same conversation until a different prefix is used
+func TestStickyPrefix(t *testing.T) {
+	tmpDir := t.TempDir()
+	codeFile := tmpDir + "/code.txt"
+	debugFile := tmpDir + "/debug.txt"
+	os.WriteFile(codeFile, []byte("CODE: <{message}>"), 0644)
+	os.WriteFile(debugFile, []byte("DEBUG: <{message}>"), 0644)
+
+	var receivedBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", codeFile)
+	watcher.AddTemplate("@debug", debugFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.StickyPrefix = true
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@code":  {Path: codeFile},
+		"@debug": {Path: debugFile},
+	}
+	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	send := func(conversationID, content string) {
+		requestBody := fmt.Sprintf(`{"messages":[{"role":"user","content":%q}]}`, content)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+		if conversationID != "" {
+			req.Header.Set("X-Conversation-ID", conversationID)
+		}
+		proxy.handleChatCompletion(httptest.NewRecorder(), req)
+	}
+
+	// Turn 1 sets @code
+	send("conv-1", "@code first")
+	if !strings.Contains(receivedBody, "CODE: first") {
+		t.Errorf("Turn 1: expected @code template, got: %s", receivedBody)
+	}
+
+	// Turn 2 has no prefix - @code still applies
+	send("conv-1", "second")
+	if !strings.Contains(receivedBody, "CODE: second") {
+		t.Errorf("Turn 2: expected sticky @code template, got: %s", receivedBody)
+	}
+
+	// Another conversation is unaffected
+	send("conv-2", "other")
+	if strings.Contains(receivedBody, "CODE:") {
+		t.Errorf("Other conversation should not use sticky prefix, got: %s", receivedBody)
+	}
+
+	// Requests without a conversation ID are unaffected
+	send("", "anonymous")
+	if strings.Contains(receivedBody, "CODE:") {
+		t.Errorf("Request without conversation ID should not use sticky prefix, got: %s", receivedBody)
+	}
+
+	// Turn 3 explicitly switches to @debug, turn 4 keeps it
+	send("conv-1", "@debug third")
+	if !strings.Contains(receivedBody, "DEBUG: third") {
+		t.Errorf("Turn 3: expected @debug template, got: %s", receivedBody)
+	}
+	send("conv-1", "fourth")
+	if !strings.Contains(receivedBody, "DEBUG: fourth") {
+		t.Errorf("Turn 4: expected sticky @debug template, got: %s", receivedBody)
+	}
+}
+
+// TestResponseFormatAndLogitBiasPassthrough tests that response_format and
+// logit_bias reach the backend unchanged when a prefix template is injected
+func TestResponseFormatAndLogitBiasPassthrough(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/test_template.txt"
+	os.WriteFile(templateFile, []byte("Template: <{message}>"), 0644)
+
+	var receivedBody []byte
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@test", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.VerifyPassthrough = true
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@test": {Path: templateFile, Stop: []string{"###"}},
+	}
+	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	requestBody := `{
+		"messages": [{"role": "user", "content": "@test hello"}],
+		"response_format": {"type": "json_schema", "json_schema": {"name": "answer", "schema": {"type": "object", "properties": {"answer": {"type": "string"}}}}},
+		"logit_bias": {"15043": -100, "50256": 5.5},
+		"temperature": 0.2
+	}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	if !strings.Contains(string(receivedBody), "Template: hello") {
+		t.Fatalf("Expected template to be injected, got: %s", receivedBody)
+	}
+
+	// Invariant: every top-level field except messages and stop is unchanged
+	if problems := checkPassthrough([]byte(requestBody), receivedBody); len(problems) != 0 {
+		t.Errorf("Expected all fields to pass through, got: %v", problems)
+	}
+
+	var received map[string]json.RawMessage
+	json.Unmarshal(receivedBody, &received)
+	for _, field := range []string{"response_format", "logit_bias", "temperature"} {
+		if _, exists := received[field]; !exists {
+			t.Errorf("Expected %s in backend request, got: %s", field, receivedBody)
+		}
+	}
+}
+
+// TestOverridesStreamAndPassthrough tests that a forced stream override
+// makes the request streaming and that verify_passthrough doesn't report
+// overridden fields or a rewritten pseudo-model
+func TestOverridesStreamAndPassthrough(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddInlineTemplate("@det", "Answer: <{message}>"); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	cfg := createTestConfig(backend.URL)
+	cfg.VerifyPassthrough = true
+	cfg.ExposePrefixesAsModels = true
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@det": {
+			Inline:           "Answer: <{message}>",
+			RequestOverrides: map[string]interface{}{"stream": true, "temperature": float64(0)},
+			ForceOverrides:   true,
+		},
+	}
+	metrics := admin.NewMetrics()
+	proxy, err := New(cfg, watcher, metrics, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	requestBody := `{"model":"local-llama+det","messages":[{"role":"user","content":"hello"}],"temperature":0.8,"stream":false}`
+	proxy.handleChatCompletion(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody)))
+
+	if snap := metrics.FullSnapshot(); snap.StreamMismatches != 1 {
+		t.Errorf("Expected the forced stream to make the request streaming, got %d stream mismatches", snap.StreamMismatches)
+	}
+	if strings.Contains(logOutput.String(), "passthrough check") {
+		t.Errorf("Expected no passthrough warnings, got:\n%s", logOutput.String())
+	}
+}
+
+// TestCheckPassthrough tests detection of dropped and changed fields
+func TestCheckPassthrough(t *testing.T) {
+	original := []byte(`{"messages":[],"stop":"x","response_format":{"type":"json_object"},"logit_bias":{"1":-100},"seed":1}`)
+
+	// Exempt fields may change, key order and formatting don't matter
+	modified := []byte(`{"seed": 1.0, "logit_bias": {"1": -100}, "response_format": {"type": "json_object"}, "messages": [1], "stop": ["x", "y"]}`)
+	if problems := checkPassthrough(original, modified); len(problems) != 0 {
+		t.Errorf("Expected no problems, got: %v", problems)
+	}
+
+	modified = []byte(`{"messages":[],"logit_bias":{"1":100},"seed":1}`)
+	problems := checkPassthrough(original, modified)
+	expected := []string{`field "logit_bias" was changed`, `field "response_format" was dropped`}
+	if strings.Join(problems, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("Expected %v, got %v", expected, problems)
+	}
+}
+
+// TestTrimMessageWhitespace tests trimming the message after prefix stripping
+func TestTrimMessageWhitespace(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/test_template.txt"
+	os.WriteFile(templateFile, []byte("[<{message}>]"), 0644)
+
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequest = nil
+		json.NewDecoder(r.Body).Decode(&receivedRequest)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		trim     bool
+		expected string
+	}{
+		{"disabled", false, "[   lots of spaces  ]"},
+		{"enabled", true, "[lots of spaces]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watcher := template.NewWatcher()
+			watcher.AddTemplate("@test", templateFile)
+
+			cfg := createTestConfig(backend.URL)
+			cfg.TrimMessageWhitespace = tt.trim
+			cfg.Prefixes = map[string]config.PrefixConfig{"@test": {Path: templateFile}}
+			proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			requestBody := `{"messages":[{"role":"user","content":"@test    lots of spaces  "}]}`
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+			proxy.handleChatCompletion(httptest.NewRecorder(), req)
+
+			messages := receivedRequest["messages"].([]interface{})
+			content := messages[0].(map[string]interface{})["content"]
+			if content != tt.expected {
+				t.Errorf("Expected content %q, got %q", tt.expected, content)
+			}
+		})
+	}
+}
+
+// TestPassthroughMode tests that passthrough mode forwards prefixed messages
+// verbatim without any KV cache slot operations or state tracking
+func TestPassthroughMode(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CODE: <{message}>"), 0644)
+
+	var mu sync.Mutex
+	var receivedBody string
+	slotCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/slots") {
+			slotCalls++
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		bodyBytes, _ := io.ReadAll(r.Body)
+		receivedBody = string(bodyBytes)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.PassthroughMode = true
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile}}
+	backendState := createTestState()
+	backendState.UpdatePrefix("@other") // Would normally trigger a save
+	metrics := admin.NewMetrics()
+	proxy, err := New(cfg, watcher, metrics, backendState, admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	requestBody := `{"messages":[{"role":"user","content":"@code hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if receivedBody != requestBody {
+		t.Errorf("Expected body forwarded verbatim, got: %s", receivedBody)
+	}
+	if slotCalls != 0 {
+		t.Errorf("Expected no slot calls in passthrough mode, got %d", slotCalls)
+	}
+	if backendState.GetLastPrefix() != "@other" {
+		t.Errorf("Expected backend state untouched, got %q", backendState.GetLastPrefix())
+	}
+	if metrics.RequestCount["/v1/chat/completions"]["200"] != 1 {
+		t.Errorf("Expected request to be counted in metrics, got %v", metrics.RequestCount)
+	}
+}
+
+// TestTemplatePosition tests where the processed template lands for each position
+func TestTemplatePosition(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CONTEXT <{message}>"), 0644)
+
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequest = nil
+		json.NewDecoder(r.Body).Decode(&receivedRequest)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	type message struct{ role, content string }
+	tests := []struct {
+		position string
+		expected []message
+	}{
+		{"", []message{
+			{"system", "be nice"}, {"user", "first"}, {"assistant", "ok"}, {"user", "CONTEXT hello"},
+		}},
+		{config.PositionInplace, []message{
+			{"system", "be nice"}, {"user", "first"}, {"assistant", "ok"}, {"user", "CONTEXT hello"},
+		}},
+		{config.PositionPrependSystem, []message{
+			{"system", "CONTEXT hello"}, {"system", "be nice"}, {"user", "first"}, {"assistant", "ok"}, {"user", "hello"},
+		}},
+		{config.PositionPrependUser, []message{
+			{"user", "CONTEXT hello"}, {"system", "be nice"}, {"user", "first"}, {"assistant", "ok"}, {"user", "hello"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run("position="+tt.position, func(t *testing.T) {
+			watcher := template.NewWatcher()
+			watcher.AddTemplate("@code", templateFile)
+
+			cfg := createTestConfig(backend.URL)
+			cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile, Position: tt.position}}
+			proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			requestBody := `{"messages":[
+				{"role":"system","content":"be nice"},
+				{"role":"user","content":"first"},
+				{"role":"assistant","content":"ok"},
+				{"role":"user","content":"@code hello"}
+			]}`
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+			proxy.handleChatCompletion(httptest.NewRecorder(), req)
+
+			messages := receivedRequest["messages"].([]interface{})
+			if len(messages) != len(tt.expected) {
+				t.Fatalf("Expected %d messages, got %d: %v", len(tt.expected), len(messages), messages)
+			}
+			for i, expected := range tt.expected {
+				msg := messages[i].(map[string]interface{})
+				if msg["role"] != expected.role || msg["content"] != expected.content {
+					t.Errorf("Message %d: expected %s %q, got %v %q", i, expected.role, expected.content, msg["role"], msg["content"])
+				}
+			}
+		})
+	}
+}
+
+// TestPrefixCheckRoles tests that a prefix on a system message is only
+// detected when "system" is one of the configured roles
+func TestPrefixCheckRoles(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CONTEXT <{message}>"), 0644)
+
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedRequest = nil
+		json.NewDecoder(r.Body).Decode(&receivedRequest)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		roles          []string
+		expectedSystem string
+		expectedUser   string
+		expectedPrefix string
+	}{
+		{"default", nil, "@code be nice", "hello", ""},
+		{"user only", []string{"user"}, "@code be nice", "hello", ""},
+		{"user and system", []string{"user", "system"}, "CONTEXT be nice", "hello", "@code"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watcher := template.NewWatcher()
+			watcher.AddTemplate("@code", templateFile)
+
+			cfg := createTestConfig(backend.URL)
+			cfg.PrefixCheckRoles = tt.roles
+			cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile}}
+			backendState := createTestState()
+			proxy, err := New(cfg, watcher, nil, backendState, admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			requestBody := `{"messages":[
+				{"role":"system","content":"@code be nice"},
+				{"role":"user","content":"hello"}
+			]}`
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+			rr := httptest.NewRecorder()
+			proxy.handleChatCompletion(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			messages := receivedRequest["messages"].([]interface{})
+			system := messages[0].(map[string]interface{})
+			user := messages[1].(map[string]interface{})
+			if system["content"] != tt.expectedSystem {
+				t.Errorf("Expected system content %q, got %q", tt.expectedSystem, system["content"])
+			}
+			if user["content"] != tt.expectedUser {
+				t.Errorf("Expected user content %q, got %q", tt.expectedUser, user["content"])
+			}
+			if prefix := backendState.GetLastPrefix(); prefix != tt.expectedPrefix {
+				t.Errorf("Expected last prefix %q, got %q", tt.expectedPrefix, prefix)
+			}
+		})
+	}
+}
+
+// TestStripResponseHeaders tests that configured backend headers are removed on
+// both the chat completion and the reverse proxy paths while others pass through
+func TestStripResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "llama.cpp")
+		w.Header().Set("X-Debug-Info", "slot=0")
+		w.Header().Set("X-Keep", "yes")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.StripResponseHeaders = []string{"server", "X-Debug-Info"}
+	proxy, err := New(cfg, template.NewWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	chatReq := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`))
+	chatRR := httptest.NewRecorder()
+	proxy.handleChatCompletion(chatRR, chatReq)
+
+	passthroughRR := httptest.NewRecorder()
+	proxy.handlePassthrough(passthroughRR, httptest.NewRequest("GET", "/v1/models", nil))
+
+	for name, rr := range map[string]*httptest.ResponseRecorder{"chat completion": chatRR, "passthrough": passthroughRR} {
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", name, rr.Code)
+		}
+		if got := rr.Header().Get("Server"); got != "" {
+			t.Errorf("%s: expected Server header to be stripped, got %q", name, got)
+		}
+		if got := rr.Header().Get("X-Debug-Info"); got != "" {
+			t.Errorf("%s: expected X-Debug-Info header to be stripped, got %q", name, got)
+		}
+		if got := rr.Header().Get("X-Keep"); got != "yes" {
+			t.Errorf("%s: expected X-Keep header to pass through, got %q", name, got)
+		}
+	}
+}
+
+// TestBackendAuthToken tests that the backend receives the configured token
+// instead of the client's Authorization header on both request paths, and
+// with KV cache operations
+func TestBackendAuthToken(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]string)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[r.URL.Path] = r.Header.Get("Authorization")
+		mu.Unlock()
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		token        string
+		expected     string
+		slotExpected string
+	}{
+		{"configured", "backend-secret", "Bearer backend-secret", "Bearer backend-secret"},
+		{"not configured", "", "Bearer client-key", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestConfig(backend.URL)
+			cfg.BackendAuthToken = tt.token
+			cfg.Prefixes["@code"] = config.PrefixConfig{Inline: "Code: <{message}>"}
+			watcher := template.NewWatcher()
+			watcher.AddInlineTemplate("@code", "Code: <{message}>")
+			proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			// The template's KV cache is restored before the completion
+			chatReq := httptest.NewRequest("POST", "/v1/chat/completions",
+				strings.NewReader(`{"messages":[{"role":"user","content":"@code hello"}]}`))
+			chatReq.Header.Set("Authorization", "Bearer client-key")
+			proxy.handleChatCompletion(httptest.NewRecorder(), chatReq)
+
+			modelsReq := httptest.NewRequest("GET", "/v1/models", nil)
+			modelsReq.Header.Set("Authorization", "Bearer client-key")
+			proxy.handlePassthrough(httptest.NewRecorder(), modelsReq)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, path := range []string{"/v1/chat/completions", "/v1/models"} {
+				if received[path] != tt.expected {
+					t.Errorf("%s: expected Authorization %q, got %q", path, tt.expected, received[path])
+				}
+			}
+			if received["/slots/0"] != tt.slotExpected {
+				t.Errorf("/slots/0: expected Authorization %q, got %q", tt.slotExpected, received["/slots/0"])
+			}
+		})
+	}
+}
+
+// TestBackendPathPrefix tests that chat completions, KV cache operations and
+// passthrough requests are sent under BackendPathPrefix, while metrics keep
+// the client's path
+func TestBackendPathPrefix(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddInlineTemplate("@code", "Code: <{message}>"); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	cfg := createTestConfig(backend.URL + "/")
+	cfg.BackendPathPrefix = "/llm"
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Inline: "Code: <{message}>"}}
+	metrics := admin.NewMetrics()
+	proxy, err := New(cfg, watcher, metrics, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"@code hello"}]}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/props", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for passthrough, got %d", rr.Code)
+	}
+
+	mu.Lock()
+	expected := []string{"/llm/slots/0", "/llm/v1/chat/completions", "/llm/props"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected backend paths %v, got %v", expected, paths)
+	}
+	mu.Unlock()
+
+	if count := metrics.GetSnapshot()["/props"]["200"]; count != 1 {
+		t.Errorf("Expected the passthrough request recorded under /props, got %d", count)
+	}
+}
+
+// TestBackendRequestSource tests that requests forwarded to the backend are
+// counted as user backend requests, whatever handler forwards them
+func TestBackendRequestSource(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Bioproxy-Source") != "" {
+			t.Errorf("Expected no source header on user requests, got %q", r.Header.Get("X-Bioproxy-Source"))
+		}
+		w.Write([]byte(`{"data":[],"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	metrics := admin.NewMetrics()
+	proxy, err := New(createTestConfig(backend.URL), createTestWatcher(), metrics, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`)),
+		httptest.NewRequest("GET", "/v1/models", nil),
+		httptest.NewRequest("GET", "/props", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	snap := metrics.FullSnapshot()
+	if snap.BackendRequests[admin.BackendSourceUser] != 3 || snap.BackendRequests[admin.BackendSourceWarmup] != 0 {
+		t.Errorf("Expected 3 user and 0 warmup backend requests, got %v", snap.BackendRequests)
+	}
+}
+
+// TestBackendTLSCACert tests that an HTTPS backend with a certificate from a
+// private CA is only reachable when the CA is configured
+func TestBackendTLSCACert(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+	// The backend's handshake failures are expected, keep them out of the test log
+	backend.Config.ErrorLog = log.New(io.Discard, "", 0)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		caCert   string
+		insecure bool
+		expected int
+	}{
+		{"CA configured", caPath, false, http.StatusOK},
+		{"no CA", "", false, http.StatusBadGateway},
+		{"insecure", "", true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestConfig(backend.URL)
+			cfg.BackendTLSCACert = tt.caCert
+			cfg.BackendTLSInsecureSkipVerify = tt.insecure
+			proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+			handler := proxy.handler()
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions",
+				strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`)))
+			if rr.Code != tt.expected {
+				t.Errorf("Expected status %d for chat completion, got %d", tt.expected, rr.Code)
+			}
+
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/props", nil))
+			if rr.Code != tt.expected {
+				t.Errorf("Expected status %d for passthrough, got %d", tt.expected, rr.Code)
+			}
+		})
+	}
+}
+
+// TestPrefixBackend tests that a prefixed request goes to its assigned backend
+// while other requests use the default one, with separate state per backend
+func TestPrefixBackend(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/big.txt"
+	os.WriteFile(templateFile, []byte("BIG: <{message}>"), 0644)
+
+	type backendLog struct {
+		mu    sync.Mutex
+		paths []string
+		body  string
+	}
+	newBackend := func(l *backendLog) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.paths = append(l.paths, r.URL.Path)
+			if r.URL.Path == "/v1/chat/completions" {
+				bodyBytes, _ := io.ReadAll(r.Body)
+				l.body = string(bodyBytes)
+			}
+			w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+		}))
+	}
+	var defaultLog, bigLog backendLog
+	defaultBackend := newBackend(&defaultLog)
+	defer defaultBackend.Close()
+	bigBackend := newBackend(&bigLog)
+	defer bigBackend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@bigcontext", templateFile)
+
+	cfg := createTestConfig(defaultBackend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@bigcontext": {Path: templateFile, Backend: bigBackend.URL},
+	}
+	backendState := createTestState()
+	proxy, err := New(cfg, watcher, nil, backendState, admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	// Prefixed request goes to the big backend, including the KV cache restore
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"@bigcontext hello"}]}`))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	bigLog.mu.Lock()
+	if strings.Join(bigLog.paths, ",") != "/slots/0,/v1/chat/completions" {
+		t.Errorf("Expected restore and completion on the big backend, got %v", bigLog.paths)
+	}
+	if !strings.Contains(bigLog.body, "BIG: hello") {
+		t.Errorf("Expected processed template on the big backend, got %s", bigLog.body)
+	}
+	bigLog.mu.Unlock()
+
+	defaultLog.mu.Lock()
+	if len(defaultLog.paths) != 0 {
+		t.Errorf("Expected no requests to the default backend, got %v", defaultLog.paths)
+	}
+	defaultLog.mu.Unlock()
+
+	// State is tracked per backend
+	if backendState.GetLastPrefix() != "" {
+		t.Errorf("Expected default backend state to be untouched, got %q", backendState.GetLastPrefix())
+	}
+	if prefix := backendState.Backend(bigBackend.URL).GetLastPrefix(); prefix != "@bigcontext" {
+		t.Errorf("Expected big backend state @bigcontext, got %q", prefix)
+	}
+
+	// A plain request goes to the default backend without any KV cache save,
+	// since @bigcontext was never loaded there
+	req = httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"plain"}]}`))
+	proxy.handleChatCompletion(httptest.NewRecorder(), req)
+
+	defaultLog.mu.Lock()
+	if strings.Join(defaultLog.paths, ",") != "/v1/chat/completions" {
+		t.Errorf("Expected only a completion on the default backend, got %v", defaultLog.paths)
+	}
+	defaultLog.mu.Unlock()
+}
+
+// TestStartPortInUse verifies that a bind failure is returned from Start
+// instead of only being logged from the serving goroutine
+func TestStartPortInUse(t *testing.T) {
+	// Find a free port
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cfg := createTestConfig("http://localhost:8081")
+	cfg.ProxyPort = port
+
+	first, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	if err := first.Start(); err != nil {
+		t.Fatalf("Failed to start first proxy: %v", err)
+	}
+	defer first.Stop()
+
+	second, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	if err := second.Start(); err == nil {
+		second.Stop()
+		t.Fatal("Expected second Start on the same port to fail")
+	}
+	if second.IsRunning() {
+		t.Error("Proxy should not be running after a failed Start")
+	}
+
+	// The first proxy keeps serving
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", port))
+	if err != nil {
+		t.Fatalf("First proxy stopped serving: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// TestDisableKVCache tests that no slot calls are made with KV cache
+// operations disabled, while the loaded template is still tracked
+func TestDisableKVCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CODE: <{message}>"), 0644)
+
+	var mu sync.Mutex
+	slotCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/slots") {
+			slotCalls++
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.DisableKVCache = true
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile}}
+	backendState := createTestState()
+	backendState.UpdatePrefix("@other") // Would normally trigger a save and restore
+	proxy, err := New(cfg, watcher, admin.NewMetrics(), backendState, admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	requestBody := `{"messages":[{"role":"user","content":"@code hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if slotCalls != 0 {
+		t.Errorf("Expected no slot calls with KV cache disabled, got %d", slotCalls)
+	}
+	if backendState.GetLastPrefix() != "@code" {
+		t.Errorf("Expected state to track @code, got %q", backendState.GetLastPrefix())
+	}
+}
+
+// TestTemplateHistory tests that <{history}> receives the messages before
+// the templated user turn
+func TestTemplateHistory(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("HISTORY:\n<{history}>\nNOW: <{message}>"), 0644)
+
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&receivedRequest)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile}}
+	proxy, err := New(cfg, watcher, admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	requestBody := `{"messages":[
+		{"role":"system","content":"Be brief"},
+		{"role":"user","content":"first question"},
+		{"role":"assistant","content":"first answer"},
+		{"role":"user","content":"@code second question"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	messages := receivedRequest["messages"].([]interface{})
+	content := messages[3].(map[string]interface{})["content"]
+	expected := "HISTORY:\nsystem: Be brief\nuser: first question\nassistant: first answer\nNOW: second question"
+	if content != expected {
+		t.Errorf("Expected %q, got %q", expected, content)
+	}
+}
+
+// TestProxyServerTimeoutsAllowLongStream tests that a stream outlasting the
+// read timeouts is delivered in full (the proxy has no write timeout)
+func TestProxyServerTimeoutsAllowLongStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: {\"chunk\":%d}\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(600 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+	}))
+	defer backend.Close()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.ProxyPort = port
+	cfg.ProxyTimeouts = config.ServerTimeouts{ReadHeader: 1, Read: 1, Idle: 1}
+	proxy, err := New(cfg, createTestWatcher(), admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop()
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/v1/chat/completions", port), "application/json",
+		strings.NewReader(`{"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Stream was cut off: %v", err)
+	}
+	if !strings.Contains(string(body), `{"chunk":2}`) || !strings.Contains(string(body), "[DONE]") {
+		t.Errorf("Expected the full stream, got %q", body)
+	}
+}
+
+// TestTracing tests that a chat completion records a span with the request
+// attributes, child spans for KV cache and backend calls, and that the
+// incoming trace is propagated to the backend
+func TestTracing(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CODE: <{message}>"), 0644)
+
+	var receivedTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/chat/completions" {
+			receivedTraceparent = r.Header.Get("traceparent")
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile}}
+	proxy, err := New(cfg, watcher, admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	exporter := &tracing.InMemoryExporter{}
+	proxy.SetTracer(tracing.New(exporter))
+
+	incoming := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	requestBody := `{"model":"llama","stream":false,"messages":[{"role":"user","content":"@code hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	req.Header.Set("traceparent", incoming)
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	spans := exporter.Spans()
+	names := make(map[string]*tracing.Span)
+	for _, span := range spans {
+		names[span.Name] = span
+	}
+	root := names["chat.completions"]
+	if root == nil {
+		t.Fatalf("Expected a chat.completions span, got %d spans", len(spans))
+	}
+
+	expected := map[string]interface{}{
+		"bioproxy.prefix":           "@code",
+		"gen_ai.request.model":      "llama",
+		"bioproxy.streaming":        false,
+		"http.response.status_code": http.StatusOK,
+	}
+	for key, want := range expected {
+		if got := root.Attribute(key); got != want {
+			t.Errorf("Expected %s=%v, got %v", key, want, got)
+		}
+	}
+
+	// The root span continues the incoming trace
+	traceID, parentID, _ := tracing.ParseTraceparent(incoming)
+	if root.TraceID != traceID || root.ParentID != parentID {
+		t.Errorf("Expected root span to continue incoming trace")
+	}
+
+	// The backend span is a child of the root and is what the backend sees
+	backendSpan := names["backend.chat_completions"]
+	if backendSpan == nil {
+		t.Fatal("Expected a backend.chat_completions span")
+	}
+	if backendSpan.ParentID != root.SpanID || backendSpan.TraceID != traceID {
+		t.Errorf("Expected backend span to be a child of the request span")
+	}
+	if want := tracing.FormatTraceparent(traceID, backendSpan.SpanID); receivedTraceparent != want {
+		t.Errorf("Expected backend to receive traceparent %q, got %q", want, receivedTraceparent)
+	}
+
+	// The first request for @code restores its KV cache
+	if restore := names["kv_cache.restore"]; restore == nil || restore.ParentID != root.SpanID {
+		t.Errorf("Expected a kv_cache.restore child span")
+	}
+}
+
+// TestPaddedPrefixMatches tests that a config prefix key with a trailing
+// space still matches at request time
+func TestPaddedPrefixMatches(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CODE: <{message}>"), 0644)
+
+	var receivedRequest map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/chat/completions" {
+			json.NewDecoder(r.Body).Decode(&receivedRequest)
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	body := fmt.Sprintf(`{"backend_url": %q, "prefixes": {"@code ": %q}}`, backend.URL, templateFile)
+	cfg, err := config.LoadConfigFromReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("LoadConfigFromReader failed: %v", err)
+	}
+	watcher := template.NewWatcher()
+	for prefix, prefixCfg := range cfg.Prefixes {
+		watcher.AddTemplate(prefix, prefixCfg.Path)
+	}
+	proxy, err := New(cfg, watcher, admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	requestBody := `{"messages":[{"role":"user","content":"@code hello"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	messages := receivedRequest["messages"].([]interface{})
+	content := messages[0].(map[string]interface{})["content"]
+	if content != "CODE: hello" {
+		t.Errorf("Expected padded prefix to match, got content %q", content)
+	}
+}
+
+// TestAllowedMethods tests that methods outside AllowedMethods are rejected
+// without contacting the backend while allowed ones are forwarded
+func TestAllowedMethods(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.AllowedMethods = []string{"GET", "POST", "OPTIONS", "HEAD"}
+	proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	for _, method := range []string{"TRACE", "CONNECT", "DELETE"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, "/v1/embeddings", nil))
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected status 405, got %d", method, rr.Code)
+		}
+		if rr.Header().Get("Allow") != "GET, POST, OPTIONS, HEAD" {
+			t.Errorf("%s: expected Allow header, got %q", method, rr.Header().Get("Allow"))
+		}
+	}
+	if backendCalls != 0 {
+		t.Errorf("Expected no backend calls for rejected methods, got %d", backendCalls)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for POST, got %d", rr.Code)
+	}
+	if backendCalls != 1 {
+		t.Errorf("Expected the POST to reach the backend, got %d calls", backendCalls)
+	}
+
+	// An empty list allows every method
+	cfg.AllowedMethods = nil
+	rr = httptest.NewRecorder()
+	proxy.handler().ServeHTTP(rr, httptest.NewRequest("DELETE", "/slots/0", nil))
+	if rr.Code != http.StatusOK || backendCalls != 2 {
+		t.Errorf("Expected DELETE to be forwarded without a restriction, got status %d, %d calls", rr.Code, backendCalls)
+	}
+}
+
+// TestMaxConcurrentUserQueries tests that chat completions over the
+// admission limit get 503 with a JSON error body and Retry-After
+func TestMaxConcurrentUserQueries(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	admissionCtrl := admission.New()
+	admissionCtrl.SetMaxUserQueries(2)
+	proxy, err := New(createTestConfig(backend.URL), createTestWatcher(), nil, createTestState(), admissionCtrl)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	chat := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`)))
+		return rr
+	}
+
+	// Two requests in flight reach the limit
+	for i := 0; i < 2; i++ {
+		if !admissionCtrl.AcquireUserQuery() {
+			t.Fatalf("Expected user query %d to be admitted", i+1)
+		}
+	}
+	if admissionCtrl.AcquireUserQuery() {
+		t.Fatal("Expected a third user query to be rejected")
+	}
+
+	rr := chat()
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 over the limit, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error.Type != "server_busy" || body.Error.Message == "" {
+		t.Errorf("Expected a JSON server_busy error, got %q (%v)", rr.Body.String(), err)
+	}
+	if backendCalls != 0 {
+		t.Errorf("Expected no backend calls over the limit, got %d", backendCalls)
+	}
+
+	// A rejected request doesn't take a slot, so one release admits one more
+	admissionCtrl.ReleaseUserQuery()
+	if rr := chat(); rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 under the limit, got %d", rr.Code)
+	}
+	admissionCtrl.ReleaseUserQuery()
+	if state := admissionCtrl.GetCurrentState(); state != admission.IDLE {
+		t.Errorf("Expected IDLE after all queries finished, got %s", state)
+	}
+}
+
+// fakeWarmupGate is a WarmupGate whose state tests set directly
+type fakeWarmupGate struct {
+	done bool
+}
+
+func (g *fakeWarmupGate) InitialWarmupDone() bool {
+	return g.done
+}
+
+// TestBlockUntilWarm tests that /v1/* requests get 503 with Retry-After until
+// the initial warmup is done, while other paths are forwarded
+func TestBlockUntilWarm(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	proxy, err := New(createTestConfig(backend.URL), createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	gate := &fakeWarmupGate{}
+	proxy.SetWarmupGate(gate)
+	handler := proxy.handler()
+
+	chat := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`)))
+		return rr
+	}
+
+	rr := chat()
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 before warmup, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header before warmup")
+	}
+	if backendCalls != 0 {
+		t.Errorf("Expected no backend calls before warmup, got %d", backendCalls)
+	}
+
+	// Health checks are forwarded during warmup
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusOK || backendCalls != 1 {
+		t.Errorf("Expected /health to be forwarded during warmup, got status %d, %d calls", rr.Code, backendCalls)
+	}
+
+	gate.done = true
+	rr = chat()
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after warmup, got %d", rr.Code)
+	}
+	if backendCalls != 2 {
+		t.Errorf("Expected the request to reach the backend after warmup, got %d calls", backendCalls)
+	}
+}
+
+// TestOptionsRequest tests that OPTIONS on /v1/* is answered locally with
+// 204 and an Allow header
+func TestOptionsRequest(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer backend.Close()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.ProxyPort = port
+	proxy, err := New(cfg, createTestWatcher(), admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop()
+
+	tests := map[string]string{
+		"/v1/chat/completions": "POST, OPTIONS",
+		"/v1/models":           "GET, OPTIONS",
+		"/v1/embeddings":       "GET, POST, OPTIONS",
+	}
+	for path, allow := range tests {
+		req, _ := http.NewRequest(http.MethodOptions, fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("OPTIONS %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected 204 for OPTIONS %s, got %d", path, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Allow"); got != allow {
+			t.Errorf("Expected Allow %q for %s, got %q", allow, path, got)
+		}
+	}
+
+	if backendCalls != 0 {
+		t.Errorf("Expected backend not to be called, got %d calls", backendCalls)
+	}
+}
+
+// recordingWarmer is a LazyWarmer that records calls into a shared event log
+type recordingWarmer struct {
+	mu     *sync.Mutex
+	events *[]string
+}
+
+func (w recordingWarmer) WarmupOnFirstUse(ctx context.Context, prefix string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	*w.events = append(*w.events, "warmup "+prefix)
+	return nil
+}
+
+// TestLazyWarmupBeforeForwarding tests that the lazy warmer is called for a
+// templated request before it is forwarded to the backend
+func TestLazyWarmupBeforeForwarding(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CODE: <{message}>"), 0644)
+
+	var mu sync.Mutex
+	var events []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/chat/completions" {
+			mu.Lock()
+			events = append(events, "forward")
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", templateFile)
+
+	cfg := createTestConfig(backend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile, Warmup: config.WarmupLazy}}
+	proxy, err := New(cfg, watcher, admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetLazyWarmer(recordingWarmer{mu: &mu, events: &events})
+
+	for _, content := range []string{"@code hello", "plain"} {
+		requestBody := fmt.Sprintf(`{"messages":[{"role":"user","content":%q}]}`, content)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"warmup @code", "forward", "forward"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+}
+
+// TestLazyWarmupSkippedForPoolMember tests that the lazy warmer only runs
+// for requests forwarded to BackendURL, not for those picked for another
+// member of the pool, which warmups never reach
+func TestLazyWarmupSkippedForPoolMember(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("CODE: <{message}>"), 0644)
+
+	var mu sync.Mutex
+	var events []string
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/chat/completions" {
+				mu.Lock()
+				events = append(events, "forward "+name)
+				mu.Unlock()
+			}
+			w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+		}))
+	}
+	first := newBackend("first")
+	defer first.Close()
+	second := newBackend("second")
+	defer second.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", templateFile)
+
+	cfg := createTestConfig(first.URL)
+	cfg.DisableKVCache = true
+	cfg.Prefixes = map[string]config.PrefixConfig{"@code": {Path: templateFile, Warmup: config.WarmupLazy}}
+	proxy, err := New(cfg, watcher, admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetLazyWarmer(recordingWarmer{mu: &mu, events: &events})
+	proxy.SetBackendPicker(backendpool.New([]config.BackendConfig{{URL: first.URL}, {URL: second.URL}}, &http.Client{}, nil))
+
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"messages":[{"role":"user","content":"@code hello"}]}`))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var warmups, firstForwards, secondForwards int
+	for i, event := range events {
+		switch event {
+		case "warmup @code":
+			warmups++
+			if i+1 >= len(events) || events[i+1] != "forward first" {
+				t.Errorf("Expected warmup to be followed by a request to BackendURL, got %v", events)
+			}
+		case "forward first":
+			firstForwards++
+		case "forward second":
+			secondForwards++
+		}
+	}
+	if firstForwards == 0 || secondForwards == 0 {
+		t.Fatalf("Expected requests on both pool members, got %d and %d", firstForwards, secondForwards)
+	}
+	if warmups != firstForwards {
+		t.Errorf("Expected one warmup per request to BackendURL (%d), got %d", firstForwards, warmups)
+	}
+}
+
+// TestStringStreamNormalized tests that a string "stream" value is forwarded
+// as a boolean
+func TestStringStreamNormalized(t *testing.T) {
+	tests := []struct {
+		stream   string
+		expected interface{}
+	}{
+		{`"true"`, true},
+		{`"false"`, false},
+		{`true`, true},
+		{`"sometimes"`, "sometimes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.stream, func(t *testing.T) {
+			var receivedRequest map[string]interface{}
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&receivedRequest)
+				w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+			}))
+			defer backend.Close()
+
+			proxy, err := New(createTestConfig(backend.URL), createTestWatcher(), admin.NewMetrics(), createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			requestBody := fmt.Sprintf(`{"stream":%s,"messages":[{"role":"user","content":"hello"}]}`, tt.stream)
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+			rr := httptest.NewRecorder()
+			proxy.handleChatCompletion(rr, req)
+
+			if got := receivedRequest["stream"]; got != tt.expected {
+				t.Errorf("Expected forwarded stream %#v, got %#v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestSharedCacheKey tests that switching between prefixes sharing a
+// cache_key triggers no KV cache save or restore
+func TestSharedCacheKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"review", "refactor"} {
+		os.WriteFile(tmpDir+"/"+name+".txt", []byte("LONG SHARED CONTEXT\n"+name+": <{message}>"), 0644)
+	}
+
+	var mu sync.Mutex
+	var slotCalls []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slots") {
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			slotCalls = append(slotCalls, fmt.Sprintf("%s %v", r.URL.Query().Get("action"), body["filename"]))
+			mu.Unlock()
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@review", tmpDir+"/review.txt")
+	watcher.AddTemplate("@refactor", tmpDir+"/refactor.txt")
+
+	cfg := createTestConfig(backend.URL)
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@review":   {Path: tmpDir + "/review.txt", CacheKey: "code"},
+		"@refactor": {Path: tmpDir + "/refactor.txt", CacheKey: "code"},
+	}
+	backendState := createTestState()
+	proxy, err := New(cfg, watcher, admin.NewMetrics(), backendState, admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	for _, content := range []string{"@review a", "@refactor b", "@review c"} {
+		requestBody := fmt.Sprintf(`{"messages":[{"role":"user","content":%q}]}`, content)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rr.Code)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Only the first request restores the shared cache
+	if expected := []string{"restore code.bin"}; !reflect.DeepEqual(slotCalls, expected) {
+		t.Errorf("Expected slot calls %v, got %v", expected, slotCalls)
+	}
+	if got := backendState.GetLastPrefix(); got != "code" {
+		t.Errorf("Expected state to track cache key code, got %q", got)
+	}
+}
+
+// TestPrefixMatchDebugLog tests the DEBUG line explaining prefix matching,
+// and that it is only logged with log_level "debug"
+func TestPrefixMatchDebugLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	templateFile := tmpDir + "/code.txt"
+	os.WriteFile(templateFile, []byte("Code: <{message}>"), 0644)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	send := func(logLevel, content string) string {
+		watcher := createTestWatcher()
+		watcher.AddTemplate("@code", templateFile)
+		cfg := createTestConfig(backend.URL)
+		cfg.LogLevel = logLevel
+		cfg.DisableKVCache = true
+		cfg.Prefixes = map[string]config.PrefixConfig{
+			"@code":  {Path: templateFile},
+			"@debug": {Path: templateFile},
+		}
+		proxy, err := New(cfg, watcher, admin.NewMetrics(), createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+
+		logOutput.Reset()
+		requestBody := fmt.Sprintf(`{"messages":[{"role":"user","content":%q}]}`, content)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+		proxy.handleChatCompletion(httptest.NewRecorder(), req)
+		return logOutput.String()
+	}
+
+	output := send(config.LogLevelDebug, "@code fix this")
+	expected := `DEBUG: Prefix match: checked [@code @debug] in 1 message(s), matched @code with separator " ", 8 bytes left after stripping`
+	if !strings.Contains(output, expected) {
+		t.Errorf("Expected debug line %q for a matched request, got:\n%s", expected, output)
+	}
+
+	output = send(config.LogLevelDebug, "@coder fix this")
+	expected = "DEBUG: Prefix match: checked [@code @debug] in 1 message(s), no match"
+	if !strings.Contains(output, expected) {
+		t.Errorf("Expected debug line %q for an unmatched request, got:\n%s", expected, output)
+	}
+
+	if output := send(config.LogLevelInfo, "@code fix this"); strings.Contains(output, "DEBUG:") {
+		t.Errorf("Expected no debug lines at info level, got:\n%s", output)
+	}
+}
+
+// TestBackendPoolEjection tests that requests shift entirely to the healthy
+// backend of the pool once the other one fails its health check
+func TestBackendPoolEjection(t *testing.T) {
+	newBackend := func(healthStatus *atomic.Int32, completions *atomic.Int32) *httptest.Server {
+		healthStatus.Store(http.StatusOK)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				w.WriteHeader(int(healthStatus.Load()))
+				return
+			}
+			completions.Add(1)
+			w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+		}))
+	}
+	var firstHealth, firstCompletions, secondHealth, secondCompletions atomic.Int32
+	first := newBackend(&firstHealth, &firstCompletions)
+	defer first.Close()
+	second := newBackend(&secondHealth, &secondCompletions)
+	defer second.Close()
+
+	cfg := createTestConfig(first.URL)
+	cfg.DisableKVCache = true
+	metrics := admin.NewMetrics()
+	admissionCtrl := admission.New()
+	admissionCtrl.SetMaxUserQueries(1)
+	proxy, err := New(cfg, createTestWatcher(), metrics, createTestState(), admissionCtrl)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	pool := backendpool.New([]config.BackendConfig{{URL: first.URL}, {URL: second.URL}}, &http.Client{}, nil)
+	proxy.SetBackendPicker(pool)
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest("POST", "/v1/chat/completions",
+				strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`))
+			rr := httptest.NewRecorder()
+			proxy.handleChatCompletion(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", rr.Code)
+			}
+		}
+	}
+
+	// Both healthy: traffic goes to both
+	send(50)
+	if firstCompletions.Load() == 0 || secondCompletions.Load() == 0 {
+		t.Errorf("Expected traffic on both backends, got %d and %d", firstCompletions.Load(), secondCompletions.Load())
+	}
+
+	// First goes unhealthy: everything shifts to the second
+	firstHealth.Store(http.StatusServiceUnavailable)
+	pool.CheckNow()
+	firstCompletions.Store(0)
+	secondCompletions.Store(0)
+	send(20)
+	if firstCompletions.Load() != 0 || secondCompletions.Load() != 20 {
+		t.Errorf("Expected all 20 requests on the healthy backend, got %d and %d", firstCompletions.Load(), secondCompletions.Load())
+	}
+
+	// Both unhealthy: requests are rejected before admission, so even with
+	// the only user query slot taken they get the no-backend error
+	secondHealth.Store(http.StatusServiceUnavailable)
+	pool.CheckNow()
+	if !admissionCtrl.AcquireUserQuery() {
+		t.Fatal("Expected the user query to be admitted")
+	}
+	defer admissionCtrl.ReleaseUserQuery()
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 without healthy backends, got %d", rr.Code)
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error.Type != "backend_unavailable" {
+		t.Errorf("Expected a JSON backend_unavailable error, got %q (%v)", rr.Body.String(), err)
+	}
+	if got := metrics.GetSnapshot()["/v1/chat/completions"]["503"]; got != 1 {
+		t.Errorf("Expected one recorded 503, got %d", got)
+	}
+}
+
+// TestBackendPoolPassthrough tests that passthrough requests keep the path
+// of the pool member URL and are rejected like chat completions when no
+// member is healthy
+func TestBackendPoolPassthrough(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	var mu sync.Mutex
+	var paths []string
+	member := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/llm/health" {
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer member.Close()
+
+	cfg := createTestConfig("http://127.0.0.1:1")
+	cfg.DisableKVCache = true
+	proxy, err := New(cfg, createTestWatcher(), admin.NewMetrics(), createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	pool := backendpool.New([]config.BackendConfig{{URL: member.URL + "/llm"}}, &http.Client{}, nil)
+	proxy.SetBackendPicker(pool)
+	handler := proxy.handler()
+
+	send := func(path, body string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	pool.CheckNow()
+	if code := send("/v1/completions", `{"prompt":"hi"}`); code != http.StatusOK {
+		t.Errorf("Expected passthrough status 200, got %d", code)
+	}
+	if code := send("/v1/chat/completions", `{"messages":[{"role":"user","content":"hello"}]}`); code != http.StatusOK {
+		t.Errorf("Expected chat status 200, got %d", code)
+	}
+	mu.Lock()
+	if expected := []string{"/llm/v1/completions", "/llm/v1/chat/completions"}; !slices.Equal(paths, expected) {
+		t.Errorf("Expected requests under the member path %v, got %v", expected, paths)
+	}
+	mu.Unlock()
+
+	healthy.Store(false)
+	pool.CheckNow()
+	if code := send("/v1/completions", `{"prompt":"hi"}`); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected passthrough status 503 without healthy backends, got %d", code)
+	}
+	if code := send("/v1/chat/completions", `{"messages":[{"role":"user","content":"hello"}]}`); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected chat status 503 without healthy backends, got %d", code)
+	}
+}
+
+// TestLogRequests tests that LogRequests off drops the per-request INFO
+// lines but keeps startup INFO lines
+func TestLogRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	run := func(logRequests bool) string {
+		cfg := createTestConfig(backend.URL)
+		cfg.LogRequests = logRequests
+		cfg.DisableKVCache = true
+		proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+
+		logOutput.Reset()
+		if err := proxy.Start(); err != nil {
+			t.Fatalf("Failed to start proxy: %v", err)
+		}
+		defer proxy.Stop()
+
+		proxy.reverseProxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`))
+		proxy.handleChatCompletion(httptest.NewRecorder(), req)
+		return logOutput.String()
+	}
+
+	perRequest := []string{"INFO: Proxying GET /health", "INFO: Backend responded with status 200 for GET /health",
+		"INFO: Forwarding chat completion request", "INFO: Backend responded with status 200\n"}
+
+	output := run(true)
+	for _, line := range perRequest {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected %q with log_requests on, got:\n%s", line, output)
+		}
+	}
+
+	output = run(false)
+	for _, line := range perRequest {
+		if strings.Contains(output, line) {
+			t.Errorf("Expected no %q with log_requests off, got:\n%s", line, output)
+		}
+	}
+	if !strings.Contains(output, "INFO: Starting proxy server") {
+		t.Errorf("Expected startup INFO line with log_requests off, got:\n%s", output)
+	}
+}
+
+// TestPromptCache tests that cache_prompt is added with EnablePromptCache
+// and that a client-provided value is kept
+func TestPromptCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		request  string
+		expected interface{} // nil means absent
+	}{
+		{"disabled", false, `{"messages":[{"role":"user","content":"hello"}]}`, nil},
+		{"enabled", true, `{"messages":[{"role":"user","content":"hello"}]}`, true},
+		{"client value kept", true, `{"cache_prompt":false,"messages":[{"role":"user","content":"hello"}]}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var receivedRequest map[string]interface{}
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&receivedRequest)
+				w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+			}))
+			defer backend.Close()
+
+			cfg := createTestConfig(backend.URL)
+			cfg.EnablePromptCache = tt.enabled
+			proxy, err := New(cfg, createTestWatcher(), admin.NewMetrics(), createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.request))
+			proxy.handleChatCompletion(httptest.NewRecorder(), req)
+
+			if got := receivedRequest["cache_prompt"]; got != tt.expected {
+				t.Errorf("Expected forwarded cache_prompt %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestMaxTokensCap tests that max_tokens above the cap is reduced, missing
+// max_tokens gets the cap, and requested values are recorded in metrics
+func TestMaxTokensCap(t *testing.T) {
+	var receivedMaxTokens []interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		receivedMaxTokens = append(receivedMaxTokens, request["max_tokens"])
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.MaxTokensCap = 2048
+	metrics := admin.NewMetrics()
+	proxy, err := New(cfg, createTestWatcher(), metrics, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	for _, maxTokens := range []string{`"max_tokens":100,`, `"max_tokens":500,`, `"max_tokens":3000,`, `"max_tokens":10000,`, ``} {
+		requestBody := `{` + maxTokens + `"messages":[{"role":"user","content":"hello"}]}`
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+		proxy.handleChatCompletion(httptest.NewRecorder(), req)
+	}
+
+	expected := []interface{}{float64(100), float64(500), float64(2048), float64(2048), float64(2048)}
+	if !reflect.DeepEqual(receivedMaxTokens, expected) {
+		t.Errorf("Expected forwarded max_tokens %v, got %v", expected, receivedMaxTokens)
+	}
+
+	snap := metrics.FullSnapshot()
+	if snap.MaxTokensClamped != 2 {
+		t.Errorf("Expected 2 clamped requests, got %d", snap.MaxTokensClamped)
+	}
+	if snap.MaxTokensCount != 4 || snap.MaxTokensSum != 13600 {
+		t.Errorf("Expected 4 requested values summing to 13600, got %d and %d", snap.MaxTokensCount, snap.MaxTokensSum)
+	}
+	// Buckets: 64 128 256 512 1024 2048 4096 8192 16384
+	expectedBuckets := []int64{0, 1, 0, 1, 0, 0, 1, 0, 1}
+	if !reflect.DeepEqual(snap.MaxTokensBuckets, expectedBuckets) {
+		t.Errorf("Expected buckets %v, got %v", expectedBuckets, snap.MaxTokensBuckets)
+	}
+}
+
+// TestMaxTokensCapAllFields tests that the cap applies to every token limit
+// field, to string and unlimited values, and to forced request_overrides
+func TestMaxTokensCapAllFields(t *testing.T) {
+	var received map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddInlineTemplate("@long", "Write: <{message}>"); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	cfg := createTestConfig(backend.URL)
+	cfg.MaxTokensCap = 2048
+	cfg.Prefixes = map[string]config.PrefixConfig{
+		"@long": {
+			Inline:           "Write: <{message}>",
+			RequestOverrides: map[string]interface{}{"max_tokens": float64(10000)},
+			ForceOverrides:   true,
+		},
+	}
+	proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		fields   string
+		content  string
+		expected map[string]interface{}
+	}{
+		{"n_predict", `"n_predict":5000,`, "hello", map[string]interface{}{"n_predict": float64(2048)}},
+		{"unlimited n_predict", `"n_predict":-1,`, "hello", map[string]interface{}{"n_predict": float64(2048)}},
+		{"string max_completion_tokens", `"max_completion_tokens":"9000",`, "hello", map[string]interface{}{"max_completion_tokens": float64(2048)}},
+		{"small string kept", `"max_tokens":"100",`, "hello", map[string]interface{}{"max_tokens": "100"}},
+		{"forced override", `"max_tokens":100,`, "@long hello", map[string]interface{}{"max_tokens": float64(2048)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestBody := `{` + tt.fields + `"messages":[{"role":"user","content":"` + tt.content + `"}]}`
+			proxy.handleChatCompletion(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody)))
+			for field, value := range tt.expected {
+				if !reflect.DeepEqual(received[field], value) {
+					t.Errorf("Expected %s %v, got %v", field, value, received[field])
+				}
+			}
+		})
+	}
+}
+
+// TestUnknownPrefixBehavior tests that a message starting with an
+// unconfigured @foo prefix is forwarded unchanged or rejected
+func TestUnknownPrefixBehavior(t *testing.T) {
+	var received []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		received = append(received, request.Messages[len(request.Messages)-1].Content)
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	send := func(behavior, content string) int {
+		watcher := createTestWatcher()
+		watcher.AddInlineTemplate("@test", "Test: <{message}>")
+		cfg := createTestConfig(backend.URL)
+		cfg.Prefixes = map[string]config.PrefixConfig{"@test": {Inline: "Test: <{message}>"}}
+		cfg.UnknownPrefixBehavior = behavior
+		cfg.DisableKVCache = true
+		proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"messages": []map[string]string{{"role": "user", "content": content}},
+		})
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(requestBody))
+		rr := httptest.NewRecorder()
+		proxy.handleChatCompletion(rr, req)
+		return rr.Code
+	}
+
+	// Passthrough: the message is forwarded including the @foo token
+	if code := send(config.UnknownPrefixPassthrough, "@foo hello"); code != http.StatusOK {
+		t.Errorf("Expected 200 with passthrough, got %d", code)
+	}
+	if len(received) != 1 || received[0] != "@foo hello" {
+		t.Errorf("Expected the raw message to be forwarded, got %v", received)
+	}
+
+	// Error: rejected before reaching the backend
+	received = nil
+	if code := send(config.UnknownPrefixError, "@foo hello"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 with error, got %d", code)
+	}
+	if len(received) != 0 {
+		t.Errorf("Expected no request to the backend, got %v", received)
+	}
+
+	// Configured prefixes and @mentions later in the message still work
+	for _, content := range []string{"@test hello", "ask @foo about it"} {
+		if code := send(config.UnknownPrefixError, content); code != http.StatusOK {
+			t.Errorf("Expected 200 for %q with error, got %d", content, code)
+		}
+	}
+}
+
+// TestTemplateSelectionPriority tests template selection by the
+// X-Bioproxy-Template header and conflicts with the message prefix
+func TestTemplateSelectionPriority(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		received = request.Messages[len(request.Messages)-1].Content
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	send := func(priority, header, content string) (int, string) {
+		watcher := createTestWatcher()
+		watcher.AddInlineTemplate("@code", "Code: <{message}>")
+		watcher.AddInlineTemplate("@review", "Review: <{message}>")
+		cfg := createTestConfig(backend.URL)
+		cfg.Prefixes = map[string]config.PrefixConfig{
+			"@code":   {Inline: "Code: <{message}>"},
+			"@review": {Inline: "Review: <{message}>"},
+		}
+		cfg.TemplateSelectionPriority = priority
+		cfg.LogLevel = config.LogLevelDebug
+		cfg.DisableKVCache = true
+		proxy, err := New(cfg, watcher, nil, createTestState(), admission.New())
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"messages": []map[string]string{{"role": "user", "content": content}},
+		})
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(requestBody))
+		if header != "" {
+			req.Header.Set("X-Bioproxy-Template", header)
+		}
+		rr := httptest.NewRecorder()
+		received = ""
+		proxy.handleChatCompletion(rr, req)
+		return rr.Code, received
+	}
+
+	tests := []struct {
+		name     string
+		priority string
+		header   string
+		content  string
+		expected string
+	}{
+		{"header only", config.TemplateSelectionHeader, "@code", "fix this", "Code: fix this"},
+		{"message only", config.TemplateSelectionHeader, "", "@review fix this", "Review: fix this"},
+		{"agreeing", config.TemplateSelectionMessage, "@review", "@review fix this", "Review: fix this"},
+		{"header wins", config.TemplateSelectionHeader, "@code", "@review fix this", "Code: fix this"},
+		{"message wins", config.TemplateSelectionMessage, "@code", "@review fix this", "Review: fix this"},
+		{"unknown header ignored", config.TemplateSelectionHeader, "@foo", "fix this", "fix this"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logOutput.Reset()
+			code, got := send(tt.priority, tt.header, tt.content)
+			if code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", code)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected backend to receive %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	// Disagreements are logged at debug level
+	logOutput.Reset()
+	send(config.TemplateSelectionHeader, "@code", "@review fix this")
+	if !strings.Contains(logOutput.String(), "DEBUG: Template header @code and message prefix @review disagree, using the header") {
+		t.Errorf("Expected a debug note on the disagreement, got:\n%s", logOutput.String())
+	}
+}
+
+// TestActiveStreams tests that an open streaming response is listed on the
+// admin /streams endpoint and removed once it completes
+func TestActiveStreams(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[]}\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	adminPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.AdminHost = "localhost"
+	cfg.AdminPort = adminPort
+	streams := admin.NewStreamRegistry()
+	adminServer := admin.New(cfg, admin.NewMetrics(), nil)
+	adminServer.SetStreams(streams)
+	if err := adminServer.Start(); err != nil {
+		t.Fatalf("Failed to start admin server: %v", err)
+	}
+	defer adminServer.Stop()
+
+	proxy, err := New(cfg, createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetStreamRegistry(streams)
+
+	listStreams := func() []admin.StreamInfo {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get(fmt.Sprintf("http://localhost:%d/streams", adminPort)); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("GET /streams failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Streams []admin.StreamInfo `json:"streams"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode /streams: %v", err)
+		}
+		return body.Streams
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"stream":true,"messages":[{"role":"user","content":"hello"}]}`))
+		proxy.handleChatCompletion(httptest.NewRecorder(), req)
+	}()
+
+	// Wait for the first chunk to be relayed
+	var active []admin.StreamInfo
+	for i := 0; i < 100; i++ {
+		if active = listStreams(); len(active) == 1 && active[0].Bytes > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(active) != 1 {
+		t.Fatalf("Expected one active stream, got %v", active)
+	}
+	if active[0].Path != "/v1/chat/completions" || active[0].Bytes != int64(len("data: {\"choices\":[]}\n\n")) {
+		t.Errorf("Unexpected active stream %+v", active[0])
+	}
+
+	close(release)
+	<-done
+	if active := listStreams(); len(active) != 0 {
+		t.Errorf("Expected no active streams after completion, got %v", active)
+	}
+}
+
+// TestBackendAuthFailure tests that a backend rejecting the backend token is
+// counted, and replaced with a distinct 502 in error mode, on every path
+func TestBackendAuthFailure(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"invalid api key"}`, http.StatusUnauthorized)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name           string
+		token          string
+		mode           string
+		expectedStatus int
+		expectedCount  int64
+	}{
+		{"passthrough", "backend-secret", config.BackendAuthFailurePassthrough, http.StatusUnauthorized, 3},
+		{"error", "backend-secret", config.BackendAuthFailureError, http.StatusBadGateway, 3},
+		{"no token", "", config.BackendAuthFailureError, http.StatusUnauthorized, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestConfig(backend.URL)
+			cfg.BackendAuthToken = tt.token
+			cfg.BackendAuthFailure = tt.mode
+			metrics := admin.NewMetrics()
+			proxy, err := New(cfg, template.NewWatcher(), metrics, createTestState(), admission.New())
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			requests := []*http.Request{
+				httptest.NewRequest("POST", "/v1/chat/completions",
+					strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`)),
+				httptest.NewRequest("GET", "/v1/models", nil),
+				httptest.NewRequest("GET", "/v1/slots", nil),
+			}
+			for _, req := range requests {
+				rr := httptest.NewRecorder()
+				if req.URL.Path == "/v1/chat/completions" {
+					proxy.handleChatCompletion(rr, req)
+				} else {
+					proxy.handlePassthrough(rr, req)
+				}
+
+				if rr.Code != tt.expectedStatus {
+					t.Errorf("%s: expected status %d, got %d", req.URL.Path, tt.expectedStatus, rr.Code)
+				}
+				if tt.expectedStatus == http.StatusBadGateway && !strings.Contains(rr.Body.String(), "backend_auth_token") {
+					t.Errorf("%s: expected backend auth error, got %q", req.URL.Path, rr.Body.String())
+				}
+			}
+
+			if got := metrics.FullSnapshot().BackendAuthFailures; got != tt.expectedCount {
+				t.Errorf("Expected %d backend auth failures, got %d", tt.expectedCount, got)
+			}
+		})
+	}
+}
+
+// TestMaintenanceMode tests that chat completions get a 503 with the
+// maintenance message while other paths are still forwarded
+func TestMaintenanceMode(t *testing.T) {
+	backendCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+		w.Write([]byte(`{"choices":[{"message":{"content":"test"}}]}`))
+	}))
+	defer backend.Close()
+
+	proxy, err := New(createTestConfig(backend.URL), createTestWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	maintenance := admin.NewMaintenance()
+	proxy.SetMaintenance(maintenance)
+	handler := proxy.handler()
+
+	chat := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"messages":[{"role":"user","content":"hello"}]}`)))
+		return rr
+	}
+
+	maintenance.Set(true, "back at 5pm")
+	rr := chat()
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 during maintenance, got %d", rr.Code)
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to parse response %q: %v", rr.Body.String(), err)
+	}
+	if body.Error.Message != "back at 5pm" || body.Error.Type != "maintenance" {
+		t.Errorf("Expected the maintenance message, got %+v", body.Error)
+	}
+	if backendCalls != 0 {
+		t.Errorf("Expected no backend calls during maintenance, got %d", backendCalls)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected /health status 200 during maintenance, got %d", rr.Code)
+	}
+
+	maintenance.Set(false, "")
+	if rr := chat(); rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after maintenance, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ResponseRewriter transforms a parsed non-streaming chat completion response
+// in place. Rewriters must not assume any field exists - backends differ in
+// what they return.
+type ResponseRewriter func(response map[string]interface{}) error
+
+// responseRewriters maps the names usable in Config.ResponseRewrite to rewriters
+var responseRewriters = map[string]ResponseRewriter{
+	"strip_think": stripThink,
+}
+
+// RegisterResponseRewriter makes a rewriter available to Config.ResponseRewrite
+// under the given name, replacing any rewriter with the same name.
+// Must be called before the proxy is created.
+func RegisterResponseRewriter(name string, rewriter ResponseRewriter) {
+	responseRewriters[name] = rewriter
+}
+
+// lookupResponseRewriters resolves rewriter names in order
+func lookupResponseRewriters(names []string) ([]ResponseRewriter, error) {
+	var rewriters []ResponseRewriter
+	for _, name := range names {
+		rewriter, ok := responseRewriters[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown response rewriter %q", name)
+		}
+		rewriters = append(rewriters, rewriter)
+	}
+	return rewriters, nil
+}
+
+// isJSON reports whether a Content-Type header denotes a JSON body
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// writeRewritten reads a complete non-streaming JSON response, applies the
+// configured rewriters and writes the result. The body is read fully, which
+// is safe here because it is not an event stream. If the body can't be parsed
+// or a rewriter fails, the original body is forwarded unchanged.
+func (p *Proxy) writeRewritten(w http.ResponseWriter, resp *http.Response) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("ERROR: Failed to read backend response: %v", err)
+		http.Error(w, "Failed to read backend response", http.StatusBadGateway)
+		return
+	}
+
+	if rewritten, err := p.rewriteResponse(body); err != nil {
+		log.Printf("WARNING: Response rewrite failed, forwarding original response: %v", err)
+	} else {
+		body = rewritten
+	}
+
+	p.stripResponseHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := w.Write(body); err != nil {
+		log.Printf("ERROR: Failed to write response: %v", err)
+	}
+}
+
+// rewriteResponse applies the configured rewriters to a JSON response body
+func (p *Proxy) rewriteResponse(body []byte) ([]byte, error) {
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	for i, rewriter := range p.rewriters {
+		if err := rewriter(response); err != nil {
+			return nil, fmt.Errorf("rewriter %s: %w", p.config.ResponseRewrite[i], err)
+		}
+	}
+
+	return json.Marshal(response)
+}
+
+// thinkBlock matches a <think>...</think> reasoning block and the whitespace after it
+var thinkBlock = regexp.MustCompile(`(?s)<think>.*?</think>\s*`)
+
+// stripThink removes <think>...</think> reasoning blocks from the assistant
+// message content of every choice
+func stripThink(response map[string]interface{}) error {
+	choices, _ := response["choices"].([]interface{})
+	for _, choice := range choices {
+		choiceMap, ok := choice.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		message, ok := choiceMap["message"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if content, ok := message["content"].(string); ok && thinkBlock.MatchString(content) {
+			message["content"] = strings.TrimSpace(thinkBlock.ReplaceAllString(content, ""))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/oleksandr/bioproxy/internal/admission"
+	"github.com/oleksandr/bioproxy/internal/template"
+)
+
+// TestStripThink tests removing reasoning blocks from assistant content
+func TestStripThink(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"<think>\nlet me see\n</think>\n\nThe answer is 4", "The answer is 4"},
+		{"no reasoning here", "no reasoning here"},
+		{"  keep my spaces  ", "  keep my spaces  "},
+		{"<think>a</think>one <think>b</think>two", "one two"},
+	}
+
+	for _, tt := range tests {
+		response := map[string]interface{}{
+			"choices": []interface{}{
+				map[string]interface{}{"message": map[string]interface{}{"role": "assistant", "content": tt.content}},
+			},
+		}
+		if err := stripThink(response); err != nil {
+			t.Fatalf("stripThink failed: %v", err)
+		}
+		message := response["choices"].([]interface{})[0].(map[string]interface{})["message"].(map[string]interface{})
+		if message["content"] != tt.expected {
+			t.Errorf("stripThink(%q): expected %q, got %q", tt.content, tt.expected, message["content"])
+		}
+	}
+
+	// Unexpected shapes are left alone
+	if err := stripThink(map[string]interface{}{"choices": "nope"}); err != nil {
+		t.Errorf("Expected no error for unexpected response shape, got %v", err)
+	}
+}
+
+// TestResponseRewrite tests that non-streaming responses are rewritten and
+// streaming responses pass through untouched
+func TestResponseRewrite(t *testing.T) {
+	const jsonBody = `{"choices":[{"message":{"role":"assistant","content":"<think>hmm</think>\n42"}}],"usage":{"total_tokens":7}}`
+	const sseBody = "data: {\"choices\":[{\"delta\":{\"content\":\"<think>hmm</think>\"}}]}\n\n"
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("X-Test-Stream"), "true") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(sseBody))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonBody))
+	}))
+	defer backend.Close()
+
+	cfg := createTestConfig(backend.URL)
+	cfg.ResponseRewrite = []string{"strip_think"}
+	proxy, err := New(cfg, template.NewWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	// Non-streaming: rewritten, other fields preserved
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"stream":false}`))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Rewritten response is not valid JSON: %v (%q)", err, rr.Body.String())
+	}
+	message := response["choices"].([]interface{})[0].(map[string]interface{})["message"].(map[string]interface{})
+	if message["content"] != "42" {
+		t.Errorf("Expected rewritten content %q, got %q", "42", message["content"])
+	}
+	if response["usage"].(map[string]interface{})["total_tokens"] != float64(7) {
+		t.Errorf("Expected other fields to be preserved, got %v", response)
+	}
+	if rr.Header().Get("Content-Length") != strconv.Itoa(rr.Body.Len()) {
+		t.Errorf("Content-Length %s does not match body length %d", rr.Header().Get("Content-Length"), rr.Body.Len())
+	}
+
+	// Streaming: forwarded verbatim
+	req = httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	req.Header.Set("X-Test-Stream", "true")
+	rr = httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if rr.Body.String() != sseBody {
+		t.Errorf("Expected streaming response to pass through untouched, got %q", rr.Body.String())
+	}
+}
+
+// TestRegisterResponseRewriter tests that custom rewriters run in configured order
+func TestRegisterResponseRewriter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"<think>x</think>hello"}}]}`))
+	}))
+	defer backend.Close()
+
+	RegisterResponseRewriter("test_mark", func(response map[string]interface{}) error {
+		message := response["choices"].([]interface{})[0].(map[string]interface{})["message"].(map[string]interface{})
+		message["content"] = message["content"].(string) + "!"
+		return nil
+	})
+	defer delete(responseRewriters, "test_mark")
+
+	cfg := createTestConfig(backend.URL)
+	cfg.ResponseRewrite = []string{"strip_think", "test_mark"}
+	proxy, err := New(cfg, template.NewWatcher(), nil, createTestState(), admission.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`))
+	rr := httptest.NewRecorder()
+	proxy.handleChatCompletion(rr, req)
+
+	if !strings.Contains(rr.Body.String(), `"content":"hello!"`) {
+		t.Errorf("Expected both rewriters to be applied in order, got %s", rr.Body.String())
+	}
+}
+
+// TestResponseRewriteUnknown tests that unknown rewriter names are rejected
+func TestResponseRewriteUnknown(t *testing.T) {
+	cfg := createTestConfig("http://localhost:8081")
+	cfg.ResponseRewrite = []string{"does_not_exist"}
+	if _, err := New(cfg, template.NewWatcher(), nil, createTestState(), admission.New()); err == nil {
+		t.Error("Expected error for unknown response rewriter")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package state
+
+import "os"
+
+// lockSupported is false where file locking is not available, so NewShared
+// fails instead of returning a State that never acquires the lock
+const lockSupported = false
+
+func lockFile(f *os.File) error {
+	return errLockUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return errLockUnsupported
+}
@@ -0,0 +1,149 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// errLockUnsupported is returned where file locking is not available
+var errLockUnsupported = errors.New("file locking is not supported on this platform")
+
+// sharedLock coordinates several bioproxy instances in front of the same
+// llama.cpp backend through an advisory lock on a shared file.
+//
+// Only the instance holding the lock performs KV cache transitions (save and
+// restore); the others defer, so instances never save or restore over each
+// other. Instances that don't hold the lock retry on every check, so another
+// instance takes over when the holder exits. The file contains the prefix
+// loaded by the holder, which a new holder starts from.
+type sharedLock struct {
+	mu   sync.Mutex
+	file *os.File
+	held bool
+}
+
+// NewShared creates a State shared with other instances through the lock
+// file at path (created if missing). Call Close to release the lock.
+// It fails on platforms without file locking, where the lock could never
+// be acquired and KV caches would silently never be saved or restored.
+func NewShared(path string) (*State, error) {
+	if !lockSupported {
+		return nil, errLockUnsupported
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	s := New()
+	s.shared = &sharedLock{file: file}
+	s.persist = true
+	return s, nil
+}
+
+// HoldsLock reports whether this instance may perform KV cache transitions.
+// Always true for a local (non-shared) State. For a shared State it tries
+// to acquire the lock if not held yet; on acquiring it, the prefix recorded
+// by the previous holder is loaded.
+//
+// Thread-safe for concurrent use.
+func (s *State) HoldsLock() bool {
+	if s.shared == nil {
+		return true
+	}
+
+	// Lock order: State.mu, then sharedLock.mu
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+
+	if s.shared.held {
+		return true
+	}
+	if err := lockFile(s.shared.file); err != nil {
+		return false
+	}
+	s.shared.held = true
+
+	if s.persist {
+		prefix, err := s.shared.read()
+		if err != nil {
+			log.Printf("WARNING: Failed to read state file: %v", err)
+		}
+		s.lastPrefix = prefix
+		log.Printf("Acquired shared state lock (loaded prefix %q)", prefix)
+	}
+	return true
+}
+
+// Persist writes the loaded prefix to the shared state file, e.g. on
+// shutdown so the next instance starts from it. No-op for a local State or
+// when this instance doesn't hold the lock.
+//
+// Thread-safe for concurrent use.
+func (s *State) Persist() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save(s.lastPrefix)
+}
+
+// Close releases the shared state lock, letting another instance take over.
+// No-op for a local State.
+func (s *State) Close() error {
+	if s.shared == nil || !s.persist {
+		return nil
+	}
+
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+
+	if s.shared.held {
+		unlockFile(s.shared.file)
+		s.shared.held = false
+	}
+	return s.shared.file.Close()
+}
+
+// save records prefix in the shared file if this instance holds the lock.
+// Must be called with s.mu held.
+func (s *State) save(prefix string) {
+	if s.shared == nil || !s.persist {
+		return
+	}
+
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+
+	if !s.shared.held {
+		return
+	}
+	if err := s.shared.write(prefix); err != nil {
+		log.Printf("WARNING: Failed to write state file: %v", err)
+	}
+}
+
+// read returns the prefix stored in the file
+func (l *sharedLock) read() (string, error) {
+	info, err := l.file.Stat()
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, info.Size())
+	if _, err := l.file.ReadAt(data, 0); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// write replaces the file's content with prefix
+func (l *sharedLock) write(prefix string) error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.file.WriteAt([]byte(prefix+"\n"), 0)
+	return err
+}
@@ -1,7 +1,9 @@
 package state
 
 import (
+	"maps"
 	"sync"
+	"time"
 )
 
 // RequestType represents the type of request currently using llama.cpp
@@ -50,6 +52,10 @@ func (r RequestType) String() string {
 //   - Repeated queries with same template: no disk I/O
 //   - Active template development: warmup runs repeatedly, no saves until switch
 //   - Switching templates: save old, restore new (one-time cost)
+//
+// Several instances in front of the same backend can share the state
+// through a lock file (see NewShared); only the lock holder performs
+// KV cache transitions.
 type State struct {
 	// mu protects concurrent access to the state
 	mu sync.RWMutex
@@ -63,6 +69,29 @@ type State struct {
 	//
 	// On first startup, lastPrefix will be "" (zero value).
 	lastPrefix string
+
+	// lastUsed is when lastPrefix was last used by a request or warmup
+	lastUsed time.Time
+
+	// now returns the current time for lastUsed, time.Now if nil (see
+	// SetClock)
+	now func() time.Time
+
+	// requestsSinceSave counts user requests on lastPrefix since it was
+	// loaded or its cache was last saved (see CountRequest)
+	requestsSinceSave int
+
+	// backends holds the state of additional backends, keyed by URL
+	// (see Backend). Only used on the default backend's State.
+	backends map[string]*State
+
+	// shared is the lock coordinating instances in shared-file mode
+	// (see NewShared), nil for local state. Additional backends share
+	// their parent's lock.
+	shared *sharedLock
+
+	// persist is set on the State whose prefix is recorded in the shared file
+	persist bool
 }
 
 // New creates a new State instance.
@@ -73,6 +102,43 @@ func New() *State {
 	}
 }
 
+// Backend returns the state of another backend, creating it on first use.
+// Each llama.cpp backend has its own KV cache, so prefixes routed to
+// different backends must be tracked separately. The receiver is the state
+// of the default backend; an empty URL returns the receiver itself.
+//
+// Thread-safe for concurrent use.
+func (s *State) Backend(backendURL string) *State {
+	if backendURL == "" {
+		return s
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.backends == nil {
+		s.backends = make(map[string]*State)
+	}
+	backendState, exists := s.backends[backendURL]
+	if !exists {
+		backendState = New()
+		backendState.shared = s.shared
+		backendState.now = s.now
+		s.backends[backendURL] = backendState
+	}
+	return backendState
+}
+
+// Backends returns the states of the additional backends created with
+// Backend, keyed by URL. The receiver is the state of the default backend.
+//
+// Thread-safe for concurrent use.
+func (s *State) Backends() map[string]*State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.backends)
+}
+
 // GetLastPrefix returns the last prefix used.
 // Returns empty string if no request has been sent yet, or if the last
 // request had no template prefix.
@@ -95,7 +161,84 @@ func (s *State) GetLastPrefix() string {
 func (s *State) UpdatePrefix(prefix string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if prefix != s.lastPrefix {
+		s.requestsSinceSave = 0
+	}
 	s.lastPrefix = prefix
+	s.lastUsed = s.clock()
+	s.save(prefix)
+}
+
+// CountRequest counts a user request on prefix, which must be the loaded
+// prefix (see UpdatePrefix), and returns the number of requests on it since
+// it was loaded or last saved. Requests without a prefix are not counted.
+//
+// Thread-safe for concurrent writes.
+func (s *State) CountRequest(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prefix == "" || prefix != s.lastPrefix {
+		return 0
+	}
+	s.requestsSinceSave++
+	return s.requestsSinceSave
+}
+
+// RequestsSinceSave returns the loaded prefix and the number of user
+// requests on it since it was loaded or last saved (see MarkSaved).
+//
+// Thread-safe for concurrent reads.
+func (s *State) RequestsSinceSave() (string, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastPrefix, s.requestsSinceSave
+}
+
+// MarkSaved records that the KV cache of prefix was saved, restarting its
+// request count if it is still loaded.
+//
+// Thread-safe for concurrent writes.
+func (s *State) MarkSaved(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prefix == s.lastPrefix {
+		s.requestsSinceSave = 0
+	}
+}
+
+// LastUsed returns when the last prefix was last used by a request or
+// warmup (see UpdatePrefix), or the zero time if nothing was sent yet.
+//
+// Thread-safe for concurrent reads.
+func (s *State) LastUsed() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastUsed
+}
+
+// IdleFor returns how long ago the last prefix was last used by a request
+// or warmup (see UpdatePrefix), by the state's clock.
+//
+// Thread-safe for concurrent reads.
+func (s *State) IdleFor() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clock().Sub(s.lastUsed)
+}
+
+// SetClock replaces time.Now as the source of the current time for
+// LastUsed and IdleFor, e.g. in tests. Must be called before the state is
+// used concurrently.
+func (s *State) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+// clock returns the current time by the state's clock
+func (s *State) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
 }
 
 // ShouldSave determines if we need to save the OLD KV cache before switching
@@ -112,11 +255,18 @@ func (s *State) UpdatePrefix(prefix string) {
 //   - old="code", new="debug" -> true (save "code" before switching)
 //   - old="code", new="" -> true (save "code" before clearing)
 //
+// In shared-file mode, always false unless this instance holds the lock
+// (see HoldsLock).
+//
 // Parameters:
 //   - newPrefix: The prefix we want to switch to
 //
 // Thread-safe for concurrent reads.
 func (s *State) ShouldSave(newPrefix string) bool {
+	if !s.HoldsLock() {
+		return false
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -138,11 +288,18 @@ func (s *State) ShouldSave(newPrefix string) bool {
 //   - old="code", new="debug" -> true (load "debug" template)
 //   - old="code", new="" -> false (clearing, nothing to restore)
 //
+// In shared-file mode, always false unless this instance holds the lock
+// (see HoldsLock).
+//
 // Parameters:
 //   - newPrefix: The prefix we want to use
 //
 // Thread-safe for concurrent reads.
 func (s *State) ShouldRestore(newPrefix string) bool {
+	if !s.HoldsLock() {
+		return false
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -154,9 +311,19 @@ func (s *State) ShouldRestore(newPrefix string) bool {
 // This should be called if we know the llama.cpp backend was restarted
 // or the KV cache was cleared externally.
 //
+// The state of additional backends (see Backend) is reset as well.
+//
+// Returns the prefix that was loaded before the reset.
+//
 // Thread-safe for concurrent writes.
-func (s *State) Reset() {
+func (s *State) Reset() string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	previous := s.lastPrefix
 	s.lastPrefix = ""
+	s.save("")
+	for _, backendState := range s.backends {
+		backendState.Reset()
+	}
+	return previous
 }
@@ -1,8 +1,10 @@
 package state
 
 import (
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -31,6 +33,43 @@ func TestUpdatePrefix(t *testing.T) {
 	}
 }
 
+func TestRequestsSinceSave(t *testing.T) {
+	s := New()
+
+	// Requests without a loaded prefix are not counted
+	if n := s.CountRequest(""); n != 0 {
+		t.Errorf("Expected no count without a prefix, got %d", n)
+	}
+
+	s.UpdatePrefix("code")
+	for i := 1; i <= 3; i++ {
+		s.UpdatePrefix("code")
+		if n := s.CountRequest("code"); n != i {
+			t.Errorf("Expected count %d, got %d", i, n)
+		}
+	}
+	if prefix, n := s.RequestsSinceSave(); prefix != "code" || n != 3 {
+		t.Errorf("Expected 3 requests on code, got %d on %q", n, prefix)
+	}
+
+	// Saving a prefix that is no longer loaded leaves the count alone
+	s.MarkSaved("debug")
+	if _, n := s.RequestsSinceSave(); n != 3 {
+		t.Errorf("Expected count 3 after saving another prefix, got %d", n)
+	}
+	s.MarkSaved("code")
+	if _, n := s.RequestsSinceSave(); n != 0 {
+		t.Errorf("Expected count 0 after save, got %d", n)
+	}
+
+	// Switching prefixes restarts the count
+	s.CountRequest("code")
+	s.UpdatePrefix("debug")
+	if prefix, n := s.RequestsSinceSave(); prefix != "debug" || n != 0 {
+		t.Errorf("Expected 0 requests on debug after switch, got %d on %q", n, prefix)
+	}
+}
+
 func TestReset(t *testing.T) {
 	s := New()
 	s.UpdatePrefix("code")
@@ -286,3 +325,132 @@ func TestActiveTemplateDevelopment(t *testing.T) {
 	}
 	s.UpdatePrefix("debug")
 }
+
+// TestBackend tests that each backend's state is tracked separately
+func TestBackend(t *testing.T) {
+	s := New()
+
+	if s.Backend("") != s {
+		t.Error("Empty backend URL should return the default backend state")
+	}
+
+	big := s.Backend("http://big:8081")
+	if s.Backend("http://big:8081") != big {
+		t.Error("Expected the same state for the same backend URL")
+	}
+	if s.Backend("http://quick:8081") == big {
+		t.Error("Expected a separate state for a different backend URL")
+	}
+
+	if backends := s.Backends(); len(backends) != 2 || backends["http://big:8081"] != big {
+		t.Errorf("Expected both additional backends, got %v", backends)
+	}
+
+	// Switching templates on one backend doesn't affect the other
+	s.UpdatePrefix("code")
+	big.UpdatePrefix("bigcontext")
+	if s.GetLastPrefix() != "code" || big.GetLastPrefix() != "bigcontext" {
+		t.Errorf("Expected independent states, got %q and %q", s.GetLastPrefix(), big.GetLastPrefix())
+	}
+	if big.ShouldRestore("bigcontext") {
+		t.Error("Should not restore bigcontext, it is loaded on its own backend")
+	}
+
+	// Resetting the default state resets all backends
+	if previous := s.Reset(); previous != "code" {
+		t.Errorf("Expected previous prefix code, got %q", previous)
+	}
+	if big.GetLastPrefix() != "" {
+		t.Errorf("Expected backend state to be reset, got %q", big.GetLastPrefix())
+	}
+}
+
+func TestSharedState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+
+	first, err := NewShared(path)
+	if err != nil {
+		t.Fatalf("NewShared failed: %v", err)
+	}
+	defer first.Close()
+	second, err := NewShared(path)
+	if err != nil {
+		t.Fatalf("NewShared failed: %v", err)
+	}
+	defer second.Close()
+
+	// The first instance to check takes the lock and performs transitions
+	if !first.ShouldRestore("code") {
+		t.Error("Expected lock holder to restore")
+	}
+	first.UpdatePrefix("code")
+	if !first.ShouldSave("debug") {
+		t.Error("Expected lock holder to save")
+	}
+
+	// The other instance defers all transitions
+	if second.HoldsLock() {
+		t.Fatal("Expected second instance not to hold the lock")
+	}
+	if second.ShouldRestore("code") || second.ShouldSave("") {
+		t.Error("Expected non-holder to defer cache transitions")
+	}
+	second.UpdatePrefix("debug")
+	if second.ShouldSave("code") {
+		t.Error("Expected non-holder to defer saves")
+	}
+
+	// Additional backends follow the same lock
+	if second.Backend("http://other:8081").ShouldRestore("code") {
+		t.Error("Expected non-holder to defer transitions on additional backends")
+	}
+
+	// When the holder goes away, the other instance takes over from the
+	// prefix it recorded
+	first.Close()
+	if !second.HoldsLock() {
+		t.Fatal("Expected second instance to take over the lock")
+	}
+	if got := second.GetLastPrefix(); got != "code" {
+		t.Errorf("Expected takeover to load prefix \"code\", got %q", got)
+	}
+	if second.ShouldRestore("code") {
+		t.Error("Expected no restore of the already loaded prefix")
+	}
+	if !second.ShouldRestore("debug") {
+		t.Error("Expected new holder to restore")
+	}
+}
+
+func TestLocalStateHoldsLock(t *testing.T) {
+	s := New()
+	if !s.HoldsLock() {
+		t.Error("Expected local state to always perform transitions")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close on local state failed: %v", err)
+	}
+}
+
+func TestIdleFor(t *testing.T) {
+	start := time.Now()
+	now := start
+	s := New()
+	s.SetClock(func() time.Time { return now })
+	big := s.Backend("http://big:8081")
+
+	s.UpdatePrefix("code")
+	big.UpdatePrefix("bigcontext")
+	now = start.Add(30 * time.Second)
+	if idle := s.IdleFor(); idle != 30*time.Second {
+		t.Errorf("Expected 30s idle, got %v", idle)
+	}
+	if idle := big.IdleFor(); idle != 30*time.Second {
+		t.Errorf("Expected the backend state to share the clock, got %v idle", idle)
+	}
+
+	s.UpdatePrefix("code")
+	if idle := s.IdleFor(); idle != 0 {
+		t.Errorf("Expected use to reset the idle time, got %v", idle)
+	}
+}
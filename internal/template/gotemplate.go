@@ -0,0 +1,143 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	gotemplate "text/template"
+)
+
+// goTemplateData is the data passed to Go templates
+type goTemplateData struct {
+	// Message is the user message (empty string during warmup)
+	Message string
+
+	// History is the prior conversation, one "role: content" line per message
+	// (empty string during warmup)
+	History string
+}
+
+// goTemplateFuncs returns the helper functions available to Go templates.
+// Included files are read through includes.
+func goTemplateFuncs(includes *includeReader) gotemplate.FuncMap {
+	return gotemplate.FuncMap{
+		// File returns the content of the file at path, e.g. {{File "docs/guide.txt"}}
+		"File": includes.readIncluded,
+
+		// Split splits s by sep, useful for loops, e.g. {{range Split "a.txt,b.txt" ","}}
+		"Split": strings.Split,
+	}
+}
+
+// ProcessGoTemplateString processes a template written in Go's text/template syntax.
+// The user message is available as {{.Message}} (and the prior conversation
+// as {{.History}} when processed by the Watcher), files can be included with
+// {{File "path"}} and {{Split s sep}} produces a list to range over.
+//
+// Like ProcessTemplateString, this is NOT recursive: only the original template is
+// parsed. The user message and included file contents are passed in as data, so any
+// {{...}} or <{...}> syntax they contain is emitted literally and never executed.
+func ProcessGoTemplateString(template string, userMessage string) (string, error) {
+	return processGoTemplate(template, goTemplateData{Message: userMessage}, &includeReader{})
+}
+
+// processGoTemplate parses and executes a Go template with the given data.
+// Included files are read through includes.
+func processGoTemplate(template string, data goTemplateData, includes *includeReader) (string, error) {
+	tmpl, err := gotemplate.New("template").Funcs(goTemplateFuncs(includes)).Parse(template)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse go-template: %w", err)
+	}
+
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", fmt.Errorf("failed to execute go-template: %w", err)
+	}
+
+	return result.String(), nil
+}
+
+// includeReader reads the files included by a template, limiting their size
+// and recording their paths so the watcher can report a template's dependencies
+type includeReader struct {
+	// maxFileBytes limits the size of each included file (0 means no limit)
+	maxFileBytes int
+
+	// maxExpansionBytes limits the total size of the included files
+	// (0 means no limit); expanded is the total read so far
+	maxExpansionBytes int
+	expanded          int
+
+	// paths lists the absolute paths of the included files, in the order
+	// they were first read
+	paths []string
+}
+
+// record adds path to the included files, unless it is already there
+func (r *includeReader) record(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if !slices.Contains(r.paths, path) {
+		r.paths = append(r.paths, path)
+	}
+}
+
+// read returns the content of an included file, failing if it can't be read
+// or if it takes the included files over maxExpansionBytes
+func (r *includeReader) read(path string) ([]byte, error) {
+	r.record(path)
+	content, err := readFileLimited(path, r.maxFileBytes)
+	if err != nil {
+		return nil, err
+	}
+	r.expanded += len(content)
+	if r.maxExpansionBytes > 0 && r.expanded > r.maxExpansionBytes {
+		return nil, fmt.Errorf("%w: includes exceed %d bytes at %s", ErrTemplateExpansionTooLarge, r.maxExpansionBytes, path)
+	}
+	return content, nil
+}
+
+// readIncluded returns the content of an included file.
+// On failure it returns an error marker, matching the simple engine's behavior,
+// except for exceeded size limits, which fail the template.
+func (r *includeReader) readIncluded(path string) (string, error) {
+	content, err := r.read(path)
+	if errors.Is(err, ErrTemplateFileTooLarge) || errors.Is(err, ErrTemplateExpansionTooLarge) {
+		return "", err
+	}
+	if err != nil {
+		log.Printf("WARNING: Failed to read included file %s: %v", path, err)
+		return fmt.Sprintf("[Error reading %s: %v]", path, err), nil
+	}
+	return string(content), nil
+}
+
+// readFileLimited reads a template or included file, failing with
+// ErrTemplateFileTooLarge if it is larger than maxFileBytes (0 means no
+// limit). It never reads more than the limit, so a huge file or a device
+// such as /dev/zero fails fast.
+func readFileLimited(path string, maxFileBytes int) ([]byte, error) {
+	if maxFileBytes <= 0 {
+		return os.ReadFile(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, int64(maxFileBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxFileBytes {
+		return nil, fmt.Errorf("%w: %s is larger than %d bytes", ErrTemplateFileTooLarge, path, maxFileBytes)
+	}
+	return content, nil
+}
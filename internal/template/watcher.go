@@ -2,9 +2,10 @@ package template
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -13,20 +14,126 @@ import (
 // messagePlaceholder is the keyword for user message in templates: <{message}>
 const messagePlaceholder = "message"
 
+// historyPlaceholder is the keyword for the prior conversation: <{history}>
+const historyPlaceholder = "history"
+
+// Message is a prior chat message substituted for <{history}>
+type Message struct {
+	Role    string
+	Content string
+}
+
+// formatHistory renders messages one per line as "role: content"
+func formatHistory(history []Message) string {
+	lines := make([]string, len(history))
+	for i, msg := range history {
+		lines[i] = msg.Role + ": " + msg.Content
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Template engines that can be selected per prefix
+const (
+	// EngineSimple is the default <{...}> placeholder engine
+	EngineSimple = "simple"
+
+	// EngineGoTemplate processes templates with Go's text/template
+	// (.Message for the user message, {{File "path"}} for file inclusion)
+	EngineGoTemplate = "go-template"
+)
+
+// Template sources reported by Templates
+const (
+	// SourceConfig is a file template listed in the config's prefixes
+	SourceConfig = "config"
+
+	// SourceDir is a file template found in the config's template_dir
+	SourceDir = "dir"
+
+	// SourceInline is a template whose content is given directly
+	SourceInline = "inline"
+
+	// SourceRuntime is a file template added through the Watcher API
+	// without a source, e.g. by tools or tests
+	SourceRuntime = "runtime"
+)
+
+// ErrTemplateTooLarge is returned by ProcessTemplate when the processed output
+// exceeds the limit set with SetMaxProcessedBytes
+var ErrTemplateTooLarge = errors.New("processed template too large")
+
+// ErrTemplateExpansionTooLarge is returned when the files a template includes
+// exceed the total size set with SetMaxExpansionBytes
+var ErrTemplateExpansionTooLarge = errors.New("template expansion too large")
+
+// ErrTemplateFileTooLarge is returned when a template file or a file it
+// includes exceeds the limit set with SetMaxFileBytes
+var ErrTemplateFileTooLarge = errors.New("template file too large")
+
 // TemplateState represents the state of a single template
 type TemplateState struct {
 	// Prefix is the message prefix that triggers this template (e.g., "@code")
 	Prefix string
 
-	// TemplatePath is the path to the template file
+	// TemplatePath is the path to the template file (empty for inline templates)
 	TemplatePath string
 
+	// ResolvedPath is TemplatePath with symlinks resolved, as of the last
+	// check. It is re-resolved on every check so repointing a symlinked
+	// template is noticed even before the template is due.
+	ResolvedPath string
+
+	// Inline is the template content for templates defined directly in the
+	// config (see AddInlineTemplate), empty for file templates.
+	// Inline templates must not be empty.
+	Inline string
+
+	// Engine is the template engine used to process this template
+	// (EngineSimple or EngineGoTemplate)
+	Engine string
+
+	// Source tells where the template comes from (SourceConfig, SourceDir,
+	// SourceInline or SourceRuntime)
+	Source string
+
+	// Includes lists fragment files prepended in order to the processed
+	// template. Their content is part of ProcessedHash, so editing any
+	// fragment is detected as a change.
+	Includes []string
+
+	// HashFiles lists files that are sent along with the template without
+	// being part of it (e.g. the prefix's tools file). Their content is part
+	// of ProcessedHash, so editing one is detected as a change.
+	HashFiles []string
+
 	// ProcessedHash is the SHA256 hash of the processed template (with empty message)
 	// We hash the fully processed template rather than individual files
 	ProcessedHash string
 
 	// NeedsWarmup indicates whether the template has changed and needs warmup
 	NeedsWarmup bool
+
+	// pendingHash is a changed hash that is not yet stable (see SetChangeDebounce)
+	pendingHash string
+
+	// pendingChecks counts the checks pendingHash has been seen unchanged since it appeared
+	pendingChecks int
+
+	// maxFileBytes limits the size of the template file and the files it
+	// includes (0 means no limit), see Watcher.SetMaxFileBytes
+	maxFileBytes int
+
+	// maxExpansionBytes limits the total size of the files included in one
+	// processing (0 means no limit), see Watcher.SetMaxExpansionBytes
+	maxExpansionBytes int
+
+	// dependencies lists the absolute paths of the files included by the
+	// last successful processing, see Watcher.Dependencies
+	dependencies []string
+
+	// recheck is set when the last check failed (e.g. the file was read
+	// mid-write), so the next check re-reads it even if it is not due
+	recheck bool
 }
 
 // Watcher monitors templates for changes
@@ -35,6 +142,23 @@ type Watcher struct {
 
 	// templates maps prefix to template state
 	templates map[string]*TemplateState
+
+	// onChange is called for every prefix whose content changed during
+	// CheckForChanges (can be nil). Used to record reload metrics.
+	onChange func(prefix string)
+
+	// maxProcessedBytes limits the size of processed templates (0 means no limit)
+	maxProcessedBytes int
+
+	// maxFileBytes limits the size of template files and their includes (0 means no limit)
+	maxFileBytes int
+
+	// maxExpansionBytes limits the total size of a template's includes (0 means no limit)
+	maxExpansionBytes int
+
+	// debounceChecks is how many additional checks a changed hash must stay
+	// the same before the change is reported (0 reports changes immediately)
+	debounceChecks int
 }
 
 // NewWatcher creates a new template watcher
@@ -44,71 +168,317 @@ func NewWatcher() *Watcher {
 	}
 }
 
-// AddTemplate adds a new template to watch
+// SetChangeHandler registers a function that is called whenever CheckForChanges
+// detects that a template's processed content changed.
+// The handler is called with the watcher lock held and must not call back into the watcher.
+func (w *Watcher) SetChangeHandler(handler func(prefix string)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onChange = handler
+}
+
+// SetMaxProcessedBytes limits the size of the output of ProcessTemplate.
+// Larger results fail with ErrTemplateTooLarge, which surfaces runaway
+// includes before they are sent to llama.cpp. 0 means no limit.
+func (w *Watcher) SetMaxProcessedBytes(limit int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxProcessedBytes = limit
+}
+
+// SetMaxFileBytes limits the size of template files and the files they
+// include. Larger files fail with ErrTemplateFileTooLarge, so a prefix
+// pointing at a huge file or a device fails AddTemplate instead of hanging.
+// 0 means no limit.
+func (w *Watcher) SetMaxFileBytes(limit int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxFileBytes = limit
+	for _, state := range w.templates {
+		state.maxFileBytes = limit
+	}
+}
+
+// SetMaxExpansionBytes limits the total size of the files a template
+// includes in one processing. Processing stops with
+// ErrTemplateExpansionTooLarge as soon as the limit is exceeded, before the
+// rest of the expansion is read. 0 means no limit.
+func (w *Watcher) SetMaxExpansionBytes(limit int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxExpansionBytes = limit
+	for _, state := range w.templates {
+		state.maxExpansionBytes = limit
+	}
+}
+
+// SetChangeDebounce makes CheckForChanges report a change only after the new
+// processed hash has stayed the same for the given number of additional checks.
+// This avoids warming up half-written files, e.g. when an editor saves twice.
+// 0 (the default) reports changes immediately.
+func (w *Watcher) SetChangeDebounce(checks int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.debounceChecks = checks
+}
+
+// AddTemplate adds a new template to watch using the default simple engine
 // prefix: the message prefix (e.g., "@code")
 // templatePath: path to the template file
 func (w *Watcher) AddTemplate(prefix, templatePath string) error {
+	return w.AddTemplateWithEngine(prefix, templatePath, EngineSimple)
+}
+
+// AddTemplateWithEngine adds a new template to watch using the given engine
+// prefix: the message prefix (e.g., "@code")
+// templatePath: path to the template file
+// engine: EngineSimple or EngineGoTemplate (empty string means EngineSimple)
+func (w *Watcher) AddTemplateWithEngine(prefix, templatePath, engine string) error {
+	return w.AddTemplateWithIncludes(prefix, templatePath, engine, nil)
+}
+
+// AddTemplateWithIncludes is like AddTemplateWithEngine, and prepends the
+// given fragment files in order to the processed template
+func (w *Watcher) AddTemplateWithIncludes(prefix, templatePath, engine string, includes []string) error {
+	return w.AddTemplateFromSource(prefix, templatePath, engine, includes, SourceRuntime)
+}
+
+// AddTemplateFromSource is like AddTemplateWithIncludes, recording where the
+// template comes from (SourceConfig or SourceDir) for Templates
+func (w *Watcher) AddTemplateFromSource(prefix, templatePath, engine string, includes []string, source string) error {
+	return w.addTemplate(&TemplateState{Prefix: prefix, TemplatePath: templatePath, Engine: engine, Includes: includes, Source: source}, templatePath)
+}
+
+// AddInlineTemplate adds a template whose content is given directly (e.g.
+// from the config) instead of read from a file, using the simple engine.
+// Its content is kept in memory; included files are still read from disk.
+// prefix: the message prefix (e.g., "@code")
+// content: the template text
+func (w *Watcher) AddInlineTemplate(prefix, content string) error {
+	return w.AddInlineTemplateWithEngine(prefix, content, EngineSimple)
+}
+
+// AddInlineTemplateWithEngine is like AddInlineTemplate with the given engine
+// (empty string means EngineSimple)
+func (w *Watcher) AddInlineTemplateWithEngine(prefix, content, engine string) error {
+	return w.AddInlineTemplateWithIncludes(prefix, content, engine, nil)
+}
+
+// AddInlineTemplateWithIncludes is like AddInlineTemplateWithEngine, and
+// prepends the given fragment files in order to the processed template
+func (w *Watcher) AddInlineTemplateWithIncludes(prefix, content, engine string, includes []string) error {
+	if content == "" {
+		return fmt.Errorf("inline template for %s is empty", prefix)
+	}
+	return w.addTemplate(&TemplateState{Prefix: prefix, Inline: content, Engine: engine, Includes: includes, Source: SourceInline}, "inline config")
+}
+
+// addTemplate validates and registers a new template state.
+// source describes where the template comes from, for logging.
+func (w *Watcher) addTemplate(state *TemplateState, source string) error {
+	// A padded prefix would never match, as messages are matched on prefix + " "
+	if trimmed := strings.TrimSpace(state.Prefix); trimmed != state.Prefix {
+		if trimmed == "" {
+			return fmt.Errorf("invalid template prefix %q", state.Prefix)
+		}
+		log.Printf("WARNING: Template prefix %q has surrounding whitespace, using %q", state.Prefix, trimmed)
+		state.Prefix = trimmed
+	}
+	if !strings.HasPrefix(state.Prefix, "@") {
+		log.Printf("WARNING: Template prefix %q does not start with @", state.Prefix)
+	}
+	prefix := state.Prefix
+	if state.Engine == "" {
+		state.Engine = EngineSimple
+	}
+	if state.Engine != EngineSimple && state.Engine != EngineGoTemplate {
+		return fmt.Errorf("unknown template engine %q for %s", state.Engine, prefix)
+	}
+
+	if state.TemplatePath != "" {
+		resolved, err := filepath.EvalSymlinks(state.TemplatePath)
+		if err != nil {
+			log.Printf("ERROR: Failed to add template %s from %s: %v", prefix, source, err)
+			return fmt.Errorf("failed to resolve template %s: %w", prefix, err)
+		}
+		state.ResolvedPath = resolved
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	state.maxFileBytes = w.maxFileBytes
+	state.maxExpansionBytes = w.maxExpansionBytes
+
 	// Process template with empty message to get initial hash
-	processed, err := processTemplateFile(templatePath, "")
+	hash, dependencies, err := state.check()
 	if err != nil {
-		log.Printf("ERROR: Failed to add template %s from %s: %v", prefix, templatePath, err)
+		log.Printf("ERROR: Failed to add template %s from %s: %v", prefix, source, err)
 		return fmt.Errorf("failed to process template %s: %w", prefix, err)
 	}
+	state.dependencies = dependencies
 
-	// Create initial state
-	state := &TemplateState{
-		Prefix:        prefix,
-		TemplatePath:  templatePath,
-		ProcessedHash: hashString(processed),
-		NeedsWarmup:   true, // Initially needs warmup
-	}
+	// Initially needs warmup
+	state.ProcessedHash = hash
+	state.NeedsWarmup = true
 
 	w.templates[prefix] = state
-	log.Printf("Added template %s from %s (needs warmup)", prefix, templatePath)
+	log.Printf("Added template %s from %s (needs warmup)", prefix, source)
 	return nil
 }
 
+// SetHashFiles sets the files sent along with a template without being part
+// of it (see TemplateState.HashFiles), e.g. the tools file of its prefix.
+// Editing one of them marks the template for warmup like editing the template.
+func (w *Watcher) SetHashFiles(prefix string, files []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	state, exists := w.templates[prefix]
+	if !exists {
+		return fmt.Errorf("template not found for prefix %s", prefix)
+	}
+	previous := state.HashFiles
+	state.HashFiles = files
+	hash, dependencies, err := state.check()
+	if err != nil {
+		state.HashFiles = previous
+		return fmt.Errorf("failed to process template %s: %w", prefix, err)
+	}
+	if hash != state.ProcessedHash {
+		state.ProcessedHash = hash
+		state.NeedsWarmup = true
+	}
+	state.dependencies = dependencies
+	return nil
+}
+
+// RemoveTemplate stops watching the template for the given prefix.
+// Removing an unknown prefix is a no-op.
+func (w *Watcher) RemoveTemplate(prefix string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, exists := w.templates[prefix]; exists {
+		delete(w.templates, prefix)
+		log.Printf("Removed template %s", prefix)
+	}
+}
+
 // CheckForChanges checks all templates for changes
 // Returns a slice of prefixes that have changed and need warmup
 func (w *Watcher) CheckForChanges() []string {
+	return w.CheckForChangesFunc(nil)
+}
+
+// CheckForChangesFunc is like CheckForChanges, but only re-reads templates
+// for which due returns true (all of them if due is nil). Templates still
+// needing warmup are always returned, and templates whose last check failed
+// are always re-read, so a transient read error doesn't leave a stale cache.
+// Templates whose symlink now points to a different file are re-read right
+// away, without debouncing. due is called once per template on every check,
+// with the watcher locked.
+func (w *Watcher) CheckForChangesFunc(due func(prefix string) bool) []string {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	var changed []string
 
 	for prefix, state := range w.templates {
-		// Check if already marked as needing warmup (e.g., newly added)
+		isDue := due == nil || due(prefix)
+
+		// Check if already marked as needing warmup (e.g., newly added).
+		// Keep its hash current, so edits made while the warmup is pending
+		// (e.g. deferred by MinWarmupInterval) aren't seen as another change
+		// once the latest content has been warmed up
 		if state.NeedsWarmup {
+			if isDue {
+				if hash, dependencies, err := state.check(); err == nil {
+					state.ProcessedHash = hash
+					state.dependencies = dependencies
+				}
+			}
 			changed = append(changed, prefix)
 			continue
 		}
 
+		retargeted, err := state.resolve()
+		if err != nil {
+			log.Printf("WARNING: Failed to resolve template %s, retrying on the next check: %v", prefix, err)
+			state.recheck = true
+			continue
+		}
+
+		if !isDue && !state.recheck && !retargeted {
+			continue
+		}
+
 		// Process template with empty message
-		processed, err := processTemplateFile(state.TemplatePath, "")
+		newHash, dependencies, err := state.check()
 		if err != nil {
-			// If we can't process template, skip it but log the error
-			log.Printf("WARNING: Failed to check template %s: %v", prefix, err)
+			// Possibly transient (e.g. the file is being written), retry next check
+			log.Printf("WARNING: Failed to check template %s, retrying on the next check: %v", prefix, err)
+			state.recheck = true
 			continue
 		}
+		state.recheck = false
+		state.dependencies = dependencies
 
-		// Calculate new hash
-		newHash := hashString(processed)
+		// Unchanged (or reverted before settling): drop any pending change
+		if newHash == state.ProcessedHash {
+			state.pendingHash = ""
+			state.pendingChecks = 0
+			continue
+		}
 
-		// Check if hash changed
-		if newHash != state.ProcessedHash {
-			state.NeedsWarmup = true
-			state.ProcessedHash = newHash
-			changed = append(changed, prefix)
-			log.Printf("Template %s changed, needs warmup", prefix)
+		// Debounce: wait until the new hash has been stable long enough.
+		// Repointing a symlink is atomic, so there is nothing to wait for.
+		if w.debounceChecks > 0 && !retargeted {
+			if newHash != state.pendingHash {
+				state.pendingHash = newHash
+				state.pendingChecks = 0
+				log.Printf("Template %s changed, waiting for it to settle", prefix)
+				continue
+			}
+			state.pendingChecks++
+			if state.pendingChecks < w.debounceChecks {
+				continue
+			}
+		}
+		state.pendingHash = ""
+		state.pendingChecks = 0
+
+		// Hash changed
+		state.NeedsWarmup = true
+		state.ProcessedHash = newHash
+		changed = append(changed, prefix)
+		log.Printf("Template %s changed, needs warmup", prefix)
+		if w.onChange != nil {
+			w.onChange(prefix)
 		}
 	}
 
 	return changed
 }
 
+// resolve re-resolves the symlinks in TemplatePath and reports whether the
+// template now points to a different file. Inline templates never change.
+func (s *TemplateState) resolve() (bool, error) {
+	if s.TemplatePath == "" {
+		return false, nil
+	}
+	resolved, err := filepath.EvalSymlinks(s.TemplatePath)
+	if err != nil {
+		return false, err
+	}
+	if resolved == s.ResolvedPath {
+		return false, nil
+	}
+	log.Printf("Template %s now points to %s (was %s)", s.Prefix, resolved, s.ResolvedPath)
+	s.ResolvedPath = resolved
+	return true, nil
+}
+
 // MarkWarmedUp marks a template as having completed warmup
 func (w *Watcher) MarkWarmedUp(prefix string) {
 	w.mu.Lock()
@@ -130,14 +500,111 @@ func (w *Watcher) NeedsWarmup(prefix string) bool {
 	return false
 }
 
+// WarmupCounts returns the number of templates and how many of them are
+// warmed up (not needing warmup)
+func (w *Watcher) WarmupCounts() (configured, warmed int) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	for _, state := range w.templates {
+		if !state.NeedsWarmup {
+			warmed++
+		}
+	}
+	return len(w.templates), warmed
+}
+
+// WarmupStatus returns every template prefix and whether it is warmed up
+// (not needing warmup)
+func (w *Watcher) WarmupStatus() map[string]bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	status := make(map[string]bool, len(w.templates))
+	for prefix, state := range w.templates {
+		status[prefix] = !state.NeedsWarmup
+	}
+	return status
+}
+
+// TemplateInfo describes a watched template, see Templates
+type TemplateInfo struct {
+	// Source tells where the template comes from (SourceConfig, SourceDir,
+	// SourceInline or SourceRuntime)
+	Source string `json:"source"`
+
+	// Path is the template file as configured, empty for inline templates
+	Path string `json:"path,omitempty"`
+
+	// ResolvedPath is Path with symlinks resolved as of the last check
+	ResolvedPath string `json:"resolved_path,omitempty"`
+
+	// Engine is the template engine
+	Engine string `json:"engine"`
+}
+
+// Templates returns every template prefix with where it comes from and
+// which file it is read from
+func (w *Watcher) Templates() map[string]TemplateInfo {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	templates := make(map[string]TemplateInfo, len(w.templates))
+	for prefix, state := range w.templates {
+		templates[prefix] = TemplateInfo{
+			Source:       state.Source,
+			Path:         state.TemplatePath,
+			ResolvedPath: state.ResolvedPath,
+			Engine:       state.Engine,
+		}
+	}
+	return templates
+}
+
+// Dependencies returns every template prefix and the absolute paths of the
+// files it included (fragments and file includes) in its last successful
+// processing, followed by its HashFiles. Templates including no files map to an empty list.
+func (w *Watcher) Dependencies() map[string][]string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	deps := make(map[string][]string, len(w.templates))
+	for prefix, state := range w.templates {
+		deps[prefix] = append([]string{}, state.dependencies...)
+	}
+	return deps
+}
+
+// Hash returns the SHA256 hash of the processed template (with empty message)
+// as last seen by the watcher. Returns false if the prefix is unknown.
+func (w *Watcher) Hash(prefix string) (string, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if state, exists := w.templates[prefix]; exists {
+		return state.ProcessedHash, true
+	}
+	return "", false
+}
+
 // ProcessTemplate processes a template by replacing placeholders with actual content
 // IMPORTANT: Patterns are ONLY detected and replaced in the original template,
 // not in substituted content. This prevents recursive replacement.
 // - <{message}> → replaced with userMessage
+// - <{history}> → replaced with nothing (see ProcessTemplateWithHistory)
 // - <{filepath}> → replaced with content of the file
 func (w *Watcher) ProcessTemplate(prefix, userMessage string) (string, error) {
+	return w.ProcessTemplateWithHistory(prefix, userMessage, nil)
+}
+
+// ProcessTemplateWithHistory is like ProcessTemplate, but also replaces
+// <{history}> with the prior messages of the conversation, one per line as
+// "role: content". Like the user message, the history is never processed
+// for placeholders.
+func (w *Watcher) ProcessTemplateWithHistory(prefix, userMessage string, history []Message) (string, error) {
 	w.mu.RLock()
 	state, exists := w.templates[prefix]
+	maxBytes := w.maxProcessedBytes
 	w.mu.RUnlock()
 
 	if !exists {
@@ -145,24 +612,93 @@ func (w *Watcher) ProcessTemplate(prefix, userMessage string) (string, error) {
 		return "", fmt.Errorf("template for prefix %s not found", prefix)
 	}
 
-	result, err := processTemplateFile(state.TemplatePath, userMessage)
+	result, err := state.process(userMessage, history)
 	if err != nil {
 		log.Printf("ERROR: Failed to process template %s: %v", prefix, err)
 		return "", err
 	}
 
+	if maxBytes > 0 && len(result) > maxBytes {
+		log.Printf("ERROR: Processed template %s is %d bytes, limit is %d", prefix, len(result), maxBytes)
+		return "", fmt.Errorf("%w: %s is %d bytes (limit %d), check its includes", ErrTemplateTooLarge, prefix, len(result), maxBytes)
+	}
+
 	return result, nil
 }
 
-// processTemplateFile reads and processes a template file
-func processTemplateFile(templatePath, userMessage string) (string, error) {
-	// Read template file
-	templateContent, err := os.ReadFile(templatePath)
+// process processes the template with its engine, reading file templates from disk
+func (s *TemplateState) process(userMessage string, history []Message) (string, error) {
+	processed, _, err := s.processWithDependencies(userMessage, history)
+	return processed, err
+}
+
+// check processes the template with an empty message and returns its hash,
+// covering HashFiles, and the absolute paths of the files it depends on
+// (see Watcher.Dependencies)
+func (s *TemplateState) check() (string, []string, error) {
+	processed, dependencies, err := s.processWithDependencies("", nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to read template: %w", err)
+		return "", nil, err
+	}
+	if len(s.HashFiles) == 0 {
+		return hashString(processed), dependencies, nil
+	}
+
+	hashed := []byte(processed)
+	for _, path := range s.HashFiles {
+		content, err := readFileLimited(path, s.maxFileBytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		// Separated, so content can't move between files unnoticed
+		hashed = append(hashed, 0)
+		hashed = append(hashed, content...)
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		dependencies = append(dependencies, path)
 	}
+	return hashString(string(hashed)), dependencies, nil
+}
+
+// processWithDependencies is like process, but also returns the absolute
+// paths of the files the template included (fragments and <{file}> or
+// {{File}} includes), without the template file itself
+func (s *TemplateState) processWithDependencies(userMessage string, history []Message) (string, []string, error) {
+	templateContent := s.Inline
+	if templateContent == "" {
+		content, err := readFileLimited(s.TemplatePath, s.maxFileBytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read template: %w", err)
+		}
+		templateContent = string(content)
+	}
+
+	includes := &includeReader{maxFileBytes: s.maxFileBytes, maxExpansionBytes: s.maxExpansionBytes}
 
-	return ProcessTemplateString(string(templateContent), userMessage)
+	// Fragments are included verbatim, like <{file}> includes, but a
+	// missing fragment is an error rather than a marker in the output
+	var result strings.Builder
+	for _, include := range s.Includes {
+		content, err := includes.read(include)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read include: %w", err)
+		}
+		result.Write(content)
+	}
+
+	var processed string
+	var err error
+	if s.Engine == EngineGoTemplate {
+		processed, err = processGoTemplate(templateContent, goTemplateData{Message: userMessage, History: formatHistory(history)}, includes)
+	} else {
+		processed, err = processSimpleTemplate(templateContent, userMessage, history, includes)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	result.WriteString(processed)
+	return result.String(), includes.paths, nil
 }
 
 // ProcessTemplateString replaces all <{...}> placeholders with appropriate content
@@ -170,7 +706,22 @@ func processTemplateFile(templatePath, userMessage string) (string, error) {
 // CRITICAL: Since regex only matches against the original template string,
 // replacements are NOT recursive. Any <{...}> patterns in the substituted
 // content (from files or user messages) will NOT be processed.
+// <{history}> is replaced with nothing; see ProcessTemplateStringWithHistory.
 func ProcessTemplateString(template string, userMessage string) (string, error) {
+	return ProcessTemplateStringWithHistory(template, userMessage, nil)
+}
+
+// ProcessTemplateStringWithHistory is like ProcessTemplateString, but
+// replaces <{history}> with the given prior messages, one per line as
+// "role: content". The history is substituted like the user message, so
+// placeholders inside it are not processed.
+func ProcessTemplateStringWithHistory(template string, userMessage string, history []Message) (string, error) {
+	return processSimpleTemplate(template, userMessage, history, &includeReader{})
+}
+
+// processSimpleTemplate is ProcessTemplateStringWithHistory with included
+// files read through includes
+func processSimpleTemplate(template string, userMessage string, history []Message, includes *includeReader) (string, error) {
 	// Match <{...}> pattern
 	// This regex will only find matches in the original template string
 	re := regexp.MustCompile(`<\{([^}]+)\}>`)
@@ -178,7 +729,13 @@ func ProcessTemplateString(template string, userMessage string) (string, error)
 	// Replace all matches using callback function
 	// The key insight: ReplaceAllStringFunc operates on the original string,
 	// so it won't see any patterns that appear in the replacement text
+	var includeErr error
 	result := re.ReplaceAllStringFunc(template, func(match string) string {
+		// The result is discarded after an error, don't read more files
+		if includeErr != nil {
+			return ""
+		}
+
 		// Extract content between <{ and }>
 		// match format: "<{something}"
 		placeholder := strings.TrimSpace(match[2 : len(match)-2])
@@ -188,18 +745,24 @@ func ProcessTemplateString(template string, userMessage string) (string, error)
 			return userMessage
 		}
 
-		// Treat as file path
-		content, err := os.ReadFile(placeholder)
-		if err != nil {
-			// Log the error and return error marker in output
-			// Note: This error marker itself won't be processed even if it
-			// contains <{...}> patterns, because we're already in the replacement
-			log.Printf("WARNING: Failed to read included file %s: %v", placeholder, err)
-			return fmt.Sprintf("[Error reading %s: %v]", placeholder, err)
+		if placeholder == historyPlaceholder {
+			// Replace with the prior conversation
+			return formatHistory(history)
 		}
 
-		return string(content)
+		// Treat as file path
+		// On error an error marker is returned in the output.
+		// Note: This error marker itself won't be processed even if it
+		// contains <{...}> patterns, because we're already in the replacement
+		content, err := includes.readIncluded(placeholder)
+		if err != nil && includeErr == nil {
+			includeErr = err
+		}
+		return content
 	})
+	if includeErr != nil {
+		return "", includeErr
+	}
 
 	return result, nil
 }
@@ -1,8 +1,10 @@
 package template
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -276,3 +278,711 @@ func TestWatcher_ProcessTemplate_NotFound(t *testing.T) {
 	}
 }
 
+// TestWatcher_Hash tests the processed hash accessor
+func TestWatcher_Hash(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "template.txt")
+	os.WriteFile(templatePath, []byte("Hello <{message}>"), 0644)
+
+	w := NewWatcher()
+	if err := w.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+
+	hash, ok := w.Hash("@test")
+	if !ok || hash != hashString("Hello ") {
+		t.Errorf("Expected hash of processed template, got %q (found=%v)", hash, ok)
+	}
+
+	// Editing the file changes the hash once the change is detected
+	w.MarkWarmedUp("@test")
+	os.WriteFile(templatePath, []byte("Goodbye <{message}>"), 0644)
+	w.CheckForChanges()
+
+	newHash, _ := w.Hash("@test")
+	if newHash == hash {
+		t.Error("Expected hash to change after editing the template")
+	}
+	if newHash != hashString("Goodbye ") {
+		t.Errorf("Expected hash of new content, got %q", newHash)
+	}
+
+	if _, ok := w.Hash("@nonexistent"); ok {
+		t.Error("Expected no hash for unknown prefix")
+	}
+}
+
+// TestWatcher_MaxProcessedBytes tests that oversized processed templates are rejected
+func TestWatcher_MaxProcessedBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	includePath := filepath.Join(tmpDir, "huge.txt")
+	templatePath := filepath.Join(tmpDir, "template.txt")
+	os.WriteFile(includePath, []byte(strings.Repeat("x", 2048)), 0644)
+	os.WriteFile(templatePath, []byte("<{"+includePath+"}> <{message}>"), 0644)
+
+	w := NewWatcher()
+	w.SetMaxProcessedBytes(1024)
+	if err := w.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+
+	_, err := w.ProcessTemplate("@test", "hi")
+	if !errors.Is(err, ErrTemplateTooLarge) {
+		t.Fatalf("Expected ErrTemplateTooLarge, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "2051 bytes (limit 1024)") {
+		t.Errorf("Expected error to mention size and limit, got %v", err)
+	}
+
+	// Raising the limit makes it work again
+	w.SetMaxProcessedBytes(0)
+	if _, err := w.ProcessTemplate("@test", "hi"); err != nil {
+		t.Errorf("Expected no error without limit, got %v", err)
+	}
+}
+
+// TestWatcher_MaxFileBytes tests that oversized template files and includes
+// make AddTemplate fail with a descriptive error
+func TestWatcher_MaxFileBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	hugePath := filepath.Join(tmpDir, "huge.txt")
+	smallPath := filepath.Join(tmpDir, "small.txt")
+	os.WriteFile(hugePath, []byte(strings.Repeat("x", 2048)), 0644)
+	os.WriteFile(smallPath, []byte("Small <{message}>"), 0644)
+	includingPath := filepath.Join(tmpDir, "including.txt")
+	os.WriteFile(includingPath, []byte("<{"+hugePath+"}> <{message}>"), 0644)
+	goTemplatePath := filepath.Join(tmpDir, "go.txt")
+	os.WriteFile(goTemplatePath, []byte(`{{File "`+hugePath+`"}} {{.Message}}`), 0644)
+
+	w := NewWatcher()
+	w.SetMaxFileBytes(1024)
+
+	err := w.AddTemplate("@huge", hugePath)
+	if !errors.Is(err, ErrTemplateFileTooLarge) {
+		t.Fatalf("Expected ErrTemplateFileTooLarge for the template file, got %v", err)
+	}
+	if !strings.Contains(err.Error(), hugePath+" is larger than 1024 bytes") {
+		t.Errorf("Expected error to name the file and limit, got %v", err)
+	}
+
+	// Includes of every kind are limited as well
+	if err := w.AddTemplate("@including", includingPath); !errors.Is(err, ErrTemplateFileTooLarge) {
+		t.Errorf("Expected ErrTemplateFileTooLarge for a <{file}> include, got %v", err)
+	}
+	if err := w.AddTemplateWithEngine("@go", goTemplatePath, EngineGoTemplate); !errors.Is(err, ErrTemplateFileTooLarge) {
+		t.Errorf("Expected ErrTemplateFileTooLarge for a File include, got %v", err)
+	}
+	if err := w.AddTemplateWithIncludes("@fragments", smallPath, EngineSimple, []string{hugePath}); !errors.Is(err, ErrTemplateFileTooLarge) {
+		t.Errorf("Expected ErrTemplateFileTooLarge for an includes entry, got %v", err)
+	}
+
+	// Small files are fine, and a missing include is still just a marker
+	os.WriteFile(includingPath, []byte("<{"+filepath.Join(tmpDir, "missing.txt")+"}> <{message}>"), 0644)
+	if err := w.AddTemplate("@small", smallPath); err != nil {
+		t.Errorf("Expected small template to be added, got %v", err)
+	}
+	if err := w.AddTemplate("@missing", includingPath); err != nil {
+		t.Errorf("Expected template with a missing include to be added, got %v", err)
+	}
+
+	// Without a limit the huge template can be added
+	w.SetMaxFileBytes(0)
+	if err := w.AddTemplate("@huge", hugePath); err != nil {
+		t.Errorf("Expected no error without limit, got %v", err)
+	}
+}
+
+// TestWatcher_MaxFileBytesDevice tests that a device that never ends fails fast
+func TestWatcher_MaxFileBytesDevice(t *testing.T) {
+	if _, err := os.Stat("/dev/zero"); err != nil {
+		t.Skip("/dev/zero not available")
+	}
+	w := NewWatcher()
+	w.SetMaxFileBytes(1024)
+	if err := w.AddTemplate("@zero", "/dev/zero"); !errors.Is(err, ErrTemplateFileTooLarge) {
+		t.Errorf("Expected ErrTemplateFileTooLarge for /dev/zero, got %v", err)
+	}
+}
+
+// TestWatcher_HashFiles tests that editing a file sent along with a
+// template marks the template for warmup without changing its content
+func TestWatcher_HashFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	toolsPath := filepath.Join(tmpDir, "tools.json")
+	os.WriteFile(toolsPath, []byte(`[{"function":{"name":"search"}}]`), 0644)
+
+	w := NewWatcher()
+	if err := w.AddInlineTemplate("@agent", "Agent: <{message}>"); err != nil {
+		t.Fatalf("AddInlineTemplate failed: %v", err)
+	}
+	plainHash, _ := w.Hash("@agent")
+	if err := w.SetHashFiles("@agent", []string{toolsPath}); err != nil {
+		t.Fatalf("SetHashFiles failed: %v", err)
+	}
+	if hash, _ := w.Hash("@agent"); hash == plainHash {
+		t.Error("Expected the hash to cover the tools file")
+	}
+	if deps := w.Dependencies()["@agent"]; !slices.Equal(deps, []string{toolsPath}) {
+		t.Errorf("Expected the tools file as dependency, got %v", deps)
+	}
+	w.MarkWarmedUp("@agent")
+
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected no change, got %v", changed)
+	}
+	os.WriteFile(toolsPath, []byte(`[{"function":{"name":"fetch"}}]`), 0644)
+	if changed := w.CheckForChanges(); !slices.Equal(changed, []string{"@agent"}) {
+		t.Errorf("Expected @agent to change with its tools file, got %v", changed)
+	}
+	if result, _ := w.ProcessTemplate("@agent", "hi"); result != "Agent: hi" {
+		t.Errorf("Expected the tools file not to be part of the content, got %q", result)
+	}
+
+	if err := w.SetHashFiles("@missing", []string{toolsPath}); err == nil {
+		t.Error("Expected error for an unknown template")
+	}
+	if err := w.SetHashFiles("@agent", []string{filepath.Join(tmpDir, "missing.json")}); err == nil {
+		t.Error("Expected error for a missing file")
+	}
+}
+
+// TestWatcher_MaxExpansionBytes tests that the total size of a template's
+// includes is limited, while each include is well under any per-file limit
+func TestWatcher_MaxExpansionBytes(t *testing.T) {
+	tmpDir := t.TempDir()
+	chunkPath := filepath.Join(tmpDir, "chunk.txt")
+	os.WriteFile(chunkPath, []byte(strings.Repeat("x", 1000)), 0644)
+
+	// 200 includes of the same 1000-byte file expand to 200KB
+	manyPath := filepath.Join(tmpDir, "many.txt")
+	os.WriteFile(manyPath, []byte(strings.Repeat("<{"+chunkPath+"}>", 200)+"<{message}>"), 0644)
+	goManyPath := filepath.Join(tmpDir, "gomany.txt")
+	os.WriteFile(goManyPath, []byte(`{{range Split "`+strings.TrimSuffix(strings.Repeat(chunkPath+",", 200), ",")+`" ","}}{{File .}}{{end}}`), 0644)
+	normalPath := filepath.Join(tmpDir, "normal.txt")
+	os.WriteFile(normalPath, []byte("<{"+chunkPath+"}> <{"+chunkPath+"}> <{message}>"), 0644)
+
+	w := NewWatcher()
+	w.SetMaxExpansionBytes(10000)
+
+	err := w.AddTemplate("@many", manyPath)
+	if !errors.Is(err, ErrTemplateExpansionTooLarge) {
+		t.Fatalf("Expected ErrTemplateExpansionTooLarge for many includes, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "exceed 10000 bytes") {
+		t.Errorf("Expected error to name the limit, got %v", err)
+	}
+	if err := w.AddTemplateWithEngine("@gomany", goManyPath, EngineGoTemplate); !errors.Is(err, ErrTemplateExpansionTooLarge) {
+		t.Errorf("Expected ErrTemplateExpansionTooLarge for many File includes, got %v", err)
+	}
+
+	// A template under the budget is processed normally
+	if err := w.AddTemplate("@normal", normalPath); err != nil {
+		t.Fatalf("Expected template under the budget to be added, got %v", err)
+	}
+	result, err := w.ProcessTemplate("@normal", "hi")
+	if err != nil {
+		t.Fatalf("ProcessTemplate failed: %v", err)
+	}
+	if len(result) != 2004 {
+		t.Errorf("Expected 2004 bytes, got %d", len(result))
+	}
+
+	// Lowering the limit applies to templates already added
+	w.SetMaxExpansionBytes(1500)
+	if _, err := w.ProcessTemplate("@normal", "hi"); !errors.Is(err, ErrTemplateExpansionTooLarge) {
+		t.Errorf("Expected ErrTemplateExpansionTooLarge after lowering the limit, got %v", err)
+	}
+
+	// Without a limit the expansion is built
+	w.SetMaxExpansionBytes(0)
+	if err := w.AddTemplate("@many", manyPath); err != nil {
+		t.Errorf("Expected no error without limit, got %v", err)
+	}
+}
+
+// TestWatcher_RemoveTemplate tests that removed templates are no longer watched
+func TestWatcher_RemoveTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "template.txt")
+	os.WriteFile(templatePath, []byte("Hello <{message}>"), 0644)
+
+	w := NewWatcher()
+	if err := w.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+
+	w.RemoveTemplate("@test")
+	w.RemoveTemplate("@nonexistent") // No-op
+
+	if _, err := w.ProcessTemplate("@test", "hi"); err == nil {
+		t.Error("Expected error processing removed template")
+	}
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected no changes after removal, got %v", changed)
+	}
+}
+
+// TestProcessGoTemplateString_Conditional tests an if/else in a go-template
+func TestProcessGoTemplateString_Conditional(t *testing.T) {
+	template := `{{if .Message}}Question: {{.Message}}{{else}}No question yet{{end}}`
+
+	result, err := ProcessGoTemplateString(template, "Why?")
+	if err != nil {
+		t.Fatalf("ProcessGoTemplateString failed: %v", err)
+	}
+	if result != "Question: Why?" {
+		t.Errorf("Expected %q, got %q", "Question: Why?", result)
+	}
+
+	// Warmup processes templates with an empty message
+	result, err = ProcessGoTemplateString(template, "")
+	if err != nil {
+		t.Fatalf("ProcessGoTemplateString failed: %v", err)
+	}
+	if result != "No question yet" {
+		t.Errorf("Expected %q, got %q", "No question yet", result)
+	}
+}
+
+// TestProcessGoTemplateString_Loop tests a range loop using the Split and File helpers
+func TestProcessGoTemplateString_Loop(t *testing.T) {
+	tmpDir := t.TempDir()
+	first := filepath.Join(tmpDir, "first.txt")
+	second := filepath.Join(tmpDir, "second.txt")
+	if err := os.WriteFile(first, []byte("ONE"), 0644); err != nil {
+		t.Fatalf("Failed to create include file: %v", err)
+	}
+	if err := os.WriteFile(second, []byte("TWO"), 0644); err != nil {
+		t.Fatalf("Failed to create include file: %v", err)
+	}
+
+	template := `{{range $i, $f := Split "` + first + `,` + second + `" ","}}[{{$i}}:{{File $f}}]{{end}} {{.Message}}`
+
+	result, err := ProcessGoTemplateString(template, "done")
+	if err != nil {
+		t.Fatalf("ProcessGoTemplateString failed: %v", err)
+	}
+
+	expected := "[0:ONE][1:TWO] done"
+	if result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+// TestProcessGoTemplateString_NonRecursive ensures template syntax in the
+// user message is emitted literally and never executed
+func TestProcessGoTemplateString_NonRecursive(t *testing.T) {
+	template := "Message: {{.Message}}"
+	userMessage := `{{File "/etc/passwd"}} and <{message}>`
+
+	result, err := ProcessGoTemplateString(template, userMessage)
+	if err != nil {
+		t.Fatalf("ProcessGoTemplateString failed: %v", err)
+	}
+
+	expected := "Message: " + userMessage
+	if result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+// TestWatcher_AddTemplateWithEngine tests selecting the go-template engine per prefix
+func TestWatcher_AddTemplateWithEngine(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "template.txt")
+	if err := os.WriteFile(templatePath, []byte("Hi {{.Message}} <{message}>"), 0644); err != nil {
+		t.Fatalf("Failed to create template: %v", err)
+	}
+
+	w := NewWatcher()
+	if err := w.AddTemplateWithEngine("@go", templatePath, EngineGoTemplate); err != nil {
+		t.Fatalf("AddTemplateWithEngine failed: %v", err)
+	}
+	if err := w.AddTemplate("@simple", templatePath); err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+
+	result, _ := w.ProcessTemplate("@go", "Bob")
+	if result != "Hi Bob <{message}>" {
+		t.Errorf("Expected go-template processing, got %q", result)
+	}
+
+	result, _ = w.ProcessTemplate("@simple", "Bob")
+	if result != "Hi {{.Message}} Bob" {
+		t.Errorf("Expected simple processing, got %q", result)
+	}
+
+	if err := w.AddTemplateWithEngine("@bad", templatePath, "jinja"); err == nil {
+		t.Error("Expected error for unknown engine")
+	}
+}
+
+// TestWatcher_ChangeDebounce tests that a change is only reported once the
+// new content has been stable for the configured number of extra checks
+func TestWatcher_ChangeDebounce(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "template.txt")
+	os.WriteFile(templatePath, []byte("Original <{message}>"), 0644)
+
+	w := NewWatcher()
+	w.SetChangeDebounce(1)
+	reloads := 0
+	w.SetChangeHandler(func(prefix string) { reloads++ })
+	if err := w.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+	w.MarkWarmedUp("@test")
+
+	// Half-written file, then the final content within the debounce window
+	os.WriteFile(templatePath, []byte("Orig"), 0644)
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected no change on first sight, got %v", changed)
+	}
+	os.WriteFile(templatePath, []byte("Updated <{message}>"), 0644)
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected no change while content is still changing, got %v", changed)
+	}
+
+	// Stable for one more check: reported exactly once
+	if changed := w.CheckForChanges(); len(changed) != 1 || changed[0] != "@test" {
+		t.Errorf("Expected @test to be reported once stable, got %v", changed)
+	}
+	if hash, _ := w.Hash("@test"); hash != hashString("Updated ") {
+		t.Errorf("Expected hash of the final content, got %q", hash)
+	}
+	w.MarkWarmedUp("@test")
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected no further changes, got %v", changed)
+	}
+	if reloads != 1 {
+		t.Errorf("Expected 1 reload, got %d", reloads)
+	}
+
+	// A change that is reverted before settling is never reported
+	os.WriteFile(templatePath, []byte("Temporary <{message}>"), 0644)
+	w.CheckForChanges()
+	os.WriteFile(templatePath, []byte("Updated <{message}>"), 0644)
+	w.CheckForChanges()
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected reverted change not to be reported, got %v", changed)
+	}
+	if reloads != 1 {
+		t.Errorf("Expected reverted change not to count as reload, got %d reloads", reloads)
+	}
+}
+
+func TestWatcher_CheckForChangesFunc(t *testing.T) {
+	tmpDir := t.TempDir()
+	pathA := filepath.Join(tmpDir, "a.txt")
+	pathB := filepath.Join(tmpDir, "b.txt")
+	os.WriteFile(pathA, []byte("A <{message}>"), 0644)
+	os.WriteFile(pathB, []byte("B <{message}>"), 0644)
+
+	w := NewWatcher()
+	w.AddTemplate("@a", pathA)
+	w.AddTemplate("@b", pathB)
+
+	// Templates needing warmup are returned even when not due
+	notDue := func(prefix string) bool { return false }
+	if changed := w.CheckForChangesFunc(notDue); len(changed) != 2 {
+		t.Errorf("Expected new templates to be returned, got %v", changed)
+	}
+	w.MarkWarmedUp("@a")
+	w.MarkWarmedUp("@b")
+
+	// Only due templates are re-read
+	os.WriteFile(pathA, []byte("A2 <{message}>"), 0644)
+	os.WriteFile(pathB, []byte("B2 <{message}>"), 0644)
+	onlyA := func(prefix string) bool { return prefix == "@a" }
+	if changed := w.CheckForChangesFunc(onlyA); len(changed) != 1 || changed[0] != "@a" {
+		t.Errorf("Expected only @a to be reported, got %v", changed)
+	}
+	if changed := w.CheckForChanges(); len(changed) != 2 {
+		t.Errorf("Expected @b to be picked up by a full check, got %v", changed)
+	}
+}
+
+// TestWatcher_RecheckAfterFailedCheck tests that a template whose check
+// failed (e.g. read mid-write) is re-read on the next check even if not due,
+// and gets flagged for warmup once it reads fine
+func TestWatcher_RecheckAfterFailedCheck(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "a.txt")
+	os.WriteFile(path, []byte("A <{message}>"), 0644)
+
+	w := NewWatcher()
+	w.AddTemplate("@a", path)
+	w.CheckForChanges()
+	w.MarkWarmedUp("@a")
+
+	// The editor replaces the file: the read fails once
+	os.Remove(path)
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected no change while the template can't be read, got %v", changed)
+	}
+
+	// The new content is picked up on the next check, although a
+	// usage-weighted schedule would not re-read the template yet
+	os.WriteFile(path, []byte("A2 <{message}>"), 0644)
+	notDue := func(prefix string) bool { return false }
+	if changed := w.CheckForChangesFunc(notDue); len(changed) != 1 || changed[0] != "@a" {
+		t.Errorf("Expected @a to be rechecked and flagged, got %v", changed)
+	}
+	if !w.NeedsWarmup("@a") {
+		t.Error("Expected @a to need warmup")
+	}
+
+	// Once read successfully, the schedule applies again
+	w.MarkWarmedUp("@a")
+	os.WriteFile(path, []byte("A3 <{message}>"), 0644)
+	if changed := w.CheckForChangesFunc(notDue); len(changed) != 0 {
+		t.Errorf("Expected no recheck after a successful read, got %v", changed)
+	}
+}
+
+// TestWatcher_SymlinkRetarget tests that repointing a symlinked template is
+// noticed even when the template is not due, bypassing debouncing
+func TestWatcher_SymlinkRetarget(t *testing.T) {
+	tmpDir := t.TempDir()
+	v1 := filepath.Join(tmpDir, "v1.txt")
+	v2 := filepath.Join(tmpDir, "v2.txt")
+	os.WriteFile(v1, []byte("V1 <{message}>"), 0644)
+	os.WriteFile(v2, []byte("V2 <{message}>"), 0644)
+	link := filepath.Join(tmpDir, "current.txt")
+	if err := os.Symlink(v1, link); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+
+	w := NewWatcher()
+	w.SetChangeDebounce(2)
+	if err := w.AddTemplate("@a", link); err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+	w.CheckForChanges()
+	w.MarkWarmedUp("@a")
+
+	resolvedV1, _ := filepath.EvalSymlinks(v1)
+	if got := w.templates["@a"].ResolvedPath; got != resolvedV1 {
+		t.Errorf("Expected resolved path %s, got %s", resolvedV1, got)
+	}
+
+	// Repoint the symlink atomically, as a deploy script would
+	tmpLink := filepath.Join(tmpDir, "current.tmp")
+	if err := os.Symlink(v2, tmpLink); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		t.Fatalf("Failed to repoint symlink: %v", err)
+	}
+
+	notDue := func(prefix string) bool { return false }
+	if changed := w.CheckForChangesFunc(notDue); len(changed) != 1 || changed[0] != "@a" {
+		t.Errorf("Expected @a to be flagged after repointing, got %v", changed)
+	}
+	if !w.NeedsWarmup("@a") {
+		t.Error("Expected @a to need warmup")
+	}
+	resolvedV2, _ := filepath.EvalSymlinks(v2)
+	if got := w.templates["@a"].ResolvedPath; got != resolvedV2 {
+		t.Errorf("Expected resolved path %s, got %s", resolvedV2, got)
+	}
+	processed, err := w.ProcessTemplate("@a", "hi")
+	if err != nil || processed != "V2 hi" {
+		t.Errorf("Expected the new target to be used, got %q (err %v)", processed, err)
+	}
+
+	// Repointing to a file with the same content needs no warmup
+	w.MarkWarmedUp("@a")
+	v3 := filepath.Join(tmpDir, "v3.txt")
+	os.WriteFile(v3, []byte("V2 <{message}>"), 0644)
+	os.Symlink(v3, tmpLink)
+	os.Rename(tmpLink, link)
+	if changed := w.CheckForChangesFunc(notDue); len(changed) != 0 {
+		t.Errorf("Expected no change for identical content, got %v", changed)
+	}
+}
+
+// TestWatcher_Includes tests that fragments are prepended in order and that
+// editing any of them is detected as a change
+func TestWatcher_Includes(t *testing.T) {
+	tmpDir := t.TempDir()
+	persona := filepath.Join(tmpDir, "persona.txt")
+	guidelines := filepath.Join(tmpDir, "guidelines.txt")
+	examples := filepath.Join(tmpDir, "examples.txt")
+	body := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(persona, []byte("Persona. "), 0644)
+	os.WriteFile(guidelines, []byte("Guidelines. "), 0644)
+	os.WriteFile(examples, []byte("Examples. "), 0644)
+	os.WriteFile(body, []byte("Q: <{message}>"), 0644)
+
+	w := NewWatcher()
+	if err := w.AddTemplateWithIncludes("@code", body, EngineSimple, []string{persona, guidelines, examples}); err != nil {
+		t.Fatalf("AddTemplateWithIncludes failed: %v", err)
+	}
+	if err := w.AddInlineTemplateWithIncludes("@help", "Help: <{message}>", EngineSimple, []string{examples, persona}); err != nil {
+		t.Fatalf("AddInlineTemplateWithIncludes failed: %v", err)
+	}
+
+	for prefix, expected := range map[string]string{
+		"@code": "Persona. Guidelines. Examples. Q: hi",
+		"@help": "Examples. Persona. Help: hi",
+	} {
+		result, err := w.ProcessTemplate(prefix, "hi")
+		if err != nil {
+			t.Fatalf("ProcessTemplate %s failed: %v", prefix, err)
+		}
+		if result != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, prefix, result)
+		}
+	}
+
+	w.CheckForChanges()
+	w.MarkWarmedUp("@code")
+	w.MarkWarmedUp("@help")
+
+	// Editing any fragment changes every template that includes it
+	for _, fragment := range []string{persona, guidelines, examples} {
+		os.WriteFile(fragment, []byte("Edited "+filepath.Base(fragment)+". "), 0644)
+		changed := w.CheckForChanges()
+		if !slices.Contains(changed, "@code") {
+			t.Errorf("Expected @code to change after editing %s, got %v", filepath.Base(fragment), changed)
+		}
+		w.MarkWarmedUp("@code")
+		w.MarkWarmedUp("@help")
+	}
+
+	// A missing fragment fails the template instead of warming up without it
+	os.Remove(guidelines)
+	if _, err := w.ProcessTemplate("@code", "hi"); err == nil {
+		t.Error("Expected an error for a missing include")
+	}
+	if err := w.AddTemplateWithIncludes("@new", body, EngineSimple, []string{guidelines}); err == nil {
+		t.Error("Expected AddTemplateWithIncludes to fail for a missing include")
+	}
+}
+
+// TestProcessTemplateString_History tests <{history}> expansion
+func TestProcessTemplateString_History(t *testing.T) {
+	template := "Conversation so far:\n<{history}>\nQuestion: <{message}>"
+	history := []Message{
+		{Role: "system", Content: "Be brief"},
+		{Role: "user", Content: "What is <{message}>?"},
+		{Role: "assistant", Content: "A placeholder <{history}>"},
+	}
+
+	result, err := ProcessTemplateStringWithHistory(template, "And now?", history)
+	if err != nil {
+		t.Fatalf("ProcessTemplateStringWithHistory failed: %v", err)
+	}
+
+	// Placeholders inside the history are not processed
+	expected := "Conversation so far:\n" +
+		"system: Be brief\n" +
+		"user: What is <{message}>?\n" +
+		"assistant: A placeholder <{history}>\n" +
+		"Question: And now?"
+	if result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+
+	// Without history (e.g. during warmup) the placeholder is empty
+	result, err = ProcessTemplateString(template, "")
+	if err != nil {
+		t.Fatalf("ProcessTemplateString failed: %v", err)
+	}
+	if expected := "Conversation so far:\n\nQuestion: "; result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+// TestWatcher_ProcessTemplateWithHistory tests history with both engines
+func TestWatcher_ProcessTemplateWithHistory(t *testing.T) {
+	tmpDir := t.TempDir()
+	simplePath := filepath.Join(tmpDir, "simple.txt")
+	goPath := filepath.Join(tmpDir, "go.txt")
+	os.WriteFile(simplePath, []byte("<{history}>\n> <{message}>"), 0644)
+	os.WriteFile(goPath, []byte("{{.History}}\n> {{.Message}}"), 0644)
+
+	w := NewWatcher()
+	w.AddTemplate("@simple", simplePath)
+	w.AddTemplateWithEngine("@go", goPath, EngineGoTemplate)
+
+	history := []Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "{{.Message}}"}}
+	expected := "user: hi\nassistant: {{.Message}}\n> next"
+	for _, prefix := range []string{"@simple", "@go"} {
+		result, err := w.ProcessTemplateWithHistory(prefix, "next", history)
+		if err != nil {
+			t.Fatalf("ProcessTemplateWithHistory(%s) failed: %v", prefix, err)
+		}
+		if result != expected {
+			t.Errorf("%s: expected %q, got %q", prefix, expected, result)
+		}
+	}
+}
+
+// TestWatcher_AddTemplateTrimsPrefix tests that a padded prefix is trimmed
+func TestWatcher_AddTemplateTrimsPrefix(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(templatePath, []byte("CODE: <{message}>"), 0644)
+
+	w := NewWatcher()
+	if err := w.AddTemplate("@code ", templatePath); err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+	result, err := w.ProcessTemplate("@code", "hello")
+	if err != nil {
+		t.Fatalf("Expected template under trimmed prefix: %v", err)
+	}
+	if result != "CODE: hello" {
+		t.Errorf("Expected %q, got %q", "CODE: hello", result)
+	}
+
+	if err := w.AddTemplate("  ", templatePath); err == nil {
+		t.Error("Expected error for blank prefix")
+	}
+}
+
+// TestWatcher_AddInlineTemplate tests templates defined without a file
+func TestWatcher_AddInlineTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	includePath := filepath.Join(tmpDir, "rules.txt")
+	os.WriteFile(includePath, []byte("Be brief."), 0644)
+
+	w := NewWatcher()
+	if err := w.AddInlineTemplate("@help", "You are a helper. <{"+includePath+"}> <{message}>"); err != nil {
+		t.Fatalf("AddInlineTemplate failed: %v", err)
+	}
+	if !w.NeedsWarmup("@help") {
+		t.Error("Expected inline template to need warmup")
+	}
+
+	result, err := w.ProcessTemplate("@help", "hi <{message}>")
+	if err != nil {
+		t.Fatalf("ProcessTemplate failed: %v", err)
+	}
+	if expected := "You are a helper. Be brief. hi <{message}>"; result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+
+	// Unchanged content is not reported; changed includes are
+	w.MarkWarmedUp("@help")
+	if changed := w.CheckForChanges(); len(changed) != 0 {
+		t.Errorf("Expected no changes, got %v", changed)
+	}
+	os.WriteFile(includePath, []byte("Be thorough."), 0644)
+	if changed := w.CheckForChanges(); len(changed) != 1 {
+		t.Errorf("Expected included file change to be detected, got %v", changed)
+	}
+
+	if err := w.AddInlineTemplateWithEngine("@go", "{{.Message}}!", EngineGoTemplate); err != nil {
+		t.Fatalf("AddInlineTemplateWithEngine failed: %v", err)
+	}
+	if result, _ := w.ProcessTemplate("@go", "hi"); result != "hi!" {
+		t.Errorf("Expected go-template inline processing, got %q", result)
+	}
+
+	if err := w.AddInlineTemplate("@empty", ""); err == nil {
+		t.Error("Expected error for empty inline template")
+	}
+}
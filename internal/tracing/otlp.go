@@ -0,0 +1,251 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpBatchSize is the number of spans sent per export request
+	otlpBatchSize = 128
+
+	// otlpQueueSize bounds the spans waiting for export; spans ending while
+	// the queue is full are dropped rather than blocking requests
+	otlpQueueSize = 2048
+
+	// otlpFlushInterval is how often a partial batch is sent
+	otlpFlushInterval = 2 * time.Second
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector over OTLP/HTTP with
+// JSON encoding. Spans are queued and exported in batches from a background
+// goroutine, so ExportSpan never blocks.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	queue chan *Span
+	stop  chan struct{} // Closed by Close to end the export loop
+	done  chan struct{}
+
+	// mu guards closed; ExportSpan holds it while queueing, so no span is
+	// queued after Close and the queue itself is never closed
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewOTLPExporter creates an exporter for the collector at endpoint and
+// starts its export loop. An endpoint without a path gets the standard
+// "/v1/traces" path (e.g. "http://localhost:4318").
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	url := strings.TrimRight(endpoint, "/")
+	if i := strings.Index(url, "://"); i < 0 || !strings.Contains(url[i+3:], "/") {
+		url += "/v1/traces"
+	}
+	e := &OTLPExporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, otlpQueueSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// ExportSpan queues the span for export, dropping it if the queue is full
+// or the exporter is closed (e.g. a request finishing after shutdown)
+func (e *OTLPExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- span:
+	default:
+		log.Printf("WARNING: Trace export queue full, dropping span %s", span.Name)
+	}
+}
+
+// Close exports queued spans and stops the export loop
+func (e *OTLPExporter) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.mu.Unlock()
+
+	close(e.stop)
+	<-e.done
+}
+
+// run batches queued spans until Close, then exports what is left
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case <-e.stop:
+			// Nothing is queued after stop is closed, so draining ends
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+					if len(batch) >= otlpBatchSize {
+						e.send(batch)
+						batch = nil
+					}
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts one batch to the collector; failures are logged and the batch dropped
+func (e *OTLPExporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Printf("WARNING: Failed to encode %d spans: %v", len(batch), err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("WARNING: Failed to export %d spans to %s: %v", len(batch), e.url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("WARNING: Trace collector %s rejected %d spans with status %d", e.url, len(batch), resp.StatusCode)
+	}
+}
+
+// OTLP/JSON request structure (ExportTraceServiceRequest)
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 = error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// encode converts spans to an OTLP/JSON export request
+func (e *OTLPExporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		s.mu.Lock()
+		for key, value := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpKeyValue{Key: key, Value: otlpValue(value)})
+		}
+		if s.Err != "" {
+			span.Status = &otlpStatus{Code: 2, Message: s.Err}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue(e.serviceName)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "bioproxy"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// otlpValue encodes an attribute value as an OTLP AnyValue
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
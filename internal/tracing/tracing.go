@@ -0,0 +1,216 @@
+// Package tracing records spans for proxied requests and exports them to an
+// OpenTelemetry collector.
+//
+// It implements the small subset of OpenTelemetry that bioproxy needs with
+// the standard library only: nested spans, W3C Trace Context propagation
+// (the traceparent header) and export over OTLP/HTTP with JSON encoding.
+//
+// A nil *Tracer is valid and records nothing, and all *Span methods accept a
+// nil receiver, so instrumented code needs no checks when tracing is disabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind describes the relationship of a span to its callers and callees,
+// using the OTLP numbering
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// TraceparentHeader is the W3C Trace Context header carrying the trace and
+// parent span IDs
+const TraceparentHeader = "traceparent"
+
+// Exporter receives finished spans. ExportSpan is called synchronously when a
+// span ends and must not block.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// Tracer creates spans and hands them to its exporter when they end
+type Tracer struct {
+	exporter Exporter
+}
+
+// New creates a tracer exporting finished spans to exporter
+func New(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte // zero for a root span
+	Name     string
+	Kind     SpanKind
+	Start    time.Time
+	End      time.Time
+
+	// Attributes are string, bool, int64 or float64 values
+	Attributes map[string]interface{}
+
+	// Err is the error the span ended with (empty if it succeeded)
+	Err string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span stored in ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start begins a span as a child of the span in ctx (a new trace if there is
+// none) and returns a context carrying it. On a nil tracer it returns ctx and
+// a nil span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// StartRequest begins a server span for an incoming request, continuing the
+// trace from its traceparent header when present and valid
+func (t *Tracer) StartRequest(r *http.Request, name string) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+	ctx, span := t.Start(r.Context(), name, SpanKindServer)
+	if traceID, parentID, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+		span.TraceID = traceID
+		span.ParentID = parentID
+	}
+	return ctx, span
+}
+
+// SetAttribute records a key/value pair on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Attribute returns the value recorded for key, or nil
+func (s *Span) Attribute(key string) interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Attributes[key]
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err.Error()
+}
+
+// Finish ends the span and exports it. Only the first call has an effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	s.tracer.exporter.ExportSpan(s)
+}
+
+// Inject sets the traceparent header so the callee continues this span's trace
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set(TraceparentHeader, FormatTraceparent(s.TraceID, s.SpanID))
+}
+
+// FormatTraceparent returns a sampled version-00 traceparent header value
+func FormatTraceparent(traceID [16]byte, spanID [8]byte) string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(traceID[:]), hex.EncodeToString(spanID[:]))
+}
+
+// ParseTraceparent extracts the trace and parent span IDs from a traceparent
+// header value. All-zero IDs are invalid per the W3C specification.
+func ParseTraceparent(value string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+	if traceID == [16]byte{} || spanID == [8]byte{} {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+// InMemoryExporter keeps finished spans in memory, for tests
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// ExportSpan records the span
+func (e *InMemoryExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the finished spans in the order they ended
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
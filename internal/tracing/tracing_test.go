@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestParseTraceparent tests parsing of valid and invalid traceparent values
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID, ok := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if !ok {
+		t.Fatal("Expected valid traceparent")
+	}
+	if got := FormatTraceparent(traceID, spanID); got != "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01" {
+		t.Errorf("Expected round trip, got %q", got)
+	}
+
+	invalid := []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-zzf7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+	for _, value := range invalid {
+		if _, _, ok := ParseTraceparent(value); ok {
+			t.Errorf("Expected %q to be invalid", value)
+		}
+	}
+}
+
+// TestNilTracer tests that a nil tracer and its nil spans are no-ops
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "op", SpanKindInternal)
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("Expected no span from a nil tracer")
+	}
+	header := http.Header{}
+	span.SetAttribute("key", "value")
+	span.Inject(header)
+	span.Finish()
+	if header.Get(TraceparentHeader) != "" {
+		t.Error("Expected nil span not to inject a header")
+	}
+}
+
+// TestOTLPExporter tests that spans are exported as OTLP/JSON on Close
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var path string
+	var request map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path = r.URL.Path
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "bioproxy")
+	tracer := New(exporter)
+	ctx, parent := tracer.Start(context.Background(), "parent", SpanKindServer)
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+	child.SetAttribute("bioproxy.prefix", "@code")
+	child.Finish()
+	parent.Finish()
+	exporter.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if path != "/v1/traces" {
+		t.Errorf("Expected export to /v1/traces, got %q", path)
+	}
+	encoded, _ := json.Marshal(request)
+	for _, want := range []string{`"name":"child"`, `"name":"parent"`, `"stringValue":"@code"`, `"stringValue":"bioproxy"`, `"parentSpanId"`} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("Expected export to contain %s, got %s", want, encoded)
+		}
+	}
+}
+
+// TestOTLPExporterAfterClose tests that spans finishing after Close are
+// dropped instead of panicking
+func TestOTLPExporterAfterClose(t *testing.T) {
+	var exports atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exports.Add(1)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "bioproxy")
+	tracer := New(exporter)
+	_, span := tracer.Start(context.Background(), "late", SpanKindServer)
+	exporter.Close()
+	exporter.Close()
+
+	span.Finish()
+	if got := exports.Load(); got != 0 {
+		t.Errorf("Expected no export after Close, got %d", got)
+	}
+}
@@ -0,0 +1,39 @@
+package warmup
+
+import (
+	"time"
+)
+
+// WarmupEventType identifies a point in a warmup's lifecycle
+type WarmupEventType string
+
+const (
+	// EventStarted is emitted once a warmup is admitted and starts
+	EventStarted WarmupEventType = "started"
+	// EventCompleted is emitted after a successful warmup
+	EventCompleted WarmupEventType = "completed"
+	// EventFailed is emitted when a warmup fails (Err is set)
+	EventFailed WarmupEventType = "failed"
+	// EventCancelled is emitted when a user request cancels a warmup
+	EventCancelled WarmupEventType = "cancelled"
+)
+
+// WarmupEvent describes a warmup lifecycle event, see Manager.OnEvent
+type WarmupEvent struct {
+	Type   WarmupEventType
+	Prefix string
+
+	// Duration is the time since the warmup started
+	// (zero for started events and failures before the start)
+	Duration time.Duration
+
+	// Err is the failure reason for failed events
+	Err error
+}
+
+// emit passes event to the OnEvent callback, if any
+func (m *Manager) emit(event WarmupEvent) {
+	if m.OnEvent != nil {
+		m.OnEvent(event)
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/oleksandr/bioproxy/internal/admission"
@@ -23,40 +27,144 @@ import (
 // Manager handles automatic warmup of templates by monitoring changes
 // and issuing warmup requests to llama.cpp
 type Manager struct {
+	// OnEvent, if set, is called on warmup lifecycle events (started,
+	// completed, failed, cancelled), e.g. for embedders updating their own UI.
+	// It is called synchronously from the warmup loop and must not block.
+	// Set it before calling Start.
+	OnEvent func(WarmupEvent)
+
 	config         *config.Config
 	watcher        *template.Watcher
 	backendURL     string
-	client         *http.Client
+	client         *http.Client // Used for warmup completions
+	cacheClient    *http.Client // Used for KV cache save/restore
 	kvCache        *kvcache.Client
 	metrics        *admin.Metrics
 	backendState   *state.State
 	admissionCtrl  *admission.Controller
 
+	// now returns the current time, used for warmup windows (replaceable in tests)
+	now func() time.Time
+
+	// scheduler picks which templates to check on each cycle with
+	// usage-weighted warmup (nil checks all templates every cycle)
+	scheduler *usageScheduler
+
+	// reportWriter appends warmup outcomes to WarmupReportFile
+	// (nil unless configured)
+	reportWriter *reportWriter
+
+	// initialCheckDone is set after the first checkAndWarmup call
+	initialCheckDone bool
+
+	// initialWarmupDone is set once the warmup loop's first check, including
+	// its warmups, has finished
+	initialWarmupDone atomic.Bool
+
+	// lastWarmed records when each template was last warmed up by the
+	// warmup loop, for MinWarmupInterval. Only used by the warmup loop.
+	lastWarmed map[string]time.Time
+
+	// lazyWarmed records the lazy templates warmed up during this process
+	// lifetime. lazyLocks holds one lock per lazy template, held during its
+	// warmup so concurrent first requests for the same template wait for it
+	// instead of warming up again; lazyMu guards both maps only
+	lazyMu     sync.Mutex
+	lazyWarmed map[string]bool
+	lazyLocks  map[string]chan struct{}
+
+	// saveErrs collects the KV cache saves that failed when switching
+	// templates while WarmupAll runs, which reports them; the warmup loop
+	// only logs them and collectSaves is unset
+	saveErrsMu   sync.Mutex
+	collectSaves bool
+	saveErrs     []error
+
+	// requested holds on-demand warmups from WarmupNow not started yet;
+	// wakeCh wakes the loop to process them
+	requestedMu sync.Mutex
+	requested   []string
+	wakeCh      chan struct{}
+
+	// stopCtx is cancelled by Stop, cancelling the background warmup in
+	// progress so shutdown doesn't wait for a slow completion
+	stopCtx    context.Context
+	cancelStop context.CancelFunc
+
 	mu      sync.Mutex
 	running bool
 	stopCh  chan struct{}
 	doneCh  chan struct{}
 }
 
+// SourceHeader is set to "warmup" on warmup requests to the backend
+const SourceHeader = "X-Bioproxy-Source"
+
+// defaultWarmupTimeout is used when a warmup timeout is not configured
+const defaultWarmupTimeout = 60 * time.Second
+
 // New creates a new warmup manager
 func New(cfg *config.Config, watcher *template.Watcher, backendURL string, metrics *admin.Metrics, backendState *state.State, admissionCtrl *admission.Controller) *Manager {
 	backendURL = strings.TrimSuffix(backendURL, "/")
-	httpClient := &http.Client{
-		Timeout: 60 * time.Second, // Warmup can take a while
+
+	// The CA file was checked when the config was loaded
+	transport, err := cfg.BackendTransport()
+	if err != nil {
+		log.Printf("WARNING: Failed to apply backend TLS settings to warmups: %v", err)
+		transport = http.DefaultTransport.(*http.Transport).Clone()
 	}
 
-	return &Manager{
+	// Completions and cache operations get separate clients with independent
+	// timeouts, so a slow save or restore doesn't hold up the completion
+	completionClient := &http.Client{
+		Transport: transport,
+		Timeout:   timeoutOrDefault(cfg.WarmupCompletionTimeout), // Warmup can take a while
+	}
+	cacheClient := &http.Client{
+		Transport: transport,
+		Timeout:   timeoutOrDefault(cfg.CacheOpTimeout),
+	}
+
+	stopCtx, cancelStop := context.WithCancel(context.Background())
+	m := &Manager{
 		config:        cfg,
 		watcher:       watcher,
 		backendURL:    backendURL,
-		client:        httpClient,
-		kvCache:       kvcache.New(backendURL, httpClient, metrics),
+		client:        completionClient,
+		cacheClient:   cacheClient,
 		metrics:       metrics,
 		backendState:  backendState,
 		admissionCtrl: admissionCtrl,
+		now:           time.Now,
+		lazyWarmed:    make(map[string]bool),
+		lazyLocks:     make(map[string]chan struct{}),
+		lastWarmed:    make(map[string]time.Time),
+		wakeCh:        make(chan struct{}, 1),
+		stopCtx:       stopCtx,
+		cancelStop:    cancelStop,
 		stopCh:        make(chan struct{}),
 		doneCh:        make(chan struct{}),
 	}
+	m.kvCache = m.newKVCache(backendURL)
+	if cfg.WarmupReportFile != "" {
+		m.reportWriter = newReportWriter(cfg.WarmupReportFile)
+	}
+	if cfg.WarmupUsageWeighted {
+		m.scheduler = newUsageScheduler(
+			time.Duration(cfg.WarmupMinInterval)*time.Second,
+			time.Duration(cfg.WarmupMaxInterval)*time.Second,
+			metrics.GetTemplateRequests,
+		)
+	}
+	return m
+}
+
+// timeoutOrDefault converts a timeout in seconds, falling back to defaultWarmupTimeout
+func timeoutOrDefault(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultWarmupTimeout
+	}
+	return time.Duration(seconds) * time.Second
 }
 
 // Start begins the background warmup check loop
@@ -76,7 +184,8 @@ func (m *Manager) Start() error {
 	return nil
 }
 
-// Stop stops the background warmup loop
+// Stop stops the background warmup loop, cancelling the warmup in progress.
+// It waits at most WarmupStopTimeout for the loop to exit.
 func (m *Manager) Stop() {
 	m.mu.Lock()
 	if !m.running {
@@ -88,10 +197,29 @@ func (m *Manager) Stop() {
 
 	log.Printf("Stopping warmup manager...")
 	close(m.stopCh)
-	<-m.doneCh
+	m.cancelStop()
+
+	timeout := time.Duration(m.config.WarmupStopTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultWarmupTimeout
+	}
+	select {
+	case <-m.doneCh:
+	case <-time.After(timeout):
+		log.Printf("WARNING: Warmup loop did not stop within %v, not waiting for it", timeout)
+	}
+	if m.reportWriter != nil {
+		m.reportWriter.close()
+	}
 	log.Printf("Warmup manager stopped")
 }
 
+// InitialWarmupDone reports whether the warmup loop has finished its first
+// check after Start, whether or not the warmups in it succeeded
+func (m *Manager) InitialWarmupDone() bool {
+	return m.initialWarmupDone.Load()
+}
+
 // checkLoop is the background goroutine that periodically checks for template changes
 func (m *Manager) checkLoop() {
 	defer close(m.doneCh)
@@ -103,21 +231,110 @@ func (m *Manager) checkLoop() {
 	// for the first interval (which could be 30+ seconds)
 	log.Printf("Performing initial warmup check...")
 	m.checkAndWarmup()
+	m.initialWarmupDone.Store(true)
 
-	// Create ticker for periodic checks
-	ticker := time.NewTicker(time.Duration(m.config.WarmupCheckInterval) * time.Second)
+	// Create ticker for periodic checks. With usage-weighted warmup each
+	// template has its own interval, so tick at the shortest one
+	interval := time.Duration(m.config.WarmupCheckInterval) * time.Second
+	if m.scheduler != nil {
+		interval = m.scheduler.minInterval
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	// Keep the loaded template's slot from being evicted while idle
+	var refreshC <-chan time.Time
+	if m.config.SlotIdleEvictSeconds > 0 {
+		refreshTicker := time.NewTicker(max(time.Second, m.slotEvictAfter()/20))
+		defer refreshTicker.Stop()
+		refreshC = refreshTicker.C
+	}
+
+	// Save the loaded template's cache after SaveEveryNRequests requests
+	var saveC <-chan time.Time
+	if m.config.SaveEveryNRequests > 0 {
+		saveTicker := time.NewTicker(requestSaveCheckInterval)
+		defer saveTicker.Stop()
+		saveC = saveTicker.C
+	}
+
 	for {
 		select {
 		case <-m.stopCh:
 			return
+		case <-refreshC:
+			m.refreshLoadedCache()
+		case <-saveC:
+			m.saveAfterRequests()
 		case <-ticker.C:
 			m.checkAndWarmup()
+		case <-m.wakeCh:
+			m.warmupRequested(nil)
 		}
 	}
 }
 
+// WarmupNow requests an on-demand warmup of a template, e.g. right after
+// deploying a change. It is performed by the warmup loop as soon as possible,
+// ahead of queued warmups of lower or equal priority, and still yields to
+// user requests through the admission controller. Warmup windows don't apply.
+func (m *Manager) WarmupNow(prefix string) {
+	m.requestedMu.Lock()
+	if !slices.Contains(m.requested, prefix) {
+		m.requested = append(m.requested, prefix)
+	}
+	m.requestedMu.Unlock()
+
+	select {
+	case m.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// nextRequested removes and returns the highest-priority on-demand warmup
+// whose priority is at least minPriority (nil for any priority)
+func (m *Manager) nextRequested(minPriority *int) (string, bool) {
+	m.requestedMu.Lock()
+	defer m.requestedMu.Unlock()
+
+	best := -1
+	for i, prefix := range m.requested {
+		priority := m.config.WarmupPriority(prefix)
+		if minPriority != nil && priority < *minPriority {
+			continue
+		}
+		if best < 0 || priority > m.config.WarmupPriority(m.requested[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	prefix := m.requested[best]
+	m.requested = slices.Delete(m.requested, best, best+1)
+	return prefix, true
+}
+
+// dropRequested removes a pending on-demand warmup of prefix, if any
+func (m *Manager) dropRequested(prefix string) {
+	m.requestedMu.Lock()
+	defer m.requestedMu.Unlock()
+	m.requested = slices.DeleteFunc(m.requested, func(p string) bool { return p == prefix })
+}
+
+// warmupRequested performs the pending on-demand warmups with a priority of
+// at least minPriority (all of them for nil), highest priority first
+func (m *Manager) warmupRequested(minPriority *int) {
+	for m.stopCtx.Err() == nil {
+		prefix, ok := m.nextRequested(minPriority)
+		if !ok {
+			return
+		}
+		log.Printf("Performing requested warmup of %s", prefix)
+		m.warmupAndMark(prefix)
+	}
+}
+
 // checkAndWarmup checks for changed templates and warms them up
 func (m *Manager) checkAndWarmup() {
 	log.Printf("Checking templates for changes...")
@@ -125,136 +342,628 @@ func (m *Manager) checkAndWarmup() {
 	// Record warmup check metric
 	m.metrics.RecordWarmupCheck()
 
+	// The initial startup warmup ignores warmup windows
+	initialCheck := !m.initialCheckDone
+	m.initialCheckDone = true
+
 	// Get list of changed templates
-	changedPrefixes := m.watcher.CheckForChanges()
+	var changedPrefixes []string
+	if m.scheduler != nil {
+		now := m.now()
+		changedPrefixes = m.watcher.CheckForChangesFunc(func(prefix string) bool {
+			return m.scheduler.due(prefix, now)
+		})
+	} else {
+		changedPrefixes = m.watcher.CheckForChanges()
+	}
 
 	if len(changedPrefixes) == 0 {
 		log.Printf("No template changes detected")
 		return
 	}
 
+	// Outside the configured warmup windows, leave the changes pending
+	// (not marked as warmed up) so they are picked up once a window opens
+	if !initialCheck && !m.config.InWarmupWindow(m.now()) {
+		log.Printf("Deferring warmup of %d template(s) until the next warmup window: %v", len(changedPrefixes), changedPrefixes)
+		return
+	}
+
+	// Don't queue warmups behind user requests at the backend: if all slots
+	// are busy, skip this cycle and retry on the next one
+	if m.config.WarmupCheckSlots {
+		idle, err := m.kvCache.HasIdleSlot()
+		if err != nil {
+			log.Printf("WARNING: Could not check backend slots, warming up anyway: %v", err)
+		} else if !idle {
+			log.Printf("All backend slots busy, skipping warmup of %d template(s) this cycle", len(changedPrefixes))
+			m.metrics.RecordWarmupSkippedBusy()
+			return
+		}
+	}
+
+	// Warm up the highest-priority templates first, after their dependencies
+	slices.SortStableFunc(changedPrefixes, func(a, b string) int {
+		return m.config.WarmupPriority(b) - m.config.WarmupPriority(a)
+	})
+	changedPrefixes = orderByDependencies(changedPrefixes, m.config.WarmupDependencies)
+
 	log.Printf("Found %d template(s) that need warmup: %v", len(changedPrefixes), changedPrefixes)
 
 	// Warmup each changed template
+	warmedKeys := make(map[string]bool)
 	for _, prefix := range changedPrefixes {
-		if err := m.warmupTemplate(prefix); err != nil {
-			// Check if warmup was skipped or cancelled
-			if err.Error() == "warmup skipped" {
-				// Skipped because user query is running - will retry next cycle
-				continue
-			}
-			if err.Error() == "warmup cancelled" {
-				log.Printf("Warmup for %s was cancelled (user request had priority)", prefix)
-				// Don't mark as warmed up - will retry on next check cycle
-				continue
-			}
-			log.Printf("ERROR: Failed to warmup template %s: %v", prefix, err)
-			// Continue with next template, will retry on next check cycle
+		// Don't start more warmups once stopping
+		if m.stopCtx.Err() != nil {
+			return
+		}
+
+		// Lazy templates stay pending until a request uses them
+		if m.config.LazyWarmup(prefix) {
+			continue
+		}
+
+		// Templates sharing a cache key share one warm cache
+		cacheKey := m.config.CacheKeyFor(prefix)
+		if warmedKeys[cacheKey] {
+			log.Printf("Cache %s of %s was already warmed up this cycle", cacheKey, prefix)
+			m.watcher.MarkWarmedUp(prefix)
 			continue
 		}
 
-		// Mark as warmed up only if warmup completed successfully
+		// On-demand warmups preempt queued ones of lower or equal priority
+		priority := m.config.WarmupPriority(prefix)
+		m.warmupRequested(&priority)
+
+		// Skip templates that were just warmed up on demand, and drop
+		// on-demand requests for the template being warmed up now
+		if !m.watcher.NeedsWarmup(prefix) {
+			continue
+		}
+
+		// Coalesce rapid edits: leave the change pending until
+		// MinWarmupInterval has passed since the last warmup
+		if wait := m.rewarmDelay(prefix); wait > 0 {
+			log.Printf("Template %s was warmed up recently, deferring warmup for %v", prefix, wait.Round(time.Second))
+			continue
+		}
+		m.dropRequested(prefix)
+
+		if m.warmupAndMark(prefix) {
+			warmedKeys[cacheKey] = true
+		}
+	}
+
+	// Remaining on-demand warmups have a lower priority than all changes
+	m.warmupRequested(nil)
+}
+
+// orderByDependencies moves every template after the templates it depends
+// on (see config DependsOn) that are also in prefixes, keeping the order of
+// prefixes otherwise. Dependencies are acyclic, which the config ensures.
+func orderByDependencies(prefixes []string, dependencies func(prefix string) []string) []string {
+	pending := make(map[string]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		pending[prefix] = true
+	}
+
+	ordered := make([]string, 0, len(prefixes))
+	var add func(prefix string)
+	add = func(prefix string) {
+		if !pending[prefix] {
+			return
+		}
+		pending[prefix] = false
+		for _, dependency := range dependencies(prefix) {
+			add(dependency)
+		}
+		ordered = append(ordered, prefix)
+	}
+	for _, prefix := range prefixes {
+		add(prefix)
+	}
+	return ordered
+}
+
+// WarmupAll warms up every template synchronously, highest priority first,
+// and makes sure each one's KV cache is saved to disk, e.g. to bake caches
+// into an image. Caches are normally saved only when switching away from a
+// template, so warming up the next template saves the previous one and the
+// template left loaded on each backend is saved explicitly at the end.
+// Returns an error naming the templates that could not be warmed up or saved.
+func (m *Manager) WarmupAll() error {
+	if m.config.DisableKVCache {
+		return fmt.Errorf("KV cache operations are disabled, nothing would be saved")
+	}
+
+	var prefixes []string
+	for prefix := range m.watcher.WarmupStatus() {
+		prefixes = append(prefixes, prefix)
+	}
+	slices.SortFunc(prefixes, func(a, b string) int {
+		if pa, pb := m.config.WarmupPriority(a), m.config.WarmupPriority(b); pa != pb {
+			return pb - pa
+		}
+		return strings.Compare(a, b)
+	})
+	prefixes = orderByDependencies(prefixes, m.config.WarmupDependencies)
+
+	m.saveErrsMu.Lock()
+	m.collectSaves, m.saveErrs = true, nil
+	m.saveErrsMu.Unlock()
+	defer func() {
+		m.saveErrsMu.Lock()
+		m.collectSaves, m.saveErrs = false, nil
+		m.saveErrsMu.Unlock()
+	}()
+
+	var errs []error
+	for _, prefix := range prefixes {
+		if err := m.warmupTemplate(prefix); errors.Is(err, errWarmupEmpty) {
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+			continue
+		}
 		m.watcher.MarkWarmedUp(prefix)
-		log.Printf("Template %s warmup complete", prefix)
 	}
+
+	// Save the template still loaded on each backend
+	saved := make(map[string]bool)
+	for _, prefix := range prefixes {
+		backend := m.backendURLFor(prefix)
+		if saved[backend] {
+			continue
+		}
+		saved[backend] = true
+		backendState, kvCache := m.backendFor(prefix)
+		loaded := backendState.GetLastPrefix()
+		if loaded == "" {
+			continue
+		}
+		log.Printf("Saving KV cache for %s", loaded)
+		if err := kvCache.Save(loaded, strings.TrimPrefix(loaded, "@")+".bin"); err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to save KV cache: %w", loaded, err))
+		}
+	}
+
+	m.saveErrsMu.Lock()
+	errs = append(errs, m.saveErrs...)
+	m.saveErrsMu.Unlock()
+	return errors.Join(errs...)
+}
+
+// recordSaveError keeps a failed KV cache save for WarmupAll to report
+func (m *Manager) recordSaveError(cacheKey string, err error) {
+	m.saveErrsMu.Lock()
+	defer m.saveErrsMu.Unlock()
+	if m.collectSaves {
+		m.saveErrs = append(m.saveErrs, fmt.Errorf("%s: failed to save KV cache: %w", cacheKey, err))
+	}
+}
+
+// warmupAndMark warms up a template and marks it as warmed up on success,
+// which it reports. Skipped, cancelled and failed warmups are retried on the
+// next check cycle.
+func (m *Manager) warmupAndMark(prefix string) bool {
+	if err := m.warmupTemplate(prefix); err != nil {
+		if errors.Is(err, errWarmupEmpty) {
+			// Nothing to warm up until the template changes
+			m.watcher.MarkWarmedUp(prefix)
+			return false
+		}
+		// Check if warmup was skipped or cancelled
+		if err.Error() == "warmup skipped" {
+			// Skipped because user query is running - will retry next cycle
+			return false
+		}
+		if err.Error() == "warmup cancelled" && m.stopCtx.Err() != nil {
+			log.Printf("Warmup for %s was cancelled by shutdown", prefix)
+			return false
+		}
+		if err.Error() == "warmup cancelled" {
+			log.Printf("Warmup for %s was cancelled (user request had priority)", prefix)
+			// Don't mark as warmed up - will retry on next check cycle
+			return false
+		}
+		log.Printf("ERROR: Failed to warmup template %s: %v", prefix, err)
+		// Continue with next template, will retry on next check cycle
+		return false
+	}
+
+	// Mark as warmed up only if warmup completed successfully
+	m.watcher.MarkWarmedUp(prefix)
+	m.lastWarmed[prefix] = m.now()
+	log.Printf("Template %s warmup complete", prefix)
+	return true
+}
+
+// slotRefreshFraction is the fraction of SlotIdleEvictSeconds without use
+// after which the loaded template's KV cache is restored again
+const slotRefreshFraction = 0.9
+
+// slotEvictAfter returns SlotIdleEvictSeconds as a duration
+func (m *Manager) slotEvictAfter() time.Duration {
+	return time.Duration(m.config.SlotIdleEvictSeconds) * time.Second
+}
+
+// refreshLoadedCache restores the KV cache of the template loaded in the
+// default backend from its saved file when the slot has been idle for most
+// of SlotIdleEvictSeconds, before llama.cpp evicts it. If nothing was saved
+// yet the template is warmed up again instead. Like warmups, refreshes
+// yield to user requests via the admission controller.
+func (m *Manager) refreshLoadedCache() {
+	if m.config.SlotIdleEvictSeconds <= 0 || m.config.DisableKVCache {
+		return
+	}
+	loaded := m.backendState.GetLastPrefix()
+	if loaded == "" || !m.backendState.HoldsLock() {
+		return
+	}
+	idleFor := m.backendState.IdleFor()
+	if idleFor < time.Duration(float64(m.slotEvictAfter())*slotRefreshFraction) {
+		return
+	}
+
+	// State tracks cache keys; metrics and warmups use the template
+	prefix, watched := m.templateForCacheKey(loaded)
+	if !watched {
+		prefix = loaded
+	}
+
+	// A restore can't be interrupted, user requests wait for it
+	if !m.admissionCtrl.AcquireWarmup(prefix, nil) {
+		return
+	}
+	log.Printf("INFO: Slot with %s idle for %v, restoring its KV cache before eviction", loaded, idleFor.Round(time.Second))
+	err := m.kvCache.Restore(prefix, strings.TrimPrefix(loaded, "@")+".bin")
+	m.admissionCtrl.ReleaseWarmup()
+
+	result := "restored"
+	if errors.Is(err, kvcache.ErrCacheNotFound) && watched {
+		log.Printf("INFO: No saved KV cache for %s, warming it up instead", loaded)
+		result = "warmed_up"
+		err = m.warmupTemplate(prefix)
+	}
+	if err != nil {
+		log.Printf("WARNING: Failed to refresh KV cache for %s: %v", loaded, err)
+		m.metrics.RecordSlotRefresh(prefix, "error")
+		return
+	}
+	m.metrics.RecordSlotRefresh(prefix, result)
+	m.backendState.UpdatePrefix(loaded)
+}
+
+// templateForCacheKey returns the watcher key of a template whose KV cache
+// is cacheKey (the first by key if several templates share it)
+func (m *Manager) templateForCacheKey(cacheKey string) (string, bool) {
+	for _, key := range slices.Sorted(maps.Keys(m.watcher.WarmupStatus())) {
+		if m.config.CacheKeyFor(key) == cacheKey {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// requestSaveCheckInterval is how often the warmup loop checks whether the
+// loaded template reached SaveEveryNRequests
+const requestSaveCheckInterval = time.Second
+
+// saveAfterRequests saves the KV cache of the template loaded in the default
+// backend once SaveEveryNRequests requests used it since it was loaded or
+// last saved. The save waits for the backend to be idle: like warmups, it
+// goes through the admission controller and is retried on the next check
+// while user requests are running. User requests arriving during the save
+// wait for it to finish.
+func (m *Manager) saveAfterRequests() {
+	if m.config.SaveEveryNRequests <= 0 || m.config.DisableKVCache {
+		return
+	}
+	loaded, requests := m.backendState.RequestsSinceSave()
+	if loaded == "" || requests < m.config.SaveEveryNRequests || !m.backendState.HoldsLock() {
+		return
+	}
+
+	// A save can't be interrupted, user requests wait for it
+	if !m.admissionCtrl.AcquireWarmup(loaded, nil) {
+		return
+	}
+	defer m.admissionCtrl.ReleaseWarmup()
+
+	log.Printf("INFO: %d requests on %s since its last save, saving its KV cache", requests, loaded)
+	if err := m.kvCache.Save(loaded, strings.TrimPrefix(loaded, "@")+".bin"); err != nil {
+		log.Printf("WARNING: Failed to save KV cache for %s: %v", loaded, err)
+		return
+	}
+	m.backendState.MarkSaved(loaded)
+}
+
+// rewarmDelay returns how long a background warmup of prefix must still wait
+// for MinWarmupInterval to pass since its last warmup (0 if it may run now)
+func (m *Manager) rewarmDelay(prefix string) time.Duration {
+	last, ok := m.lastWarmed[prefix]
+	if !ok || m.config.MinWarmupInterval <= 0 {
+		return 0
+	}
+	return max(0, last.Add(time.Duration(m.config.MinWarmupInterval)*time.Second).Sub(m.now()))
+}
+
+// WarmupOnFirstUse warms up a lazy template synchronously if it hasn't been
+// warmed up during this process lifetime or has changed since. It is called
+// by the proxy before forwarding a request that uses the template, while the
+// request holds the backend. Eager templates are ignored.
+func (m *Manager) WarmupOnFirstUse(ctx context.Context, prefix string) error {
+	if !m.config.LazyWarmup(prefix) {
+		return nil
+	}
+
+	// Already warm templates skip the lock entirely
+	if m.LazyWarmed(prefix) && !m.watcher.NeedsWarmup(prefix) {
+		return nil
+	}
+
+	lock := m.lazyLock(prefix)
+	select {
+	case lock <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-lock }()
+
+	// Another request may have warmed it up while we waited
+	if m.LazyWarmed(prefix) && !m.watcher.NeedsWarmup(prefix) {
+		return nil
+	}
+
+	log.Printf("INFO: Warming up lazy template %s on first use", prefix)
+	if err := m.runWarmup(ctx, prefix, true); err != nil && !errors.Is(err, errWarmupEmpty) {
+		return err
+	}
+	m.lazyMu.Lock()
+	m.lazyWarmed[prefix] = true
+	m.lazyMu.Unlock()
+	m.watcher.MarkWarmedUp(prefix)
+	return nil
+}
+
+// lazyLock returns the lock serializing lazy warmups of a template, creating
+// it on first use. The lock is a one-slot channel so waiting on it can be
+// cancelled with the request context
+func (m *Manager) lazyLock(prefix string) chan struct{} {
+	m.lazyMu.Lock()
+	defer m.lazyMu.Unlock()
+	lock, ok := m.lazyLocks[prefix]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		m.lazyLocks[prefix] = lock
+	}
+	return lock
+}
+
+// LazyWarmed reports whether a lazy template has been warmed up on first use
+// during this process lifetime
+func (m *Manager) LazyWarmed(prefix string) bool {
+	m.lazyMu.Lock()
+	defer m.lazyMu.Unlock()
+	return m.lazyWarmed[prefix]
 }
 
-// warmupTemplate executes the warmup sequence for a single template
+// errWarmupEmpty is returned by warmupTemplate when the template processes to
+// empty content and no WarmupEmptyPlaceholder is configured
+var errWarmupEmpty = errors.New("warmup content is empty")
+
+// warmupTemplate executes the warmup sequence for a single template from the
+// background loop, yielding to user requests via the admission controller.
+// The warmup is cancelled when the manager is stopped.
 func (m *Manager) warmupTemplate(prefix string) error {
+	return m.runWarmup(m.stopCtx, prefix, false)
+}
+
+// runWarmup executes the warmup sequence for a single template.
+// inRequest is set when warming up from within a user request (lazy
+// warmup), which already holds the backend through the admission
+// controller; the warmup then doesn't acquire it and isn't cancelled by it.
+func (m *Manager) runWarmup(ctx context.Context, prefix string, inRequest bool) error {
+	// Process template with empty message to get warmup content.
+	// This happens before touching the backend, so a broken or empty
+	// template never causes a KV cache save/restore.
+	warmupContent, err := m.watcher.ProcessTemplate(prefix, "")
+	if err != nil {
+		m.metrics.RecordWarmupError(prefix, "template_error")
+		err = fmt.Errorf("failed to process template: %w", err)
+		m.emit(WarmupEvent{Type: EventFailed, Prefix: prefix, Err: err})
+		m.report(prefix, reportFailure, "", 0, 0, err)
+		return err
+	}
+
+	// A template that is only <{message}> has nothing to warm up
+	if strings.TrimSpace(warmupContent) == "" {
+		if m.config.WarmupEmptyPlaceholder == "" {
+			log.Printf("WARNING: Template %s is empty without a message, skipping warmup", prefix)
+			m.metrics.RecordWarmupSkippedEmpty(prefix)
+			return errWarmupEmpty
+		}
+		log.Printf("Template %s is empty without a message, warming up with the placeholder", prefix)
+		warmupContent = m.config.WarmupEmptyPlaceholder
+	}
+
 	// Create cancellable context for this warmup
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Try to acquire permission to run warmup via admission controller
-	if !m.admissionCtrl.AcquireWarmup(prefix, cancel) {
-		// Skipped - user query is running or already warming
-		return fmt.Errorf("warmup skipped")
-	}
+	if !inRequest {
+		// Try to acquire permission to run warmup via admission controller
+		if !m.admissionCtrl.AcquireWarmup(prefix, cancel) {
+			// Skipped - user query is running or already warming
+			return fmt.Errorf("warmup skipped")
+		}
 
-	// Release warmup state when done
-	defer m.admissionCtrl.ReleaseWarmup()
+		// Release warmup state when done
+		defer m.admissionCtrl.ReleaseWarmup()
+	}
 
 	log.Printf("Starting warmup for %s", prefix)
 
 	// Track warmup duration
 	startTime := time.Now()
+	m.emit(WarmupEvent{Type: EventStarted, Prefix: prefix})
+
+	// Templates may be pinned to their own backend, which has its own state
+	backendState, kvCache := m.backendFor(prefix)
+
+	// State tracks cache keys, which templates sharing a cache have in common
+	cacheKey := m.config.CacheKeyFor(prefix)
 
 	// Get cache filename (remove @ prefix if present)
-	cacheFilename := strings.TrimPrefix(prefix, "@") + ".bin"
+	cacheFilename := strings.TrimPrefix(cacheKey, "@") + ".bin"
 
 	// BEFORE sending the warmup request:
-	// Step 1: Save old KV cache if we're switching away from a different template
-	if m.backendState.ShouldSave(prefix) {
-		oldPrefix := m.backendState.GetLastPrefix()
-		oldFilename := strings.TrimPrefix(oldPrefix, "@") + ".bin"
-		log.Printf("Saving KV cache for %s before switching to %s", oldPrefix, prefix)
-		if err := m.kvCache.Save(oldPrefix, oldFilename); err != nil {
-			log.Printf("WARNING: Failed to save KV cache for %s: %v", oldPrefix, err)
-			// Don't fail the warmup - continue with the new template
+	// With KV cache operations disabled the warmup only primes the
+	// in-memory cache
+	cacheResult := ""
+	if !m.config.DisableKVCache {
+		cacheResult = reportCacheHit
+		// Step 1: Save old KV cache if we're switching away from a different template
+		if backendState.ShouldSave(cacheKey) {
+			oldPrefix := backendState.GetLastPrefix()
+			oldFilename := strings.TrimPrefix(oldPrefix, "@") + ".bin"
+			log.Printf("Saving KV cache for %s before switching to %s", oldPrefix, cacheKey)
+			if err := kvCache.Save(oldPrefix, oldFilename); err != nil {
+				log.Printf("WARNING: Failed to save KV cache for %s: %v", oldPrefix, err)
+				// Don't fail the warmup - continue with the new template
+				m.recordSaveError(oldPrefix, err)
+			}
 		}
-	}
 
-	// Step 2: Restore new KV cache if we're switching to a different template
-	if m.backendState.ShouldRestore(prefix) {
-		log.Printf("Restoring KV cache for %s", prefix)
-		if err := m.kvCache.Restore(prefix, cacheFilename); err != nil {
-			// Log but don't fail - this is expected on first warmup
-			log.Printf("INFO: Could not restore KV cache for %s (may be first warmup): %v", prefix, err)
+		// Step 2: Restore new KV cache if we're switching to a different template
+		if backendState.ShouldRestore(cacheKey) {
+			log.Printf("Restoring KV cache for %s", cacheKey)
+			if err := kvCache.Restore(cacheKey, cacheFilename); errors.Is(err, kvcache.ErrCacheNotFound) {
+				// Expected on first warmup - there is nothing saved yet
+				log.Printf("INFO: No saved KV cache for %s yet (first warmup)", cacheKey)
+				cacheResult = reportCacheMiss
+			} else if err != nil {
+				// Log but don't fail - the warmup rebuilds the cache anyway
+				log.Printf("WARNING: Could not restore KV cache for %s: %v", cacheKey, err)
+				cacheResult = reportCacheMiss
+			}
+		} else {
+			log.Printf("Skipping KV cache restore for %s (already loaded)", cacheKey)
 		}
-	} else {
-		log.Printf("Skipping KV cache restore for %s (already loaded)", prefix)
 	}
 
-	// Step 3: Process template with empty message to get warmup content
-	warmupContent, err := m.watcher.ProcessTemplate(prefix, "")
+	// Step 3: Send warmup request to llama.cpp with cancellation support
+	promptTokens, err := m.sendWarmupRequest(ctx, prefix, warmupContent)
 	if err != nil {
-		m.metrics.RecordWarmupError(prefix, "template_error")
-		return fmt.Errorf("failed to process template: %w", err)
-	}
-
-	// Step 4: Send warmup request to llama.cpp with cancellation support
-	if err := m.sendWarmupRequest(ctx, prefix, warmupContent); err != nil {
 		// Check if we were cancelled
 		if ctx.Err() == context.Canceled {
 			log.Printf("Warmup for %s was cancelled", prefix)
 			// Don't record error or update state - cancellation is expected
+			m.emit(WarmupEvent{Type: EventCancelled, Prefix: prefix, Duration: time.Since(startTime)})
+			m.report(prefix, reportCancelled, cacheResult, time.Since(startTime), 0, nil)
 			return fmt.Errorf("warmup cancelled")
 		}
 		m.metrics.RecordWarmupError(prefix, "completion_failed")
-		return fmt.Errorf("warmup request failed: %w", err)
+		err = fmt.Errorf("warmup request failed: %w", err)
+		m.emit(WarmupEvent{Type: EventFailed, Prefix: prefix, Duration: time.Since(startTime), Err: err})
+		m.report(prefix, reportFailure, cacheResult, time.Since(startTime), 0, err)
+		return err
 	}
 
-	// Step 5: Update state to reflect that this template is now loaded
+	// Step 4: Update state to reflect that this template is now loaded
 	// We do NOT save the KV cache here - we only save when switching away
-	m.backendState.UpdatePrefix(prefix)
+	backendState.UpdatePrefix(cacheKey)
 
 	// Record successful warmup execution and duration
-	duration := time.Since(startTime).Seconds()
-	m.metrics.RecordWarmupExecution(prefix, duration)
+	elapsed := time.Since(startTime)
+	m.metrics.RecordWarmupExecution(prefix, elapsed.Seconds())
+
+	// Record which template content the cache was warmed from
+	if hash, ok := m.watcher.Hash(prefix); ok {
+		m.metrics.RecordTemplateHash(prefix, hash)
+		log.Printf("Warmed up %s from template hash %s", prefix, hash)
+	}
 
+	m.emit(WarmupEvent{Type: EventCompleted, Prefix: prefix, Duration: elapsed})
+	m.report(prefix, reportSuccess, cacheResult, elapsed, promptTokens, nil)
 	return nil
 }
 
-// sendWarmupRequest sends a chat completion request with the warmup content
-// The context allows the request to be cancelled if a user request arrives
-func (m *Manager) sendWarmupRequest(ctx context.Context, prefix, content string) error {
-	url := fmt.Sprintf("%s/v1/chat/completions", m.backendURL)
+// backendURLFor returns the backend URL for a template, honouring a
+// per-prefix backend override
+func (m *Manager) backendURLFor(prefix string) string {
+	backend := strings.TrimSuffix(m.config.BackendForTemplate(prefix), "/")
+	if backend == "" || backend == strings.TrimSuffix(m.config.BackendURL, "/") {
+		return m.backendURL
+	}
+	return backend
+}
+
+// backendFor returns the state tracker and KV cache client for a template's backend
+func (m *Manager) backendFor(prefix string) (*state.State, *kvcache.Client) {
+	backend := m.backendURLFor(prefix)
+	if backend == m.backendURL {
+		return m.backendState, m.kvCache
+	}
+	return m.backendState.Backend(backend), m.newKVCache(backend)
+}
+
+// newKVCache returns a KV cache client for a backend, sending BackendAuthToken
+func (m *Manager) newKVCache(backend string) *kvcache.Client {
+	kvCache := kvcache.New(m.config.BackendBaseURL(backend), m.cacheClient, m.metrics)
+	kvCache.SetAuthToken(m.config.BackendAuthToken)
+	return kvCache
+}
+
+// defaultWarmupEndpoint is used when WarmupEndpoint is not configured
+const defaultWarmupEndpoint = "/v1/chat/completions"
+
+// sendWarmupRequest sends a completion request with the warmup content to the
+// configured warmup endpoint of the template's backend, shaped as a chat or a
+// flat prompt request.
+// The context allows the request to be cancelled if a user request arrives.
+// Returns the prompt token count reported by the backend (0 if unknown).
+func (m *Manager) sendWarmupRequest(ctx context.Context, prefix, content string) (int, error) {
+	endpoint := m.config.WarmupEndpoint
+	if endpoint == "" {
+		endpoint = defaultWarmupEndpoint
+	}
+	url := m.backendURLFor(prefix) + m.config.BackendPath(endpoint)
 
 	// Build minimal warmup request
-	reqBody := map[string]interface{}{
-		"messages": []map[string]string{
-			{
-				"role":    "user",
-				"content": content,
+	var reqBody map[string]interface{}
+	if m.config.WarmupFormat() == config.WarmupFormatPrompt {
+		reqBody = map[string]interface{}{
+			"prompt":     content,
+			"max_tokens": 1,     // Minimal generation (OpenAI-style /v1/completions)
+			"n_predict":  1,     // Minimal generation (native llama.cpp /completion)
+			"stream":     false, // Non-streaming
+		}
+	} else {
+		reqBody = map[string]interface{}{
+			"messages": []map[string]string{
+				{
+					"role":    "user",
+					"content": content,
+				},
 			},
-		},
-		"max_tokens": 1,     // Minimal generation
-		"stream":     false, // Non-streaming
+			"max_tokens": 1,     // Minimal generation
+			"stream":     false, // Non-streaming
+		}
+		// Chat templates render tools ahead of the messages, so the cache
+		// only matches real requests if it was warmed up with them
+		if tools := m.config.ToolsForTemplate(prefix); len(tools) > 0 {
+			reqBody["tools"] = tools
+		}
+	}
+
+	if m.config.EnablePromptCache {
+		reqBody["cache_prompt"] = true
 	}
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return 0, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
 	log.Printf("Sending warmup request for %s", prefix)
@@ -264,17 +973,23 @@ func (m *Manager) sendWarmupRequest(ctx context.Context, prefix, content string)
 	// Create request with cancellable context
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return 0, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	// Lets the backend's own logs tell warmups from user traffic
+	req.Header.Set(SourceHeader, admin.BackendSourceWarmup)
+	if m.config.BackendAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+m.config.BackendAuthToken)
+	}
 
+	m.metrics.RecordBackendRequest(admin.BackendSourceWarmup)
 	resp, err := m.client.Do(req)
 	if err != nil {
 		// Check if error was due to context cancellation
 		if ctx.Err() == context.Canceled {
-			return fmt.Errorf("request cancelled: %w", ctx.Err())
+			return 0, fmt.Errorf("request cancelled: %w", ctx.Err())
 		}
-		return fmt.Errorf("request failed: %w", err)
+		return 0, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -284,9 +999,31 @@ func (m *Manager) sendWarmupRequest(ctx context.Context, prefix, content string)
 	body, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+		if m.config.BackendAuthToken != "" && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			m.metrics.RecordBackendAuthFailure()
+		}
+		return 0, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
 	}
 
 	log.Printf("Warmup request completed for %s (%.2fs)", prefix, duration.Seconds())
-	return nil
+	return promptTokens(body), nil
+}
+
+// promptTokens extracts the prompt token count from a completion response:
+// usage.prompt_tokens (OpenAI-style endpoints) or tokens_evaluated (native
+// llama.cpp /completion). Returns 0 if neither is present.
+func promptTokens(body []byte) int {
+	var resp struct {
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+		TokensEvaluated int `json:"tokens_evaluated"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0
+	}
+	if resp.Usage.PromptTokens > 0 {
+		return resp.Usage.PromptTokens
+	}
+	return resp.TokensEvaluated
 }
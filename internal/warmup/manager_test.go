@@ -3,10 +3,13 @@ package warmup
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -15,6 +18,7 @@ import (
 	"github.com/oleksandr/bioproxy/internal/admission"
 	"github.com/oleksandr/bioproxy/internal/admin"
 	"github.com/oleksandr/bioproxy/internal/config"
+	"github.com/oleksandr/bioproxy/internal/kvcache"
 	"github.com/oleksandr/bioproxy/internal/state"
 	"github.com/oleksandr/bioproxy/internal/template"
 )
@@ -27,16 +31,21 @@ type mockLlamaCppServer struct {
 	restoreCalls      []string // filenames of restore calls
 	saveCalls         []string // filenames of save calls
 	completionCalls   int
+	completionSources []string        // X-Bioproxy-Source header of completion calls
 	restoreFailures   map[string]bool // files that should fail to restore
 	saveFailures      map[string]bool // files that should fail to save
 	completionFailure bool            // whether completion should fail
 	completionDelay   time.Duration   // delay before responding to completion requests
+	saveDelay         time.Duration   // delay before responding to save requests
+	slotsResponse     string          // JSON body returned by GET /slots
+	apiKey            string          // bearer token required on every request, like llama.cpp --api-key
 }
 
 func newMockLlamaCppServer() *mockLlamaCppServer {
 	mock := &mockLlamaCppServer{
 		restoreFailures: make(map[string]bool),
 		saveFailures:    make(map[string]bool),
+		slotsResponse:   `[{"id":0,"is_processing":false}]`,
 	}
 
 	// Create test server
@@ -59,6 +68,13 @@ func newMockLlamaCppServer() *mockLlamaCppServer {
 			return
 		}
 
+		mock.mu.Lock()
+		saveDelay := mock.saveDelay
+		mock.mu.Unlock()
+		if action == "save" {
+			time.Sleep(saveDelay)
+		}
+
 		mock.mu.Lock()
 		defer mock.mu.Unlock()
 
@@ -98,11 +114,20 @@ func newMockLlamaCppServer() *mockLlamaCppServer {
 		}
 	})
 
+	// Slot status endpoint
+	mux.HandleFunc("/slots", func(w http.ResponseWriter, r *http.Request) {
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(mock.slotsResponse))
+	})
+
 	// Chat completions endpoint
 	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
 		mock.mu.Lock()
 		delay := mock.completionDelay
 		mock.completionCalls++
+		mock.completionSources = append(mock.completionSources, r.Header.Get(SourceHeader))
 
 		if mock.completionFailure {
 			mock.mu.Unlock()
@@ -113,7 +138,13 @@ func newMockLlamaCppServer() *mockLlamaCppServer {
 
 		// Simulate slow response if delay is set
 		if delay > 0 {
-			time.Sleep(delay)
+			// Consume the body so the server notices a cancelled request
+			io.Copy(io.Discard, r.Body)
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
 		}
 
 		// Return minimal completion response
@@ -132,11 +163,21 @@ func newMockLlamaCppServer() *mockLlamaCppServer {
 					"finish_reason": "stop",
 				},
 			},
+			"usage": map[string]int{"prompt_tokens": 12, "completion_tokens": 1, "total_tokens": 13},
 		}
 		json.NewEncoder(w).Encode(resp)
 	})
 
-	mock.server = httptest.NewServer(mux)
+	mock.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mock.mu.Lock()
+		apiKey := mock.apiKey
+		mock.mu.Unlock()
+		if apiKey != "" && r.Header.Get("Authorization") != "Bearer "+apiKey {
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
 	return mock
 }
 
@@ -174,6 +215,12 @@ func (m *mockLlamaCppServer) GetCompletionCalls() int {
 	return m.completionCalls
 }
 
+func (m *mockLlamaCppServer) GetCompletionSources() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.completionSources...)
+}
+
 func TestManagerLifecycle(t *testing.T) {
 	// Create mock server
 	mock := newMockLlamaCppServer()
@@ -254,6 +301,10 @@ func TestImmediateWarmupOnStartup(t *testing.T) {
 	// Create manager
 	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
 
+	if mgr.InitialWarmupDone() {
+		t.Error("Initial warmup should not be done before Start()")
+	}
+
 	// Start manager
 	if err := mgr.Start(); err != nil {
 		t.Fatalf("Failed to start manager: %v", err)
@@ -264,6 +315,10 @@ func TestImmediateWarmupOnStartup(t *testing.T) {
 	// Should be much less than the 60 second interval
 	time.Sleep(100 * time.Millisecond)
 
+	if !mgr.InitialWarmupDone() {
+		t.Error("Initial warmup should be done after the immediate warmup")
+	}
+
 	// Verify warmup happened immediately
 	completionCalls := mock.GetCompletionCalls()
 	if completionCalls != 1 {
@@ -280,6 +335,88 @@ func TestImmediateWarmupOnStartup(t *testing.T) {
 	// The completion call happening immediately (not after 60 seconds) proves it works
 }
 
+// TestWarmupSource tests that warmup requests are marked for the backend and
+// counted as warmup backend requests
+func TestWarmupSource(t *testing.T) {
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10}
+	watcher := template.NewWatcher()
+	if err := watcher.AddInlineTemplate("@test", "You are a helpful assistant. <{message}>"); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+	metrics := admin.NewMetrics()
+	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
+
+	for i := 0; i < 2; i++ {
+		if err := mgr.warmupTemplate("@test"); err != nil {
+			t.Fatalf("Warmup failed: %v", err)
+		}
+	}
+
+	if sources := mock.GetCompletionSources(); !slices.Equal(sources, []string{"warmup", "warmup"}) {
+		t.Errorf("Expected both completions marked as warmup, got %v", sources)
+	}
+	snap := metrics.FullSnapshot()
+	if snap.BackendRequests[admin.BackendSourceWarmup] != 2 || snap.BackendRequests[admin.BackendSourceUser] != 0 {
+		t.Errorf("Expected 2 warmup and 0 user backend requests, got %v", snap.BackendRequests)
+	}
+}
+
+// TestWarmupBackendAuth tests that warmups and KV cache operations carry
+// BackendAuthToken for a backend started with --api-key
+func TestWarmupBackendAuth(t *testing.T) {
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.apiKey = "backend-secret"
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, BackendAuthToken: "backend-secret"}
+	watcher := template.NewWatcher()
+	for _, prefix := range []string{"@a", "@b"} {
+		if err := watcher.AddInlineTemplate(prefix, prefix+" assistant. <{message}>"); err != nil {
+			t.Fatalf("Failed to add template: %v", err)
+		}
+	}
+	metrics := admin.NewMetrics()
+	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
+
+	// Switching from @a to @b restores both and saves @a
+	for _, prefix := range []string{"@a", "@b"} {
+		if err := mgr.warmupTemplate(prefix); err != nil {
+			t.Fatalf("Warmup of %s failed: %v", prefix, err)
+		}
+	}
+	if completions := mock.GetCompletionCalls(); completions != 2 {
+		t.Errorf("Expected 2 completions, got %d", completions)
+	}
+	if restores := mock.GetRestoreCalls(); !slices.Equal(restores, []string{"a.bin", "b.bin"}) {
+		t.Errorf("Expected both caches restored, got %v", restores)
+	}
+	if saves := mock.GetSaveCalls(); !slices.Equal(saves, []string{"a.bin"}) {
+		t.Errorf("Expected @a saved, got %v", saves)
+	}
+	if idle, err := mgr.kvCache.HasIdleSlot(); err != nil || !idle {
+		t.Errorf("Expected an idle slot, got %v (err: %v)", idle, err)
+	}
+	if failures := metrics.FullSnapshot().BackendAuthFailures; failures != 0 {
+		t.Errorf("Expected no auth failures, got %d", failures)
+	}
+
+	// A wrong token fails the warmup and is counted
+	cfg.BackendAuthToken = "wrong"
+	mgr = New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
+	if err := mgr.warmupTemplate("@a"); err == nil {
+		t.Error("Expected warmup to fail with a rejected token")
+	}
+	if _, err := mgr.kvCache.HasIdleSlot(); err == nil {
+		t.Error("Expected the slots check to fail with a rejected token")
+	}
+	if failures := metrics.FullSnapshot().BackendAuthFailures; failures != 3 {
+		t.Errorf("Expected the restore, completion and slots rejections counted, got %d", failures)
+	}
+}
+
 func TestWarmupTemplate(t *testing.T) {
 	// Create temporary template file
 	tmpDir := t.TempDir()
@@ -516,6 +653,112 @@ func TestWarmupSaveFailure(t *testing.T) {
 	}
 }
 
+// TestWarmupTemplateTooLarge verifies that an oversized template fails warmup
+// with a template_error before anything is sent to llama.cpp
+func TestWarmupTemplateTooLarge(t *testing.T) {
+	tmpDir := t.TempDir()
+	includePath := filepath.Join(tmpDir, "huge.txt")
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	os.WriteFile(includePath, []byte(strings.Repeat("x", 4096)), 0644)
+	os.WriteFile(templatePath, []byte("<{"+includePath+"}>"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+	}
+
+	watcher := template.NewWatcher()
+	watcher.SetMaxProcessedBytes(1024)
+	if err := watcher.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	metrics := admin.NewMetrics()
+	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
+
+	err := mgr.warmupTemplate("@test")
+	if !errors.Is(err, template.ErrTemplateTooLarge) {
+		t.Fatalf("Expected ErrTemplateTooLarge, got %v", err)
+	}
+	if metrics.WarmupErrors["@test"]["template_error"] != 1 {
+		t.Errorf("Expected template_error to be recorded, got %v", metrics.WarmupErrors["@test"])
+	}
+	if mock.GetCompletionCalls() != 0 {
+		t.Errorf("Expected no completion calls, got %d", mock.GetCompletionCalls())
+	}
+}
+
+// TestWarmupSlowSave verifies that a hung KV cache save times out on its own
+// client and the warmup completion still proceeds
+func TestWarmupSlowSave(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	if err := os.WriteFile(templatePath, []byte("Template"), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	var mu sync.Mutex
+	completionCalls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("action") == "save" {
+			// Hang until the client gives up (the body must be consumed
+			// for the server to notice the disconnect)
+			io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		if r.URL.Path == "/v1/chat/completions" {
+			mu.Lock()
+			completionCalls++
+			mu.Unlock()
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		BackendURL:              backend.URL,
+		WarmupCheckInterval:     10,
+		WarmupCompletionTimeout: 5,
+	}
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	// Another template is loaded, so warming up @test saves it first
+	backendState := state.New()
+	backendState.UpdatePrefix("@other")
+
+	mgr := New(cfg, watcher, backend.URL, admin.NewMetrics(), backendState, admission.New())
+	mgr.cacheClient.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if err := mgr.warmupTemplate("@test"); err != nil {
+		t.Fatalf("Warmup should succeed despite slow save: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected slow save to time out quickly, warmup took %v", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if completionCalls != 1 {
+		t.Errorf("Expected 1 completion call, got %d", completionCalls)
+	}
+	if mgr.client.Timeout != 5*time.Second {
+		t.Errorf("Expected completion timeout 5s, got %v", mgr.client.Timeout)
+	}
+}
+
 func TestCheckAndWarmup(t *testing.T) {
 	// Create temporary template file
 	tmpDir := t.TempDir()
@@ -555,6 +798,12 @@ func TestCheckAndWarmup(t *testing.T) {
 		t.Errorf("Expected 1 completion call after first check, got %d", mock.GetCompletionCalls())
 	}
 
+	// Verify the warmed template hash was recorded
+	initialHash, _ := watcher.Hash("@test")
+	if metrics.TemplateHashes["@test"] != initialHash {
+		t.Errorf("Expected recorded hash %q, got %q", initialHash, metrics.TemplateHashes["@test"])
+	}
+
 	// Reset mock
 	mock.Reset()
 
@@ -579,6 +828,174 @@ func TestCheckAndWarmup(t *testing.T) {
 	if mock.GetCompletionCalls() != 1 {
 		t.Errorf("Expected 1 completion call after template change, got %d", mock.GetCompletionCalls())
 	}
+
+	// Verify the recorded hash follows the new content
+	if metrics.TemplateHashes["@test"] == initialHash {
+		t.Error("Expected recorded hash to change after template change")
+	}
+}
+
+// TestTemplateReloadMetric verifies that modifying a template increments
+// the template reload counter (but the initial warmup does not)
+func TestTemplateReloadMetric(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	if err := os.WriteFile(templatePath, []byte("Initial content"), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+	}
+
+	// Wire the watcher to metrics the same way main does
+	metrics := admin.NewMetrics()
+	watcher := template.NewWatcher()
+	watcher.SetChangeHandler(metrics.RecordTemplateReload)
+	if err := watcher.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
+
+	// Initial warmup is not a reload
+	mgr.checkAndWarmup()
+	if metrics.TemplateReloads["@test"] != 0 {
+		t.Errorf("Expected 0 reloads after initial warmup, got %d", metrics.TemplateReloads["@test"])
+	}
+
+	// Modify template
+	if err := os.WriteFile(templatePath, []byte("Modified content"), 0644); err != nil {
+		t.Fatalf("Failed to update template file: %v", err)
+	}
+
+	mgr.checkAndWarmup()
+	if metrics.TemplateReloads["@test"] != 1 {
+		t.Errorf("Expected 1 reload after template change, got %d", metrics.TemplateReloads["@test"])
+	}
+
+	// No further changes - counter stays the same
+	mgr.checkAndWarmup()
+	if metrics.TemplateReloads["@test"] != 1 {
+		t.Errorf("Expected reload count to stay at 1, got %d", metrics.TemplateReloads["@test"])
+	}
+}
+
+// TestWarmupTemplateVariants verifies that every A/B variant of a prefix
+// is warmed up with its own cache file
+func TestWarmupTemplateVariants(t *testing.T) {
+	tmpDir := t.TempDir()
+	variantA := filepath.Join(tmpDir, "a.txt")
+	variantB := filepath.Join(tmpDir, "b.txt")
+	os.WriteFile(variantA, []byte("Variant A"), 0644)
+	os.WriteFile(variantB, []byte("Variant B"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	prefixCfg := config.PrefixConfig{
+		Variants: []config.VariantConfig{
+			{Path: variantA, Weight: 2},
+			{Path: variantB, Weight: 1},
+		},
+	}
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		Prefixes:            map[string]config.PrefixConfig{"@code": prefixCfg},
+	}
+
+	// Register templates the same way main does
+	watcher := template.NewWatcher()
+	for _, ref := range prefixCfg.Templates("@code") {
+		if err := watcher.AddTemplate(ref.Key, ref.Path); err != nil {
+			t.Fatalf("Failed to add template: %v", err)
+		}
+	}
+
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+	mgr.checkAndWarmup()
+
+	if mock.GetCompletionCalls() != 2 {
+		t.Errorf("Expected 2 warmup completions (one per variant), got %d", mock.GetCompletionCalls())
+	}
+
+	restored := make(map[string]bool)
+	for _, filename := range mock.GetRestoreCalls() {
+		restored[filename] = true
+	}
+	for _, filename := range []string{"code.v1.bin", "code.v2.bin"} {
+		if !restored[filename] {
+			t.Errorf("Expected restore attempt for %s, got %v", filename, mock.GetRestoreCalls())
+		}
+	}
+
+	for _, key := range []string{"@code.v1", "@code.v2"} {
+		if watcher.NeedsWarmup(key) {
+			t.Errorf("Expected %s to be warmed up", key)
+		}
+	}
+}
+
+// TestWarmupWindows verifies that after the initial warmup, template changes
+// are only warmed up inside the configured warmup windows
+func TestWarmupWindows(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	if err := os.WriteFile(templatePath, []byte("Initial content"), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		WarmupWindows:       []config.WarmupWindow{{Start: "02:00", End: "05:00"}},
+	}
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+	clock := time.Date(2025, 1, 1, 14, 0, 0, 0, time.Local)
+	mgr.now = func() time.Time { return clock }
+
+	// Initial warmup runs even outside the window
+	mgr.checkAndWarmup()
+	if mock.GetCompletionCalls() != 1 {
+		t.Fatalf("Expected initial warmup outside window, got %d completion calls", mock.GetCompletionCalls())
+	}
+	mock.Reset()
+
+	// Change outside the window is detected but deferred
+	if err := os.WriteFile(templatePath, []byte("Modified content"), 0644); err != nil {
+		t.Fatalf("Failed to update template file: %v", err)
+	}
+	mgr.checkAndWarmup()
+	if mock.GetCompletionCalls() != 0 {
+		t.Errorf("Expected no warmup outside window, got %d completion calls", mock.GetCompletionCalls())
+	}
+	if !watcher.NeedsWarmup("@test") {
+		t.Error("Expected deferred template to still need warmup")
+	}
+
+	// Inside the window the deferred warmup runs
+	clock = time.Date(2025, 1, 2, 3, 0, 0, 0, time.Local)
+	mgr.checkAndWarmup()
+	if mock.GetCompletionCalls() != 1 {
+		t.Errorf("Expected deferred warmup inside window, got %d completion calls", mock.GetCompletionCalls())
+	}
+	if watcher.NeedsWarmup("@test") {
+		t.Error("Expected template to be warmed up inside window")
+	}
 }
 
 func TestRestoreKVCache(t *testing.T) {
@@ -606,8 +1023,8 @@ func TestRestoreKVCache(t *testing.T) {
 
 	if err := mgr.kvCache.Restore("@test", "missing.bin"); err == nil {
 		t.Error("Expected error when cache file not found")
-	} else if !strings.Contains(err.Error(), "404") {
-		t.Errorf("Expected 404 error, got: %v", err)
+	} else if !errors.Is(err, kvcache.ErrCacheNotFound) {
+		t.Errorf("Expected ErrCacheNotFound, got: %v", err)
 	}
 }
 
@@ -634,8 +1051,28 @@ func TestSaveKVCache(t *testing.T) {
 	mock.saveFailures["fail.bin"] = true
 	mock.mu.Unlock()
 
-	if err := mgr.kvCache.Save("@test", "fail.bin"); err == nil {
-		t.Error("Expected error when save fails")
+	err := mgr.kvCache.Save("@test", "fail.bin")
+	if err == nil {
+		t.Fatal("Expected error when save fails")
+	}
+	var backendErr *kvcache.BackendError
+	if !errors.As(err, &backendErr) {
+		t.Fatalf("Expected *kvcache.BackendError, got: %v", err)
+	}
+	if backendErr.Status != http.StatusInternalServerError || !strings.Contains(backendErr.Body, "save failed") {
+		t.Errorf("Unexpected backend error: status %d, body %q", backendErr.Status, backendErr.Body)
+	}
+	if errors.Is(err, kvcache.ErrCacheNotFound) {
+		t.Error("Save failure should not be ErrCacheNotFound")
+	}
+
+	// Both calls reached llama.cpp and were timed
+	snap := metrics.FullSnapshot()
+	if snap.KVCacheSaveDurationCount["@test"] != 2 {
+		t.Errorf("Expected 2 timed saves, got %d", snap.KVCacheSaveDurationCount["@test"])
+	}
+	if snap.KVCacheSaveDurationTotal["@test"] <= 0 {
+		t.Errorf("Expected positive save duration, got %v", snap.KVCacheSaveDurationTotal["@test"])
 	}
 }
 
@@ -654,7 +1091,7 @@ func TestSendWarmupRequest(t *testing.T) {
 
 	// Test successful request
 	content := "Test warmup content"
-	if err := mgr.sendWarmupRequest(context.Background(), "@test", content); err != nil {
+	if _, err := mgr.sendWarmupRequest(context.Background(), "@test", content); err != nil {
 		t.Errorf("Warmup request should succeed: %v", err)
 	}
 
@@ -668,7 +1105,1466 @@ func TestSendWarmupRequest(t *testing.T) {
 	mock.completionFailure = true
 	mock.mu.Unlock()
 
-	if err := mgr.sendWarmupRequest(context.Background(), "@test", content); err == nil {
+	if _, err := mgr.sendWarmupRequest(context.Background(), "@test", content); err == nil {
 		t.Error("Expected error when completion fails")
 	}
 }
+
+// TestWarmupTools verifies that chat-shaped warmups carry the prefix's
+// tools, so the warmed cache matches requests that get them merged in
+func TestWarmupTools(t *testing.T) {
+	var receivedBody map[string]interface{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&receivedBody)
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	toolsPath := filepath.Join(t.TempDir(), "tools.json")
+	os.WriteFile(toolsPath, []byte(`[{"type": "function", "function": {"name": "search"}}]`), 0644)
+	cfg := &config.Config{
+		BackendURL:          backend.URL,
+		WarmupCheckInterval: 10,
+		Prefixes: map[string]config.PrefixConfig{
+			"@agent": {Inline: "Agent: <{message}>", ToolsFile: toolsPath},
+		},
+	}
+	mgr := New(cfg, template.NewWatcher(), backend.URL, admin.NewMetrics(), state.New(), admission.New())
+
+	if _, err := mgr.sendWarmupRequest(context.Background(), "@agent", "Agent: "); err != nil {
+		t.Fatalf("Warmup request failed: %v", err)
+	}
+	tools, ok := receivedBody["tools"].([]interface{})
+	if !ok || len(tools) != 1 {
+		t.Fatalf("Expected the search tool in the warmup, got %v", receivedBody["tools"])
+	}
+	if name := tools[0].(map[string]interface{})["function"].(map[string]interface{})["name"]; name != "search" {
+		t.Errorf("Expected the search tool, got %v", name)
+	}
+
+	// Prompt-shaped warmups have no tools
+	cfg.WarmupRequestFormat = config.WarmupFormatPrompt
+	receivedBody = nil
+	mgr.sendWarmupRequest(context.Background(), "@agent", "Agent: ")
+	if _, exists := receivedBody["tools"]; exists {
+		t.Error("Expected no tools in a prompt-shaped warmup")
+	}
+}
+
+// TestSendWarmupRequestFormats verifies chat-shaped and prompt-shaped warmup
+// requests against the configured endpoint
+func TestSendWarmupRequestFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		format   string
+		path     string
+		check    func(t *testing.T, body map[string]interface{})
+	}{
+		{
+			name: "default chat",
+			path: "/v1/chat/completions",
+			check: func(t *testing.T, body map[string]interface{}) {
+				messages, ok := body["messages"].([]interface{})
+				if !ok || len(messages) != 1 {
+					t.Fatalf("Expected one chat message, got %v", body)
+				}
+				if content := messages[0].(map[string]interface{})["content"]; content != "warmup content" {
+					t.Errorf("Expected warmup content in message, got %v", content)
+				}
+			},
+		},
+		{
+			name:     "native completion derives prompt format",
+			endpoint: "/completion",
+			path:     "/completion",
+			check: func(t *testing.T, body map[string]interface{}) {
+				if body["prompt"] != "warmup content" {
+					t.Errorf("Expected flat prompt, got %v", body)
+				}
+				if body["n_predict"] != float64(1) {
+					t.Errorf("Expected n_predict 1, got %v", body["n_predict"])
+				}
+				if _, exists := body["messages"]; exists {
+					t.Error("Expected no messages in prompt-shaped request")
+				}
+			},
+		},
+		{
+			name:     "explicit prompt format",
+			endpoint: "/v1/completions",
+			format:   config.WarmupFormatPrompt,
+			path:     "/v1/completions",
+			check: func(t *testing.T, body map[string]interface{}) {
+				if body["prompt"] != "warmup content" || body["max_tokens"] != float64(1) {
+					t.Errorf("Expected flat prompt with max_tokens 1, got %v", body)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var receivedPath string
+			var receivedBody map[string]interface{}
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				receivedPath = r.URL.Path
+				json.NewDecoder(r.Body).Decode(&receivedBody)
+				w.Write([]byte(`{}`))
+			}))
+			defer backend.Close()
+
+			cfg := &config.Config{
+				BackendURL:          backend.URL,
+				WarmupCheckInterval: 10,
+				WarmupEndpoint:      tt.endpoint,
+				WarmupRequestFormat: tt.format,
+			}
+			mgr := New(cfg, template.NewWatcher(), backend.URL, admin.NewMetrics(), state.New(), admission.New())
+
+			if _, err := mgr.sendWarmupRequest(context.Background(), "@test", "warmup content"); err != nil {
+				t.Fatalf("Warmup request should succeed: %v", err)
+			}
+			if receivedPath != tt.path {
+				t.Errorf("Expected request to %s, got %s", tt.path, receivedPath)
+			}
+			tt.check(t, receivedBody)
+		})
+	}
+}
+
+// TestWarmupCheckSlots verifies that warmup is skipped while all backend
+// slots are busy and runs once a slot is idle
+func TestWarmupCheckSlots(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	if err := os.WriteFile(templatePath, []byte("Template"), 0644); err != nil {
+		t.Fatalf("Failed to create template file: %v", err)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.mu.Lock()
+	mock.slotsResponse = `[{"id":0,"is_processing":true},{"id":1,"state":1}]`
+	mock.mu.Unlock()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		WarmupCheckSlots:    true,
+	}
+
+	watcher := template.NewWatcher()
+	if err := watcher.AddTemplate("@test", templatePath); err != nil {
+		t.Fatalf("Failed to add template: %v", err)
+	}
+
+	metrics := admin.NewMetrics()
+	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
+
+	// All slots busy - no warmup completion is sent
+	mgr.checkAndWarmup()
+	if mock.GetCompletionCalls() != 0 {
+		t.Errorf("Expected no completion calls while slots are busy, got %d", mock.GetCompletionCalls())
+	}
+	if metrics.WarmupSkippedBusy != 1 {
+		t.Errorf("Expected 1 busy skip, got %d", metrics.WarmupSkippedBusy)
+	}
+	if !watcher.NeedsWarmup("@test") {
+		t.Error("Expected template to still need warmup")
+	}
+
+	// A slot becomes idle (older llama.cpp "state" format) - warmup runs
+	mock.mu.Lock()
+	mock.slotsResponse = `[{"id":0,"state":1},{"id":1,"state":0}]`
+	mock.mu.Unlock()
+
+	mgr.checkAndWarmup()
+	if mock.GetCompletionCalls() != 1 {
+		t.Errorf("Expected 1 completion call once a slot is idle, got %d", mock.GetCompletionCalls())
+	}
+	if metrics.WarmupSkippedBusy != 1 {
+		t.Errorf("Expected busy skips to stay at 1, got %d", metrics.WarmupSkippedBusy)
+	}
+}
+
+// TestWarmupPrefixBackend tests that a template pinned to its own backend is
+// warmed up there, with state tracked separately from the default backend
+func TestWarmupPrefixBackend(t *testing.T) {
+	tmpDir := t.TempDir()
+	bigPath := filepath.Join(tmpDir, "big.txt")
+	os.WriteFile(bigPath, []byte("Big context"), 0644)
+
+	defaultMock := newMockLlamaCppServer()
+	defer defaultMock.Close()
+	bigMock := newMockLlamaCppServer()
+	defer bigMock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          defaultMock.URL(),
+		WarmupCheckInterval: 10,
+		Prefixes: map[string]config.PrefixConfig{
+			"@bigcontext": {Path: bigPath, Backend: bigMock.URL()},
+		},
+	}
+
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@bigcontext", bigPath)
+
+	backendState := state.New()
+	mgr := New(cfg, watcher, defaultMock.URL(), admin.NewMetrics(), backendState, admission.New())
+	mgr.checkAndWarmup()
+
+	if bigMock.GetCompletionCalls() != 1 {
+		t.Errorf("Expected 1 completion call on the big backend, got %d", bigMock.GetCompletionCalls())
+	}
+	if len(bigMock.GetRestoreCalls()) != 1 {
+		t.Errorf("Expected 1 restore call on the big backend, got %v", bigMock.GetRestoreCalls())
+	}
+	if defaultMock.GetCompletionCalls() != 0 || len(defaultMock.GetRestoreCalls()) != 0 {
+		t.Errorf("Expected no calls on the default backend, got %d completions and restores %v",
+			defaultMock.GetCompletionCalls(), defaultMock.GetRestoreCalls())
+	}
+
+	if backendState.GetLastPrefix() != "" {
+		t.Errorf("Expected default backend state to be untouched, got %q", backendState.GetLastPrefix())
+	}
+	if prefix := backendState.Backend(bigMock.URL()).GetLastPrefix(); prefix != "@bigcontext" {
+		t.Errorf("Expected big backend state @bigcontext, got %q", prefix)
+	}
+}
+
+// TestWarmupEmptyTemplate tests that a template processing to empty content
+// is skipped, or warmed up with the configured placeholder
+func TestWarmupEmptyTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "passthrough.txt")
+	os.WriteFile(templatePath, []byte(" <{message}>\n"), 0644)
+
+	t.Run("skip", func(t *testing.T) {
+		mock := newMockLlamaCppServer()
+		defer mock.Close()
+
+		cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10}
+		watcher := template.NewWatcher()
+		watcher.AddTemplate("@raw", templatePath)
+		metrics := admin.NewMetrics()
+		backendState := state.New()
+		mgr := New(cfg, watcher, mock.URL(), metrics, backendState, admission.New())
+
+		mgr.checkAndWarmup()
+
+		if mock.GetCompletionCalls() != 0 || len(mock.GetRestoreCalls()) != 0 {
+			t.Errorf("Expected no backend calls, got %d completions and restores %v",
+				mock.GetCompletionCalls(), mock.GetRestoreCalls())
+		}
+		if metrics.WarmupSkippedEmpty["@raw"] != 1 {
+			t.Errorf("Expected 1 empty skip recorded, got %d", metrics.WarmupSkippedEmpty["@raw"])
+		}
+		if backendState.GetLastPrefix() != "" {
+			t.Errorf("Expected state to be untouched, got %q", backendState.GetLastPrefix())
+		}
+
+		// Not retried until the template changes
+		mgr.checkAndWarmup()
+		if metrics.WarmupSkippedEmpty["@raw"] != 1 {
+			t.Errorf("Expected the skip not to repeat, got %d", metrics.WarmupSkippedEmpty["@raw"])
+		}
+	})
+
+	t.Run("placeholder", func(t *testing.T) {
+		var mu sync.Mutex
+		var content string
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/chat/completions" {
+				var body struct {
+					Messages []map[string]string `json:"messages"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				mu.Lock()
+				content = body.Messages[0]["content"]
+				mu.Unlock()
+			}
+			w.Write([]byte(`{}`))
+		}))
+		defer backend.Close()
+
+		cfg := &config.Config{BackendURL: backend.URL, WarmupCheckInterval: 10, WarmupEmptyPlaceholder: "Hello"}
+		watcher := template.NewWatcher()
+		watcher.AddTemplate("@raw", templatePath)
+		metrics := admin.NewMetrics()
+		mgr := New(cfg, watcher, backend.URL, metrics, state.New(), admission.New())
+
+		mgr.checkAndWarmup()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if content != "Hello" {
+			t.Errorf("Expected placeholder warmup content, got %q", content)
+		}
+		if metrics.WarmupExecutions["@raw"] != 1 {
+			t.Errorf("Expected 1 warmup execution, got %d", metrics.WarmupExecutions["@raw"])
+		}
+		if len(metrics.WarmupSkippedEmpty) != 0 {
+			t.Errorf("Expected no empty skips, got %v", metrics.WarmupSkippedEmpty)
+		}
+	})
+}
+
+// TestWarmupChangeDebounce tests that a template saved twice in quick
+// succession is warmed up only once, after it settles
+func TestWarmupChangeDebounce(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	os.WriteFile(templatePath, []byte("Initial content"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10}
+	watcher := template.NewWatcher()
+	watcher.SetChangeDebounce(1)
+	watcher.AddTemplate("@test", templatePath)
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	// Initial warmup
+	mgr.checkAndWarmup()
+	mock.Reset()
+
+	// Partial write, then the final write on the next cycle
+	os.WriteFile(templatePath, []byte("Modif"), 0644)
+	mgr.checkAndWarmup()
+	os.WriteFile(templatePath, []byte("Modified content"), 0644)
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 0 {
+		t.Errorf("Expected no warmup while the template is changing, got %d", calls)
+	}
+
+	// Stable content is warmed up once
+	mgr.checkAndWarmup()
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Errorf("Expected exactly 1 warmup after the template settled, got %d", calls)
+	}
+}
+
+func TestWarmupUsageWeighted(t *testing.T) {
+	tmpDir := t.TempDir()
+	hotPath := filepath.Join(tmpDir, "hot.txt")
+	coldPath := filepath.Join(tmpDir, "cold.txt")
+	os.WriteFile(hotPath, []byte("Hot template"), 0644)
+	os.WriteFile(coldPath, []byte("Cold template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		WarmupUsageWeighted: true,
+		WarmupMinInterval:   10,
+		WarmupMaxInterval:   300,
+	}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@hot", hotPath)
+	watcher.AddTemplate("@cold", coldPath)
+	metrics := admin.NewMetrics()
+	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admission.New())
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.now = func() time.Time { return now }
+
+	// Initial warmup of both templates
+	mgr.checkAndWarmup()
+	mock.Reset()
+
+	// @hot gets traffic, then both templates change
+	for i := 0; i < 20; i++ {
+		metrics.RecordTemplateRequest("@hot")
+	}
+	os.WriteFile(hotPath, []byte("Hot template v2"), 0644)
+	os.WriteFile(coldPath, []byte("Cold template v2"), 0644)
+
+	// After 30s only the busy template is re-checked
+	now = now.Add(30 * time.Second)
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Fatalf("Expected only the busy template to be warmed up, got %d warmups", calls)
+	}
+	if watcher.NeedsWarmup("@hot") {
+		t.Error("Expected @hot to be warmed up")
+	}
+
+	// The idle template is picked up once maxInterval has passed
+	now = now.Add(270 * time.Second)
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 2 {
+		t.Errorf("Expected the idle template to be warmed up after maxInterval, got %d warmups", calls)
+	}
+}
+
+// TestWarmupAfterFailedCheck tests that a template whose change check failed
+// once is re-checked and warmed up on the next cycle instead of waiting for
+// its usage-weighted interval
+func TestWarmupAfterFailedCheck(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(path, []byte("Code template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		WarmupUsageWeighted: true,
+		WarmupMinInterval:   10,
+		WarmupMaxInterval:   300,
+	}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", path)
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.now = func() time.Time { return now }
+	mgr.checkAndWarmup()
+	mock.Reset()
+
+	// Due again, but the file is missing mid-write
+	os.Remove(path)
+	now = now.Add(300 * time.Second)
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 0 {
+		t.Fatalf("Expected no warmup while the template can't be read, got %d", calls)
+	}
+
+	// The next cycle picks up the new content, well before the next due time
+	os.WriteFile(path, []byte("Code template v2"), 0644)
+	now = now.Add(10 * time.Second)
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Errorf("Expected the template to be warmed up on the next cycle, got %d warmups", calls)
+	}
+	if watcher.NeedsWarmup("@code") {
+		t.Error("Expected @code to be warmed up")
+	}
+}
+
+func TestWarmupAfterSymlinkRetarget(t *testing.T) {
+	tmpDir := t.TempDir()
+	v1 := filepath.Join(tmpDir, "code-v1.txt")
+	v2 := filepath.Join(tmpDir, "code-v2.txt")
+	os.WriteFile(v1, []byte("Code template v1"), 0644)
+	os.WriteFile(v2, []byte("Code template v2"), 0644)
+	link := filepath.Join(tmpDir, "code.txt")
+	if err := os.Symlink(v1, link); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		WarmupUsageWeighted: true,
+		WarmupMinInterval:   10,
+		WarmupMaxInterval:   300,
+	}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", link)
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.now = func() time.Time { return now }
+	mgr.checkAndWarmup()
+	mock.Reset()
+
+	// Deploy a new version by repointing the symlink, long before @code is due
+	tmpLink := filepath.Join(tmpDir, "code.tmp")
+	os.Symlink(v2, tmpLink)
+	if err := os.Rename(tmpLink, link); err != nil {
+		t.Fatalf("Failed to repoint symlink: %v", err)
+	}
+	now = now.Add(10 * time.Second)
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Errorf("Expected a re-warm after repointing the symlink, got %d warmups", calls)
+	}
+	if watcher.NeedsWarmup("@code") {
+		t.Error("Expected @code to be warmed up")
+	}
+}
+
+// TestStopCancelsWarmup tests that Stop cancels a warmup blocked on a slow
+// completion instead of waiting for it
+func TestStopCancelsWarmup(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	os.WriteFile(templatePath, []byte("Test template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.completionDelay = 30 * time.Second
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, WarmupStopTimeout: 5}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@test", templatePath)
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+	var events []WarmupEvent
+	mgr.OnEvent = func(event WarmupEvent) { events = append(events, event) }
+
+	if err := mgr.Start(); err != nil {
+		t.Fatalf("Failed to start warmup manager: %v", err)
+	}
+
+	// Wait until the initial warmup is blocked on the completion
+	deadline := time.Now().Add(2 * time.Second)
+	for mock.GetCompletionCalls() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the warmup request")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	mgr.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Stop to return promptly, took %v", elapsed)
+	}
+
+	// The loop has exited, so the events are complete
+	if len(events) != 2 || events[1].Type != EventCancelled {
+		t.Errorf("Expected the warmup to be cancelled, got %v", events)
+	}
+	if !watcher.NeedsWarmup("@test") {
+		t.Error("Expected @test to still need warmup")
+	}
+}
+
+// TestMinWarmupInterval tests that rapid changes within MinWarmupInterval
+// are coalesced into one warmup once the interval has passed
+func TestMinWarmupInterval(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(path, []byte("Code template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, MinWarmupInterval: 60}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", path)
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	mgr.now = func() time.Time { return now }
+	mgr.checkAndWarmup()
+	mock.Reset()
+
+	// Two edits in quick succession are not warmed up yet
+	for i, content := range []string{"Code template v2", "Code template v3"} {
+		os.WriteFile(path, []byte(content), 0644)
+		now = now.Add(10 * time.Second)
+		mgr.checkAndWarmup()
+		if calls := mock.GetCompletionCalls(); calls != 0 {
+			t.Fatalf("Expected no warmup within the interval after edit %d, got %d", i+1, calls)
+		}
+		if !watcher.NeedsWarmup("@code") {
+			t.Fatalf("Expected @code to stay pending after edit %d", i+1)
+		}
+	}
+
+	// Once the interval has passed, the latest content is warmed up once;
+	// the next check doesn't see the second edit as another change
+	now = now.Add(40 * time.Second)
+	mgr.checkAndWarmup()
+	now = now.Add(10 * time.Second)
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Errorf("Expected one warmup after the interval, got %d", calls)
+	}
+	if watcher.NeedsWarmup("@code") {
+		t.Error("Expected @code to be warmed up")
+	}
+}
+
+// TestSlotIdleRefresh tests that the loaded template's KV cache is restored
+// again before the slot idle eviction threshold is reached
+func TestSlotIdleRefresh(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "code.txt")
+	os.WriteFile(path, []byte("Code template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	// The state and the manager share one fake clock
+	start := time.Now()
+	var elapsed time.Duration
+	clock := func() time.Time { return start.Add(elapsed) }
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, SlotIdleEvictSeconds: 100}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@code", path)
+	backendState := state.New()
+	backendState.SetClock(clock)
+	metrics := admin.NewMetrics()
+	mgr := New(cfg, watcher, mock.URL(), metrics, backendState, admission.New())
+	mgr.now = clock
+
+	// Nothing loaded yet
+	elapsed = 95 * time.Second
+	mgr.refreshLoadedCache()
+	if calls := mock.GetRestoreCalls(); len(calls) != 0 {
+		t.Fatalf("Expected no restore without a loaded template, got %v", calls)
+	}
+
+	// A request used @code; well before the threshold nothing happens
+	elapsed = 0
+	backendState.UpdatePrefix("@code")
+	elapsed = 80 * time.Second
+	mgr.refreshLoadedCache()
+	if calls := mock.GetRestoreCalls(); len(calls) != 0 {
+		t.Fatalf("Expected no restore after 80s idle, got %v", calls)
+	}
+
+	// Approaching the 100s eviction, the saved cache is restored
+	elapsed = 91 * time.Second
+	mgr.refreshLoadedCache()
+	if calls := mock.GetRestoreCalls(); len(calls) != 1 || calls[0] != "code.bin" {
+		t.Errorf("Expected code.bin to be restored before eviction, got %v", calls)
+	}
+	if mock.GetCompletionCalls() != 0 {
+		t.Error("Expected a restore, not a warmup")
+	}
+	if got := metrics.SlotRefreshes["@code"]["restored"]; got != 1 {
+		t.Errorf("Expected 1 restored slot refresh recorded, got %d", got)
+	}
+
+	// The restore counts as use
+	elapsed = 150 * time.Second
+	mgr.refreshLoadedCache()
+	if calls := mock.GetRestoreCalls(); len(calls) != 1 {
+		t.Errorf("Expected no restore 59s after the refresh, got %v", calls)
+	}
+
+	// Without a saved file the template is warmed up instead
+	mock.Reset()
+	mock.restoreFailures["code.bin"] = true
+	elapsed = 200 * time.Second
+	mgr.refreshLoadedCache()
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Errorf("Expected a re-warm without a saved cache, got %d completions", calls)
+	}
+	if backendState.GetLastPrefix() != "@code" {
+		t.Errorf("Expected @code to stay loaded, got %q", backendState.GetLastPrefix())
+	}
+	if got := metrics.SlotRefreshes["@code"]["warmed_up"]; got != 1 {
+		t.Errorf("Expected 1 warmed up slot refresh recorded, got %d", got)
+	}
+}
+
+// TestSlotIdleRefreshCacheKey tests that a refresh of a cache shared under
+// cache_key maps it back to its template, for metrics and the re-warm
+func TestSlotIdleRefreshCacheKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "review.txt")
+	os.WriteFile(path, []byte("Review template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.restoreFailures["code.bin"] = true
+
+	start := time.Now()
+	var elapsed time.Duration
+	clock := func() time.Time { return start.Add(elapsed) }
+
+	cfg := &config.Config{
+		BackendURL:           mock.URL(),
+		WarmupCheckInterval:  10,
+		SlotIdleEvictSeconds: 100,
+		Prefixes:             map[string]config.PrefixConfig{"@review": {Path: path, CacheKey: "code"}},
+	}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@review", path)
+	backendState := state.New()
+	backendState.SetClock(clock)
+	metrics := admin.NewMetrics()
+	mgr := New(cfg, watcher, mock.URL(), metrics, backendState, admission.New())
+	mgr.now = clock
+
+	backendState.UpdatePrefix("code")
+	elapsed = 95 * time.Second
+	mgr.refreshLoadedCache()
+
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Errorf("Expected @review to be re-warmed for cache key code, got %d completions", calls)
+	}
+	if got := metrics.SlotRefreshes["@review"]["warmed_up"]; got != 1 {
+		t.Errorf("Expected the refresh recorded for @review, got %v", metrics.SlotRefreshes)
+	}
+	if got := metrics.KVCacheRestores["@review"]["not_found"]; got != 1 {
+		t.Errorf("Expected the restore recorded for @review, got %v", metrics.KVCacheRestores)
+	}
+	if backendState.GetLastPrefix() != "code" {
+		t.Errorf("Expected cache key code to stay loaded, got %q", backendState.GetLastPrefix())
+	}
+}
+
+func TestSaveEveryNRequests(t *testing.T) {
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, SaveEveryNRequests: 3}
+	backendState := state.New()
+	admissionCtrl := admission.New()
+	mgr := New(cfg, template.NewWatcher(), mock.URL(), admin.NewMetrics(), backendState, admissionCtrl)
+
+	request := func() {
+		backendState.UpdatePrefix("@code")
+		backendState.CountRequest("@code")
+	}
+
+	// Below the threshold nothing is saved
+	request()
+	request()
+	mgr.saveAfterRequests()
+	if calls := mock.GetSaveCalls(); len(calls) != 0 {
+		t.Fatalf("Expected no save after 2 requests, got %v", calls)
+	}
+
+	// At the threshold the save waits for the backend to be idle
+	request()
+	admissionCtrl.AcquireUserQuery()
+	mgr.saveAfterRequests()
+	if calls := mock.GetSaveCalls(); len(calls) != 0 {
+		t.Fatalf("Expected no save while a user request runs, got %v", calls)
+	}
+	admissionCtrl.ReleaseUserQuery()
+	mgr.saveAfterRequests()
+	if calls := mock.GetSaveCalls(); len(calls) != 1 || calls[0] != "code.bin" {
+		t.Fatalf("Expected code.bin to be saved once idle, got %v", calls)
+	}
+	if backendState.GetLastPrefix() != "@code" {
+		t.Errorf("Expected @code to stay loaded, got %q", backendState.GetLastPrefix())
+	}
+
+	// The count restarts after the save
+	mgr.saveAfterRequests()
+	if calls := mock.GetSaveCalls(); len(calls) != 1 {
+		t.Errorf("Expected no second save right after the first, got %v", calls)
+	}
+}
+
+// TestSaveEveryNRequestsLoop tests that the warmup loop saves the loaded
+// template's cache once the backend is idle after SaveEveryNRequests
+func TestSaveEveryNRequestsLoop(t *testing.T) {
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, SaveEveryNRequests: 3}
+	backendState := state.New()
+	admissionCtrl := admission.New()
+	mgr := New(cfg, template.NewWatcher(), mock.URL(), admin.NewMetrics(), backendState, admissionCtrl)
+
+	// The threshold is reached while a user request holds the backend
+	admissionCtrl.AcquireUserQuery()
+	for range 3 {
+		backendState.UpdatePrefix("@code")
+		backendState.CountRequest("@code")
+	}
+
+	if err := mgr.Start(); err != nil {
+		t.Fatalf("Failed to start manager: %v", err)
+	}
+	defer mgr.Stop()
+
+	time.Sleep(requestSaveCheckInterval + 500*time.Millisecond)
+	if calls := mock.GetSaveCalls(); len(calls) != 0 {
+		t.Fatalf("Expected no save while a user request runs, got %v", calls)
+	}
+
+	// In the next idle window the loop saves it
+	admissionCtrl.ReleaseUserQuery()
+	deadline := time.Now().Add(3 * requestSaveCheckInterval)
+	for len(mock.GetSaveCalls()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if calls := mock.GetSaveCalls(); len(calls) != 1 || calls[0] != "code.bin" {
+		t.Fatalf("Expected code.bin to be saved by the loop once idle, got %v", calls)
+	}
+}
+
+// TestSaveBlocksUserRequests tests that a user request arriving during a
+// count-based save waits for it instead of interrupting it
+func TestSaveBlocksUserRequests(t *testing.T) {
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.saveDelay = 300 * time.Millisecond
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, SaveEveryNRequests: 1}
+	backendState := state.New()
+	admissionCtrl := admission.New()
+	metrics := admin.NewMetrics()
+	admissionCtrl.SetGraceCompletionHandler(metrics.RecordWarmupGraceCompletion)
+	mgr := New(cfg, template.NewWatcher(), mock.URL(), metrics, backendState, admissionCtrl)
+
+	backendState.UpdatePrefix("@code")
+	backendState.CountRequest("@code")
+
+	saved := make(chan struct{})
+	go func() {
+		mgr.saveAfterRequests()
+		close(saved)
+	}()
+	for admissionCtrl.GetCurrentState() != admission.WARMUP_QUERY {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The save is marked done before it releases the backend
+	admissionCtrl.AcquireUserQuery()
+	if _, requests := backendState.RequestsSinceSave(); requests != 0 {
+		t.Errorf("Expected the user request to be admitted only after the save, got %d requests since save", requests)
+	}
+	admissionCtrl.ReleaseUserQuery()
+	<-saved
+	if len(metrics.WarmupGraceCompletions) != 0 {
+		t.Errorf("Expected a save not to count as a warmup grace completion, got %v", metrics.WarmupGraceCompletions)
+	}
+}
+
+func TestWarmupCancelGrace(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	os.WriteFile(templatePath, []byte("Test template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.completionDelay = 100 * time.Millisecond
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@test", templatePath)
+	metrics := admin.NewMetrics()
+	admissionCtrl := admission.New()
+	admissionCtrl.SetCancelGrace(2 * time.Second)
+	admissionCtrl.SetGraceCompletionHandler(metrics.RecordWarmupGraceCompletion)
+	mgr := New(cfg, watcher, mock.URL(), metrics, state.New(), admissionCtrl)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- mgr.warmupTemplate("@test") }()
+
+	// Wait for the warmup to start, then arrive as a user request
+	deadline := time.Now().Add(time.Second)
+	for admissionCtrl.GetCurrentState() != admission.WARMUP_QUERY {
+		if time.Now().After(deadline) {
+			t.Fatal("Warmup did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	admissionCtrl.AcquireUserQuery()
+	waited := time.Since(start)
+	admissionCtrl.ReleaseUserQuery()
+
+	// The warmup finished inside the grace period instead of being cancelled
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected warmup to complete, got %v", err)
+	}
+	if waited >= 2*time.Second {
+		t.Errorf("Expected user request to proceed once the warmup finished, waited %v", waited)
+	}
+	snap := metrics.FullSnapshot()
+	if snap.WarmupGraceCompletions["@test"] != 1 {
+		t.Errorf("Expected 1 grace completion, got %d", snap.WarmupGraceCompletions["@test"])
+	}
+	if snap.WarmupExecutions["@test"] != 1 {
+		t.Errorf("Expected 1 warmup execution, got %d", snap.WarmupExecutions["@test"])
+	}
+}
+
+func TestWarmupEvents(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	os.WriteFile(templatePath, []byte("Test template"), 0644)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.completionDelay = 10 * time.Millisecond
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@test", templatePath)
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	var events []WarmupEvent
+	mgr.OnEvent = func(event WarmupEvent) { events = append(events, event) }
+
+	mgr.checkAndWarmup()
+
+	if len(events) != 2 {
+		t.Fatalf("Expected started and completed events, got %+v", events)
+	}
+	if events[0].Type != EventStarted || events[0].Prefix != "@test" {
+		t.Errorf("Expected started event for @test, got %+v", events[0])
+	}
+	completed := events[1]
+	if completed.Type != EventCompleted || completed.Prefix != "@test" {
+		t.Errorf("Expected completed event for @test, got %+v", completed)
+	}
+	if completed.Duration <= 0 {
+		t.Errorf("Expected non-zero duration, got %v", completed.Duration)
+	}
+	if completed.Err != nil {
+		t.Errorf("Expected no error, got %v", completed.Err)
+	}
+
+	// A failing warmup emits a failed event with the error
+	events = nil
+	mock.completionFailure = true
+	os.WriteFile(templatePath, []byte("Changed template"), 0644)
+	mgr.checkAndWarmup()
+	if len(events) != 2 || events[1].Type != EventFailed || events[1].Err == nil {
+		t.Errorf("Expected started and failed events, got %+v", events)
+	}
+}
+
+func TestWarmupDisableKVCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("Template "+name), 0644)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, DisableKVCache: true}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@a", filepath.Join(tmpDir, "a.txt"))
+	watcher.AddTemplate("@b", filepath.Join(tmpDir, "b.txt"))
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	// Warming up two templates would normally save and restore caches
+	mgr.checkAndWarmup()
+
+	if calls := mock.GetCompletionCalls(); calls != 2 {
+		t.Errorf("Expected 2 warmup completions, got %d", calls)
+	}
+	if restores := mock.GetRestoreCalls(); len(restores) != 0 {
+		t.Errorf("Expected no restore calls, got %v", restores)
+	}
+	if saves := mock.GetSaveCalls(); len(saves) != 0 {
+		t.Errorf("Expected no save calls, got %v", saves)
+	}
+}
+
+// TestWarmupCompletionTimeout verifies the configured completion timeout is
+// honored: a backend just under the limit succeeds, one over it times out
+func TestWarmupCompletionTimeout(t *testing.T) {
+	tmpDir := t.TempDir()
+	templatePath := filepath.Join(tmpDir, "test_template.txt")
+	os.WriteFile(templatePath, []byte("Test template"), 0644)
+
+	tests := []struct {
+		name      string
+		delay     time.Duration
+		expectErr bool
+	}{
+		{"under limit", 500 * time.Millisecond, false},
+		{"over limit", 1500 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockLlamaCppServer()
+			defer mock.Close()
+			mock.completionDelay = tt.delay
+
+			cfg := &config.Config{
+				BackendURL:              mock.URL(),
+				WarmupCheckInterval:     10,
+				WarmupCompletionTimeout: 1,
+			}
+			watcher := template.NewWatcher()
+			watcher.AddTemplate("@test", templatePath)
+			mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+			if mgr.client.Timeout != time.Second {
+				t.Errorf("Expected completion timeout 1s, got %v", mgr.client.Timeout)
+			}
+
+			err := mgr.warmupTemplate("@test")
+			if (err != nil) != tt.expectErr {
+				t.Errorf("Expected error: %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+// TestWarmupLazy tests that lazy templates are skipped by the warmup loop
+// and warmed up once on first use
+func TestWarmupLazy(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"eager.txt", "lazy.txt"} {
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("Template "+name), 0644)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		Prefixes: map[string]config.PrefixConfig{
+			"@eager": {Path: filepath.Join(tmpDir, "eager.txt")},
+			"@lazy":  {Path: filepath.Join(tmpDir, "lazy.txt"), Warmup: config.WarmupLazy},
+		},
+	}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@eager", filepath.Join(tmpDir, "eager.txt"))
+	watcher.AddTemplate("@lazy", filepath.Join(tmpDir, "lazy.txt"))
+	admissionCtrl := admission.New()
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admissionCtrl)
+
+	// The loop only warms up the eager template
+	mgr.checkAndWarmup()
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Fatalf("Expected 1 warmup completion from the loop, got %d", calls)
+	}
+	if !watcher.NeedsWarmup("@lazy") || mgr.LazyWarmed("@lazy") {
+		t.Error("Expected lazy template not to be warmed by the loop")
+	}
+
+	// The first use warms it up while the request holds the backend
+	admissionCtrl.AcquireUserQuery()
+	if err := mgr.WarmupOnFirstUse(context.Background(), "@lazy"); err != nil {
+		t.Fatalf("WarmupOnFirstUse failed: %v", err)
+	}
+	admissionCtrl.ReleaseUserQuery()
+	if calls := mock.GetCompletionCalls(); calls != 2 {
+		t.Errorf("Expected the first use to warm up, got %d completions", calls)
+	}
+	if !mgr.LazyWarmed("@lazy") || watcher.NeedsWarmup("@lazy") {
+		t.Error("Expected lazy template to be marked warmed up")
+	}
+
+	// Later uses and eager templates don't warm up again
+	mgr.WarmupOnFirstUse(context.Background(), "@lazy")
+	mgr.WarmupOnFirstUse(context.Background(), "@eager")
+	if calls := mock.GetCompletionCalls(); calls != 2 {
+		t.Errorf("Expected no further warmups, got %d completions", calls)
+	}
+}
+
+// TestWarmupLazyPerPrefix tests that a lazy warmup only blocks requests for
+// its own template: already warm templates return immediately and concurrent
+// first uses of the same template warm it up once
+func TestWarmupLazyPerPrefix(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"warm.txt", "slow.txt"} {
+		os.WriteFile(filepath.Join(tmpDir, name), []byte("Template "+name), 0644)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{
+		BackendURL:          mock.URL(),
+		WarmupCheckInterval: 10,
+		Prefixes: map[string]config.PrefixConfig{
+			"@warm": {Path: filepath.Join(tmpDir, "warm.txt"), Warmup: config.WarmupLazy},
+			"@slow": {Path: filepath.Join(tmpDir, "slow.txt"), Warmup: config.WarmupLazy},
+		},
+	}
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@warm", filepath.Join(tmpDir, "warm.txt"))
+	watcher.AddTemplate("@slow", filepath.Join(tmpDir, "slow.txt"))
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	if err := mgr.WarmupOnFirstUse(context.Background(), "@warm"); err != nil {
+		t.Fatalf("WarmupOnFirstUse failed: %v", err)
+	}
+
+	mock.mu.Lock()
+	mock.completionDelay = 500 * time.Millisecond
+	mock.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := mgr.WarmupOnFirstUse(context.Background(), "@slow"); err != nil {
+				t.Errorf("WarmupOnFirstUse failed: %v", err)
+			}
+		}()
+	}
+
+	// Wait for the slow warmup to reach the backend
+	deadline := time.Now().Add(2 * time.Second)
+	for mock.GetCompletionCalls() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := mgr.WarmupOnFirstUse(context.Background(), "@warm"); err != nil {
+		t.Fatalf("WarmupOnFirstUse failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected warm template not to wait for another warmup, took %v", elapsed)
+	}
+
+	wg.Wait()
+	if calls := mock.GetCompletionCalls(); calls != 2 {
+		t.Errorf("Expected the slow template to be warmed up once, got %d completions", calls-1)
+	}
+	if !mgr.LazyWarmed("@slow") {
+		t.Error("Expected slow template to be marked warmed up")
+	}
+}
+
+// TestWarmupPriority tests that changed templates are warmed up highest
+// priority first and that WarmupNow preempts queued lower-priority warmups
+func TestWarmupPriority(t *testing.T) {
+	tmpDir := t.TempDir()
+	prefixes := map[string]config.PrefixConfig{}
+	watcher := template.NewWatcher()
+	for name, priority := range map[string]int{"critical": 10, "normal": 0, "rarely_used": -5, "urgent": 20} {
+		path := filepath.Join(tmpDir, name+".txt")
+		os.WriteFile(path, []byte("Template "+name), 0644)
+		prefixes["@"+name] = config.PrefixConfig{Path: path, Priority: priority}
+		if name != "urgent" {
+			watcher.AddTemplate("@"+name, path)
+		}
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, Prefixes: prefixes}
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	var order []string
+	mgr.OnEvent = func(event WarmupEvent) {
+		if event.Type == EventCompleted {
+			order = append(order, event.Prefix)
+		}
+	}
+
+	mgr.checkAndWarmup()
+	expected := []string{"@critical", "@normal", "@rarely_used"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("Expected warmup order %v, got %v", expected, order)
+	}
+
+	// Change all templates; while @critical warms up, an urgent warmup is
+	// requested and runs before the queued lower-priority ones
+	path := filepath.Join(tmpDir, "urgent.txt")
+	watcher.AddTemplate("@urgent", path)
+	watcher.MarkWarmedUp("@urgent")
+	for _, name := range []string{"critical", "normal", "rarely_used"} {
+		os.WriteFile(filepath.Join(tmpDir, name+".txt"), []byte("Changed "+name), 0644)
+	}
+	order = nil
+	mgr.OnEvent = func(event WarmupEvent) {
+		if event.Type == EventStarted && event.Prefix == "@critical" {
+			mgr.WarmupNow("@urgent")
+			mgr.WarmupNow("@rarely_used")
+		}
+		if event.Type == EventCompleted {
+			order = append(order, event.Prefix)
+		}
+	}
+
+	mgr.checkAndWarmup()
+	// The on-demand @rarely_used warmup waits for higher-priority queued ones
+	// and is merged with the queued warmup of the same template
+	expected = []string{"@critical", "@urgent", "@normal", "@rarely_used"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("Expected warmup order %v, got %v", expected, order)
+	}
+}
+
+// TestWarmupDependencies tests that templates are warmed up after the
+// templates they depend on, even if those have a lower priority
+func TestWarmupDependencies(t *testing.T) {
+	tmpDir := t.TempDir()
+	prefixes := map[string]config.PrefixConfig{}
+	watcher := template.NewWatcher()
+	for name, prefixCfg := range map[string]config.PrefixConfig{
+		"base":          {Priority: -5},
+		"base_extended": {Priority: 10, DependsOn: []string{"@base"}},
+		"base_deep":     {Priority: 20, DependsOn: []string{"@base_extended"}},
+		"other":         {Priority: 5},
+	} {
+		path := filepath.Join(tmpDir, name+".txt")
+		os.WriteFile(path, []byte("Template "+name), 0644)
+		prefixCfg.Path = path
+		prefixes["@"+name] = prefixCfg
+		watcher.AddTemplate("@"+name, path)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, Prefixes: prefixes}
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	var order []string
+	mgr.OnEvent = func(event WarmupEvent) {
+		if event.Type == EventCompleted {
+			order = append(order, event.Prefix)
+		}
+	}
+
+	mgr.checkAndWarmup()
+	expected := []string{"@base", "@base_extended", "@base_deep", "@other"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("Expected warmup order %v, got %v", expected, order)
+	}
+
+	// Only changed templates are warmed up, dependencies that didn't change
+	// are not warmed up again
+	os.WriteFile(filepath.Join(tmpDir, "base_deep.txt"), []byte("Changed base_deep"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "other.txt"), []byte("Changed other"), 0644)
+	order = nil
+	mgr.checkAndWarmup()
+	expected = []string{"@base_deep", "@other"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("Expected warmup order %v, got %v", expected, order)
+	}
+}
+
+// TestWarmupAll tests that every template is warmed up and saved, including
+// the one left loaded at the end
+func TestWarmupAll(t *testing.T) {
+	tmpDir := t.TempDir()
+	watcher := template.NewWatcher()
+	prefixes := map[string]config.PrefixConfig{}
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(tmpDir, name+".txt")
+		os.WriteFile(path, []byte("Template "+name), 0644)
+		watcher.AddTemplate("@"+name, path)
+		prefixes["@"+name] = config.PrefixConfig{Path: path}
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, Prefixes: prefixes}
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	if err := mgr.WarmupAll(); err != nil {
+		t.Fatalf("WarmupAll failed: %v", err)
+	}
+
+	if calls := mock.GetCompletionCalls(); calls != 3 {
+		t.Errorf("Expected 3 warmup completions, got %d", calls)
+	}
+	saves := mock.GetSaveCalls()
+	slices.Sort(saves)
+	if expected := []string{"a.bin", "b.bin", "c.bin"}; !slices.Equal(saves, expected) {
+		t.Errorf("Expected a save per template %v, got %v", expected, saves)
+	}
+	if configured, warmed := watcher.WarmupCounts(); warmed != configured {
+		t.Errorf("Expected all templates marked warmed up, got %d of %d", warmed, configured)
+	}
+}
+
+// TestWarmupAllSaveFailure tests that a KV cache save failing while
+// switching templates fails WarmupAll, so "warmup -once" exits non-zero
+func TestWarmupAllSaveFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	watcher := template.NewWatcher()
+	prefixes := map[string]config.PrefixConfig{}
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(tmpDir, name+".txt")
+		os.WriteFile(path, []byte("Template "+name), 0644)
+		watcher.AddTemplate("@"+name, path)
+		prefixes["@"+name] = config.PrefixConfig{Path: path}
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.saveFailures["a.bin"] = true
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, Prefixes: prefixes}
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	err := mgr.WarmupAll()
+	if err == nil || !strings.Contains(err.Error(), "@a: failed to save KV cache") {
+		t.Fatalf("Expected WarmupAll to report the failed save of @a, got %v", err)
+	}
+
+	// The warmup loop only logs save failures
+	mgr.recordSaveError("@a", errors.New("boom"))
+	if len(mgr.saveErrs) != 0 {
+		t.Errorf("Expected save failures to be collected only during WarmupAll, got %v", mgr.saveErrs)
+	}
+}
+
+// TestWarmupSharedCacheKey tests that templates sharing a cache key are
+// warmed up once per cycle into a single cache file
+func TestWarmupSharedCacheKey(t *testing.T) {
+	tmpDir := t.TempDir()
+	watcher := template.NewWatcher()
+	prefixes := map[string]config.PrefixConfig{}
+	for _, name := range []string{"review", "refactor"} {
+		path := filepath.Join(tmpDir, name+".txt")
+		os.WriteFile(path, []byte("Shared context for "+name), 0644)
+		watcher.AddTemplate("@"+name, path)
+		prefixes["@"+name] = config.PrefixConfig{Path: path, CacheKey: "code"}
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, Prefixes: prefixes}
+	backendState := state.New()
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), backendState, admission.New())
+
+	mgr.checkAndWarmup()
+
+	if calls := mock.GetCompletionCalls(); calls != 1 {
+		t.Errorf("Expected a single warmup for the shared cache, got %d", calls)
+	}
+	if configured, warmed := watcher.WarmupCounts(); warmed != configured {
+		t.Errorf("Expected both templates marked warmed up, got %d of %d", warmed, configured)
+	}
+	if restores := mock.GetRestoreCalls(); !slices.Equal(restores, []string{"code.bin"}) {
+		t.Errorf("Expected a restore of code.bin, got %v", restores)
+	}
+	if got := backendState.GetLastPrefix(); got != "code" {
+		t.Errorf("Expected state to track cache key code, got %q", got)
+	}
+}
+
+// TestWarmupReport tests that every warmup appends a JSON line with its
+// outcome to the report file
+func TestWarmupReport(t *testing.T) {
+	tmpDir := t.TempDir()
+	watcher := template.NewWatcher()
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(tmpDir, name+".txt")
+		os.WriteFile(path, []byte("Template "+name), 0644)
+		watcher.AddTemplate("@"+name, path)
+	}
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+	mock.restoreFailures["a.bin"] = true
+
+	reportFile := filepath.Join(tmpDir, "warmups.jsonl")
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, WarmupReportFile: reportFile}
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	// @a has no saved cache, @b is restored, @c fails
+	mgr.warmupTemplate("@a")
+	mgr.warmupTemplate("@b")
+	mock.mu.Lock()
+	mock.completionFailure = true
+	mock.mu.Unlock()
+	mgr.warmupTemplate("@c")
+
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 report lines, got %d:\n%s", len(lines), data)
+	}
+
+	expected := []struct {
+		prefix, cache, outcome string
+		promptTokens           float64
+	}{
+		{"@a", "miss", "success", 12},
+		{"@b", "hit", "success", 12},
+		{"@c", "hit", "failure", 0},
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Report line %d is not valid JSON: %v\n%s", i, err, line)
+		}
+		for _, field := range []string{"prefix", "timestamp", "duration_ms", "outcome"} {
+			if _, ok := entry[field]; !ok {
+				t.Errorf("Report line %d is missing %q: %s", i, field, line)
+			}
+		}
+		if timestamp, _ := entry["timestamp"].(string); !isRFC3339(timestamp) {
+			t.Errorf("Report line %d has invalid timestamp: %s", i, line)
+		}
+		want := expected[i]
+		if entry["prefix"] != want.prefix || entry["cache"] != want.cache || entry["outcome"] != want.outcome {
+			t.Errorf("Report line %d: expected %s/%s/%s, got %s", i, want.prefix, want.cache, want.outcome, line)
+		}
+		if tokens, _ := entry["prompt_tokens"].(float64); tokens != want.promptTokens {
+			t.Errorf("Report line %d: expected %v prompt tokens, got %s", i, want.promptTokens, line)
+		}
+		if _, hasError := entry["error"]; hasError != (want.outcome == "failure") {
+			t.Errorf("Report line %d: unexpected error field: %s", i, line)
+		}
+	}
+}
+
+// isRFC3339 reports whether s is an RFC 3339 timestamp
+func isRFC3339(s string) bool {
+	_, err := time.Parse(time.RFC3339Nano, s)
+	return err == nil
+}
+
+// TestWarmupReportUnwritable tests that an unopenable report file disables
+// the report without affecting warmups
+func TestWarmupReportUnwritable(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "a.txt")
+	os.WriteFile(path, []byte("Template a"), 0644)
+	watcher := template.NewWatcher()
+	watcher.AddTemplate("@a", path)
+
+	mock := newMockLlamaCppServer()
+	defer mock.Close()
+
+	cfg := &config.Config{BackendURL: mock.URL(), WarmupCheckInterval: 10, WarmupReportFile: filepath.Join(tmpDir, "missing", "warmups.jsonl")}
+	mgr := New(cfg, watcher, mock.URL(), admin.NewMetrics(), state.New(), admission.New())
+
+	for i := 0; i < 2; i++ {
+		if err := mgr.warmupTemplate("@a"); err != nil {
+			t.Fatalf("Warmup failed with an unwritable report: %v", err)
+		}
+	}
+	if !mgr.reportWriter.disabled {
+		t.Error("Expected the report to be disabled")
+	}
+}
+
+// TestWarmupPromptCache tests that warmup requests carry cache_prompt only
+// with EnablePromptCache
+func TestWarmupPromptCache(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		var receivedBody map[string]interface{}
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&receivedBody)
+			w.Write([]byte(`{}`))
+		}))
+
+		cfg := &config.Config{BackendURL: backend.URL, WarmupCheckInterval: 10, EnablePromptCache: enabled}
+		mgr := New(cfg, template.NewWatcher(), backend.URL, admin.NewMetrics(), state.New(), admission.New())
+		_, err := mgr.sendWarmupRequest(context.Background(), "@test", "warmup content")
+		backend.Close()
+		if err != nil {
+			t.Fatalf("Warmup request failed: %v", err)
+		}
+
+		value, exists := receivedBody["cache_prompt"]
+		if enabled && value != true {
+			t.Errorf("Expected cache_prompt true with EnablePromptCache, got %v", receivedBody)
+		}
+		if !enabled && exists {
+			t.Errorf("Expected no cache_prompt without EnablePromptCache, got %v", receivedBody)
+		}
+	}
+}
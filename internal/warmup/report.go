@@ -0,0 +1,114 @@
+package warmup
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Warmup outcomes in the report
+const (
+	reportSuccess   = "success"
+	reportFailure   = "failure"
+	reportCancelled = "cancelled"
+)
+
+// KV cache states in the report
+const (
+	// reportCacheHit means the cache was restored or already loaded
+	reportCacheHit = "hit"
+	// reportCacheMiss means there was no usable saved cache
+	reportCacheMiss = "miss"
+)
+
+// reportEntry is one line of the warmup report
+type reportEntry struct {
+	Prefix       string  `json:"prefix"`
+	Timestamp    string  `json:"timestamp"`
+	DurationMs   float64 `json:"duration_ms"`
+	Cache        string  `json:"cache,omitempty"`
+	Outcome      string  `json:"outcome"`
+	Error        string  `json:"error,omitempty"`
+	PromptTokens int     `json:"prompt_tokens,omitempty"`
+}
+
+// reportWriter appends warmup outcomes as JSON lines to WarmupReportFile.
+// The file is opened on the first write; if that fails the report is
+// disabled after a single warning, so warmups are never affected.
+type reportWriter struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	disabled bool
+}
+
+// newReportWriter creates a report writer for path
+func newReportWriter(path string) *reportWriter {
+	return &reportWriter{path: path}
+}
+
+// write appends entry to the report
+func (r *reportWriter) write(entry reportEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.disabled {
+		return
+	}
+	if r.file == nil {
+		file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("WARNING: Failed to open warmup report file, disabling the report: %v", err)
+			r.disabled = true
+			return
+		}
+		r.file = file
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("WARNING: Failed to encode warmup report entry: %v", err)
+		return
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		log.Printf("WARNING: Failed to write warmup report, disabling the report: %v", err)
+		r.file.Close()
+		r.file = nil
+		r.disabled = true
+	}
+}
+
+// close closes the report file, if open. Later writes are dropped, e.g.
+// from a warmup loop that outlived Stop.
+func (r *reportWriter) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.disabled = true
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// report appends a warmup outcome to the report, if configured
+func (m *Manager) report(prefix, outcome, cache string, duration time.Duration, promptTokens int, err error) {
+	if m.reportWriter == nil {
+		return
+	}
+	entry := reportEntry{
+		Prefix:       prefix,
+		Timestamp:    m.now().UTC().Format(time.RFC3339Nano),
+		DurationMs:   float64(duration.Microseconds()) / 1000,
+		Cache:        cache,
+		Outcome:      outcome,
+		PromptTokens: promptTokens,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	m.reportWriter.write(entry)
+}
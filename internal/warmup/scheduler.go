@@ -0,0 +1,73 @@
+package warmup
+
+import (
+	"time"
+)
+
+// usageScheduler decides when each template is due for a change check when
+// usage-weighted warmup is enabled.
+//
+// A template's check interval is maxInterval scaled down by its request rate
+// since its last check:
+//
+//	interval = maxInterval / (1 + requests per minute)
+//
+// bounded below by minInterval. A template without traffic is checked every
+// maxInterval; one with 9 requests per minute ten times as often.
+//
+// Not thread-safe; only used from the manager's check loop.
+type usageScheduler struct {
+	minInterval time.Duration
+	maxInterval time.Duration
+
+	// requests returns the total number of requests that used a template
+	requests func(prefix string) int64
+
+	// lastCheck and lastRequests record when each template was last checked
+	// and its request count at that time
+	lastCheck    map[string]time.Time
+	lastRequests map[string]int64
+}
+
+// newUsageScheduler creates a scheduler reading request counts from requests
+func newUsageScheduler(minInterval, maxInterval time.Duration, requests func(prefix string) int64) *usageScheduler {
+	return &usageScheduler{
+		minInterval:  minInterval,
+		maxInterval:  maxInterval,
+		requests:     requests,
+		lastCheck:    make(map[string]time.Time),
+		lastRequests: make(map[string]int64),
+	}
+}
+
+// interval returns the check interval for the given request rate
+func (s *usageScheduler) interval(requestsPerMinute float64) time.Duration {
+	interval := time.Duration(float64(s.maxInterval) / (1 + requestsPerMinute))
+	if interval < s.minInterval {
+		return s.minInterval
+	}
+	return interval
+}
+
+// due reports whether prefix should be checked at now. A template that was
+// never checked is always due. When due, the check is recorded and the
+// template's rate is measured from now on.
+func (s *usageScheduler) due(prefix string, now time.Time) bool {
+	requests := s.requests(prefix)
+
+	last, checked := s.lastCheck[prefix]
+	if checked {
+		elapsed := now.Sub(last)
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(requests-s.lastRequests[prefix]) / elapsed.Minutes()
+		}
+		if elapsed < s.interval(rate) {
+			return false
+		}
+	}
+
+	s.lastCheck[prefix] = now
+	s.lastRequests[prefix] = requests
+	return true
+}
@@ -0,0 +1,72 @@
+package warmup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsageSchedulerInterval(t *testing.T) {
+	s := newUsageScheduler(10*time.Second, 300*time.Second, nil)
+
+	tests := []struct {
+		rate     float64
+		expected time.Duration
+	}{
+		{0, 300 * time.Second},
+		{1, 150 * time.Second},
+		{9, 30 * time.Second},
+		{1000, 10 * time.Second}, // bounded by minInterval
+	}
+	for _, tt := range tests {
+		if got := s.interval(tt.rate); got != tt.expected {
+			t.Errorf("interval(%v) = %v, expected %v", tt.rate, got, tt.expected)
+		}
+	}
+}
+
+func TestUsageSchedulerDue(t *testing.T) {
+	requests := map[string]int64{}
+	s := newUsageScheduler(10*time.Second, 300*time.Second, func(prefix string) int64 {
+		return requests[prefix]
+	})
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Never-checked templates are due immediately
+	if !s.due("@hot", start) || !s.due("@cold", start) {
+		t.Fatal("Expected templates to be due on first check")
+	}
+
+	// 30 requests in the first minute: 30 rpm -> 300s/31 ~ 9.7s -> 10s
+	requests["@hot"] = 30
+	at := start.Add(time.Minute)
+	if !s.due("@hot", at) {
+		t.Error("Expected busy template to be due after a minute")
+	}
+	if s.due("@cold", at) {
+		t.Error("Expected idle template not to be due before maxInterval")
+	}
+
+	// The busy template is checked again shortly after
+	requests["@hot"] = 35
+	if !s.due("@hot", at.Add(10*time.Second)) {
+		t.Error("Expected busy template to be due after minInterval")
+	}
+
+	// Once traffic stops, its interval grows back towards maxInterval
+	at = at.Add(10 * time.Second)
+	if s.due("@hot", at.Add(2*time.Minute)) {
+		t.Error("Expected template without recent traffic not to be due after 2 minutes")
+	}
+	if !s.due("@hot", at.Add(300*time.Second)) {
+		t.Error("Expected template without recent traffic to be due after maxInterval")
+	}
+
+	// The idle template is checked every maxInterval
+	if s.due("@cold", start.Add(299*time.Second)) {
+		t.Error("Expected idle template not to be due before maxInterval")
+	}
+	if !s.due("@cold", start.Add(300*time.Second)) {
+		t.Error("Expected idle template to be due after maxInterval")
+	}
+}